@@ -16,11 +16,13 @@ import (
 	"bastionzero.com/agent/agenttype"
 	"bastionzero.com/agent/bastion"
 	"bastionzero.com/agent/bastion/agentidentity"
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/controlchannel"
 	"bastionzero.com/agent/controlconnection"
+	"bastionzero.com/agent/direct"
 	"bastionzero.com/agent/registration"
 	"bastionzero.com/bzerolib/connection"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/connection/transporter/websocket"
 	"bastionzero.com/bzerolib/logger"
 )
@@ -54,6 +56,14 @@ type Agent struct {
 
 	agentConfig    AgentConfig
 	keyShardConfig controlchannel.KeyShardConfig
+	pluginConfig   pluginconfig.PluginConfig
+
+	// which protocol we speak to BastionZero, or a self-hosted relay
+	messengerProtocol messenger.Protocol
+
+	// for daemons connecting to us without going through BastionZero
+	directConfig   direct.Config
+	directListener *direct.Listener
 
 	agentType agenttype.AgentType
 	version   string
@@ -95,6 +105,10 @@ func (a *Agent) Run() (err error) {
 		return
 	}
 
+	// Web targets can have the user's identity signed with our key, which we
+	// only know for sure now that we're registered
+	a.pluginConfig.WebHeaders.SigningKey = a.agentConfig.GetPrivateKey()
+
 	// Connect the control channel to BastionZero
 	a.logger.Info("Creating connection to BastionZero...")
 	if err = a.startControlChannel(); err != nil {
@@ -110,6 +124,14 @@ func (a *Agent) Run() (err error) {
 		a.Close(err)
 	}()
 
+	// Listen for any daemons connecting to us directly
+	if a.directConfig.Enabled() {
+		dlLogger := a.logger.GetComponentLogger("DirectListener")
+		if a.directListener, err = direct.Listen(dlLogger, a.directConfig, a.bastionClient, a.agentConfig, a.keyShardConfig, a.pluginConfig); err != nil {
+			return err
+		}
+	}
+
 	for {
 		select {
 		case <-a.tmb.Dead():
@@ -145,10 +167,12 @@ func (a *Agent) startControlChannel() error {
 	ccId := uuid.New().String()
 	ccLogger := a.logger.GetControlChannelLogger(ccId)
 	wsLogger := ccLogger.GetComponentLogger("Websocket")
-	srLogger := ccLogger.GetComponentLogger("SignalR")
 
 	// Make our connection
-	client := signalr.New(srLogger, websocket.New(wsLogger))
+	client, err := messenger.New(a.messengerProtocol, ccLogger, websocket.New(wsLogger))
+	if err != nil {
+		return err
+	}
 
 	headers := http.Header{}
 	params := url.Values{
@@ -165,7 +189,7 @@ func (a *Agent) startControlChannel() error {
 	}
 
 	// Start up our control channel
-	a.controlChannel, err = controlchannel.Start(ccLogger, a.bastionClient, ccId, conn, a.agentType, agentIdProvider, privateKey, a.agentConfig, a.keyShardConfig, defaultLogPath)
+	a.controlChannel, err = controlchannel.Start(ccLogger, a.bastionClient, ccId, conn, a.agentType, agentIdProvider, privateKey, a.agentConfig, a.keyShardConfig, a.pluginConfig, a.messengerProtocol, defaultLogPath)
 	a.controlConn = conn
 
 	return err
@@ -179,6 +203,10 @@ func (a *Agent) Close(reason error) {
 		a.tmb.Wait()
 	}
 
+	if a.directListener != nil {
+		a.directListener.Close(reason)
+	}
+
 	if a.controlConn != nil {
 		a.controlConn.Close(reason, 10*time.Second)
 	}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"bastionzero.com/agent/localpolicy"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -28,4 +31,24 @@ var _ = Describe("Agent", func() {
 
 	// 	return mockConfig
 	// }
+
+	Context("Plugin config", func() {
+		BeforeEach(func() {
+			originalPath := localPolicyPath
+			DeferCleanup(func() { localPolicyPath = originalPath })
+
+			localPolicyPath = filepath.Join(GinkgoT().TempDir(), "local-policy.yaml")
+			policy := "deny:\n  - plugins: [kube]\n    kubeGroups: [\"system:masters\"]\n"
+			Expect(os.WriteFile(localPolicyPath, []byte(policy), 0600)).To(Succeed())
+		})
+
+		It("checks kube Syns against the local policy", func() {
+			pluginConfig := newPluginConfig()
+			Expect(pluginConfig.LocalPolicy.Enabled()).To(BeTrue())
+
+			request, err := localpolicy.NewRequest("kube", "kube/restapi", []byte(`{"targetUser":"alice","targetGroups":["system:masters"]}`), "subject", "alice@example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pluginConfig.LocalPolicy.Evaluate(request)).ToNot(Succeed())
+		})
+	})
 })
@@ -1,8 +1,20 @@
 package client
 
+import (
+	agentdata "bastionzero.com/agent/config/agentconfig/data"
+	ksdata "bastionzero.com/agent/config/keyshardconfig/data"
+)
+
 type ConfigType string
 
 const (
 	Agent    ConfigType = "agent"
 	KeyShard ConfigType = "keyshard"
 )
+
+// Store is implemented by every place we can keep our config
+type Store interface {
+	FetchAgentData() (agentdata.AgentDataV2, error)
+	FetchKeyShardData() (ksdata.KeyShardData, error)
+	Save(d interface{}) error
+}
@@ -22,7 +22,7 @@ const (
 	keyShardConfigFileName = "keyshards.json"
 )
 
-// for Linux and Windows agents (i.e. excluding Kuberenetes)
+// for Linux and Windows agents, and Kubernetes agents running outside of the cluster
 type fileStore struct {
 	configPath string
 	fileLock   *filelock.FileLock
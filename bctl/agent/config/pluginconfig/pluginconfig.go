@@ -0,0 +1,68 @@
+/*
+This package holds the agent-local settings that a datachannel hands to its
+plugin when it starts one up. Unlike the agent and key shard configs, these
+are read from the agent's flags or environment at startup and are never
+persisted or changed by BastionZero.
+*/
+package pluginconfig
+
+import (
+	"bastionzero.com/agent/localpolicy"
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
+	"bastionzero.com/agent/plugin/kube/filter"
+	"bastionzero.com/agent/plugin/web/headerpolicy"
+	"bastionzero.com/agent/plugin/web/upstreamtls"
+	"bastionzero.com/agent/recording"
+)
+
+type PluginConfig struct {
+	// Where and for how long to keep asciicast recordings of shell sessions
+	ShellRecording recording.Config
+
+	// Where and for how long to keep asciicast recordings of kube exec sessions
+	KubeRecording recording.Config
+
+	// The kube clusters we serve and how to reach them, nil unless we're a
+	// kube agent
+	KubeClusters *cluster.Clusters
+
+	// The target BastionZero opened our datachannels' connection for, which
+	// decides which of our kube clusters they go to. Empty if BastionZero
+	// didn't tell us or the daemon connected to us directly
+	TargetId string
+
+	// Where to send audit events for kube requests, nil if we don't
+	KubeAudit audit.Sink
+
+	// Rules for which kube requests we refuse to make, nil if we make them all
+	KubeFilter *filter.Filter
+
+	// Local deny rules that every Syn is checked against before we start or
+	// continue a plugin for it, and what each user may run in a shell
+	LocalPolicy localpolicy.Config
+
+	// Whether our datachannels' daemon connected to us directly, in which
+	// case nothing has checked BastionZero policy and the local policy's
+	// direct rules have to allow every Syn
+	DirectConnection bool
+
+	// How we rewrite the headers of requests to web targets, and the key we
+	// sign the user's identity with when we add it to them
+	WebHeaders headerpolicy.Config
+
+	// How we make TLS connections to web targets that need more than the
+	// defaults
+	WebTLS upstreamtls.Config
+}
+
+// Session describes the datachannel a plugin is serving and the verified
+// user who opened it
+type Session struct {
+	DataChannelId string
+
+	// Identity from the user's verified BZCert
+	Subject string
+	Email   string
+	Groups  []string
+}
@@ -0,0 +1,42 @@
+/*
+This package reads the optional YAML files that let the owner of a target change
+what the agent does, such as its local policy or its web header policy.
+
+A file is read every time it's needed, so that changes take effect immediately
+without restarting the agent. A file that doesn't exist just means the owner
+hasn't asked for anything, but a file that exists and can't be read or parsed is
+an error, so that a mistake can never quietly undo what the owner asked for.
+*/
+package policyfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the YAML file at path into out and returns true, or returns false
+// if there's no such file. We refuse any field out doesn't have, so that a
+// misspelt one can't quietly change what the file means, and an empty file
+// leaves out as it is
+func Load(path string, out interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return true, nil
+}
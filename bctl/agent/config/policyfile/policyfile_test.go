@@ -0,0 +1,78 @@
+package policyfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPolicyFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Policy File Suite")
+}
+
+type testPolicy struct {
+	Allow []string `yaml:"allow"`
+}
+
+var _ = Describe("Policy File", func() {
+	var path string
+
+	writeFile := func(contents string) {
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "policy.yaml")
+	})
+
+	It("reads the file", func() {
+		writeFile("allow: [a, b]\n")
+
+		var policy testPolicy
+		found, err := Load(path, &policy)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(policy.Allow).To(Equal([]string{"a", "b"}))
+	})
+
+	It("tells us if there's no file", func() {
+		var policy testPolicy
+		found, err := Load(path, &policy)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("accepts an empty file", func() {
+		for _, contents := range []string{"", "\n\n", "# nothing yet\n"} {
+			writeFile(contents)
+
+			var policy testPolicy
+			found, err := Load(path, &policy)
+			Expect(err).ToNot(HaveOccurred(), contents)
+			Expect(found).To(BeTrue())
+			Expect(policy.Allow).To(BeEmpty())
+		}
+	})
+
+	It("refuses files it can't use", func() {
+		for contents, expected := range map[string]string{
+			"allow: [a":   "failed to parse",
+			"alow: [a]\n": "field alow not found",
+		} {
+			writeFile(contents)
+
+			var policy testPolicy
+			_, err := Load(path, &policy)
+			Expect(err).To(MatchError(ContainSubstring(expected)), contents)
+		}
+
+		Expect(os.Remove(path)).To(Succeed())
+		Expect(os.Mkdir(path, 0700)).To(Succeed())
+		_, err := Load(path, &testPolicy{})
+		Expect(err).To(MatchError(ContainSubstring("failed to read")))
+	})
+})
@@ -18,12 +18,14 @@ import (
 	"bastionzero.com/agent/bastion/agentidentity"
 	"bastionzero.com/agent/bastion/report"
 	"bastionzero.com/agent/config/keyshardconfig/data"
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/controlchannel/dataconnection"
 	"bastionzero.com/agent/mrtap"
 	"bastionzero.com/agent/plugin/db/actions/pwdb"
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/connection"
 	am "bastionzero.com/bzerolib/connection/agentmessage"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/connection/transporter/websocket"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/logger"
@@ -33,7 +35,6 @@ import (
 	"gopkg.in/tomb.v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 const (
@@ -66,6 +67,10 @@ type ControlChannel struct {
 
 	ccConfig       ControlChannelConfig
 	keyShardConfig KeyShardConfig
+	pluginConfig   pluginconfig.PluginConfig
+
+	// which protocol our datachannel connections speak
+	messengerProtocol messenger.Protocol
 
 	// agent attributes
 	agentType    agenttype.AgentType
@@ -88,8 +93,11 @@ type ControlChannel struct {
 	// helps with race, see ShouldBeSendingPongs() for more information
 	isSendingPongs bool
 
-	// keeps track of the last fetch of cluster users we did, we update if changes on new fetch are detected
-	clusterUserCache []string
+	// keeps track of the last fetch of cluster users we did for each target, we update if changes on new fetch are detected
+	clusterUserCache map[string][]string
+
+	// whether we've told bastion which clusters we serve as virtual targets
+	reportedKubeClusters bool
 
 	// for communicating with the bastion
 	bastionClient bastion.ApiClient
@@ -106,26 +114,30 @@ func Start(logger *logger.Logger,
 	privateKey *keypair.PrivateKey,
 	cConfig ControlChannelConfig,
 	keyShardConfig KeyShardConfig,
+	pluginConfig pluginconfig.PluginConfig,
+	messengerProtocol messenger.Protocol,
 	logFilePath string,
 ) (*ControlChannel, error) {
 
 	control := &ControlChannel{
-		conn:             conn,
-		logger:           logger,
-		channelId:        id,
-		bastionClient:    bastion,
-		agentType:        agentType,
-		agentIdToken:     agentIdToken,
-		privateKey:       privateKey,
-		ccConfig:         cConfig,
-		keyShardConfig:   keyShardConfig,
-		inputChan:        make(chan am.AgentMessage, 25),
-		connections:      make(map[string]AgentDatachannelConnection),
-		agentPongChan:    make(chan bool),
-		runtimeErrChan:   make(chan error),
-		isSendingPongs:   conn.Ready(),
-		clusterUserCache: []string{},
-		logFilePath:      logFilePath,
+		conn:              conn,
+		logger:            logger,
+		channelId:         id,
+		bastionClient:     bastion,
+		agentType:         agentType,
+		agentIdToken:      agentIdToken,
+		privateKey:        privateKey,
+		ccConfig:          cConfig,
+		keyShardConfig:    keyShardConfig,
+		pluginConfig:      pluginConfig,
+		messengerProtocol: messengerProtocol,
+		inputChan:         make(chan am.AgentMessage, 25),
+		connections:       make(map[string]AgentDatachannelConnection),
+		agentPongChan:     make(chan bool),
+		runtimeErrChan:    make(chan error),
+		isSendingPongs:    conn.Ready(),
+		clusterUserCache:  make(map[string][]string),
+		logFilePath:       logFilePath,
 	}
 
 	// Since the CC has its own websocket and Bastion doesn't know what it is, there's no point
@@ -326,7 +338,7 @@ func (c *ControlChannel) processInput(agentMessage am.AgentMessage, ctx context.
 		if err := json.Unmarshal(agentMessage.MessagePayload, &owRequest); err != nil {
 			return fmt.Errorf("malformed open websocket request: %s", err)
 		}
-		return c.openWebsocket(owRequest.ConnectionId, owRequest.ConnectionServiceUrl)
+		return c.openWebsocket(owRequest.ConnectionId, owRequest.ConnectionServiceUrl, owRequest.TargetId)
 	case am.CloseWebsocket:
 		var cwRequest CloseWebsocketMessage
 		if err := json.Unmarshal(agentMessage.MessagePayload, &cwRequest); err != nil {
@@ -360,13 +372,20 @@ func (c *ControlChannel) processInput(agentMessage am.AgentMessage, ctx context.
 	return nil
 }
 
-func (c *ControlChannel) openWebsocket(connectionId, connectionServiceUrl string) error {
+func (c *ControlChannel) openWebsocket(connectionId, connectionServiceUrl, targetId string) error {
 	subLogger := c.logger.GetConnectionLogger(connectionId)
 
+	// every datachannel on this connection is for the target it was opened for
+	pluginConfig := c.pluginConfig
+	pluginConfig.TargetId = targetId
+
 	wsLogger := subLogger.GetComponentLogger("Websocket")
-	srLogger := subLogger.GetComponentLogger("SignalR")
 
-	client := signalr.New(srLogger, websocket.New(wsLogger))
+	client, err := messenger.New(c.messengerProtocol, subLogger, websocket.New(wsLogger))
+	if err != nil {
+		return fmt.Errorf("could not create new connection: %s", err)
+	}
+
 	headers := http.Header{}
 	params := url.Values{}
 	if conn, err := dataconnection.New(
@@ -376,6 +395,7 @@ func (c *ControlChannel) openWebsocket(connectionId, connectionServiceUrl string
 		connectionId,
 		c.ccConfig,
 		c.keyShardConfig,
+		pluginConfig,
 		c.agentIdToken,
 		c.privateKey,
 		params,
@@ -446,20 +466,53 @@ func (c *ControlChannel) reportHealth() error {
 
 	// Let bastion know a list of valid cluster users if they have changed
 	if c.agentType == agenttype.Kubernetes {
-		if err := c.reportClusterUsers(); err != nil {
+		c.reportKubeClusters()
+
+		clusters := c.pluginConfig.KubeClusters
+		if err := c.reportClusterUsers(clusters.Local(), ""); err != nil {
 			c.logger.Errorf("failed to report valid cluster users: %s", err)
 		}
+		for _, virtual := range clusters.Virtual() {
+			if err := c.reportClusterUsers(virtual, virtual.TargetId); err != nil {
+				c.logger.Errorf("failed to report valid cluster users for target %s: %s", virtual.TargetId, err)
+			}
+		}
 	}
 
 	return nil
 }
 
-func (c *ControlChannel) reportClusterUsers() error {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return err
+// reportKubeClusters lets bastion know which clusters we serve as virtual
+// targets, once per control channel
+func (c *ControlChannel) reportKubeClusters() {
+	virtual := c.pluginConfig.KubeClusters.Virtual()
+	if c.reportedKubeClusters || len(virtual) == 0 {
+		return
+	}
+
+	msg := KubeClustersMessage{KubeClusters: []KubeCluster{}}
+	for _, kubeCluster := range virtual {
+		msg.KubeClusters = append(msg.KubeClusters, KubeCluster{
+			TargetId: kubeCluster.TargetId,
+			Name:     kubeCluster.Name,
+			Server:   kubeCluster.Host(),
+		})
+	}
+
+	if err := c.send(am.KubeClusters, msg); err != nil {
+		c.logger.Errorf("failed to report kube clusters: %s", err)
+	} else {
+		c.reportedKubeClusters = true
+	}
+}
+
+// reportClusterUsers sends the users of a cluster we serve, where targetId is
+// empty for the cluster we're running in
+func (c *ControlChannel) reportClusterUsers(kubeCluster *cluster.Cluster, targetId string) error {
+	if kubeCluster == nil {
+		return fmt.Errorf("no kube cluster loaded")
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(kubeCluster.Config())
 	if err != nil {
 		return err
 	}
@@ -513,15 +566,16 @@ func (c *ControlChannel) reportClusterUsers() error {
 
 	// If the set of valid users are different from the last time we checked
 	// then send an update message
-	if !reflect.DeepEqual(users, c.clusterUserCache) {
+	if cached, ok := c.clusterUserCache[targetId]; !ok || !reflect.DeepEqual(users, cached) {
 		c.logger.Info("sending updated valid cluster users in the control channel.")
 		msg := ClusterUsersMessage{
 			ClusterUsers: users,
+			TargetId:     targetId,
 		}
 		c.send(am.ClusterUsers, msg)
 
 		// update the cached valid cluster users
-		c.clusterUserCache = users
+		c.clusterUserCache[targetId] = users
 	}
 
 	return nil
@@ -12,12 +12,29 @@ type HeartbeatMessage struct {
 
 type ClusterUsersMessage struct {
 	ClusterUsers []string `json:"clusterUsers"`
+
+	// set if these are the users of one of our virtual targets
+	TargetId string `json:"targetId,omitempty"`
+}
+
+type KubeClustersMessage struct {
+	KubeClusters []KubeCluster `json:"kubeClusters"`
+}
+
+type KubeCluster struct {
+	TargetId string `json:"targetId"`
+	Name     string `json:"name"`
+	Server   string `json:"server"`
 }
 
 // connection and datachannel management payloads
 type OpenWebsocketMessage struct {
 	ConnectionId         string `json:"connectionId"`
 	ConnectionServiceUrl string `json:"connectionServiceUrl"`
+
+	// The target BastionZero authorized this connection for, which may be one
+	// of the virtual targets we serve. Older versions of BastionZero don't send it
+	TargetId string `json:"targetId,omitempty"`
 }
 
 type CloseWebsocketMessage struct {
@@ -25,6 +25,7 @@ import (
 
 	"bastionzero.com/agent/bastion"
 	"bastionzero.com/agent/bastion/agentidentity"
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/datachannel"
 	"bastionzero.com/agent/mrtap"
 	"bastionzero.com/agent/plugin/db/actions/pwdb"
@@ -76,6 +77,9 @@ type DataConnection struct {
 	// Config interface for interacting with key shards
 	keyshardConfig pwdb.PWDBConfig
 
+	// Agent-local settings handed to every datachannel's plugin
+	pluginConfig pluginconfig.PluginConfig
+
 	// Agent identity attributes
 	agentIdToken agentidentity.AgentIdentityToken
 	privateKey   *keypair.PrivateKey // for signing
@@ -94,6 +98,7 @@ func New(
 	connectionId string,
 	mrtapConfig mrtap.MrtapConfig,
 	keyshardConfig pwdb.PWDBConfig,
+	pluginConfig pluginconfig.PluginConfig,
 	agentIdToken agentidentity.AgentIdentityToken,
 	privateKey *keypair.PrivateKey,
 	params url.Values,
@@ -117,6 +122,7 @@ func New(
 		sendQueue:      make(chan *am.AgentMessage, 50),
 		mrtapConfig:    mrtapConfig,
 		keyshardConfig: keyshardConfig,
+		pluginConfig:   pluginConfig,
 		agentIdToken:   agentIdToken,
 		privateKey:     privateKey,
 	}
@@ -278,7 +284,7 @@ func (d *DataConnection) openDataChannel(odMessage OpenDataChannelMessage) error
 	if mt, err := mrtap.New(ksSubLogger, d.mrtapConfig); err != nil {
 		return err
 	} else {
-		_, err := datachannel.New(&d.tmb, subLogger, d, d.keyshardConfig, mt, d.bastionClient, dcId, odMessage.Syn)
+		_, err := datachannel.New(&d.tmb, subLogger, d, d.keyshardConfig, d.pluginConfig, mt, d.bastionClient, dcId, odMessage.Syn)
 		return err
 	}
 }
@@ -7,6 +7,7 @@ import (
 
 	agentidentity "bastionzero.com/agent/bastion/agentidentity/mocks"
 	bastion "bastionzero.com/agent/bastion/mocks"
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/mrtap"
 	"bastionzero.com/agent/plugin/db/actions/pwdb/mocks"
 	"bastionzero.com/bzerolib/connection"
@@ -50,7 +51,7 @@ var _ = Describe("Agent Data Connection Integration", Ordered, func() {
 		srLogger := logger.GetComponentLogger("SignalR")
 
 		client := signalr.New(srLogger, websocket.New(wsLogger))
-		conn, _ := New(logger, mockBastionApiClient, cnUrl, connectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, client)
+		conn, _ := New(logger, mockBastionApiClient, cnUrl, connectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, client)
 
 		return conn
 	}
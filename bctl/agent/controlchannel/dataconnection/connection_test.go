@@ -10,6 +10,7 @@ import (
 
 	agentidentity "bastionzero.com/agent/bastion/agentidentity/mocks"
 	bastion "bastionzero.com/agent/bastion/mocks"
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/mrtap"
 	"bastionzero.com/agent/plugin/db/actions/pwdb/mocks"
 	"bastionzero.com/bzerolib/connection"
@@ -75,7 +76,7 @@ var _ = Describe("Agent Datachannel Connection", Ordered, func() {
 
 			BeforeEach(func() {
 				setupHappyClient()
-				conn, err = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, mockClient)
+				conn, err = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, mockClient)
 			})
 
 			It("instantiates without error", func() {
@@ -93,7 +94,7 @@ var _ = Describe("Agent Datachannel Connection", Ordered, func() {
 
 			BeforeEach(func() {
 				setupHappyClient()
-				_, err = New(logger, mockBastionApiClient, malformedUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, mockClient)
+				_, err = New(logger, mockBastionApiClient, malformedUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, mockClient)
 			})
 
 			It("fails to establish a connection", func() {
@@ -111,7 +112,7 @@ var _ = Describe("Agent Datachannel Connection", Ordered, func() {
 
 			BeforeEach(func() {
 				setupHappyClient()
-				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, mockClient)
+				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, mockClient)
 				conn.Send(testAgentMessage)
 			})
 
@@ -143,7 +144,7 @@ var _ = Describe("Agent Datachannel Connection", Ordered, func() {
 
 			BeforeEach(func() {
 				setupHappyClient()
-				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, mockClient)
+				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, mockClient)
 
 				mockChannel = new(broker.MockChannel)
 				mockChannel.On("Receive").Return()
@@ -165,7 +166,7 @@ var _ = Describe("Agent Datachannel Connection", Ordered, func() {
 
 			BeforeEach(func() {
 				setupHappyClient()
-				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, mockClient)
+				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, mockClient)
 
 				doneChan <- struct{}{}
 			})
@@ -180,7 +181,7 @@ var _ = Describe("Agent Datachannel Connection", Ordered, func() {
 
 			BeforeEach(func() {
 				setupHappyClient()
-				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, mockAgentIdentityToken, privateKey, params, headers, mockClient)
+				conn, _ = New(logger, mockBastionApiClient, validUrl, fakeConnectionId, mockMrtapConfig, mockKeyShardConfig, pluginconfig.PluginConfig{}, mockAgentIdentityToken, privateKey, params, headers, mockClient)
 				conn.Close(fmt.Errorf("felt like it"), 2*time.Second)
 			})
 
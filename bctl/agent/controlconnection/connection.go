@@ -282,6 +282,8 @@ func targetSelectHandler(agentMessage am.AgentMessage) (string, error) {
 		return "Heartbeat", nil
 	case am.ClusterUsers:
 		return "ClusterUsers", nil
+	case am.KubeClusters:
+		return "KubeClusters", nil
 	default:
 		return "", fmt.Errorf("unsupported message type")
 	}
@@ -11,6 +11,8 @@ import (
 	"github.com/Masterminds/semver"
 	"gopkg.in/tomb.v2"
 
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/localpolicy"
 	"bastionzero.com/agent/plugin/db"
 	"bastionzero.com/agent/plugin/db/actions/pwdb"
 	"bastionzero.com/agent/plugin/kube"
@@ -23,6 +25,7 @@ import (
 	am "bastionzero.com/bzerolib/connection/agentmessage"
 	bzerror "bastionzero.com/bzerolib/error"
 	"bastionzero.com/bzerolib/logger"
+	bzcrt "bastionzero.com/bzerolib/mrtap/bzcert"
 	"bastionzero.com/bzerolib/mrtap/message"
 	bzplugin "bastionzero.com/bzerolib/plugin"
 	smsg "bastionzero.com/bzerolib/stream/message"
@@ -35,6 +38,8 @@ const (
 type IMrtap interface {
 	Validate(mrtapMessage *message.MrtapMessage) error
 	BuildAck(mrtapMessage *message.MrtapMessage, action string, actionPayload []byte) (message.MrtapMessage, error)
+	ClientBZCert() *bzcrt.BZCert
+	Encoding() message.Encoding
 }
 
 type IPlugin interface {
@@ -43,6 +48,12 @@ type IPlugin interface {
 	Kill()
 }
 
+// synAcker is implemented by plugins which have something to tell the daemon
+// in our SynAck, e.g. what they can do that older versions of them can't
+type synAcker interface {
+	SynAckPayload() []byte
+}
+
 type DataChannel struct {
 	tmb    tomb.Tomb
 	logger *logger.Logger
@@ -56,6 +67,9 @@ type DataChannel struct {
 	// config for interacting with key shard store needed for pwdb
 	keyshardConfig pwdb.PWDBConfig
 
+	// agent-local settings handed to our plugin
+	pluginConfig pluginconfig.PluginConfig
+
 	// incoming and outgoing message channels
 	inputChan  chan am.AgentMessage
 	outputChan chan am.AgentMessage
@@ -72,6 +86,7 @@ func New(
 	logger *logger.Logger,
 	conn connection.Connection,
 	keyshardConfig pwdb.PWDBConfig,
+	pluginConfig pluginconfig.PluginConfig,
 	mrtap IMrtap,
 	bastion bastion.ApiClient,
 	id string,
@@ -83,6 +98,7 @@ func New(
 		id:             id,
 		conn:           conn,
 		keyshardConfig: keyshardConfig,
+		pluginConfig:   pluginConfig,
 		mrtap:          mrtap,
 		bastion:        bastion,
 		inputChan:      make(chan am.AgentMessage, 50),
@@ -176,6 +192,10 @@ func (d *DataChannel) Close(reason error) {
 // Wraps and sends the payload
 func (d *DataChannel) send(messageType am.MessageType, messagePayload interface{}) {
 	messageBytes, _ := json.Marshal(messagePayload)
+	d.sendBytes(messageType, messageBytes)
+}
+
+func (d *DataChannel) sendBytes(messageType am.MessageType, messageBytes []byte) {
 	agentMessage := am.AgentMessage{
 		ChannelId:      d.id,
 		MessageType:    messageType,
@@ -192,9 +212,13 @@ func (d *DataChannel) sendMrtap(mrtapMessage *message.MrtapMessage, action strin
 		rerr := fmt.Errorf("could not build response message: %s", err)
 		d.logger.Error(rerr)
 		return rerr
+	} else if ackBytes, err := ackMessage.Encode(d.mrtap.Encoding()); err != nil {
+		rerr := fmt.Errorf("could not encode response message: %s", err)
+		d.logger.Error(rerr)
+		return rerr
 	} else {
 		// TODO: CWC-2183; we still send a legacy message to accommodate older daemons. Newer ones can handle either
-		d.send(am.MrtapLegacy, ackMessage)
+		d.sendBytes(am.MrtapLegacy, ackBytes)
 		return nil
 	}
 }
@@ -224,8 +248,7 @@ func (d *DataChannel) processInput(agentMessage am.AgentMessage) {
 
 	switch am.MessageType(agentMessage.MessageType) {
 	case am.Mrtap:
-		var mrtapMessage message.MrtapMessage
-		if err := json.Unmarshal(agentMessage.MessagePayload, &mrtapMessage); err != nil {
+		if mrtapMessage, err := message.Decode(agentMessage.MessagePayload); err != nil {
 			d.sendError(bzerror.ComponentProcessingError, fmt.Errorf("malformed MrTAP message: %s", err), "")
 		} else {
 			d.handleMrtapMessage(&mrtapMessage)
@@ -248,6 +271,14 @@ func (d *DataChannel) handleMrtapMessage(mrtapMessage *message.MrtapMessage) err
 	case message.Syn:
 		synPayload := mrtapMessage.Payload.(message.SynPayload)
 
+		// the target's own policy gets a veto over everything, including
+		// continuing a session it previously allowed
+		if err := d.checkLocalPolicy(synPayload); err != nil {
+			d.logger.Error(err)
+			d.sendError(bzerror.ComponentStartupError, err, mrtapMessage.Hash())
+			return err
+		}
+
 		if d.plugin == nil {
 			// Grab user's action
 			if parsedAction := strings.Split(synPayload.Action, "/"); len(parsedAction) <= 1 {
@@ -262,9 +293,17 @@ func (d *DataChannel) handleMrtapMessage(mrtapMessage *message.MrtapMessage) err
 					return err
 				}
 			}
+		} else {
+			// the daemon is recovering or resuming its session, so we keep our
+			// existing plugin and let the SynAck tell it where we left off
+			d.logger.Infof("Continuing session with existing %s plugin", synPayload.Action)
 		}
 
-		d.sendMrtap(mrtapMessage, "", []byte{}) // empty payload
+		synAckPayload := []byte{}
+		if acker, ok := d.plugin.(synAcker); ok {
+			synAckPayload = acker.SynAckPayload()
+		}
+		d.sendMrtap(mrtapMessage, "", synAckPayload)
 	case message.Data:
 		dataPayload := mrtapMessage.Payload.(message.DataPayload)
 
@@ -319,17 +358,18 @@ func (d *DataChannel) startPlugin(pluginName bzplugin.PluginName, action string,
 	}()
 
 	subLogger := d.logger.GetPluginLogger(pluginName)
+	session := d.session()
 
 	var err error
 	switch pluginName {
 	case bzplugin.Kube:
-		d.plugin, err = kube.New(subLogger, streamOutputChan, action, payload)
+		d.plugin, err = kube.New(subLogger, streamOutputChan, action, payload, d.pluginConfig, session)
 	case bzplugin.Shell:
-		d.plugin, err = shell.New(subLogger, streamOutputChan, action, payload)
+		d.plugin, err = shell.New(subLogger, streamOutputChan, action, payload, d.pluginConfig, session)
 	case bzplugin.Ssh:
 		d.plugin, err = ssh.New(subLogger, streamOutputChan, action, payload)
 	case bzplugin.Web:
-		d.plugin, err = web.New(subLogger, streamOutputChan, action, payload)
+		d.plugin, err = web.New(subLogger, streamOutputChan, action, payload, d.pluginConfig, session)
 	case bzplugin.Db:
 		d.plugin, err = db.New(subLogger, streamOutputChan, d.keyshardConfig, d.bastion, action, payload)
 	default:
@@ -354,6 +394,39 @@ func (d *DataChannel) startPlugin(pluginName bzplugin.PluginName, action string,
 	}
 }
 
+func (d *DataChannel) checkLocalPolicy(synPayload message.SynPayload) error {
+	if !d.pluginConfig.LocalPolicy.Enabled() && !d.pluginConfig.DirectConnection {
+		return nil
+	}
+
+	pluginName, _, _ := strings.Cut(synPayload.Action, "/")
+	session := d.session()
+
+	if request, err := localpolicy.NewRequest(pluginName, synPayload.Action, synPayload.ActionPayload, session.Subject, session.Email); err != nil {
+		return err
+	} else if err := d.pluginConfig.LocalPolicy.Evaluate(request); err != nil {
+		return err
+	} else if d.pluginConfig.DirectConnection {
+		return d.pluginConfig.LocalPolicy.EvaluateDirect(request)
+	}
+	return nil
+}
+
+// session describes this datachannel and the user who opened it to our plugin
+func (d *DataChannel) session() pluginconfig.Session {
+	session := pluginconfig.Session{
+		DataChannelId: d.id,
+	}
+
+	if cert := d.mrtap.ClientBZCert(); cert != nil {
+		session.Subject = cert.Subject()
+		session.Email = cert.Email()
+		session.Groups = cert.Groups()
+	}
+
+	return session
+}
+
 func cleanPayload(payload []byte) ([]byte, error) {
 	// TODO: CWC-1819: remove once all daemon's are updated
 	if len(payload) > 0 {
@@ -0,0 +1,276 @@
+package direct
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"bastionzero.com/agent/bastion"
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/datachannel"
+	"bastionzero.com/agent/mrtap"
+	"bastionzero.com/agent/plugin/db/actions/pwdb"
+	am "bastionzero.com/bzerolib/connection/agentmessage"
+	"bastionzero.com/bzerolib/connection/broker"
+	"bastionzero.com/bzerolib/connection/messenger/jsonframe"
+	"bastionzero.com/bzerolib/connection/transporter/tlsconn"
+	"bastionzero.com/bzerolib/logger"
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	// Methods the daemon invokes on what it thinks is the connection node
+	requestDaemonToBastionV1          = "RequestDaemonToBastionV1"
+	openDataChannelDaemonToBastionV1  = "OpenDataChannelDaemonToBastionV1"
+	closeDataChannelDaemonToBastionV1 = "CloseDataChannelDaemonToBastionV1"
+	closeAgentWebsocketV1             = "CloseAgentWebsocketV1"
+
+	// Methods we invoke on the daemon in place of the connection node
+	agentConnected          = "AgentConnected"
+	closeConnection         = "CloseConnection"
+	responseAgentToDaemonV1 = "ResponseAgentToDaemonV1"
+)
+
+// The same payloads the daemon sends and expects from the connection node
+type openDataChannelPayload struct {
+	Syn    []byte `json:"syn"`
+	Action string `json:"action"`
+}
+
+type agentConnectedMessage struct {
+	ConnectionId string `json:"connectionId"`
+}
+
+type closeWebsocketMessage struct {
+	Reason string `json:"reason"`
+}
+
+// Connection is the connection manager for a single daemon which has dialed
+// us directly. It never reconnects; if the daemon goes away then so do all of
+// its datachannels
+type Connection struct {
+	tmb          tomb.Tomb
+	logger       *logger.Logger
+	ready        bool
+	connectionId string
+
+	client *jsonframe.JsonFrame
+
+	// A connection broker, allows us to narrowcast to one subscribed datachannel
+	broker *broker.Broker
+
+	// Buffered channel to keep track of outbound messages
+	sendQueue chan *am.AgentMessage
+
+	mrtapConfig    mrtap.MrtapConfig
+	keyshardConfig pwdb.PWDBConfig
+	pluginConfig   pluginconfig.PluginConfig
+	bastionClient  bastion.ApiClient
+}
+
+func newConnection(
+	logger *logger.Logger,
+	conn net.Conn,
+	connectionId string,
+	bastionClient bastion.ApiClient,
+	mrtapConfig mrtap.MrtapConfig,
+	keyshardConfig pwdb.PWDBConfig,
+	pluginConfig pluginconfig.PluginConfig,
+) (*Connection, error) {
+	tlsLogger := logger.GetComponentLogger("TLS")
+	jfLogger := logger.GetComponentLogger("JsonFrame")
+
+	c := &Connection{
+		logger:         logger,
+		connectionId:   connectionId,
+		client:         jsonframe.New(jfLogger, tlsconn.NewFromConn(tlsLogger, conn)),
+		broker:         broker.New(),
+		sendQueue:      make(chan *am.AgentMessage, 50),
+		mrtapConfig:    mrtapConfig,
+		keyshardConfig: keyshardConfig,
+		pluginConfig:   pluginConfig,
+		bastionClient:  bastionClient,
+	}
+
+	// our transporter is already connected so this just starts it reading
+	remoteUrl := &url.URL{Scheme: "tls", Host: conn.RemoteAddr().String()}
+	if err := c.client.Connect(context.Background(), remoteUrl.String(), http.Header{}, url.Values{}, targetSelectHandler); err != nil {
+		return nil, err
+	}
+
+	// let the daemon know it can start opening datachannels
+	if err := c.client.Invoke(agentConnected, agentConnectedMessage{ConnectionId: connectionId}); err != nil {
+		c.client.Close(err)
+		return nil, fmt.Errorf("failed to tell daemon we're connected: %w", err)
+	}
+	c.ready = true
+
+	go c.receive()
+
+	c.tmb.Go(func() error {
+		c.logger.Infof("Connection has started")
+		defer c.logger.Infof("Connection has stopped")
+
+		for {
+			select {
+			case <-c.tmb.Dying():
+				c.ready = false
+
+				// Close any listening datachannels
+				c.broker.Close(fmt.Errorf("connection closed"))
+
+				// send everything we have left so the daemon sees the
+				// datachannels close before it sees us go
+				c.sendRemainingMessages()
+
+				if err := c.client.Invoke(closeConnection, closeWebsocketMessage{Reason: c.tmb.Err().Error()}); err != nil {
+					c.logger.Errorf("failed to tell daemon we're closing the connection: %s", err)
+				}
+
+				c.client.Close(c.tmb.Err())
+				return nil
+			case <-c.client.Done():
+				c.ready = false
+				c.broker.Close(fmt.Errorf("daemon disconnected"))
+				return fmt.Errorf("lost connection to daemon: %w", c.client.Err())
+			case message := <-c.sendQueue:
+				if err := c.client.Send(*message); err != nil {
+					c.logger.Errorf("failed to send message: %s", err)
+				} else {
+					c.logger.Tracef("Sending %s message", message.MessageType)
+				}
+			}
+		}
+	})
+
+	return c, nil
+}
+
+func (c *Connection) receive() {
+	for {
+		select {
+		case <-c.tmb.Dead():
+			return
+		case message := <-c.client.Inbound():
+			if len(message.Arguments) != 1 {
+				c.logger.Errorf("expected a single agent message argument but got %d arguments", len(message.Arguments))
+				continue
+			}
+
+			var agentMessage am.AgentMessage
+			if err := json.Unmarshal(message.Arguments[0], &agentMessage); err != nil {
+				c.logger.Errorf("error unmarshalling %s message: %s", message.Target, err)
+				continue
+			}
+
+			if err := c.processInbound(message.Target, agentMessage); err != nil {
+				c.logger.Error(err)
+			}
+		}
+	}
+}
+
+func (c *Connection) processInbound(target string, agentMessage am.AgentMessage) error {
+	switch target {
+	case openDataChannelDaemonToBastionV1:
+		var payload openDataChannelPayload
+		if err := json.Unmarshal(agentMessage.MessagePayload, &payload); err != nil {
+			return fmt.Errorf("error unmarshalling open data channel message: %w", err)
+		}
+		return c.openDataChannel(agentMessage.ChannelId, payload.Syn)
+	case closeDataChannelDaemonToBastionV1:
+		c.logger.Infof("Closing datachannel with id: %s", agentMessage.ChannelId)
+		if ok := c.broker.CloseChannel(agentMessage.ChannelId, fmt.Errorf("received close data channel control message from daemon")); !ok {
+			return fmt.Errorf("agent connection does not have a datachannel with id: %s", agentMessage.ChannelId)
+		}
+	case closeAgentWebsocketV1:
+		var cawMessage closeWebsocketMessage
+		if err := json.Unmarshal(agentMessage.MessagePayload, &cawMessage); err != nil {
+			return fmt.Errorf("error unmarshalling close agent websocket message: %w", err)
+		}
+		c.tmb.Kill(fmt.Errorf("the daemon terminated the connection with reason: %s", cawMessage.Reason))
+	case requestDaemonToBastionV1:
+		if err := c.broker.DirectMessage(agentMessage.ChannelId, agentMessage); err != nil {
+			return fmt.Errorf("failed to forward agent message to data channel: %w", err)
+		}
+	default:
+		return fmt.Errorf("unhandled method target: %s", target)
+	}
+
+	return nil
+}
+
+func (c *Connection) openDataChannel(dcId string, syn []byte) error {
+	c.logger.Infof("Opening new datachannel with id: %s", dcId)
+
+	subLogger := c.logger.GetDatachannelLogger(dcId)
+	ksSubLogger := c.logger.GetComponentLogger("mrtap")
+
+	if mt, err := mrtap.New(ksSubLogger, c.mrtapConfig); err != nil {
+		return err
+	} else {
+		_, err := datachannel.New(&c.tmb, subLogger, c, c.keyshardConfig, c.pluginConfig, mt, c.bastionClient, dcId, syn)
+		return err
+	}
+}
+
+func (c *Connection) Send(agentMessage am.AgentMessage) {
+	c.sendQueue <- &agentMessage
+}
+
+// add channel to channels dictionary for forwarding incoming messages
+func (c *Connection) Subscribe(id string, channel broker.IChannel) {
+	c.broker.Subscribe(id, channel)
+}
+
+func (c *Connection) Ready() bool {
+	return c.ready
+}
+
+func (c *Connection) Done() <-chan struct{} {
+	return c.tmb.Dead()
+}
+
+func (c *Connection) Err() error {
+	return c.tmb.Err()
+}
+
+func (c *Connection) Close(reason error, timeout time.Duration) {
+	if c.tmb.Alive() {
+		c.logger.Infof("Connection closing because: %s", reason)
+		c.tmb.Kill(reason)
+
+		select {
+		case <-c.tmb.Dead():
+		case <-time.After(timeout):
+			c.logger.Infof("Timed out after %s waiting for connection to close", timeout.String())
+		}
+	} else {
+		c.logger.Infof("Close was called while in a dying state")
+	}
+}
+
+func (c *Connection) sendRemainingMessages() {
+	sendQueueLength := len(c.sendQueue)
+	for i := 0; i < sendQueueLength; i++ {
+		message := <-c.sendQueue
+		if err := c.client.Send(*message); err != nil {
+			c.logger.Errorf("failed to send message: %s", err)
+		}
+	}
+}
+
+// Everything we send the daemon, other than our own control messages, is a
+// response to one of its datachannels
+func targetSelectHandler(agentMessage am.AgentMessage) (string, error) {
+	switch am.MessageType(agentMessage.MessageType) {
+	case am.Mrtap, am.MrtapLegacy, am.Stream, am.Error:
+		return responseAgentToDaemonV1, nil
+	default:
+		return "", fmt.Errorf("unable to determine target for message type: %s", agentMessage.MessageType)
+	}
+}
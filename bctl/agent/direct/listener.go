@@ -0,0 +1,206 @@
+/*
+This package lets daemons on the same network as the agent connect to it
+directly, without going through the connection node. The agent listens for
+mutually authenticated TLS connections and then plays the part of the
+connection node for each daemon that dials it, speaking jsonframe over the TLS
+stream.
+
+mTLS only decides who may open a connection. Every datachannel opened on that
+connection still goes through the MrTAP handshake, but that only proves who the
+user is: BastionZero policy, which decides which target users, plugins and
+actions they may use, is enforced by the connection node, which we skip. So we
+refuse to listen unless the agent's local policy has direct rules, and every
+Syn on a direct connection must match one of them (see the localpolicy
+package).
+*/
+package direct
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/tomb.v2"
+
+	"bastionzero.com/agent/bastion"
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/mrtap"
+	"bastionzero.com/agent/plugin/db/actions/pwdb"
+	"bastionzero.com/bzerolib/connection/transporter/tlsconn"
+	"bastionzero.com/bzerolib/logger"
+)
+
+const (
+	// How long a daemon has to complete the TLS handshake after connecting
+	handshakeTimeout = 10 * time.Second
+
+	connectionCloseTimeout = 10 * time.Second
+)
+
+type Config struct {
+	// Address to listen on for direct connections; disabled if this is empty
+	ListenAddr string
+
+	// Our certificate and key, presented to connecting daemons
+	CertPath string
+	KeyPath  string
+
+	// Only daemons presenting a certificate signed by this CA may connect
+	ClientCAPath string
+}
+
+func (c Config) Enabled() bool {
+	return c.ListenAddr != ""
+}
+
+type Listener struct {
+	tmb      tomb.Tomb
+	logger   *logger.Logger
+	listener net.Listener
+
+	connectionsLock sync.Mutex
+	connections     map[string]*Connection
+
+	// everything a connection needs to open datachannels
+	bastionClient  bastion.ApiClient
+	mrtapConfig    mrtap.MrtapConfig
+	keyshardConfig pwdb.PWDBConfig
+	pluginConfig   pluginconfig.PluginConfig
+}
+
+func Listen(
+	logger *logger.Logger,
+	config Config,
+	bastionClient bastion.ApiClient,
+	mrtapConfig mrtap.MrtapConfig,
+	keyshardConfig pwdb.PWDBConfig,
+	pluginConfig pluginconfig.PluginConfig,
+) (*Listener, error) {
+	// nothing else will check what the users who connect may do
+	if err := pluginConfig.LocalPolicy.CheckDirect(); err != nil {
+		return nil, fmt.Errorf("refusing to listen for direct connections: %w", err)
+	}
+	pluginConfig.DirectConnection = true
+
+	tlsConfig, err := tlsconn.ServerConfig(config.CertPath, config.KeyPath, config.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load direct connection TLS config: %w", err)
+	}
+
+	listener, err := tls.Listen("tcp", config.ListenAddr, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for direct connections on %s: %w", config.ListenAddr, err)
+	}
+
+	l := &Listener{
+		logger:         logger,
+		listener:       listener,
+		connections:    make(map[string]*Connection),
+		bastionClient:  bastionClient,
+		mrtapConfig:    mrtapConfig,
+		keyshardConfig: keyshardConfig,
+		pluginConfig:   pluginConfig,
+	}
+
+	l.tmb.Go(func() error {
+		logger.Infof("Listening for direct daemon connections on %s", listener.Addr())
+		defer logger.Infof("Stopped listening for direct daemon connections")
+
+		l.tmb.Go(l.accept)
+
+		<-l.tmb.Dying()
+		listener.Close()
+
+		for _, conn := range l.snapshot() {
+			conn.Close(l.tmb.Err(), connectionCloseTimeout)
+		}
+		return nil
+	})
+
+	return l, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Listener) Done() <-chan struct{} {
+	return l.tmb.Dead()
+}
+
+func (l *Listener) Err() error {
+	return l.tmb.Err()
+}
+
+func (l *Listener) Close(reason error) {
+	if l.tmb.Alive() {
+		l.tmb.Kill(reason)
+		l.tmb.Wait()
+	}
+}
+
+func (l *Listener) accept() error {
+	for {
+		conn, err := l.listener.Accept()
+		if !l.tmb.Alive() {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to accept direct connection: %w", err)
+		}
+
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	// complete the handshake now so that unauthorized clients are turned away
+	// before we treat them like a daemon
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	tlsConn := conn.(*tls.Conn)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		l.logger.Errorf("rejected direct connection from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	connectionId := uuid.New().String()
+	subLogger := l.logger.GetConnectionLogger(connectionId)
+
+	peer := tlsConn.ConnectionState().PeerCertificates[0]
+	subLogger.Infof("Accepted direct connection from %s presenting certificate for %s", conn.RemoteAddr(), peer.Subject)
+
+	c, err := newConnection(subLogger, conn, connectionId, l.bastionClient, l.mrtapConfig, l.keyshardConfig, l.pluginConfig)
+	if err != nil {
+		subLogger.Errorf("failed to start direct connection: %s", err)
+		conn.Close()
+		return
+	}
+
+	l.connectionsLock.Lock()
+	l.connections[connectionId] = c
+	l.connectionsLock.Unlock()
+
+	<-c.Done()
+	subLogger.Infof("Direct connection closed: %s", c.Err())
+
+	l.connectionsLock.Lock()
+	delete(l.connections, connectionId)
+	l.connectionsLock.Unlock()
+}
+
+func (l *Listener) snapshot() []*Connection {
+	l.connectionsLock.Lock()
+	defer l.connectionsLock.Unlock()
+
+	conns := []*Connection{}
+	for _, conn := range l.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
@@ -0,0 +1,112 @@
+package main
+
+/*
+Functions supporting the `kube-check` subcommand
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"bastionzero.com/agent/plugin/kube/cluster"
+	"bastionzero.com/agent/rbac"
+)
+
+const kubeCheckCmdName = "kube-check"
+
+// kubeCheck checks whether a kube agent could serve a cluster with the
+// credentials it would run with, the same way it does when it starts. It
+// prints anything that's missing to stderr and the RBAC to fix it to stdout,
+// so that it can be piped to kubectl apply. Returns false if anything was
+// missing
+func kubeCheck(args []string) bool {
+	kubeCheckCmd := flag.NewFlagSet(kubeCheckCmdName, flag.ExitOnError)
+
+	var checkKubeconfig, checkContext, checkNamespace, roleName, users, groups string
+	kubeCheckCmd.StringVar(&checkKubeconfig, "kubeconfig", os.Getenv(kubeconfigEnvVar), "Path to the kubeconfig of an agent running outside of the cluster. Defaults to BASTIONZERO_KUBECONFIG. If neither is set, the agent's in-cluster service account is checked.")
+	kubeCheckCmd.StringVar(&checkContext, "context", os.Getenv(kubeContextEnvVar), "The kubeconfig context to check. Defaults to BASTIONZERO_KUBE_CONTEXT, then the kubeconfig's current context.")
+	kubeCheckCmd.StringVar(&checkNamespace, "namespace", os.Getenv("NAMESPACE"), "The namespace the agent keeps its config in. Defaults to NAMESPACE, then the namespace of the agent's service account.")
+	kubeCheckCmd.StringVar(&roleName, "roleName", "bastionzero-agent", "The name to give the ClusterRole and Role that grant any missing permissions.")
+	kubeCheckCmd.StringVar(&users, "users", "", "Comma-separated list of users the agent should be able to impersonate, e.g. 'alice@example.com,bob@example.com'")
+	kubeCheckCmd.StringVar(&groups, "groups", "", "Comma-separated list of groups the agent should be able to impersonate, e.g. 'system:masters,developers'")
+	kubeCheckCmd.Parse(args)
+
+	inCluster := checkKubeconfig == ""
+
+	var kubeCluster *cluster.Cluster
+	var err error
+	if inCluster {
+		kubeCluster, err = cluster.InCluster()
+	} else {
+		kubeCluster, err = cluster.OutOfCluster(checkKubeconfig, checkContext)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return false
+	}
+
+	if inCluster && checkNamespace == "" {
+		if data, err := os.ReadFile(rbac.ServiceAccountNamespacePath); err == nil {
+			checkNamespace = strings.TrimSpace(string(data))
+		}
+	}
+	if inCluster && checkNamespace == "" {
+		fmt.Fprintln(os.Stderr, "error: could not tell which namespace the agent runs in, please set -namespace")
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Checking permissions for the %s cluster at %s\n", kubeCluster.Name, kubeCluster.Host())
+
+	result, err := rbac.Check(context.Background(), kubeCluster.Config(), checkNamespace, inCluster, splitList(users), splitList(groups))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return false
+	} else if result.Ok() {
+		fmt.Fprintln(os.Stderr, "The agent has every permission it needs")
+		return true
+	}
+
+	for _, missing := range result.Missing {
+		fmt.Fprintf(os.Stderr, "Missing: %s %s", strings.Join(missing.Verbs, ","), strings.Join(missing.Resources, ","))
+		if missing.ApiGroups[0] != "" {
+			fmt.Fprintf(os.Stderr, ".%s", missing.ApiGroups[0])
+		}
+		if missing.Namespaced {
+			fmt.Fprintf(os.Stderr, " in namespace %s", checkNamespace)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	for _, user := range result.Users {
+		fmt.Fprintf(os.Stderr, "Cannot impersonate user: %s\n", user)
+	}
+	for _, group := range result.Groups {
+		fmt.Fprintf(os.Stderr, "Cannot impersonate group: %s\n", group)
+	}
+
+	manifest, err := result.Manifest(roleName, checkNamespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return false
+	}
+
+	if inCluster {
+		fmt.Fprintf(os.Stderr, "\nApply the following and bind it to the agent's service account in namespace %s:\n\n", checkNamespace)
+	} else {
+		fmt.Fprint(os.Stderr, "\nApply the following and bind it to the user in the agent's kubeconfig:\n\n")
+	}
+	fmt.Print(manifest)
+	return false
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
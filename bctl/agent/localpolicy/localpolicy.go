@@ -0,0 +1,375 @@
+/*
+This package lets the owner of a target veto connections to it, no matter what
+their BastionZero policy allows. The agent checks every Syn it receives against
+an optional YAML file of deny rules such as:
+
+	deny:
+	  - reason: nobody gets a root shell on this box
+	    plugins: [shell, ssh]
+	    targetUsers: [root]
+	  - reason: contractors can't reach the payments database
+	    plugins: [db]
+	    remoteHosts: ["payments-*.internal"]
+	    remotePorts: [5432]
+	    emails: ["*@contractor.example.com"]
+
+Each field of a rule is a list of glob patterns (see path.Match), apart from
+remotePorts which is a list of ports. A rule matches a request when every field
+it sets has at least one entry which matches, and the request is denied if any
+rule matches it. Fields which the request doesn't have never match, so a rule
+with remotePorts will never deny a shell, while a rule with no fields at all
+denies everything.
+
+The same file can also restrict what the shell plugin lets each target user
+run:
+
+	shellRestrictions:
+	  contractor:
+	    allow: [/opt/scripts/deploy.sh, /opt/scripts/restart.sh, /usr/bin/uptime]
+	  backup:
+	    forceCommand: /opt/backup/run.sh
+
+A user with an allow list gets a restricted prompt which will only run the
+listed binaries, while a user with a forced command gets that command instead of
+a shell, and their session ends when it does. Users who aren't listed get a
+normal login shell.
+
+Daemons which connect to the agent directly (see the direct package) skip the
+connection node, which is where a user's BastionZero policy is normally
+enforced. The only thing that checks what such a user may do is this file's
+direct rules, which allow rather than deny:
+
+	direct:
+	  - subjects: ["00u1a2b3c4d5e6f7g8h9"]
+	    plugins: [shell]
+	    targetUsers: [ec2-user]
+	  - emails: ["*@sre.example.com"]
+	    plugins: [db, web]
+
+They match like deny rules, but each one must say which subjects or emails it
+applies to. The agent won't listen for direct connections unless the file has
+at least one, and a Syn that arrives on a direct connection is denied unless one
+of them matches it, on top of having to get past the deny rules.
+
+The file is read every time we evaluate a request (see the policyfile package).
+If it doesn't exist then everything is allowed, but if it can't be read or
+parsed then everything is denied.
+*/
+package localpolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"bastionzero.com/agent/config/policyfile"
+)
+
+const DefaultPath = "/etc/bzero/local-policy.yaml"
+
+type Config struct {
+	// Path to the policy file; local policy is disabled if this is empty
+	Path string
+}
+
+func (c Config) Enabled() bool {
+	return c.Path != ""
+}
+
+type Policy struct {
+	Deny []Rule `yaml:"deny"`
+
+	// Everything users who connect directly may do
+	Direct []Rule `yaml:"direct"`
+
+	// Keyed by target user
+	ShellRestrictions map[string]ShellRestriction `yaml:"shellRestrictions"`
+}
+
+type Rule struct {
+	// Returned to the user when this rule denies their request
+	Reason string `yaml:"reason"`
+
+	Plugins     []string `yaml:"plugins"`
+	Actions     []string `yaml:"actions"`
+	TargetUsers []string `yaml:"targetUsers"`
+	RemoteHosts []string `yaml:"remoteHosts"`
+	RemotePorts []int    `yaml:"remotePorts"`
+	KubeGroups  []string `yaml:"kubeGroups"`
+
+	// Identity from the user's BZCert
+	Subjects []string `yaml:"subjects"`
+	Emails   []string `yaml:"emails"`
+}
+
+type ShellRestriction struct {
+	// Absolute paths of the only binaries the user may run
+	Allow []string `yaml:"allow"`
+
+	// Run instead of the user's shell
+	ForceCommand string `yaml:"forceCommand"`
+}
+
+// Request is everything a rule can match on about a Syn
+type Request struct {
+	Plugin     string
+	Action     string
+	TargetUser string
+	RemoteHost string
+	RemotePort int
+	KubeGroups []string
+
+	Subject string
+	Email   string
+}
+
+// NewRequest pulls whatever a rule can match on out of a Syn's action payload.
+// Every plugin's action params are a subset of the same few fields, so we don't
+// need to know which plugin we're dealing with
+func NewRequest(plugin string, action string, actionPayload []byte, subject string, email string) (Request, error) {
+	var params struct {
+		TargetUser   string   `json:"targetUser"`
+		TargetGroups []string `json:"targetGroups"`
+		RemoteHost   string   `json:"remoteHost"`
+		RemotePort   int      `json:"remotePort"`
+	}
+
+	if len(actionPayload) > 0 {
+		if err := json.Unmarshal(actionPayload, &params); err != nil {
+			return Request{}, fmt.Errorf("malformed %s action payload: %s", plugin, err)
+		}
+	}
+
+	return Request{
+		Plugin:     plugin,
+		Action:     action,
+		TargetUser: params.TargetUser,
+		RemoteHost: params.RemoteHost,
+		RemotePort: params.RemotePort,
+		KubeGroups: params.TargetGroups,
+		Subject:    subject,
+		Email:      email,
+	}, nil
+}
+
+// Evaluate returns an error explaining why the request is denied, or nil if
+// it's allowed
+func (c Config) Evaluate(request Request) error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	policy, err := Load(c.Path)
+	if err != nil {
+		return fmt.Errorf("denied by local policy: %s", err)
+	} else if policy == nil {
+		return nil
+	}
+
+	return policy.Evaluate(request)
+}
+
+// CheckDirect returns an error unless the policy says who may do what over a
+// direct connection
+func (c Config) CheckDirect() error {
+	if !c.Enabled() {
+		return fmt.Errorf("direct connections need direct rules in the local policy, but local policy is disabled")
+	}
+
+	policy, err := Load(c.Path)
+	if err != nil {
+		return fmt.Errorf("direct connections need direct rules in the local policy: %w", err)
+	} else if policy == nil {
+		return fmt.Errorf("direct connections need direct rules in the local policy, but there is no local policy file %s", c.Path)
+	} else if len(policy.Direct) == 0 {
+		return fmt.Errorf("local policy file %s has no direct rules", c.Path)
+	}
+	return nil
+}
+
+// EvaluateDirect returns an error explaining why a request that arrived over a
+// direct connection isn't allowed, or nil if a direct rule allows it
+func (c Config) EvaluateDirect(request Request) error {
+	if !c.Enabled() {
+		return fmt.Errorf("denied by local policy: local policy is disabled")
+	}
+
+	policy, err := Load(c.Path)
+	if err != nil {
+		return fmt.Errorf("denied by local policy: %s", err)
+	} else if policy == nil {
+		return fmt.Errorf("denied by local policy: there is no local policy file %s", c.Path)
+	}
+
+	for _, rule := range policy.Direct {
+		if rule.matches(request) {
+			return nil
+		}
+	}
+	return fmt.Errorf("denied by local policy: no direct rule allows %s", request.Action)
+}
+
+// ShellRestriction returns how the user's shells are restricted, or nil if they
+// aren't
+func (c Config) ShellRestriction(targetUser string) (*ShellRestriction, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+
+	policy, err := Load(c.Path)
+	if err != nil || policy == nil {
+		return nil, err
+	}
+
+	if restriction, ok := policy.ShellRestrictions[targetUser]; ok {
+		return &restriction, nil
+	}
+	return nil, nil
+}
+
+// Load reads the policy file, or returns nil if there isn't one
+func Load(policyPath string) (*Policy, error) {
+	var policy Policy
+	if found, err := policyfile.Load(policyPath, &policy); err != nil {
+		return nil, fmt.Errorf("malformed local policy file: %w", err)
+	} else if !found {
+		return nil, nil
+	}
+
+	// catch bad patterns now rather than letting them silently never match
+	for i, rule := range policy.Deny {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule %d in local policy file %s: %w", i+1, policyPath, err)
+		}
+	}
+
+	for i, rule := range policy.Direct {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid direct rule %d in local policy file %s: %w", i+1, policyPath, err)
+		} else if len(rule.Subjects) == 0 && len(rule.Emails) == 0 {
+			// otherwise a rule could let anyone with a certificate do anything
+			return nil, fmt.Errorf("direct rule %d in local policy file %s must have subjects or emails", i+1, policyPath)
+		}
+	}
+
+	for user, restriction := range policy.ShellRestrictions {
+		if err := restriction.validate(); err != nil {
+			return nil, fmt.Errorf("invalid shell restriction for %s in local policy file %s: %w", user, policyPath, err)
+		}
+	}
+
+	return &policy, nil
+}
+
+func (p *Policy) Evaluate(request Request) error {
+	for i, rule := range p.Deny {
+		if rule.matches(request) {
+			reason := rule.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("rule %d", i+1)
+			}
+			return fmt.Errorf("denied by local policy: %s", reason)
+		}
+	}
+
+	return nil
+}
+
+func (r Rule) validate() error {
+	patterns := [][]string{r.Plugins, r.Actions, r.TargetUsers, r.RemoteHosts, r.KubeGroups, r.Subjects, r.Emails}
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r ShellRestriction) validate() error {
+	if r.ForceCommand != "" && len(r.Allow) > 0 {
+		return fmt.Errorf("can't have both an allow list and a forced command")
+	} else if r.ForceCommand == "" && len(r.Allow) == 0 {
+		return fmt.Errorf("must have either an allow list or a forced command")
+	}
+
+	// users may run allowed binaries by name alone, so no two can share one
+	names := make(map[string]string)
+	for _, binary := range r.Allow {
+		if !path.IsAbs(binary) {
+			return fmt.Errorf("allowed binary %q is not an absolute path", binary)
+		}
+
+		name := path.Base(binary)
+		if other, ok := names[name]; ok && other != path.Clean(binary) {
+			return fmt.Errorf("allowed binaries %q and %q have the same name", other, binary)
+		}
+		names[name] = path.Clean(binary)
+	}
+
+	return nil
+}
+
+func (r Rule) matches(request Request) bool {
+	return matchesAny(r.Plugins, request.Plugin, false) &&
+		matchesAny(r.Actions, request.Action, false) &&
+		matchesAny(r.TargetUsers, request.TargetUser, false) &&
+		matchesAny(r.RemoteHosts, request.RemoteHost, true) &&
+		matchesPort(r.RemotePorts, request.RemotePort) &&
+		matchesAnyOf(r.KubeGroups, request.KubeGroups) &&
+		matchesAny(r.Subjects, request.Subject, false) &&
+		matchesAny(r.Emails, request.Email, true)
+}
+
+// matchesAny returns true if there are no patterns, or if any of them match
+// the value. Hostnames and emails are compared case insensitively
+func matchesAny(patterns []string, value string, ignoreCase bool) bool {
+	if len(patterns) == 0 {
+		return true
+	} else if value == "" {
+		return false
+	}
+
+	if ignoreCase {
+		value = strings.ToLower(value)
+	}
+
+	for _, pattern := range patterns {
+		if ignoreCase {
+			pattern = strings.ToLower(pattern)
+		}
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyOf(patterns []string, values []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		if matchesAny(patterns, value, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPort(ports []int, port int) bool {
+	if len(ports) == 0 {
+		return true
+	}
+
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package localpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLocalPolicy(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Local Policy Suite")
+}
+
+const testPolicy = `
+deny:
+  - reason: nobody gets a root shell on this box
+    plugins: [shell, ssh]
+    targetUsers: [root]
+  - reason: contractors can't reach the payments database
+    plugins: [db]
+    remoteHosts: ["payments-*.internal"]
+    remotePorts: [5432]
+    emails: ["*@contractor.example.com"]
+  - plugins: [kube]
+    kubeGroups: ["system:masters"]
+`
+
+var _ = Describe("Local Policy", func() {
+	var config Config
+
+	writePolicy := func(policy string) {
+		Expect(os.WriteFile(config.Path, []byte(policy), 0600)).To(Succeed())
+	}
+
+	newRequest := func(action string, actionPayload string, email string) Request {
+		plugin := filepath.Dir(action)
+		request, err := NewRequest(plugin, action, []byte(actionPayload), "subject", email)
+		Expect(err).ToNot(HaveOccurred())
+		return request
+	}
+
+	BeforeEach(func() {
+		config = Config{Path: filepath.Join(GinkgoT().TempDir(), "local-policy.yaml")}
+	})
+
+	When("there is no policy file", func() {
+		It("allows everything", func() {
+			request := newRequest("shell/defaultShell", `{"targetUser":"root"}`, "alice@example.com")
+			Expect(config.Evaluate(request)).To(Succeed())
+		})
+	})
+
+	When("there is a policy file", func() {
+		BeforeEach(func() {
+			writePolicy(testPolicy)
+		})
+
+		It("denies requests matching a rule, with its reason", func() {
+			request := newRequest("shell/defaultShell", `{"targetUser":"root"}`, "alice@example.com")
+			err := config.Evaluate(request)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("nobody gets a root shell on this box"))
+		})
+
+		It("allows requests which only match part of a rule", func() {
+			request := newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "alice@example.com")
+			Expect(config.Evaluate(request)).To(Succeed())
+		})
+
+		It("matches hosts and emails with globs, ignoring case", func() {
+			request := newRequest("db/pwdb", `{"remoteHost":"Payments-1.internal","remotePort":5432}`, "bob@Contractor.Example.com")
+			Expect(config.Evaluate(request)).ToNot(Succeed())
+
+			request = newRequest("db/pwdb", `{"remoteHost":"payments-1.internal","remotePort":5432}`, "bob@example.com")
+			Expect(config.Evaluate(request)).To(Succeed())
+		})
+
+		It("understands the web plugin's untagged action params", func() {
+			writePolicy("deny:\n  - remotePorts: [8080]\n")
+			request := newRequest("web/dial", `{"RemoteHost":"localhost","RemotePort":8080}`, "alice@example.com")
+			Expect(config.Evaluate(request)).ToNot(Succeed())
+		})
+
+		It("denies kube requests impersonating any matching group", func() {
+			request := newRequest("kube/restapi", `{"targetUser":"alice","targetGroups":["developers","system:masters"]}`, "alice@example.com")
+			err := config.Evaluate(request)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("rule 3"))
+		})
+
+		It("picks up changes to the file", func() {
+			writePolicy("deny: []\n")
+			request := newRequest("shell/defaultShell", `{"targetUser":"root"}`, "alice@example.com")
+			Expect(config.Evaluate(request)).To(Succeed())
+		})
+	})
+
+	Context("shell restrictions", func() {
+		BeforeEach(func() {
+			writePolicy(`
+shellRestrictions:
+  contractor:
+    allow: [/opt/scripts/deploy.sh]
+  backup:
+    forceCommand: /opt/backup/run.sh
+`)
+		})
+
+		It("returns the restriction for a listed user", func() {
+			restriction, err := config.ShellRestriction("contractor")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restriction.Allow).To(Equal([]string{"/opt/scripts/deploy.sh"}))
+
+			restriction, err = config.ShellRestriction("backup")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restriction.ForceCommand).To(Equal("/opt/backup/run.sh"))
+		})
+
+		It("doesn't restrict anyone else", func() {
+			Expect(config.ShellRestriction("ec2-user")).To(BeNil())
+		})
+
+		It("refuses allow lists of relative paths", func() {
+			writePolicy("shellRestrictions:\n  contractor:\n    allow: [deploy.sh]\n")
+			_, err := config.ShellRestriction("contractor")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses allow lists with two binaries of the same name", func() {
+			writePolicy("shellRestrictions:\n  contractor:\n    allow: [/opt/scripts/deploy.sh, /tmp/deploy.sh]\n")
+			_, err := config.ShellRestriction("contractor")
+			Expect(err).To(MatchError(ContainSubstring("same name")))
+		})
+	})
+
+	Context("direct rules", func() {
+		BeforeEach(func() {
+			writePolicy(`
+deny:
+  - targetUsers: [root]
+direct:
+  - emails: ["*@sre.example.com"]
+    plugins: [shell]
+    targetUsers: [ec2-user, root]
+`)
+		})
+
+		It("allows only what a direct rule matches", func() {
+			Expect(config.CheckDirect()).To(Succeed())
+
+			request := newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "bob@sre.example.com")
+			Expect(config.EvaluateDirect(request)).To(Succeed())
+
+			for _, request := range []Request{
+				newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "alice@example.com"),
+				newRequest("shell/defaultShell", `{"targetUser":"ubuntu"}`, "bob@sre.example.com"),
+				newRequest("db/dial", `{"remoteHost":"localhost","remotePort":5432}`, "bob@sre.example.com"),
+			} {
+				Expect(config.EvaluateDirect(request)).ToNot(Succeed(), request.Action)
+			}
+		})
+
+		It("still applies deny rules", func() {
+			request := newRequest("shell/defaultShell", `{"targetUser":"root"}`, "bob@sre.example.com")
+			Expect(config.EvaluateDirect(request)).To(Succeed())
+			Expect(config.Evaluate(request)).ToNot(Succeed())
+		})
+
+		It("denies every direct request without a policy that has them", func() {
+			request := newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "bob@sre.example.com")
+
+			writePolicy("deny: []\n")
+			Expect(config.CheckDirect()).ToNot(Succeed())
+			Expect(config.EvaluateDirect(request)).ToNot(Succeed())
+
+			Expect(os.Remove(config.Path)).To(Succeed())
+			Expect(config.CheckDirect()).ToNot(Succeed())
+			Expect(config.EvaluateDirect(request)).ToNot(Succeed())
+
+			Expect(Config{}.CheckDirect()).ToNot(Succeed())
+			Expect(Config{}.EvaluateDirect(request)).ToNot(Succeed())
+		})
+
+		It("refuses direct rules that don't say who they're for", func() {
+			writePolicy("direct:\n  - plugins: [shell]\n")
+			Expect(config.CheckDirect()).To(MatchError(ContainSubstring("must have subjects or emails")))
+		})
+	})
+
+	When("the policy file is malformed", func() {
+		It("denies everything when it isn't YAML", func() {
+			writePolicy("deny: [")
+			request := newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "alice@example.com")
+			Expect(config.Evaluate(request)).ToNot(Succeed())
+		})
+
+		It("denies everything when a field is misspelt", func() {
+			writePolicy("deny:\n  - plugin: [db]\n")
+			request := newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "alice@example.com")
+			Expect(config.Evaluate(request)).ToNot(Succeed())
+		})
+
+		It("denies everything when a pattern is invalid", func() {
+			writePolicy("deny:\n  - targetUsers: [\"[\"]\n")
+			request := newRequest("shell/defaultShell", `{"targetUser":"ec2-user"}`, "alice@example.com")
+			Expect(config.Evaluate(request)).ToNot(Succeed())
+		})
+	})
+})
@@ -8,15 +8,27 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"bastionzero.com/agent/agenttype"
 	agentconfig "bastionzero.com/agent/config/agentconfig"
 	"bastionzero.com/agent/config/client"
 	ksconfig "bastionzero.com/agent/config/keyshardconfig"
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/direct"
+	"bastionzero.com/agent/localpolicy"
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
+	"bastionzero.com/agent/plugin/kube/filter"
+	"bastionzero.com/agent/plugin/web/headerpolicy"
+	"bastionzero.com/agent/plugin/web/upstreamtls"
 	"bastionzero.com/agent/rbac"
+	"bastionzero.com/agent/recording"
 	"bastionzero.com/agent/registration"
 	"bastionzero.com/bzerolib/bzos"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/logger"
 )
 
@@ -35,6 +47,32 @@ var (
 	attemptedRegistration            bool
 	successfulRegistration           bool
 	svcFlag                          string
+	messengerProtocol                string
+
+	// session recording vars
+	recordingDir       string
+	recordingMaxAge    time.Duration
+	recordingMaxSizeMB int64
+
+	// local policy vars
+	localPolicyPath string
+
+	// web target vars
+	webHeaderPolicyPath string
+	webTLSConfigPath    string
+
+	// kube audit and filtering vars
+	kubeAuditSink       string
+	kubeFilterConfigMap string
+
+	// extra clusters a kube agent serves as virtual targets
+	kubeClustersConfig string
+
+	// the cluster a kube agent running outside of it serves
+	kubeconfigPath, kubeContext string
+
+	// direct connection vars
+	directListenAddr, directCertPath, directKeyPath, directClientCAPath string
 
 	// key-shard vars
 	getKeyShards, clearKeyShards, addKeyShards, addTargets, removeTargets bool
@@ -45,6 +83,13 @@ const (
 
 	// Env var to flag if we are in a kube cluster
 	inClusterEnvVar = "BASTIONZERO_IN_CLUSTER"
+
+	// Env var with the kubeconfig of the cluster we serve, if we're a kube agent
+	// running outside of it
+	kubeconfigEnvVar = "BASTIONZERO_KUBECONFIG"
+
+	// Env var with the kubeconfig context to use, if not its current one
+	kubeContextEnvVar = "BASTIONZERO_KUBE_CONTEXT"
 )
 
 var (
@@ -151,6 +196,7 @@ func parseFlags() bool {
 	flag.StringVar(&targetName, "targetName", "", "The desired name of the target. If no name is provided, this will default to the target’s host name.")
 	flag.StringVar(&targetId, "targetId", "", "Target ID to use")
 	flag.StringVar(&logLevel, "logLevel", "debug", "The log level to use -- must be one of 'disabled', 'debug', 'info', 'error'")
+	flag.StringVar(&messengerProtocol, "messenger", string(messenger.SignalR), "The protocol to speak to BastionZero -- must be one of 'signalr', 'json'. Only use 'json' when connecting to a self-hosted relay")
 
 	flag.StringVar(&idpOrgId, "orgId", "", "The unique identifier for your SSO instance. For more information locating it please see https://docs.bastionzero.com/docs/deployment/installing-the-agent#bzero-flags")
 	flag.StringVar(&idpProvider, "orgProvider", "", "Your identity provider, e.g., “Google”, “Microsoft”, “Okta”, etc. If neither the -orgId nor the -orgProvider are set, the information defaults to values provided by BastionZero during the registration process.")
@@ -162,6 +208,24 @@ func parseFlags() bool {
 	flag.StringVar(&environmentId, "envId", "", "(Deprecated) Please use -environmentId")
 	flag.StringVar(&environmentName, "envName", "", "(Deprecated) Please use -environmentId")
 
+	// Direct connection flags
+	flag.StringVar(&directListenAddr, "directListenAddr", "", "Address to listen on for daemons connecting directly to this agent, without going through BastionZero, e.g. ':8443'. Direct connections are disabled if this is not set, and the local policy must have direct rules saying what their users may do.")
+	flag.StringVar(&directCertPath, "directCertPath", "", "Path to the TLS certificate this agent presents to directly connecting daemons.")
+	flag.StringVar(&directKeyPath, "directKeyPath", "", "Path to the private key for -directCertPath.")
+	flag.StringVar(&directClientCAPath, "directClientCAPath", "", "Path to the CA certificate that directly connecting daemons' certificates must be signed by.")
+
+	// Session recording flags
+	flag.StringVar(&recordingDir, "sessionRecordingDir", "", "Directory to save asciicast recordings of shell and kube exec sessions to. Sessions are not recorded if this is not set. Kube agents read this from SESSION_RECORDING_DIR instead, e.g. a mounted PersistentVolumeClaim.")
+	flag.DurationVar(&recordingMaxAge, "sessionRecordingMaxAge", 30*24*time.Hour, "Session recordings older than this will be deleted. Set to 0 to keep recordings forever.")
+	flag.Int64Var(&recordingMaxSizeMB, "sessionRecordingMaxSize", 1024, "Maximum total size in MB of the session recording directory. The oldest recordings are deleted once this is exceeded. Set to 0 for no limit.")
+
+	// Local policy flags
+	flag.StringVar(&localPolicyPath, "localPolicyPath", localpolicy.DefaultPath, "Path to a YAML file of local deny rules that every connection to this target is checked against, on top of BastionZero policy, and of which binaries each target user may run in a shell. Connections are allowed if the file does not exist, and denied if it exists but cannot be parsed. Set to an empty string to disable.")
+
+	// Web target flags
+	flag.StringVar(&webHeaderPolicyPath, "webHeaderPolicyPath", "", "Path to a YAML file of how to rewrite the headers of requests to web targets, and whether to add the user's identity to them. Requests are passed on as they are if this is not set or the file does not exist.")
+	flag.StringVar(&webTLSConfigPath, "webTLSConfigPath", "", "Path to a YAML file of the CA bundle, client certificate, server name and minimum TLS version to use for each web target that needs them. Web targets use the system's CAs and the defaults if this is not set or the file does not exist.")
+
 	/* key-shard configuration command */
 	keyShardsCmd := flag.NewFlagSet("keyshards", flag.ExitOnError)
 
@@ -171,6 +235,15 @@ func parseFlags() bool {
 	keyShardsCmd.BoolVar(&addTargets, "addTargets", false, "Add one or more targetIds to this agent's keyshard config. These targets will be accessible via SplitCert access if they use this agent as a proxy. Example: 'bzero keyShards -addTargets target1 target2'")
 	keyShardsCmd.BoolVar(&removeTargets, "removeTargets", false, "Remove one or more targetIds from this agent's keyshard config. These targets will no longer be accessible via SplitCert access from this agent. Example: 'bzero keyShards -removeTargets target1 target2'")
 
+	// check whether we have the permissions to serve a cluster, which doesn't
+	// need the agent to be registered so it can be run before installing it
+	if len(os.Args) > 1 && os.Args[1] == kubeCheckCmdName {
+		if !kubeCheck(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return false
+	}
+
 	// check if we're in key-shard mode (only supported on the linux agent)
 	if getAgentType() == agenttype.Linux && len(os.Args) > 1 && os.Args[1] == "keyshards" {
 		// parse the flags, call this function with args
@@ -227,11 +300,75 @@ func parseFlags() bool {
 			namespace = os.Getenv("NAMESPACE")
 			registrationKey = os.Getenv("API_KEY")
 			logLevel = os.Getenv("LOG_LEVEL")
+			messengerProtocol = os.Getenv("MESSENGER")
+			if policyPath, ok := os.LookupEnv("LOCAL_POLICY_PATH"); ok {
+				localPolicyPath = policyPath
+			}
+			kubeAuditSink = os.Getenv("KUBE_AUDIT_SINK")
+			kubeFilterConfigMap = os.Getenv("KUBE_REQUEST_FILTER_CONFIGMAP")
+			kubeClustersConfig = os.Getenv("KUBE_CLUSTERS_CONFIG")
+			kubeconfigPath = os.Getenv(kubeconfigEnvVar)
+			kubeContext = os.Getenv(kubeContextEnvVar)
+			if err := loadKubeRecordingEnv(); err != nil {
+				fmt.Printf("ERROR: %s\n", err)
+				os.Exit(1)
+			}
 		}
 		return true
 	}
 }
 
+// loadKubeRecordingEnv lets kube agents point session recording at a mounted
+// volume, since they are configured through their environment
+func loadKubeRecordingEnv() error {
+	if dir, ok := os.LookupEnv("SESSION_RECORDING_DIR"); ok {
+		recordingDir = dir
+	}
+
+	if maxAge, ok := os.LookupEnv("SESSION_RECORDING_MAX_AGE"); ok && maxAge != "" {
+		if parsed, err := time.ParseDuration(maxAge); err != nil {
+			return fmt.Errorf("invalid SESSION_RECORDING_MAX_AGE %s: %w", maxAge, err)
+		} else {
+			recordingMaxAge = parsed
+		}
+	}
+
+	if maxSize, ok := os.LookupEnv("SESSION_RECORDING_MAX_SIZE"); ok && maxSize != "" {
+		if parsed, err := strconv.ParseInt(maxSize, 10, 64); err != nil {
+			return fmt.Errorf("invalid SESSION_RECORDING_MAX_SIZE %s: %w", maxSize, err)
+		} else {
+			recordingMaxSizeMB = parsed
+		}
+	}
+
+	return nil
+}
+
+// newPluginConfig builds the settings we hand to every plugin from our flags
+// and environment
+func newPluginConfig() pluginconfig.PluginConfig {
+	sessionRecording := recording.Config{
+		Dir:     recordingDir,
+		MaxAge:  recordingMaxAge,
+		MaxSize: recordingMaxSizeMB * 1024 * 1024,
+	}
+
+	return pluginconfig.PluginConfig{
+		ShellRecording: sessionRecording,
+		KubeRecording:  sessionRecording,
+		LocalPolicy: localpolicy.Config{
+			Path: localPolicyPath,
+		},
+		WebHeaders: headerpolicy.Config{
+			Path: webHeaderPolicyPath,
+		},
+		WebTLS: upstreamtls.Config{
+			Path:       webTLSConfigPath,
+			Transports: upstreamtls.NewTransports(),
+		},
+	}
+}
+
 func NewAgent(
 	version string,
 	registration *registration.Registration,
@@ -244,6 +381,13 @@ func NewAgent(
 		osSignalChan: bzos.OsShutdownChan(),
 		version:      version,
 		agentType:    agentType,
+		pluginConfig: newPluginConfig(),
+		directConfig: direct.Config{
+			ListenAddr:   directListenAddr,
+			CertPath:     directCertPath,
+			KeyPath:      directKeyPath,
+			ClientCAPath: directClientCAPath,
+		},
 	}
 
 	// This context will allow us to cancel everything concisely
@@ -292,6 +436,10 @@ func NewAgent(
 		return a, fmt.Errorf("failed to load key shard config: %w", err)
 	}
 
+	if a.messengerProtocol, err = messenger.ParseProtocol(messengerProtocol); err != nil {
+		return a, fmt.Errorf("invalid messenger protocol: %w", err)
+	}
+
 	a.logger.Info("Starting up the BastionZero Agent")
 
 	// If this is an agent run by systemd, we add the -w (wait) flag
@@ -352,6 +500,7 @@ func NewKubeAgent(
 		version:      version,
 		osSignalChan: bzos.OsShutdownChan(),
 		agentType:    agenttype.Kubernetes,
+		pluginConfig: newPluginConfig(),
 	}
 
 	// This context will allow us to cancel everything concisely
@@ -386,28 +535,68 @@ func NewKubeAgent(
 		}
 	}()
 
-	// Initialize our config
-	if agentClient, err := client.NewSecretsStore(ctx, namespace, targetName, client.Agent); err != nil {
-		return a, fmt.Errorf("failed to initialize agent config client: %w", err)
-	} else if a.agentConfig, err = agentconfig.LoadAgentConfig(agentClient); err != nil {
-		return a, fmt.Errorf("failed to load agent config: %w", err)
+	// Set up wherever we've been asked to send kube audit events
+	if a.pluginConfig.KubeAudit, err = audit.NewSink(a.logger.GetComponentLogger("KubeAudit"), kubeAuditSink); err != nil {
+		return
 	}
 
-	if keyShardClient, err := client.NewSecretsStore(ctx, namespace, targetName, client.KeyShard); err != nil {
-		return a, fmt.Errorf("failed to initialize key shard config client: %w", err)
+	// Load the cluster we serve, which we're running in unless we've been given
+	// a kubeconfig for it
+	inCluster := kubeconfigPath == ""
+	var localCluster *cluster.Cluster
+	if inCluster {
+		localCluster, err = cluster.InCluster()
+	} else {
+		localCluster, err = cluster.OutOfCluster(kubeconfigPath, kubeContext)
+	}
+	if err != nil {
+		return a, fmt.Errorf("failed to load kube cluster: %w", err)
+	}
+	a.logger.Infof("Serving the %s cluster at %s", localCluster.Name, localCluster.Host())
+
+	// Initialize our config. Agents running in the cluster keep it in secrets
+	// so that it survives pod restarts, everyone else keeps it on disk
+	var agentClient, keyShardClient client.Store
+	if inCluster {
+		if agentClient, err = client.NewSecretsStore(ctx, namespace, targetName, client.Agent); err != nil {
+			return a, fmt.Errorf("failed to initialize agent config client: %w", err)
+		} else if keyShardClient, err = client.NewSecretsStore(ctx, namespace, targetName, client.KeyShard); err != nil {
+			return a, fmt.Errorf("failed to initialize key shard config client: %w", err)
+		}
+	} else {
+		if agentClient, err = client.NewFileStore(configDir, client.Agent); err != nil {
+			return a, fmt.Errorf("failed to initialize agent config client: %w", err)
+		} else if keyShardClient, err = client.NewFileStore(configDir, client.KeyShard); err != nil {
+			return a, fmt.Errorf("failed to initialize key shard config client: %w", err)
+		}
+	}
+
+	if a.agentConfig, err = agentconfig.LoadAgentConfig(agentClient); err != nil {
+		return a, fmt.Errorf("failed to load agent config: %w", err)
 	} else if a.keyShardConfig, err = ksconfig.LoadKeyShardConfig(keyShardClient); err != nil {
 		return a, fmt.Errorf("failed to load key shard config: %w", err)
 	}
 
+	if a.messengerProtocol, err = messenger.ParseProtocol(messengerProtocol); err != nil {
+		return a, fmt.Errorf("invalid messenger protocol: %w", err)
+	}
+
 	a.logger.Infof("Starting up the BastionZero Agent")
 
 	// Verify we have the correct RBAC permissions
-	if err = rbac.CheckPermissions(a.logger, namespace); err != nil {
+	if err = rbac.CheckPermissions(a.logger, localCluster.Config(), namespace, inCluster); err != nil {
 		return a, fmt.Errorf("error verifying agent kubernetes setup: %w", err)
 	} else {
 		a.logger.Info("Namespace and service account permissions verified")
 	}
 
+	// Start watching our kube request filter if we've been given one
+	if kubeFilterConfigMap != "" {
+		if a.pluginConfig.KubeFilter, err = filter.Watch(ctx, a.logger.GetComponentLogger("KubeFilter"), localCluster.Config(), namespace, kubeFilterConfigMap); err != nil {
+			return a, fmt.Errorf("failed to load kube request filter: %w", err)
+		}
+	}
+
 	// The kube agent registers itself (if requested) and then reloads the config
 	// to continue running. There is no restart after registration.
 	isRegistered := !a.agentConfig.GetPublicKey().IsEmpty()
@@ -432,6 +621,14 @@ func NewKubeAgent(
 		a.logger.Infof("BastionZero Agent is registered with %s", a.agentConfig.GetServiceUrl())
 	}
 
+	// Now that we know our target id, load every cluster we serve
+	if a.pluginConfig.KubeClusters, err = cluster.Load(kubeClustersConfig, localCluster, a.agentConfig.GetTargetId()); err != nil {
+		return a, fmt.Errorf("failed to load kube clusters: %w", err)
+	}
+	for _, virtual := range a.pluginConfig.KubeClusters.Virtual() {
+		a.logger.Infof("Serving the %s cluster at %s as target %s", virtual.Name, virtual.Host(), virtual.TargetId)
+	}
+
 	return
 }
 
@@ -443,6 +640,8 @@ func getAgentType() agenttype.AgentType {
 	// determine agent type
 	if val := os.Getenv(inClusterEnvVar); val != "" {
 		return agenttype.Kubernetes
+	} else if val := os.Getenv(kubeconfigEnvVar); val != "" {
+		return agenttype.Kubernetes
 	} else if runtime.GOOS == "windows" {
 		return agenttype.Windows
 	} else {
@@ -14,9 +14,21 @@ import (
 // schema version <= this value doesn't set targetId to the agent's pubkey
 const schemaVersionTargetIdNotSet string = "1.0"
 
+// The most Data messages we let a daemon have in flight before it's received our
+// DataAcks, which we advertise in our SynAck. It's comfortably less than the
+// datachannel's input buffer so that a full pipeline never blocks the messages
+// of other datachannels on the same connection
+const maxPipelineLimit = 32
+
+// How many of the Data messages we've most recently validated a daemon may
+// resume its session from. It may not have received our acks for everything in
+// its pipeline before it lost its connection
+const resumableDataMessages = 2 * maxPipelineLimit
+
 type Mrtap struct {
 	logger           *logger.Logger
 	lastDataMessage  *message.MrtapMessage
+	recentDataHashes []string
 	expectedHPointer string
 	clientBZCert     *bzcrt.BZCert // only for one client
 	clientPublicKey  *keypair.PublicKey
@@ -27,7 +39,9 @@ type Mrtap struct {
 	serviceAccounts  []string
 
 	// define constraints based on schema version
-	shouldCheckTargetId *semver.Constraints
+	shouldCheckTargetId          *semver.Constraints
+	shouldUseCompactEncoding     *semver.Constraints
+	shouldAdvertisePipelineLimit *semver.Constraints
 
 	daemonSchemaVersion *semver.Version
 }
@@ -46,6 +60,16 @@ func New(logger *logger.Logger, config MrtapConfig) (*Mrtap, error) {
 		return nil, fmt.Errorf("failed to create check target id constraint: %w", err)
 	}
 
+	shouldUseCompactEncodingConstraint, err := semver.NewConstraint(fmt.Sprintf(">= %s", message.CompactSchemaVersion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compact encoding constraint: %w", err)
+	}
+
+	shouldAdvertisePipelineLimitConstraint, err := semver.NewConstraint(fmt.Sprintf(">= %s", message.PipelineLimitSchemaVersion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipeline limit constraint: %w", err)
+	}
+
 	return &Mrtap{
 		logger:              logger,
 		publickey:           config.GetPublicKey(),
@@ -54,6 +78,9 @@ func New(logger *logger.Logger, config MrtapConfig) (*Mrtap, error) {
 		idpOrgId:            config.GetIdpOrgId(),
 		serviceAccounts:     config.GetServiceAccountJwksUrls(),
 		shouldCheckTargetId: shouldCheckTargetIdConstraint,
+
+		shouldUseCompactEncoding:     shouldUseCompactEncodingConstraint,
+		shouldAdvertisePipelineLimit: shouldAdvertisePipelineLimitConstraint,
 	}, nil
 }
 
@@ -63,22 +90,36 @@ func (m *Mrtap) Validate(msg *message.MrtapMessage) error {
 		synPayload := msg.Payload.(message.SynPayload)
 		bzcert := synPayload.BZCert
 
+		// Once a user has opened this datachannel, only they may carry on with
+		// it, whether they're resuming their session or recovering from an error
+		if m.clientBZCert != nil && bzcert.ClientPublicKey != m.clientBZCert.ClientPublicKey {
+			return fmt.Errorf("SYN's BZCert does not match the active user's")
+		}
+
 		// Verify the BZCert
 		if err := bzcert.Verify(m.idpProvider, m.idpOrgId, m.serviceAccounts); err != nil {
 			return fmt.Errorf("failed to verify SYN's BZCert: %w", err)
 		}
 
-		if pubkey, err := keypair.PublicKeyFromString(bzcert.ClientPublicKey); err != nil {
+		pubkey, err := keypair.PublicKeyFromString(bzcert.ClientPublicKey)
+		if err != nil {
 			return fmt.Errorf("malformatted public key: %s", bzcert.ClientPublicKey)
-		} else {
-			m.clientPublicKey = pubkey
 		}
 
 		// Verify the signature
-		if err := msg.VerifySignature(m.clientPublicKey); err != nil {
+		if err := msg.VerifySignature(pubkey); err != nil {
 			return fmt.Errorf("failed to verify SYN's signature: %w", err)
 		}
 
+		// A daemon resuming its session must agree with us about where that
+		// session left off
+		if synPayload.HPointer != "" {
+			if err := m.validateResumption(synPayload); err != nil {
+				return fmt.Errorf("failed to resume session: %w", err)
+			}
+		}
+		m.clientPublicKey = pubkey
+
 		// Extract semver version to determine if different protocol checks must be done
 		v, err := semver.NewVersion(synPayload.SchemaVersion)
 		if err != nil {
@@ -122,6 +163,10 @@ func (m *Mrtap) Validate(msg *message.MrtapMessage) error {
 		}
 
 		m.lastDataMessage = msg
+		m.recentDataHashes = append(m.recentDataHashes, msg.Hash())
+		if len(m.recentDataHashes) > resumableDataMessages {
+			m.recentDataHashes = m.recentDataHashes[1:]
+		}
 	default:
 		return fmt.Errorf("error validating unhandled MrTAP type")
 	}
@@ -129,6 +174,27 @@ func (m *Mrtap) Validate(msg *message.MrtapMessage) error {
 	return nil
 }
 
+// validateResumption checks that a SYN carrying a hash pointer is for a session
+// we already have, and that it points at a DATA message we recently validated
+func (m *Mrtap) validateResumption(synPayload message.SynPayload) error {
+	if m.clientBZCert == nil {
+		return fmt.Errorf("there is no session to resume")
+	}
+
+	for _, hash := range m.recentDataHashes {
+		if hash == synPayload.HPointer {
+			return nil
+		}
+	}
+	return fmt.Errorf("SYN's hash pointer %s does not refer to a recent DATA message", synPayload.HPointer)
+}
+
+// ClientBZCert returns the verified BZCert of the user who opened this
+// datachannel, or nil if we haven't validated a SYN yet
+func (m *Mrtap) ClientBZCert() *bzcrt.BZCert {
+	return m.clientBZCert
+}
+
 func (m *Mrtap) BuildAck(msg *message.MrtapMessage, action string, actionPayload []byte) (message.MrtapMessage, error) {
 	var responseMessage message.MrtapMessage
 	var err error
@@ -153,6 +219,13 @@ func (m *Mrtap) BuildAck(msg *message.MrtapMessage, action string, actionPayload
 
 		responseMessage, err = msg.BuildUnsignedSynAck(actionPayload, m.publickey.String(), nonce, schemaVersion.String())
 
+		// older daemons wouldn't know about the limit and so would fail to
+		// verify our signature if we included it
+		if synAckPayload, ok := responseMessage.Payload.(message.SynAckPayload); ok && m.shouldAdvertisePipelineLimit.Check(schemaVersion) {
+			synAckPayload.MaxPipelineLimit = maxPipelineLimit
+			responseMessage.Payload = synAckPayload
+		}
+
 	case message.Data:
 		responseMessage, err = msg.BuildUnsignedDataAck(actionPayload, m.publickey.String(), schemaVersion.String())
 	default:
@@ -174,6 +247,20 @@ func (m *Mrtap) BuildAck(msg *message.MrtapMessage, action string, actionPayload
 	}
 }
 
+// Encoding returns how our acks should be sent, which depends on the schema
+// version we agreed on with the daemon in the Syn/SynAck
+func (m *Mrtap) Encoding() message.Encoding {
+	if m.daemonSchemaVersion == nil {
+		return message.JSON
+	} else if schemaVersion, err := m.getSchemaVersionToUse(); err != nil {
+		return message.JSON
+	} else if m.shouldUseCompactEncoding.Check(schemaVersion) {
+		return message.Compact
+	} else {
+		return message.JSON
+	}
+}
+
 func (m *Mrtap) getSchemaVersionToUse() (*semver.Version, error) {
 	agentVersion, err := semver.NewVersion(message.SchemaVersion)
 	if err != nil {
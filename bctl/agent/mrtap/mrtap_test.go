@@ -0,0 +1,57 @@
+package mrtap
+
+import (
+	"testing"
+
+	"bastionzero.com/bzerolib/keypair"
+	bzcrt "bastionzero.com/bzerolib/mrtap/bzcert"
+	"bastionzero.com/bzerolib/mrtap/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestAgentMrtap(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent MrTAP suite")
+}
+
+var _ = Describe("Agent MrTAP", func() {
+	userPublicKey, _, _ := keypair.GenerateKeyPair()
+	otherPublicKey, _, _ := keypair.GenerateKeyPair()
+
+	Context("Validating a SYN once a user has opened the datachannel", func() {
+		var m *Mrtap
+
+		BeforeEach(func() {
+			m = &Mrtap{
+				clientBZCert: &bzcrt.BZCert{ClientPublicKey: userPublicKey.String()},
+			}
+		})
+
+		buildSyn := func(clientPublicKey string, hPointer string) *message.MrtapMessage {
+			return &message.MrtapMessage{
+				Type: message.Syn,
+				Payload: message.SynPayload{
+					SchemaVersion: message.SchemaVersion,
+					Type:          string(message.Syn),
+					Action:        "test/action",
+					BZCert:        bzcrt.BZCert{ClientPublicKey: clientPublicKey},
+					HPointer:      hPointer,
+				},
+			}
+		}
+
+		It("refuses a recovery SYN from a different user", func() {
+			err := m.Validate(buildSyn(otherPublicKey.String(), ""))
+			Expect(err).To(MatchError(ContainSubstring("does not match the active user's")))
+			Expect(m.ClientBZCert().ClientPublicKey).To(Equal(userPublicKey.String()))
+		})
+
+		It("refuses a resumption SYN from a different user", func() {
+			err := m.Validate(buildSyn(otherPublicKey.String(), "some-hash"))
+			Expect(err).To(MatchError(ContainSubstring("does not match the active user's")))
+			Expect(m.ClientBZCert().ClientPublicKey).To(Equal(userPublicKey.String()))
+		})
+	})
+})
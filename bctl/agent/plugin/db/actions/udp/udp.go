@@ -0,0 +1,206 @@
+package udp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
+	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/bzerolib/plugin/db"
+	"bastionzero.com/bzerolib/plugin/db/actions/udp"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+const (
+	// the largest datagram UDP can carry
+	maxDatagramSize = 64 * 1024
+)
+
+type Udp struct {
+	tmb    tomb.Tomb
+	logger *logger.Logger
+
+	// channel for letting the plugin know we're done
+	doneChan chan struct{}
+
+	// output channel to send all of our stream messages directly to datachannel
+	streamOutputChan     chan smsg.StreamMessage
+	streamMessageVersion smsg.SchemaVersion
+
+	requestId        string
+	remoteAddress    *net.UDPAddr
+	remoteConnection *net.UDPConn
+
+	// we close the flow once it's gone this long without a datagram either way
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64
+}
+
+func New(logger *logger.Logger,
+	ch chan smsg.StreamMessage,
+	doneChan chan struct{},
+	remoteHost string,
+	remotePort int) (*Udp, error) {
+
+	// Build our address
+	address := fmt.Sprintf("%s:%v", remoteHost, remotePort)
+
+	if raddr, err := net.ResolveUDPAddr("udp", address); err != nil {
+		logger.Errorf("Failed to resolve remote address: %s", err)
+		return nil, fmt.Errorf("failed to resolve remote address: %s", err)
+	} else {
+		return &Udp{
+			logger:           logger,
+			doneChan:         doneChan,
+			streamOutputChan: ch,
+			remoteAddress:    raddr,
+			idleTimeout:      udp.DefaultIdleTimeout,
+		}, nil
+	}
+}
+
+func (u *Udp) Kill() {
+	if !u.tmb.Alive() {
+		return
+	}
+
+	u.tmb.Kill(nil)
+	if u.remoteConnection != nil {
+		u.remoteConnection.Close()
+		u.tmb.Wait()
+	}
+}
+
+func (u *Udp) Receive(action string, actionPayload []byte) ([]byte, error) {
+	var err error
+
+	switch udp.UdpSubAction(action) {
+	case udp.UdpStart:
+		var udpActionRequest udp.UdpActionPayload
+		if err = json.Unmarshal(actionPayload, &udpActionRequest); err != nil {
+			err = fmt.Errorf("malformed udp action payload %v", actionPayload)
+			break
+		}
+		return u.start(udpActionRequest)
+	case udp.UdpInput:
+		var udpInput udp.UdpInputActionPayload
+		if err = json.Unmarshal(actionPayload, &udpInput); err != nil {
+			err = fmt.Errorf("unable to unmarshal udp input message: %s", err)
+			break
+		} else if u.remoteConnection == nil {
+			err = fmt.Errorf("received udp input before the flow was started")
+			break
+		}
+
+		u.logger.Debugf("Sending %d byte datagram from daemon to remote address", len(udpInput.Datagram))
+		u.lastActivity.Store(time.Now().UnixNano())
+
+		// a datagram that doesn't make it is no different from one that's lost on the way,
+		// so we only stop if the socket itself is broken
+		if _, werr := u.remoteConnection.Write(udpInput.Datagram); !u.tmb.Alive() {
+			return []byte{}, nil
+		} else if werr != nil && !isUnreachable(werr) {
+			u.logger.Errorf("error writing to remote udp address: %s", werr)
+			u.Kill()
+		}
+	case udp.UdpStop:
+		u.Kill()
+		return actionPayload, nil
+	default:
+		err = fmt.Errorf("unhandled stream action: %v", action)
+	}
+
+	if err != nil {
+		u.logger.Error(err)
+	}
+	return []byte{}, err
+}
+
+func (u *Udp) start(udpActionRequest udp.UdpActionPayload) ([]byte, error) {
+	// keep track of who we're talking to
+	u.requestId = udpActionRequest.RequestId
+	u.logger.Infof("Setting request id: %s", u.requestId)
+	u.streamMessageVersion = udpActionRequest.StreamMessageVersion
+	u.logger.Infof("Setting stream message version: %s", u.streamMessageVersion)
+
+	if udpActionRequest.IdleTimeout > 0 {
+		u.idleTimeout = time.Duration(udpActionRequest.IdleTimeout) * time.Second
+	}
+
+	// every flow gets its own socket, so that the target's replies to it come back to us on it
+	if remoteConnection, err := net.DialUDP("udp", nil, u.remoteAddress); err != nil {
+		u.logger.Errorf("Failed to dial remote address: %s", err)
+		return []byte{}, err
+	} else {
+		u.remoteConnection = remoteConnection
+	}
+	u.lastActivity.Store(time.Now().UnixNano())
+
+	// Setup a go routine to listen for datagrams coming from the remote address and send them to the daemon
+	u.tmb.Go(func() error {
+		defer close(u.doneChan)
+
+		sequenceNumber := 0
+		buff := make([]byte, maxDatagramSize)
+
+		for {
+			lastActivity := time.Unix(0, u.lastActivity.Load())
+			u.remoteConnection.SetReadDeadline(lastActivity.Add(u.idleTimeout))
+
+			// this line blocks until it reads a datagram, the flow goes idle, or error
+			if n, err := u.remoteConnection.Read(buff); !u.tmb.Alive() {
+				return nil
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				// the daemon may have sent us something since we started waiting
+				if time.Since(time.Unix(0, u.lastActivity.Load())) < u.idleTimeout {
+					continue
+				}
+
+				u.logger.Infof("udp flow has been idle for %s, closing it", u.idleTimeout)
+				u.sendStreamMessage(sequenceNumber, smsg.Stream, false, []byte{})
+				return nil
+			} else if isUnreachable(err) {
+				// nothing is listening at the remote address yet, which UDP clients
+				// expect to find out about by not getting an answer
+				u.logger.Debugf("remote udp address is unreachable: %s", err)
+			} else if err != nil {
+				u.logger.Errorf("failed to read from udp connection: %s", err)
+				u.sendStreamMessage(sequenceNumber, smsg.Error, false, []byte(err.Error()))
+				return err
+			} else {
+				u.logger.Debugf("Sending %d byte datagram from remote address to daemon", n)
+				u.lastActivity.Store(time.Now().UnixNano())
+
+				u.sendStreamMessage(sequenceNumber, smsg.Stream, true, buff[:n])
+				sequenceNumber += 1
+			}
+		}
+	})
+
+	return []byte{}, nil
+}
+
+// isUnreachable tells us whether the target told us that nothing is listening
+// on the port we sent a datagram to
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func (u *Udp) sendStreamMessage(sequenceNumber int, streamType smsg.StreamType, more bool, contentBytes []byte) {
+	u.streamOutputChan <- smsg.StreamMessage{
+		SchemaVersion:  u.streamMessageVersion,
+		SequenceNumber: sequenceNumber,
+		Action:         string(db.Udp),
+		Type:           streamType,
+		More:           more,
+		Content:        base64.StdEncoding.EncodeToString(contentBytes),
+	}
+}
@@ -0,0 +1,119 @@
+package udp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+	bzudp "bastionzero.com/bzerolib/plugin/db/actions/udp"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestUdp(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent UDP Suite")
+}
+
+var _ = Describe("Agent UDP action", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var streamChan chan smsg.StreamMessage
+	var doneChan chan struct{}
+	var target *net.UDPConn
+	var udp *Udp
+
+	receive := func(action bzudp.UdpSubAction, payload interface{}) {
+		payloadBytes, _ := json.Marshal(payload)
+		_, err := udp.Receive(string(action), payloadBytes)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	input := func(sequenceNumber int, datagram string) {
+		receive(bzudp.UdpInput, bzudp.UdpInputActionPayload{
+			RequestId:      "1234",
+			SequenceNumber: sequenceNumber,
+			Datagram:       []byte(datagram),
+		})
+	}
+
+	nextDatagram := func() (smsg.StreamMessage, string) {
+		var message smsg.StreamMessage
+		Eventually(streamChan).Should(Receive(&message))
+		content, err := base64.StdEncoding.DecodeString(message.Content)
+		Expect(err).ToNot(HaveOccurred())
+		return message, string(content)
+	}
+
+	BeforeEach(func() {
+		streamChan = make(chan smsg.StreamMessage, 10)
+		doneChan = make(chan struct{})
+
+		var err error
+		target, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+
+		targetAddress := target.LocalAddr().(*net.UDPAddr)
+		udp, err = New(logger, streamChan, doneChan, "127.0.0.1", targetAddress.Port)
+		Expect(err).ToNot(HaveOccurred())
+
+		receive(bzudp.UdpStart, bzudp.UdpActionPayload{
+			RequestId:            "1234",
+			StreamMessageVersion: smsg.CurrentSchema,
+			IdleTimeout:          1,
+		})
+	})
+
+	AfterEach(func() {
+		udp.Kill()
+		target.Close()
+	})
+
+	It("forwards each datagram in its own message both ways", func() {
+		input(0, "who is")
+		input(1, "example.com")
+
+		buff := make([]byte, 1024)
+		var from *net.UDPAddr
+		for _, expected := range []string{"who is", "example.com"} {
+			n, addr, err := target.ReadFromUDP(buff)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buff[:n])).To(Equal(expected))
+			from = addr
+		}
+
+		By("sending the target's replies back from the flow's own address")
+		target.WriteToUDP([]byte("93.184.216.34"), from)
+		target.WriteToUDP([]byte(""), from)
+
+		message, datagram := nextDatagram()
+		Expect(message.Type).To(Equal(smsg.Stream))
+		Expect(message.More).To(BeTrue())
+		Expect(message.SequenceNumber).To(Equal(0))
+		Expect(datagram).To(Equal("93.184.216.34"))
+
+		message, datagram = nextDatagram()
+		Expect(message.SequenceNumber).To(Equal(1))
+		Expect(datagram).To(BeEmpty())
+	})
+
+	It("closes the flow once it's been idle", func() {
+		By("staying open while the daemon is sending")
+		for i := 0; i < 4; i++ {
+			input(i, "ping")
+			time.Sleep(400 * time.Millisecond)
+		}
+		Expect(doneChan).ToNot(BeClosed())
+
+		var message smsg.StreamMessage
+		Eventually(streamChan, 2*time.Second).Should(Receive(&message))
+		Expect(message.Type).To(Equal(smsg.Stream))
+		Expect(message.More).To(BeFalse())
+		Eventually(doneChan).Should(BeClosed())
+	})
+})
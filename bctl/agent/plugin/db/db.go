@@ -8,6 +8,7 @@ import (
 	"bastionzero.com/agent/bastion"
 	"bastionzero.com/agent/plugin/db/actions/dial"
 	"bastionzero.com/agent/plugin/db/actions/pwdb"
+	"bastionzero.com/agent/plugin/db/actions/udp"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin/db"
 	smsg "bastionzero.com/bzerolib/stream/message"
@@ -66,6 +67,8 @@ func New(logger *logger.Logger,
 		switch parsedAction {
 		case db.Dial:
 			plugin.action, rerr = dial.New(subLogger, plugin.streamOutputChan, plugin.doneChan, syn.RemoteHost, syn.RemotePort)
+		case db.Udp:
+			plugin.action, rerr = udp.New(subLogger, plugin.streamOutputChan, plugin.doneChan, syn.RemoteHost, syn.RemotePort)
 		case db.Pwdb:
 			plugin.action, rerr = pwdb.New(subLogger, plugin.streamOutputChan, plugin.doneChan, keyshardConfig, bastion, syn.RemoteHost, syn.RemotePort)
 		default:
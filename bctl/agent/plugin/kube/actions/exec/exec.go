@@ -4,11 +4,19 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
 
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
+	"bastionzero.com/agent/recording"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin/kube"
 	bzexec "bastionzero.com/bzerolib/plugin/kube/actions/exec"
@@ -16,13 +24,29 @@ import (
 	smsg "bastionzero.com/bzerolib/stream/message"
 )
 
-// wrap this code so at test time we can inject a mock executor / config
-var getExecutor = func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error) {
-	return remotecommand.NewSPDYExecutor(config, method, url)
+// wrap this code so at test time we can inject a mock executor. connected is
+// called once the API server has upgraded our connection
+var getExecutor = func(config *rest.Config, method string, url *url.URL, connected func(code int)) (remotecommand.Executor, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return remotecommand.NewSPDYExecutorForTransports(transport, connectedUpgrader{upgrader, connected}, method, url)
+}
+
+// connectedUpgrader tells us when our connection to the API server has been
+// upgraded, since the executor doesn't return until the exec is over
+type connectedUpgrader struct {
+	spdy.Upgrader
+	connected func(code int)
 }
 
-var getConfig = func() (*rest.Config, error) {
-	return rest.InClusterConfig()
+func (c connectedUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := c.Upgrader.NewConnection(resp)
+	if err == nil {
+		c.connected(resp.StatusCode)
+	}
+	return conn, err
 }
 
 type ExecAction struct {
@@ -30,6 +54,9 @@ type ExecAction struct {
 
 	doneChan chan struct{}
 
+	// exec or attach, which only differ in whether there's a command to run
+	action kube.KubeAction
+
 	// output channel to send all of our stream messages directly to datachannel
 	streamOutputChan     chan smsg.StreamMessage
 	streamMessageVersion smsg.SchemaVersion
@@ -41,12 +68,19 @@ type ExecAction struct {
 	// we hold onto this so we can close appropriately
 	stdinReader *StdReader
 
-	serviceAccountToken string
-	kubeHost            string
-	targetGroups        []string
-	targetUser          string
-	logId               string
-	requestId           string
+	cluster      *cluster.Cluster
+	targetGroups []string
+	targetUser   string
+	logId        string
+	requestId    string
+
+	// where to record this session to, if recording is enabled
+	recordingConfig recording.Config
+	session         pluginconfig.Session
+	recorder        ISessionRecorder
+
+	// emits audit events for our exec, nil if auditing is disabled
+	auditor *audit.Auditor
 
 	// to prevent us from responding to two stop messages in the same plugin
 	stopped bool
@@ -56,22 +90,28 @@ func New(
 	logger *logger.Logger,
 	ch chan smsg.StreamMessage,
 	doneChan chan struct{},
-	serviceAccountToken string,
-	kubeHost string,
+	action kube.KubeAction,
+	cluster *cluster.Cluster,
 	targetGroups []string,
 	targetUser string,
+	recordingConfig recording.Config,
+	session pluginconfig.Session,
+	auditor *audit.Auditor,
 ) *ExecAction {
 
 	return &ExecAction{
-		logger:              logger,
-		doneChan:            doneChan,
-		streamOutputChan:    ch,
-		execStdinChannel:    make(chan []byte, 10),
-		execResizeChannel:   make(chan bzexec.KubeExecResizeActionPayload, 10),
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		targetGroups:        targetGroups,
-		targetUser:          targetUser,
+		logger:            logger,
+		doneChan:          doneChan,
+		action:            action,
+		streamOutputChan:  ch,
+		execStdinChannel:  make(chan []byte, 10),
+		execResizeChannel: make(chan bzexec.KubeExecResizeActionPayload, 10),
+		cluster:           cluster,
+		targetGroups:      targetGroups,
+		targetUser:        targetUser,
+		recordingConfig:   recordingConfig,
+		session:           session,
+		auditor:           auditor,
 	}
 }
 
@@ -155,7 +195,7 @@ func (e *ExecAction) Receive(action string, actionPayload []byte) ([]byte, error
 }
 
 func (e *ExecAction) startExec(startExecRequest bzexec.KubeExecStartActionPayload) ([]byte, error) {
-	e.logger.Infof("executing kube exec cmd: %s. command: %s. isTty: %t. isStdIn: %t", startExecRequest.CommandBeingRun, startExecRequest.Command, startExecRequest.IsTty, startExecRequest.IsStdIn)
+	e.logger.Infof("executing kube %s cmd: %s. command: %s. isTty: %t. isStdIn: %t", e.action, startExecRequest.CommandBeingRun, startExecRequest.Command, startExecRequest.IsTty, startExecRequest.IsStdIn)
 	// keep track of who we're talking to
 	e.requestId = startExecRequest.RequestId
 	e.logger.Infof("Setting request id: %s", e.requestId)
@@ -163,15 +203,6 @@ func (e *ExecAction) startExec(startExecRequest bzexec.KubeExecStartActionPayloa
 	e.streamMessageVersion = startExecRequest.StreamMessageVersion
 	e.logger.Infof("Setting stream message version: %s", e.streamMessageVersion)
 
-	// Now open up our local exec session
-	// Create the in-cluster config
-	config, err := getConfig()
-	if err != nil {
-		rerr := fmt.Errorf("error creating in-custer config: %s", err)
-		e.logger.Error(rerr)
-		return []byte{}, rerr
-	}
-
 	// Always ensure that our targetUser is set
 	if e.targetUser == "" {
 		rerr := fmt.Errorf("target user field is not set")
@@ -179,14 +210,14 @@ func (e *ExecAction) startExec(startExecRequest bzexec.KubeExecStartActionPayloa
 		return []byte{}, rerr
 	}
 
-	// Add our impersonation information
+	// Now open up our local exec session, adding our impersonation information
+	config := e.cluster.Config()
 	config.Impersonate = rest.ImpersonationConfig{
 		UserName: e.targetUser,
 		Groups:   e.targetGroups,
 	}
-	config.BearerToken = e.serviceAccountToken
 
-	kubeExecApiUrl := e.kubeHost + startExecRequest.Endpoint
+	kubeExecApiUrl := e.cluster.Host() + startExecRequest.Endpoint
 	kubeExecApiUrlParsed, err := url.Parse(kubeExecApiUrl)
 	if err != nil {
 		rerr := fmt.Errorf("could not parse kube exec url: %s", err)
@@ -195,42 +226,78 @@ func (e *ExecAction) startExec(startExecRequest bzexec.KubeExecStartActionPayloa
 	}
 
 	// Turn it into a SPDY executor
-	exec, err := getExecutor(config, "POST", kubeExecApiUrlParsed)
+	auditRequest := e.auditor.Start(http.MethodPost, startExecRequest.Endpoint, nil, startExecRequest.LogId, startExecRequest.RequestId)
+	exec, err := getExecutor(config, http.MethodPost, kubeExecApiUrlParsed, func(code int) {
+		auditRequest.ResponseStarted(code, nil)
+	})
 	if err != nil {
-		return []byte{}, fmt.Errorf("error creating Spdy executor: %s", err)
+		rerr := fmt.Errorf("error creating Spdy executor: %s", err)
+		auditRequest.ResponseComplete(0, rerr)
+		return []byte{}, rerr
+	}
+
+	// Start recording before we connect so that the session never runs unrecorded
+	if e.recordingConfig.Enabled() {
+		if recorder, err := newRecorder(e.logger, e.recordingConfig, e.session, startExecRequest, e.targetUser, e.targetGroups); err != nil {
+			e.logger.Error(err)
+			auditRequest.ResponseComplete(0, err)
+			return []byte{}, err
+		} else {
+			e.recorder = recorder
+		}
 	}
 
 	// NOTE: don't need to version this because Type is not read on the other end
-	stderrWriter := NewStdWriter(e.streamOutputChan, e.streamMessageVersion, e.requestId, string(kube.Exec), smsg.StdErr, e.logId)
-	stdoutWriter := NewStdWriter(e.streamOutputChan, e.streamMessageVersion, e.requestId, string(kube.Exec), smsg.StdOut, e.logId)
+	stderrWriter := NewStdWriter(e.streamOutputChan, e.streamMessageVersion, e.requestId, string(e.action), smsg.StdErr, e.logId)
+	stdoutWriter := NewStdWriter(e.streamOutputChan, e.streamMessageVersion, e.requestId, string(e.action), smsg.StdOut, e.logId)
 	terminalSizeQueue := NewTerminalSizeQueue(startExecRequest.RequestId, e.execResizeChannel)
 
+	var stdout, stderr io.Writer = stdoutWriter, stderrWriter
+	var sizeQueue remotecommand.TerminalSizeQueue = terminalSizeQueue
+	if e.recorder != nil {
+		stdout = &recordedWriter{writer: stdoutWriter, recorder: e.recorder}
+		stderr = &recordedWriter{writer: stderrWriter, recorder: e.recorder}
+		sizeQueue = &recordedSizeQueue{queue: terminalSizeQueue, recorder: e.recorder}
+	}
+
 	// runs the exec interaction with the kube server
 	go func() {
 		defer close(e.doneChan)
+		defer func() {
+			if e.recorder != nil {
+				if err := e.recorder.Close(); err != nil {
+					e.logger.Errorf("failed to close session recording: %s", err)
+				}
+			}
+		}()
 
 		if startExecRequest.IsStdIn {
 			e.stdinReader = NewStdReader(string(bzexec.StdIn), startExecRequest.RequestId, e.execStdinChannel)
 
+			var stdin io.Reader = e.stdinReader
+			if e.recorder != nil {
+				stdin = &recordedReader{reader: e.stdinReader, recorder: e.recorder}
+			}
+
 			if startExecRequest.IsTty {
 				err = exec.Stream(remotecommand.StreamOptions{
-					Stdin:             e.stdinReader,
-					Stdout:            stdoutWriter,
-					Stderr:            stderrWriter,
-					TerminalSizeQueue: terminalSizeQueue,
+					Stdin:             stdin,
+					Stdout:            stdout,
+					Stderr:            stderr,
+					TerminalSizeQueue: sizeQueue,
 					Tty:               true,
 				})
 			} else {
 				err = exec.Stream(remotecommand.StreamOptions{
-					Stdin:  e.stdinReader,
-					Stdout: stdoutWriter,
-					Stderr: stderrWriter,
+					Stdin:  stdin,
+					Stdout: stdout,
+					Stderr: stderr,
 				})
 			}
 		} else {
 			err = exec.Stream(remotecommand.StreamOptions{
-				Stdout: stdoutWriter,
-				Stderr: stderrWriter,
+				Stdout: stdout,
+				Stderr: stderr,
 			})
 		}
 
@@ -238,6 +305,9 @@ func (e *ExecAction) startExec(startExecRequest bzexec.KubeExecStartActionPayloa
 			rerr := fmt.Errorf("error in SPDY stream: %s", err)
 			e.logger.Error(rerr)
 			e.sendStreamMessage(0, smsg.Error, false, []byte(rerr.Error()))
+			auditRequest.ResponseComplete(0, rerr)
+		} else {
+			auditRequest.ResponseComplete(http.StatusSwitchingProtocols, nil)
 		}
 
 		// Now close the stream by sending an empty stdout stream message with more=false
@@ -251,7 +321,7 @@ func (e *ExecAction) sendStreamMessage(sequenceNumber int, streamType smsg.Strea
 	e.streamOutputChan <- smsg.StreamMessage{
 		SchemaVersion:  e.streamMessageVersion,
 		SequenceNumber: sequenceNumber,
-		Action:         string(kube.Exec),
+		Action:         string(e.action),
 		Type:           streamType,
 		More:           more,
 		Content:        base64.StdEncoding.EncodeToString(contentBytes),
@@ -1,20 +1,34 @@
 package exec
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/plugin/kube/cluster"
+	"bastionzero.com/agent/recording"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin/kube"
 	bzexec "bastionzero.com/bzerolib/plugin/kube/actions/exec"
+	kubeutils "bastionzero.com/bzerolib/plugin/kube/utils"
 	smsg "bastionzero.com/bzerolib/stream/message"
 	"bastionzero.com/bzerolib/tests"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 )
@@ -46,16 +60,51 @@ func buildStdinActionPayload(requestId string, data []byte) []byte {
 
 // inject our mocked object
 func setGetExecutor(mockExec MockExecutor) {
-	getExecutor = func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error) {
+	getExecutor = func(config *rest.Config, method string, url *url.URL, connected func(code int)) (remotecommand.Executor, error) {
 		return mockExec, nil
 	}
 }
 
-// save exec action the trouble of trying to read a nonexsitent config
-func setGetConfig() {
-	getConfig = func() (*rest.Config, error) {
-		return &rest.Config{}, nil
+// echoExecutor waits for the terminal's size and then echoes stdin back on
+// stdout until it's closed, like a shell would
+type echoExecutor struct {
+	remotecommand.Executor
+}
+
+func (e echoExecutor) Stream(options remotecommand.StreamOptions) error {
+	if options.TerminalSizeQueue != nil {
+		options.TerminalSizeQueue.Next()
 	}
+	_, err := io.Copy(options.Stdout, options.Stdin)
+	return err
+}
+
+// catExecutor copies stdin to stdout a little at a time until stdin is closed,
+// like the tar on either end of a kubectl cp
+type catExecutor struct {
+	remotecommand.Executor
+}
+
+func (c catExecutor) Stream(options remotecommand.StreamOptions) error {
+	// hide any ReadFrom / WriteTo so that we really do use our small buffer
+	_, err := io.CopyBuffer(struct{ io.Writer }{options.Stdout}, struct{ io.Reader }{options.Stdin}, make([]byte, 1000))
+	return err
+}
+
+// fakeUpgrader stands in for upgrading our connection to the API server
+type fakeUpgrader struct {
+	err error
+}
+
+func (f fakeUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	return nil, f.err
+}
+
+// save exec action the trouble of trying to read a nonexsitent config
+func testCluster() *cluster.Cluster {
+	testCluster, err := cluster.New("test", &rest.Config{Host: "https://kubeHost"})
+	Expect(err).ToNot(HaveOccurred())
+	return testCluster
 }
 
 func TestExec(t *testing.T) {
@@ -65,7 +114,6 @@ func TestExec(t *testing.T) {
 
 var _ = Describe("Agent Exec action", Ordered, func() {
 	oldGetExecutor := getExecutor
-	oldGetConfig := getConfig
 
 	logger := logger.MockLogger(GinkgoWriter)
 
@@ -84,17 +132,15 @@ var _ = Describe("Agent Exec action", Ordered, func() {
 		stdoutWriter := NewStdWriter(outputChan, smsg.CurrentSchema, requestId, string(kube.Exec), smsg.StdOut, logId)
 		mockExecutor.On("Stream", stdoutWriter).Return(nil)
 		setGetExecutor(mockExecutor)
-		setGetConfig()
 	})
 
 	AfterAll(func() {
 		getExecutor = oldGetExecutor
-		getConfig = oldGetConfig
 	})
 
 	Context("Happy path I - Command includes -it", func() {
 		It("handles the exec session correctly", func() {
-			e := New(logger, outputChan, doneChan, "serviceAccountToken", "kubeHost", make([]string, 0), "test user")
+			e := New(logger, outputChan, doneChan, kube.Exec, testCluster(), make([]string, 0), "test user", recording.Config{}, pluginconfig.Session{}, nil)
 
 			startPayloadBytes := buildStartActionPayload(make(map[string][]string), requestId, smsg.CurrentSchema, true)
 
@@ -122,4 +168,197 @@ var _ = Describe("Agent Exec action", Ordered, func() {
 			mockExecutor.AssertExpectations(GinkgoT())
 		})
 	})
+
+	Context("Recording is enabled", func() {
+		It("records the session along with who ran it and where", func() {
+			dir := GinkgoT().TempDir()
+			outputChan = make(chan smsg.StreamMessage, 10)
+			getExecutor = func(config *rest.Config, method string, url *url.URL, connected func(code int)) (remotecommand.Executor, error) {
+				return echoExecutor{}, nil
+			}
+
+			session := pluginconfig.Session{DataChannelId: "dcid", Subject: "1234", Email: "alice@example.com"}
+			e := New(logger, outputChan, doneChan, kube.Exec, testCluster(), []string{"developers"}, "alice", recording.Config{Dir: dir}, session, nil)
+
+			startPayloadBytes, _ := json.Marshal(bzexec.KubeExecStartActionPayload{
+				Endpoint:             "/api/v1/namespaces/default/pods/web-0/exec?container=nginx&command=sh",
+				RequestId:            requestId,
+				StreamMessageVersion: smsg.CurrentSchema,
+				LogId:                logId,
+				IsTty:                true,
+				IsStdIn:              true,
+				Command:              []string{"sh"},
+				CommandBeingRun:      "sh",
+			})
+			_, err := e.Receive(string(bzexec.ExecStart), startPayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+
+			resizePayloadBytes, _ := json.Marshal(bzexec.KubeExecResizeActionPayload{RequestId: requestId, Width: 120, Height: 40})
+			_, err = e.Receive(string(bzexec.ExecResize), resizePayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = e.Receive(string(bzexec.ExecInput), buildStdinActionPayload(requestId, []byte(testString)))
+			Expect(err).ToNot(HaveOccurred())
+			tests.ExpectNextMessageHasContent(outputChan, testString)
+
+			stopPayloadBytes, _ := json.Marshal(bzexec.KubeExecStopActionPayload{RequestId: requestId})
+			_, err = e.Receive(string(bzexec.ExecStop), stopPayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(doneChan).Should(BeClosed())
+
+			By("writing a single recording for the session")
+			matches, err := filepath.Glob(filepath.Join(dir, "*-dcid-rid.cast"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(HaveLen(1))
+
+			file, err := os.Open(matches[0])
+			Expect(err).ToNot(HaveOccurred())
+			defer file.Close()
+			scanner := bufio.NewScanner(file)
+
+			By("describing the pod and the impersonated identity in its header")
+			Expect(scanner.Scan()).To(BeTrue())
+			var header struct {
+				Width    uint32            `json:"width"`
+				Height   uint32            `json:"height"`
+				Command  string            `json:"command"`
+				Metadata map[string]string `json:"bastionzero"`
+			}
+			Expect(json.Unmarshal(scanner.Bytes(), &header)).To(Succeed())
+			Expect(header.Width).To(Equal(uint32(120)))
+			Expect(header.Height).To(Equal(uint32(40)))
+			Expect(header.Command).To(Equal("sh"))
+			Expect(header.Metadata).To(Equal(map[string]string{
+				"datachannelId": "dcid",
+				"requestId":     requestId,
+				"targetUser":    "alice",
+				"targetGroups":  "developers",
+				"subject":       "1234",
+				"email":         "alice@example.com",
+				"namespace":     "default",
+				"pod":           "web-0",
+				"container":     "nginx",
+			}))
+
+			By("recording both input and output")
+			events := []string{}
+			for scanner.Scan() {
+				var event []interface{}
+				Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+				events = append(events, fmt.Sprintf("%s:%s", event[1], event[2]))
+			}
+			Expect(events).To(Equal([]string{"i:" + testString, "o:" + testString}))
+		})
+	})
+
+	Context("kubectl cp", func() {
+		It("passes a large binary stream through intact", func() {
+			outputChan = make(chan smsg.StreamMessage, 10)
+			getExecutor = func(config *rest.Config, method string, url *url.URL, connected func(code int)) (remotecommand.Executor, error) {
+				return catExecutor{}, nil
+			}
+
+			e := New(logger, outputChan, doneChan, kube.Exec, testCluster(), make([]string, 0), "test user", recording.Config{}, pluginconfig.Session{}, nil)
+
+			startPayloadBytes, _ := json.Marshal(bzexec.KubeExecStartActionPayload{
+				Endpoint:             "/api/v1/namespaces/default/pods/web-0/exec?command=tar&command=xmf&command=-&stdin=true",
+				RequestId:            requestId,
+				StreamMessageVersion: smsg.CurrentSchema,
+				LogId:                logId,
+				IsStdIn:              true,
+				Command:              []string{"tar", "xmf", "-"},
+			})
+			_, err := e.Receive(string(bzexec.ExecStart), startPayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+
+			// collect everything written to stdout until the exec ends
+			received := make(chan []byte)
+			go func() {
+				defer GinkgoRecover()
+				stdout := []byte{}
+				for message := range outputChan {
+					Expect(message.Action).To(Equal(string(kube.Exec)))
+					content, _ := base64.StdEncoding.DecodeString(message.Content)
+					stdout = append(stdout, content...)
+					if !message.More {
+						break
+					}
+				}
+				received <- stdout
+			}()
+
+			sent := make([]byte, 1024*1024)
+			rand.New(rand.NewSource(0)).Read(sent)
+
+			for i := 0; i < len(sent); i += 3 * kubeutils.ExecChunkSize {
+				end := i + 3*kubeutils.ExecChunkSize
+				if end > len(sent) {
+					end = len(sent)
+				}
+				_, err = e.Receive(string(bzexec.ExecInput), buildStdinActionPayload(requestId, sent[i:end]))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			By("finishing once stdin is closed")
+			stopPayloadBytes, _ := json.Marshal(bzexec.KubeExecStopActionPayload{RequestId: requestId})
+			_, err = e.Receive(string(bzexec.ExecStop), stopPayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+
+			var stdout []byte
+			Eventually(received, 10*time.Second).Should(Receive(&stdout))
+			Expect(bytes.Equal(stdout, sent)).To(BeTrue())
+			Eventually(doneChan).Should(BeClosed())
+		})
+	})
+
+	Context("kubectl attach", func() {
+		It("sends output as the attach action", func() {
+			getExecutor = func(config *rest.Config, method string, url *url.URL, connected func(code int)) (remotecommand.Executor, error) {
+				return echoExecutor{}, nil
+			}
+
+			e := New(logger, outputChan, doneChan, kube.Attach, testCluster(), make([]string, 0), "test user", recording.Config{}, pluginconfig.Session{}, nil)
+
+			startPayloadBytes, _ := json.Marshal(bzexec.KubeExecStartActionPayload{
+				Endpoint:             "/api/v1/namespaces/default/pods/web-0/attach?stdin=true&stdout=true",
+				RequestId:            requestId,
+				StreamMessageVersion: smsg.CurrentSchema,
+				LogId:                logId,
+				IsStdIn:              true,
+			})
+			_, err := e.Receive(string(bzexec.ExecStart), startPayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = e.Receive(string(bzexec.ExecInput), buildStdinActionPayload(requestId, []byte(testString)))
+			Expect(err).ToNot(HaveOccurred())
+
+			var message smsg.StreamMessage
+			Eventually(outputChan).Should(Receive(&message))
+			Expect(message.Action).To(Equal(string(kube.Attach)))
+			content, _ := base64.StdEncoding.DecodeString(message.Content)
+			Expect(string(content)).To(Equal(testString))
+
+			stopPayloadBytes, _ := json.Marshal(bzexec.KubeExecStopActionPayload{RequestId: requestId})
+			_, err = e.Receive(string(bzexec.ExecStop), stopPayloadBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(doneChan).Should(BeClosed())
+		})
+	})
+
+	Context("Connecting", func() {
+		It("only says we've connected once the API server has upgraded our connection", func() {
+			codes := []int{}
+			connected := func(code int) {
+				codes = append(codes, code)
+			}
+
+			_, err := connectedUpgrader{fakeUpgrader{err: errors.New("forbidden")}, connected}.NewConnection(&http.Response{StatusCode: http.StatusForbidden})
+			Expect(err).To(HaveOccurred())
+			Expect(codes).To(BeEmpty())
+
+			_, err = connectedUpgrader{fakeUpgrader{}, connected}.NewConnection(&http.Response{StatusCode: http.StatusSwitchingProtocols})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(codes).To(Equal([]int{http.StatusSwitchingProtocols}))
+		})
+	})
 })
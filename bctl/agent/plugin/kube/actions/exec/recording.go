@@ -0,0 +1,115 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"k8s.io/client-go/tools/remotecommand"
+
+	"bastionzero.com/agent/config/pluginconfig"
+	"bastionzero.com/agent/recording"
+	"bastionzero.com/bzerolib/logger"
+	bzexec "bastionzero.com/bzerolib/plugin/kube/actions/exec"
+)
+
+// ISessionRecorder persists everything that goes in and out of an exec session
+type ISessionRecorder interface {
+	Input(data []byte)
+	Output(data []byte)
+	Resize(cols, rows uint32)
+	Close() error
+}
+
+// newRecorder starts recording this exec session. If the agent has been
+// configured to record sessions and we can't, we refuse to start the exec
+// rather than allow an unrecorded session
+func newRecorder(
+	logger *logger.Logger,
+	config recording.Config,
+	session pluginconfig.Session,
+	startExecRequest bzexec.KubeExecStartActionPayload,
+	targetUser string,
+	targetGroups []string,
+) (*recording.Recorder, error) {
+	metadata := map[string]string{
+		"datachannelId": session.DataChannelId,
+		"requestId":     startExecRequest.RequestId,
+		"targetUser":    targetUser,
+		"targetGroups":  strings.Join(targetGroups, ","),
+		"subject":       session.Subject,
+		"email":         session.Email,
+	}
+
+	// the endpoint looks like /api/v1/namespaces/{namespace}/pods/{pod}/exec?container={container}
+	if endpoint, err := url.Parse(startExecRequest.Endpoint); err == nil {
+		parts := strings.Split(strings.Trim(endpoint.Path, "/"), "/")
+		for i := 0; i+1 < len(parts); i++ {
+			switch parts[i] {
+			case "namespaces":
+				metadata["namespace"] = parts[i+1]
+			case "pods":
+				metadata["pod"] = parts[i+1]
+			}
+		}
+		if container := endpoint.Query().Get("container"); container != "" {
+			metadata["container"] = container
+		}
+	}
+
+	command := startExecRequest.CommandBeingRun
+	if command == "" {
+		command = strings.Join(startExecRequest.Command, " ")
+	}
+
+	name := session.DataChannelId
+	if startExecRequest.RequestId != "" {
+		name += "-" + startExecRequest.RequestId
+	}
+
+	if recorder, err := recording.New(logger.GetComponentLogger("Recorder"), config, name, command, metadata); err != nil {
+		return nil, fmt.Errorf("failed to start session recording: %w", err)
+	} else {
+		return recorder, nil
+	}
+}
+
+// recordedReader records everything read from stdin before it is sent to the pod
+type recordedReader struct {
+	reader   io.Reader
+	recorder ISessionRecorder
+}
+
+func (r *recordedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.recorder.Input(p[:n])
+	}
+	return n, err
+}
+
+// recordedWriter records everything the pod writes to stdout or stderr
+type recordedWriter struct {
+	writer   io.Writer
+	recorder ISessionRecorder
+}
+
+func (w *recordedWriter) Write(p []byte) (int, error) {
+	w.recorder.Output(p)
+	return w.writer.Write(p)
+}
+
+// recordedSizeQueue records every terminal resize before it is sent to the pod
+type recordedSizeQueue struct {
+	queue    remotecommand.TerminalSizeQueue
+	recorder ISessionRecorder
+}
+
+func (q *recordedSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.queue.Next()
+	if size != nil {
+		q.recorder.Resize(uint32(size.Width), uint32(size.Height))
+	}
+	return size
+}
@@ -10,6 +10,10 @@ type StdReader struct {
 	RequestId    string
 	stdinChannel chan []byte
 	doneChannel  chan bool
+
+	// whatever didn't fit in the last read, so that we never drop any of a
+	// large binary stream such as the tar that kubectl cp sends
+	leftover []byte
 }
 
 func NewStdReader(streamType string, requestId string, stdinChannel chan []byte) *StdReader {
@@ -28,12 +32,19 @@ func (r *StdReader) Close() {
 }
 
 func (r *StdReader) Read(p []byte) (int, error) {
+	if len(r.leftover) > 0 {
+		n := copy(p, r.leftover)
+		r.leftover = r.leftover[n:]
+		return n, nil
+	}
+
 	select {
 	case stdin, more := <-r.stdinChannel:
 		if !more {
 			return 0, io.EOF
 		} else {
 			n := copy(p, stdin)
+			r.leftover = stdin[n:]
 			return n, nil
 		}
 	case <-r.doneChannel:
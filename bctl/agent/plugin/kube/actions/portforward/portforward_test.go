@@ -3,13 +3,17 @@ package portforward
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
 
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin/kube/actions/portforward"
 	smsg "bastionzero.com/bzerolib/stream/message"
@@ -33,13 +37,13 @@ func buildStartActionPayload(headers map[string][]string, requestId string, vers
 }
 
 // what portforward action will receive from "bastion"
-func buildActionPayload(bodyText string, requestId string, portForwardRequestId string) []byte {
+func buildActionPayload(bodyText string, requestId string, portForwardRequestId string, podPort int64) []byte {
 	payloadBytes, _ := json.Marshal(portforward.KubePortForwardActionPayload{
 		RequestId:            requestId,
 		LogId:                "lid",
 		Data:                 []byte(bodyText),
 		PortForwardRequestId: portForwardRequestId,
-		PodPort:              5000,
+		PodPort:              podPort,
 	})
 	return payloadBytes
 }
@@ -63,6 +67,25 @@ func buildStopActionPayload(requestId string) []byte {
 	return payloadBytes
 }
 
+// nextMessage returns the next stream message of streamType the daemon would get
+// for the given portforward request, skipping any others
+func nextMessage(outputChan chan smsg.StreamMessage, portForwardRequestId string, streamType smsg.StreamType) (smsg.StreamMessage, string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			Fail(fmt.Sprintf("timed out waiting for %s message for %s", streamType, portForwardRequestId))
+		case message := <-outputChan:
+			wrappedContent, _ := base64.StdEncoding.DecodeString(message.Content)
+			var content portforward.KubePortForwardStreamMessageContent
+			json.Unmarshal(wrappedContent, &content)
+			if content.PortForwardRequestId == portForwardRequestId && message.Type == streamType {
+				return message, string(content.Content)
+			}
+		}
+	}
+}
+
 // inject our mocked object
 func setDoDial(streamConnection *tests.MockStreamConnection) {
 	doDial = func(dialer httpstream.Dialer, protocolName string) (httpstream.Connection, string, error) {
@@ -71,10 +94,10 @@ func setDoDial(streamConnection *tests.MockStreamConnection) {
 }
 
 // save portforward action the trouble of trying to read a nonexsitent config
-func setGetConfig() {
-	getConfig = func() (*rest.Config, error) {
-		return &rest.Config{}, nil
-	}
+func testCluster() *cluster.Cluster {
+	testCluster, err := cluster.New("test", &rest.Config{Host: "https://kubeHost"})
+	Expect(err).ToNot(HaveOccurred())
+	return testCluster
 }
 
 func TestPortForward(t *testing.T) {
@@ -112,9 +135,8 @@ var _ = Describe("Agent PortForward action", Ordered, func() {
 		mockStreamConnection.On("CloseChan").Return(closeChan)
 
 		setDoDial(mockStreamConnection)
-		setGetConfig()
 
-		p := New(logger, outputChan, doneChan, "serviceAccountToken", "kubeHost", make([]string, 0), "test user")
+		p := New(logger, outputChan, doneChan, testCluster(), make([]string, 0), "test user", nil)
 
 		It("handles the portforwarding session correctly", func() {
 			By("receiving a PortForward request without error")
@@ -127,7 +149,7 @@ var _ = Describe("Agent PortForward action", Ordered, func() {
 			By("alerting that it has started the portforward interaction with the kube server")
 			Expect(readyMessage.Content).To(Equal(""))
 
-			payload = buildActionPayload(testData, requestId, portForwardRequestId)
+			payload = buildActionPayload(testData, requestId, portForwardRequestId, 5000)
 			By("receiving data from the remote port")
 			responsePayload, err = p.Receive(string(portforward.DataInPortForward), payload)
 			Expect(err).To(BeNil())
@@ -160,4 +182,139 @@ var _ = Describe("Agent PortForward action", Ordered, func() {
 			mockStreamConnection.AssertExpectations(GinkgoT())
 		})
 	})
+
+	Context("Forwarding several ports", func() {
+		outputChan := make(chan smsg.StreamMessage, 30)
+		doneChan := make(chan struct{})
+		mockStream := tests.MockStream{MyStreamData: testData}
+		mockStream.On("Read").Return(len(testData), nil)
+		mockStream.On("Close").Return(nil)
+
+		mockStreamConnection := new(tests.MockStreamConnection)
+		mockStreamConnection.On("CreateStream", http.Header{
+			"Port":      []string{"5000"},
+			"Requestid": []string{"good"},
+		}).Return(&mockStream, nil)
+		mockStreamConnection.On("CreateStream", http.Header{
+			"Port":      []string{"6000"},
+			"Requestid": []string{"bad"},
+		}).Return(&mockStream, errors.New("connection refused"))
+		mockStreamConnection.On("Close").Return(nil)
+		closeChan := make(chan bool)
+		mockStreamConnection.On("CloseChan").Return(closeChan)
+
+		p := New(logger, outputChan, doneChan, testCluster(), make([]string, 0), "test user", nil)
+
+		It("reports errors for each port separately", func() {
+			setDoDial(mockStreamConnection)
+
+			_, err := p.Receive(string(portforward.StartPortForward), buildStartActionPayload(make(map[string][]string), requestId, smsg.CurrentSchema))
+			Expect(err).To(BeNil())
+			readyMessage := <-outputChan
+			Expect(readyMessage.Content).To(Equal(""))
+
+			By("opening a port before the client has sent anything")
+			_, err = p.Receive(string(portforward.DataInPortForward), buildActionPayload("", requestId, "good", 5000))
+			Expect(err).To(BeNil())
+
+			By("telling the client why a port can't be forwarded without ending the session")
+			_, err = p.Receive(string(portforward.DataInPortForward), buildActionPayload(testData, requestId, "bad", 6000))
+			Expect(err).To(BeNil())
+			errorMessage, content := nextMessage(outputChan, "bad", smsg.Error)
+			Expect(errorMessage.SequenceNumber).To(Equal(0))
+			Expect(content).To(ContainSubstring("connection refused"))
+			dataMessage, _ := nextMessage(outputChan, "bad", smsg.Data)
+			Expect(dataMessage.SequenceNumber).To(Equal(0))
+			Expect(dataMessage.More).To(BeFalse())
+
+			By("dropping anything else sent to a port that failed")
+			_, err = p.Receive(string(portforward.DataInPortForward), buildActionPayload(testData, requestId, "bad", 6000))
+			Expect(err).To(BeNil())
+
+			By("refusing ports that can't exist")
+			_, err = p.Receive(string(portforward.DataInPortForward), buildActionPayload(testData, requestId, "invalid", 70000))
+			Expect(err).To(BeNil())
+			_, content = nextMessage(outputChan, "invalid", smsg.Error)
+			Expect(content).To(Equal("invalid port 70000"))
+
+			By("still forwarding the port that works")
+			_, content = nextMessage(outputChan, "good", smsg.Data)
+			Expect(content).To(Equal(testData))
+
+			By("ending every open port when the pod goes away")
+			close(closeChan)
+			_, content = nextMessage(outputChan, "good", smsg.Error)
+			Expect(content).To(Equal("lost connection to test/endpoint"))
+			dataMessage, _ = nextMessage(outputChan, "good", smsg.Data)
+			Expect(dataMessage.More).To(BeFalse())
+			Eventually(doneChan).Should(BeClosed())
+
+			p.Kill()
+		})
+	})
+
+	Context("Opening a port that's slow to connect", func() {
+		outputChan := make(chan smsg.StreamMessage, 30)
+		doneChan := make(chan struct{})
+		mockStream := tests.MockStream{MyStreamData: testData}
+		mockStream.On("Read").Return(len(testData), nil)
+		mockStream.On("Close").Return(nil)
+
+		opening := make(chan struct{}, 2)
+		release := make(chan struct{})
+
+		mockStreamConnection := new(tests.MockStreamConnection)
+		mockStreamConnection.On("CreateStream", http.Header{
+			"Port":      []string{"5000"},
+			"Requestid": []string{"slow"},
+		}).Run(func(mock.Arguments) {
+			opening <- struct{}{}
+			<-release
+		}).Return(&mockStream, nil)
+		mockStreamConnection.On("CreateStream", http.Header{
+			"Port":      []string{"6000"},
+			"Requestid": []string{"fast"},
+		}).Return(&mockStream, nil)
+		mockStreamConnection.On("Close").Return(nil)
+		closeChan := make(chan bool)
+		mockStreamConnection.On("CloseChan").Return(closeChan)
+
+		p := New(logger, outputChan, doneChan, testCluster(), make([]string, 0), "test user", nil)
+
+		It("doesn't hold up the other ports", func() {
+			setDoDial(mockStreamConnection)
+
+			_, err := p.Receive(string(portforward.StartPortForward), buildStartActionPayload(make(map[string][]string), requestId, smsg.CurrentSchema))
+			Expect(err).To(BeNil())
+			readyMessage := <-outputChan
+			Expect(readyMessage.Content).To(Equal(""))
+
+			By("starting to open the slow port")
+			slowOpened := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(slowOpened)
+				_, err := p.Receive(string(portforward.DataInPortForward), buildActionPayload("", requestId, "slow", 5000))
+				Expect(err).To(BeNil())
+			}()
+			Eventually(opening).Should(Receive())
+
+			By("forwarding another port while it's still opening")
+			_, err = p.Receive(string(portforward.DataInPortForward), buildActionPayload("", requestId, "fast", 6000))
+			Expect(err).To(BeNil())
+			_, content := nextMessage(outputChan, "fast", smsg.Data)
+			Expect(content).To(Equal(testData))
+			Consistently(slowOpened).ShouldNot(BeClosed())
+
+			By("forwarding the slow port once it's open")
+			close(release)
+			Eventually(slowOpened).Should(BeClosed())
+			_, content = nextMessage(outputChan, "slow", smsg.Data)
+			Expect(content).To(Equal(testData))
+
+			close(closeChan)
+			Eventually(doneChan).Should(BeClosed())
+			p.Kill()
+		})
+	})
 })
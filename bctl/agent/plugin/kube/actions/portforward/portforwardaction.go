@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
+	"sync"
 
 	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport/spdy"
 
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/logger"
 	kubeaction "bastionzero.com/bzerolib/plugin/kube"
 	"bastionzero.com/bzerolib/plugin/kube/actions/portforward"
@@ -18,24 +20,22 @@ import (
 	smsg "bastionzero.com/bzerolib/stream/message"
 )
 
-// wrap this code so at test-time we can mock the dial / config
+// wrap this code so at test-time we can mock the dial
 var doDial = func(dialer httpstream.Dialer, protocolName string) (httpstream.Connection, string, error) {
 	return dialer.Dial(kubeutils.PortForwardProtocolV1Name)
 }
 
-var getConfig = func() (*rest.Config, error) {
-	return rest.InClusterConfig()
-}
-
 type PortForwardAction struct {
 	logger *logger.Logger
 
-	serviceAccountToken string
-	kubeHost            string
-	targetGroups        []string
-	targetUser          string
-	logId               string
-	requestId           string
+	cluster      *cluster.Cluster
+	targetGroups []string
+	targetUser   string
+	logId        string
+	requestId    string
+
+	// emits audit events for our port forward, nil if auditing is disabled
+	auditor *audit.Auditor
 
 	// output channel to send all of our stream messages directly to datachannel
 	streamOutputChan     chan smsg.StreamMessage
@@ -44,47 +44,65 @@ type PortForwardAction struct {
 	// Done channel
 	doneChan chan struct{}
 
-	// Map of portforardId <-> PortForwardSubAction
-	requestMap map[string]*PortForwardRequest
+	// Map of portforardId <-> PortForwardSubAction. Each is a single connection
+	// to one of the ports being forwarded, and they succeed or fail separately
+	requestMap     map[string]*PortForwardRequest
+	requestMapLock sync.Mutex
+
+	// set once we've been told to stop, so we know the connection to the pod
+	// closing isn't a problem
+	closing bool
 
 	// So we can recreate the port forward
 	Endpoint        string
 	DataHeaders     map[string]string
 	ErrorHeaders    map[string]string
 	CommandBeingRun string
-	streamConn      httpstream.Connection
+
+	// our connection to the pod, which we may be told to close from another
+	// goroutine, so we only touch it with the requestMapLock held
+	streamConn httpstream.Connection
 }
 
 func New(
 	logger *logger.Logger,
 	ch chan smsg.StreamMessage,
 	doneChan chan struct{},
-	serviceAccountToken string,
-	kubeHost string,
+	cluster *cluster.Cluster,
 	targetGroups []string,
 	targetUser string,
+	auditor *audit.Auditor,
 ) *PortForwardAction {
 
 	return &PortForwardAction{
-		logger:              logger,
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		targetGroups:        targetGroups,
-		targetUser:          targetUser,
-		streamOutputChan:    ch,
-		requestMap:          make(map[string]*PortForwardRequest),
-		doneChan:            doneChan,
+		logger:           logger,
+		cluster:          cluster,
+		targetGroups:     targetGroups,
+		targetUser:       targetUser,
+		auditor:          auditor,
+		streamOutputChan: ch,
+		requestMap:       make(map[string]*PortForwardRequest),
+		doneChan:         doneChan,
 	}
 }
 
 func (p *PortForwardAction) Kill() {
+	p.requestMapLock.Lock()
+	p.closing = true
+	requests := make([]*PortForwardRequest, 0, len(p.requestMap))
 	for _, val := range p.requestMap {
+		requests = append(requests, val)
+	}
+	streamConn := p.streamConn
+	p.requestMapLock.Unlock()
+
+	for _, val := range requests {
 		val.Kill()
 	}
 
 	// close the connection
-	if p.streamConn != nil {
-		p.streamConn.Close()
+	if streamConn != nil {
+		streamConn.Close()
 	}
 }
 
@@ -102,7 +120,7 @@ func (p *PortForwardAction) Receive(action string, actionPayload []byte) ([]byte
 		}
 
 		return p.startPortForward(startPortForwardRequest)
-	case portforward.DataInPortForward, portforward.ErrorInPortForward:
+	case portforward.DataInPortForward, portforward.ErrorInPortForward, portforward.ErrorPortForward:
 		var dataInputAction portforward.KubePortForwardActionPayload
 		if err := json.Unmarshal(actionPayload, &dataInputAction); err != nil {
 			rerr := fmt.Errorf("error unmarshaling datain: %s", err)
@@ -110,30 +128,13 @@ func (p *PortForwardAction) Receive(action string, actionPayload []byte) ([]byte
 			return []byte{}, rerr
 		}
 
-		// See if we already have a session for this portforwardRequestId, else create it
-		if oldRequest, ok := p.requestMap[dataInputAction.PortForwardRequestId]; ok {
-			oldRequest.dataInChannel <- dataInputAction.Data
+		// a request that couldn't be opened has already told the daemon why, so
+		// that's not a reason to end every other request
+		request := p.getRequest(dataInputAction)
+		if portforward.PortForwardSubAction(action) == portforward.DataInPortForward {
+			request.receive(request.dataInChannel, dataInputAction.Data)
 		} else {
-			// Create a new action and update our map
-			subLogger := p.logger.GetActionLogger("kube/portforward/agent/request")
-			subLogger.AddRequestId(p.requestId)
-			newRequest := createPortForwardRequest(
-				subLogger,
-				p.streamOutputChan,
-				p.streamMessageVersion,
-				p.requestId,
-				p.logId,
-				dataInputAction.PortForwardRequestId,
-			)
-
-			p.logger.Infof("Starting port forwarding for %s on port %d. PortforwardRequestId: %s", p.Endpoint, dataInputAction.PodPort, dataInputAction.PortForwardRequestId)
-			if err := newRequest.openPortForwardStream(p.DataHeaders, p.ErrorHeaders, dataInputAction.PodPort, p.streamConn); err != nil {
-				rerr := fmt.Errorf("error opening stream for new portforward request: %s", err)
-				p.logger.Error(rerr)
-				return []byte{}, rerr
-			}
-			p.requestMap[dataInputAction.PortForwardRequestId] = newRequest
-			newRequest.dataInChannel <- dataInputAction.Data
+			request.receive(request.errorInChannel, dataInputAction.Data)
 		}
 
 		return []byte{}, nil
@@ -145,14 +146,16 @@ func (p *PortForwardAction) Receive(action string, actionPayload []byte) ([]byte
 			return []byte{}, rerr
 		}
 
+		p.requestMapLock.Lock()
+		portForwardRequest, ok := p.requestMap[stopRequestAction.PortForwardRequestId]
+		delete(p.requestMap, stopRequestAction.PortForwardRequestId)
+		p.requestMapLock.Unlock()
+
 		// Alert on the done channel
-		if portForwardRequest, ok := p.requestMap[stopRequestAction.PortForwardRequestId]; ok {
+		if ok {
 			portForwardRequest.Kill()
 		}
 
-		// Else update our requestMap
-		delete(p.requestMap, stopRequestAction.PortForwardRequestId)
-
 		return []byte{}, nil
 	case portforward.StopPortForward:
 		p.Kill()
@@ -165,6 +168,39 @@ func (p *PortForwardAction) Receive(action string, actionPayload []byte) ([]byte
 	}
 }
 
+// getRequest returns the request with the given id, opening its streams to the
+// pod if this is the first we've heard of it. We don't hold the map lock while
+// we do, so that a port that's slow to open doesn't hold up the others
+func (p *PortForwardAction) getRequest(dataInputAction portforward.KubePortForwardActionPayload) *PortForwardRequest {
+	p.requestMapLock.Lock()
+	if oldRequest, ok := p.requestMap[dataInputAction.PortForwardRequestId]; ok {
+		p.requestMapLock.Unlock()
+		return oldRequest
+	}
+
+	// Create a new action and update our map
+	subLogger := p.logger.GetActionLogger("kube/portforward/agent/request")
+	subLogger.AddRequestId(p.requestId)
+	newRequest := createPortForwardRequest(
+		subLogger,
+		p.streamOutputChan,
+		p.streamMessageVersion,
+		p.requestId,
+		p.logId,
+		dataInputAction.PortForwardRequestId,
+	)
+	p.requestMap[dataInputAction.PortForwardRequestId] = newRequest
+	streamConn := p.streamConn
+	p.requestMapLock.Unlock()
+
+	p.logger.Infof("Starting port forwarding for %s on port %d. PortforwardRequestId: %s", p.Endpoint, dataInputAction.PodPort, dataInputAction.PortForwardRequestId)
+	if err := newRequest.openPortForwardStream(p.DataHeaders, p.ErrorHeaders, dataInputAction.PodPort, streamConn); err != nil {
+		p.logger.Errorf("error opening stream for new portforward request %s: %s", dataInputAction.PortForwardRequestId, err)
+	}
+
+	return newRequest
+}
+
 func (p *PortForwardAction) startPortForward(startPortForwardRequest portforward.KubePortForwardStartActionPayload) ([]byte, error) {
 	// Update our object to keep track of the pod and url information
 	p.DataHeaders = startPortForwardRequest.DataHeaders
@@ -178,15 +214,6 @@ func (p *PortForwardAction) startPortForward(startPortForwardRequest portforward
 	p.streamMessageVersion = startPortForwardRequest.StreamMessageVersion
 	p.logger.Infof("Setting stream message version: %s", p.streamMessageVersion)
 
-	// Now make our stream chan
-	// Create the in-cluster config
-	config, err := getConfig()
-	if err != nil {
-		rerr := fmt.Errorf("error creating in-custer config: %s", err)
-		p.logger.Error(rerr)
-		return []byte{}, rerr
-	}
-
 	// Always ensure that our targetUser is set
 	if p.targetUser == "" {
 		rerr := fmt.Errorf("target user field is not set")
@@ -194,12 +221,12 @@ func (p *PortForwardAction) startPortForward(startPortForwardRequest portforward
 		return []byte{}, rerr
 	}
 
-	// Add our impersonation information
+	// Now make our stream chan, adding our impersonation information
+	config := p.cluster.Config()
 	config.Impersonate = rest.ImpersonationConfig{
 		UserName: p.targetUser,
 		Groups:   p.targetGroups,
 	}
-	config.BearerToken = p.serviceAccountToken
 
 	// Start building our spdy stream
 	transport, upgrader, err := spdy.RoundTripperFor(config)
@@ -209,17 +236,25 @@ func (p *PortForwardAction) startPortForward(startPortForwardRequest portforward
 		return []byte{}, rerr
 	}
 
-	hostIP := strings.TrimLeft(config.Host, "htps:/")
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, &url.URL{Scheme: "https", Path: p.Endpoint, Host: hostIP})
+	portForwardUrl, err := url.Parse(p.cluster.Host() + p.Endpoint)
+	if err != nil {
+		rerr := fmt.Errorf("could not parse kube port forward url: %s", err)
+		p.logger.Error(rerr)
+		return []byte{}, rerr
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, portForwardUrl)
 
 	var readyMessageErr string
+	auditRequest := p.auditor.Start(http.MethodPost, p.Endpoint, nil, p.logId, p.requestId)
 	streamConn, protocolSelected, err := doDial(dialer, kubeutils.PortForwardProtocolV1Name)
 	if err != nil {
 		rerr := fmt.Errorf("error dialing portforward spdy stream: %s", err)
 		p.logger.Error(rerr)
 		readyMessageErr = err.Error()
+		auditRequest.ResponseComplete(0, rerr)
 	} else {
 		p.logger.Infof("Dial successful. Selected protocol: %s", protocolSelected)
+		auditRequest.ResponseStarted(http.StatusSwitchingProtocols, nil)
 	}
 
 	switch p.streamMessageVersion {
@@ -230,18 +265,56 @@ func (p *PortForwardAction) startPortForward(startPortForwardRequest portforward
 		p.sendReadyMessage(smsg.Ready, readyMessageErr)
 	}
 
-	// Save the connection to use later
+	// there's nothing more to do once we've told the daemon why we failed
+	if err != nil {
+		close(p.doneChan)
+		return []byte{}, nil
+	}
+
+	// Save the connection to use later, unless we were told to stop while we
+	// were dialing, in which case nothing else is going to close it
+	p.requestMapLock.Lock()
 	p.streamConn = streamConn
+	closing := p.closing
+	p.requestMapLock.Unlock()
+
+	if closing {
+		streamConn.Close()
+	}
 
 	// track when the http stream connection has closed so we know when we're done
 	go func() {
 		<-streamConn.CloseChan()
+		p.failRequests(fmt.Errorf("lost connection to %s", p.Endpoint))
+		auditRequest.ResponseComplete(http.StatusSwitchingProtocols, nil)
 		close(p.doneChan)
 	}()
 
 	return []byte{}, nil
 }
 
+// failRequests lets the client know why every port it's still forwarding is
+// ending, such as the pod being deleted, unless the daemon asked us to stop
+func (p *PortForwardAction) failRequests(err error) {
+	p.requestMapLock.Lock()
+	if p.closing {
+		p.requestMapLock.Unlock()
+		return
+	}
+	requests := make(map[string]*PortForwardRequest, len(p.requestMap))
+	for portForwardRequestId, request := range p.requestMap {
+		requests[portForwardRequestId] = request
+	}
+	p.requestMapLock.Unlock()
+
+	for portForwardRequestId, request := range requests {
+		if request.Alive() {
+			p.logger.Infof("Ending portforward request %s: %s", portForwardRequestId, err)
+			request.fail(err)
+		}
+	}
+}
+
 func (p *PortForwardAction) sendReadyMessage(streamType smsg.StreamType, errorMessage string) {
 	p.streamOutputChan <- smsg.StreamMessage{
 		SchemaVersion:  p.streamMessageVersion,
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 
 	"bastionzero.com/bzerolib/logger"
 	kubeaction "bastionzero.com/bzerolib/plugin/kube"
@@ -31,6 +32,12 @@ type PortForwardRequest struct {
 	dataInChannel  chan []byte
 	errorInChannel chan []byte
 	doneChan       chan bool // Done channel so the go routines can communicate with eachother
+
+	// we may send on either stream from more than one go routine, and each
+	// stream type has its own sequence numbers
+	sendLock        sync.Mutex
+	sequenceNumbers map[smsg.StreamType]int
+	finished        bool // whether we've told the daemon there's no more data
 }
 
 func createPortForwardRequest(
@@ -50,9 +57,10 @@ func createPortForwardRequest(
 		logId:                logId,
 		portForwardRequestId: portForwardRequestId,
 
-		dataInChannel:  make(chan []byte),
-		errorInChannel: make(chan []byte),
-		doneChan:       make(chan bool),
+		dataInChannel:   make(chan []byte),
+		errorInChannel:  make(chan []byte),
+		doneChan:        make(chan bool),
+		sequenceNumbers: make(map[smsg.StreamType]int),
 	}
 }
 
@@ -61,7 +69,79 @@ func (p *PortForwardRequest) Kill() {
 	p.tmb.Wait()
 }
 
+// Alive is false once this request has failed or been killed
+func (p *PortForwardRequest) Alive() bool {
+	return p.tmb.Alive()
+}
+
+// receive passes data from the daemon on to one of our streams, dropping it if
+// the request has already ended so that one port can't hold up the others
+func (p *PortForwardRequest) receive(ch chan []byte, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	select {
+	case ch <- data:
+	case <-p.tmb.Dying():
+	}
+}
+
+// abort reports an error opening the request and leaves it dead, so that
+// anything else the daemon sends for it is dropped
+func (p *PortForwardRequest) abort(err error) error {
+	p.fail(err)
+	p.tmb.Go(func() error { return err })
+	return err
+}
+
+// fail tells the daemon why this request is ending on its error stream, which
+// the client will print for this port, and then that there's no more data
+func (p *PortForwardRequest) fail(err error) {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	if p.finished {
+		return
+	}
+	p.finished = true
+
+	if content, werr := p.wrapStreamMessageContent([]byte(err.Error())); werr == nil {
+		p.sendStreamMessage(smsg.Error, true, content)
+	}
+	if content, werr := p.wrapStreamMessageContent([]byte{}); werr == nil {
+		p.sendStreamMessage(smsg.Data, false, content)
+	}
+}
+
+// finish tells the daemon there's no more data
+func (p *PortForwardRequest) finish() error {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	if p.finished {
+		return nil
+	}
+	p.finished = true
+
+	content, err := p.wrapStreamMessageContent([]byte{})
+	if err != nil {
+		return err
+	}
+	p.sendStreamMessage(smsg.Data, false, content)
+	return nil
+}
+
+// openPortForwardStream opens a data and error stream to podPort for this
+// request. If that fails, the error is reported on this request's error stream
+// rather than ending the whole port forward, so that other ports keep working
 func (p *PortForwardRequest) openPortForwardStream(dataHeaders map[string]string, errorHeaders map[string]string, podPort int64, streamConn httpstream.Connection) error {
+	// pods can only forward TCP ports
+	if podPort < 1 || podPort > 65535 {
+		return p.abort(fmt.Errorf("invalid port %d", podPort))
+	} else if streamConn == nil {
+		return p.abort(fmt.Errorf("not connected to pod"))
+	}
 
 	// Create our two streams with the provided headers
 	// We purposely share the header object for data and error stream
@@ -75,9 +155,7 @@ func (p *PortForwardRequest) openPortForwardStream(dataHeaders map[string]string
 	// Create our http.Header
 	errorStream, err := streamConn.CreateStream(headers)
 	if err != nil {
-		rerr := fmt.Errorf("error creating error stream: %s", err)
-		p.logger.Error(rerr)
-		return rerr
+		return p.abort(fmt.Errorf("error creating error stream: %s", err))
 	}
 
 	for name, value := range dataHeaders {
@@ -87,9 +165,8 @@ func (p *PortForwardRequest) openPortForwardStream(dataHeaders map[string]string
 	// Create our http.Header
 	dataStream, err := streamConn.CreateStream(headers)
 	if err != nil {
-		rerr := fmt.Errorf("error creating data stream: %s", err)
-		p.logger.Error(rerr)
-		return rerr
+		errorStream.Close()
+		return p.abort(fmt.Errorf("error creating data stream: %s", err))
 	}
 
 	p.tmb.Go(func() error {
@@ -97,35 +174,33 @@ func (p *PortForwardRequest) openPortForwardStream(dataHeaders map[string]string
 		defer dataStream.Close()
 
 		p.tmb.Go(func() error {
-			// Keep track of seq number
-			dataSeqNumber := 0
 			for {
 				select {
 				case <-p.tmb.Dying():
 					return nil
 				default:
-					if err := p.forwardStream(smsg.Data, dataStream, dataSeqNumber); err != nil {
+					if err := p.forwardStream(smsg.Data, dataStream); err == io.EOF {
+						return nil
+					} else if err != nil {
 						p.logger.Error(err)
 						return err
 					}
-					dataSeqNumber += 1
 				}
 			}
 		})
 
 		p.tmb.Go(func() error {
-			// Keep track of seq number
-			errorSeqNumber := 0
 			for {
 				select {
 				case <-p.tmb.Dying():
 					return nil
 				default:
-					if err := p.forwardStream(smsg.Error, errorStream, errorSeqNumber); err != nil {
+					if err := p.forwardStream(smsg.Error, errorStream); err == io.EOF {
+						return nil
+					} else if err != nil {
 						p.logger.Error(err)
 						return err
 					}
-					errorSeqNumber += 1
 				}
 			}
 		})
@@ -137,14 +212,18 @@ func (p *PortForwardRequest) openPortForwardStream(dataHeaders map[string]string
 			case dataInMessage := <-p.dataInChannel:
 				// Make this request locally, and then return that info to the user
 				if _, err := io.Copy(dataStream, bytes.NewReader(dataInMessage)); err != nil {
-					p.logger.Errorf("error writing to data stream: %s", err)
-					return nil
+					rerr := fmt.Errorf("error writing to data stream: %s", err)
+					p.logger.Error(rerr)
+					p.fail(rerr)
+					return rerr
 				}
 			case errorInMessage := <-p.errorInChannel:
 				// Make this request locally, and then return that info to the user
 				if _, err := io.Copy(errorStream, bytes.NewReader(errorInMessage)); err != nil {
-					p.logger.Errorf("error writing to error stream: %s", err)
-					return nil
+					rerr := fmt.Errorf("error writing to error stream: %s", err)
+					p.logger.Error(rerr)
+					p.fail(rerr)
+					return rerr
 				}
 			}
 		}
@@ -155,31 +234,35 @@ func (p *PortForwardRequest) openPortForwardStream(dataHeaders map[string]string
 
 // NOTE: we don't need to check version here because Portforward is broken on previous versions of bzero
 // thus, anyone using it at all is using the new version
-func (p *PortForwardRequest) forwardStream(streamType smsg.StreamType, stream httpstream.Stream, sequenceNumber int) error {
+//
+// forwardStream returns io.EOF once the stream has been closed by the pod
+func (p *PortForwardRequest) forwardStream(streamType smsg.StreamType, stream httpstream.Stream) error {
 	buf := make([]byte, portforward.DataStreamBufferSize)
 
 	if n, err := stream.Read(buf); !p.tmb.Alive() {
 		return nil
-	} else if err != nil {
-		if err != io.EOF {
-			return fmt.Errorf("error reading data from %s stream: %s", streamType, err)
-		} else if streamType == smsg.Data {
-			if content, err := p.wrapStreamMessageContent([]byte{}); err != nil {
+	} else if err == io.EOF {
+		if streamType == smsg.Data {
+			if err := p.finish(); err != nil {
 				return err
-			} else {
-				// NOTE: we don't have to version this because this part of portforward is broken prior to 202204
-				p.sendStreamMessage(sequenceNumber, streamType, false, content)
-				return nil
 			}
 		}
-		return err
+		return io.EOF
+	} else if err != nil {
+		rerr := fmt.Errorf("error reading data from %s stream: %s", streamType, err)
+		p.fail(rerr)
+		return rerr
 	} else {
 		// Send this data back to the bastion
 		if content, err := p.wrapStreamMessageContent(buf[:n]); err != nil {
 			return err
 		} else {
 			// NOTE: we don't have to version this because this part of portforward is broken prior to 202204
-			p.sendStreamMessage(sequenceNumber, streamType, true, content)
+			p.sendLock.Lock()
+			defer p.sendLock.Unlock()
+			if !p.finished {
+				p.sendStreamMessage(streamType, true, content)
+			}
 			return nil
 		}
 	}
@@ -198,7 +281,11 @@ func (p *PortForwardRequest) wrapStreamMessageContent(content []byte) (string, e
 	return base64.StdEncoding.EncodeToString(streamMessageToSendBytes), nil
 }
 
-func (p *PortForwardRequest) sendStreamMessage(sequenceNumber int, streamType smsg.StreamType, more bool, content string) {
+// sendStreamMessage must be called with sendLock held
+func (p *PortForwardRequest) sendStreamMessage(streamType smsg.StreamType, more bool, content string) {
+	sequenceNumber := p.sequenceNumbers[streamType]
+	p.sequenceNumbers[streamType] += 1
+
 	p.streamOutputChan <- smsg.StreamMessage{
 		SchemaVersion:  p.streamMessageVersion,
 		SequenceNumber: sequenceNumber,
@@ -6,14 +6,15 @@ import (
 	"io"
 	"net/http"
 
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/logger"
 	kuberest "bastionzero.com/bzerolib/plugin/kube/actions/restapi"
 	kubeutils "bastionzero.com/bzerolib/plugin/kube/utils"
 )
 
 // wrap the client-creation code so that during testing we can inject a mock client
-var makeRequest = func(req *http.Request) (*http.Response, error) {
-	client := http.Client{}
+var makeRequest = func(client *http.Client, req *http.Request) (*http.Response, error) {
 	return client.Do(req)
 }
 
@@ -21,26 +22,28 @@ type RestApiAction struct {
 	logger   *logger.Logger
 	doneChan chan struct{}
 
-	serviceAccountToken string
-	kubeHost            string
-	targetGroups        []string
-	targetUser          string
+	cluster      *cluster.Cluster
+	targetGroups []string
+	targetUser   string
+
+	// emits an audit event for our request, nil if auditing is disabled
+	auditor *audit.Auditor
 }
 
 func New(
 	logger *logger.Logger,
 	doneChan chan struct{},
-	serviceAccountToken string,
-	kubeHost string,
+	cluster *cluster.Cluster,
 	targetGroups []string,
-	targetUser string) *RestApiAction {
+	targetUser string,
+	auditor *audit.Auditor) *RestApiAction {
 	return &RestApiAction{
-		logger:              logger,
-		doneChan:            doneChan,
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		targetGroups:        targetGroups,
-		targetUser:          targetUser,
+		logger:       logger,
+		doneChan:     doneChan,
+		cluster:      cluster,
+		targetGroups: targetGroups,
+		targetUser:   targetUser,
+		auditor:      auditor,
 	}
 }
 
@@ -63,13 +66,16 @@ func (r *RestApiAction) Receive(action string, actionPayload []byte) ([]byte, er
 		return []byte{}, err
 	}
 
-	res, err := makeRequest(req)
+	auditRequest := r.auditor.Start(apiRequest.Method, apiRequest.Endpoint, apiRequest.Headers, apiRequest.LogId, apiRequest.RequestId)
+	res, err := makeRequest(r.cluster.Client(), req)
 	if err != nil {
 		rerr := fmt.Errorf("bad response to API request: %s", err)
 		r.logger.Error(rerr)
+		auditRequest.ResponseComplete(0, rerr)
 		return []byte{}, rerr
 	}
 	defer res.Body.Close()
+	auditRequest.ResponseComplete(res.StatusCode, nil)
 
 	// Build the header response
 	header := make(map[string][]string)
@@ -96,7 +102,7 @@ func (r *RestApiAction) Receive(action string, actionPayload []byte) ([]byte, er
 }
 
 func (r *RestApiAction) buildHttpRequest(endpoint, body, method string, headers map[string][]string) (*http.Request, error) {
-	if toReturn, err := kubeutils.BuildHttpRequest(r.kubeHost, endpoint, body, method, headers, r.serviceAccountToken, r.targetUser, r.targetGroups); err != nil {
+	if toReturn, err := kubeutils.BuildHttpRequest(r.cluster.Host(), endpoint, body, method, headers, r.targetUser, r.targetGroups); err != nil {
 		r.logger.Error(err)
 		return nil, err
 	} else {
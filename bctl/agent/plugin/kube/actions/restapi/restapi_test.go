@@ -9,7 +9,9 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
 
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/logger"
 	kuberest "bastionzero.com/bzerolib/plugin/kube/actions/restapi"
 )
@@ -41,7 +43,7 @@ func buildExpectedResponsePayload(statusCode int, headers map[string][]string, r
 
 // inject logic for what happens when restapi makes an HTTP request
 func setMakeRequest(statusCode int, headers map[string][]string, bodyText string) {
-	makeRequest = func(req *http.Request) (*http.Response, error) {
+	makeRequest = func(_ *http.Client, req *http.Request) (*http.Response, error) {
 		return &http.Response{
 			StatusCode: statusCode,
 			Header:     headers,
@@ -50,6 +52,13 @@ func setMakeRequest(statusCode int, headers map[string][]string, bodyText string
 	}
 }
 
+// save restapi action the trouble of trying to read a nonexsitent config
+func testCluster() *cluster.Cluster {
+	testCluster, err := cluster.New("test", &rest.Config{Host: "https://kubeHost"})
+	Expect(err).ToNot(HaveOccurred())
+	return testCluster
+}
+
 func TestRestApi(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Agent RestApi Suite")
@@ -75,7 +84,7 @@ var _ = Describe("Agent RestApi action", Ordered, func() {
 	Context("Happy path", func() {
 		doneChan := make(chan struct{})
 		setMakeRequest(statusCode, headers, testString)
-		r := New(logger, doneChan, "serviceAccountToken", "kubeHost", make([]string, 0), "test user")
+		r := New(logger, doneChan, testCluster(), make([]string, 0), "test user", nil)
 
 		It("handles the API request and response correctly", func() {
 			By("receiving an API request without error")
@@ -11,6 +11,8 @@ import (
 	"net/url"
 	"strings"
 
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/logger"
 	kubeaction "bastionzero.com/bzerolib/plugin/kube"
 	"bastionzero.com/bzerolib/plugin/kube/actions/stream"
@@ -20,8 +22,7 @@ import (
 )
 
 // wrap the client-creation code so that during testing we can inject a mock client
-var makeRequest = func(req *http.Request) (*http.Response, error) {
-	client := http.Client{}
+var makeRequest = func(client *http.Client, req *http.Request) (*http.Response, error) {
 	return client.Do(req)
 }
 
@@ -33,28 +34,39 @@ type StreamAction struct {
 	streamOutputChan     chan smsg.StreamMessage
 	streamMessageVersion smsg.SchemaVersion
 
-	requestId           string
-	serviceAccountToken string
-	kubeHost            string
-	targetGroups        []string
-	targetUser          string
+	requestId    string
+	cluster      *cluster.Cluster
+	targetGroups []string
+	targetUser   string
+
+	// emits audit events for our request, nil if auditing is disabled
+	auditor *audit.Auditor
+
+	// if the daemon acknowledges what it has written to the client, we won't
+	// read more than windowSize bytes ahead of it
+	windowSize int
+	acks       chan int
+
+	// if the daemon is streaming the request body, this is where it goes
+	bodyWriter *io.PipeWriter
 }
 
 func New(logger *logger.Logger,
 	ch chan smsg.StreamMessage,
 	doneChan chan struct{},
-	serviceAccountToken string,
-	kubeHost string,
+	cluster *cluster.Cluster,
 	targetGroups []string,
-	targetUser string) *StreamAction {
+	targetUser string,
+	auditor *audit.Auditor) *StreamAction {
 	return &StreamAction{
-		logger:              logger,
-		streamOutputChan:    ch,
-		doneChan:            doneChan,
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		targetGroups:        targetGroups,
-		targetUser:          targetUser,
+		logger:           logger,
+		streamOutputChan: ch,
+		doneChan:         doneChan,
+		cluster:          cluster,
+		targetGroups:     targetGroups,
+		targetUser:       targetUser,
+		auditor:          auditor,
+		acks:             make(chan int, 16),
 	}
 }
 
@@ -90,6 +102,28 @@ func (s *StreamAction) Receive(action string, actionPayload []byte) ([]byte, err
 		s.Kill()
 
 		return []byte{}, nil
+	case stream.StreamAck:
+		var ack stream.KubeStreamAckPayload
+		if err := json.Unmarshal(actionPayload, &ack); err != nil {
+			rerr := fmt.Errorf("malformed Kube Stream Ack payload %v", actionPayload)
+			s.logger.Error(rerr)
+			return []byte{}, rerr
+		}
+
+		select {
+		case s.acks <- ack.Bytes:
+		case <-s.tmb.Dying():
+		}
+		return []byte{}, nil
+	case stream.StreamInput:
+		var input stream.KubeStreamInputPayload
+		if err := json.Unmarshal(actionPayload, &input); err != nil {
+			rerr := fmt.Errorf("malformed Kube Stream Input payload %v", actionPayload)
+			s.logger.Error(rerr)
+			return []byte{}, rerr
+		}
+
+		return []byte{}, s.writeBody(input)
 	default:
 		rerr := fmt.Errorf("unhandled stream action: %v", action)
 		s.logger.Error(rerr)
@@ -103,6 +137,7 @@ func (s *StreamAction) startStream(streamActionRequest stream.KubeStreamActionPa
 	s.logger.Infof("Setting request id: %s", s.requestId)
 	s.streamMessageVersion = streamActionRequest.StreamMessageVersion
 	s.logger.Infof("Setting stream message version: %s", s.streamMessageVersion)
+	s.windowSize = streamActionRequest.WindowSize
 
 	// Build our request
 	s.logger.Infof("Making request for %s", streamActionRequest.Endpoint)
@@ -116,105 +151,177 @@ func (s *StreamAction) startStream(streamActionRequest stream.KubeStreamActionPa
 
 	// Make the request and wait for the body to close
 	req = req.WithContext(ctx)
-	res, err := makeRequest(req)
+	auditRequest := s.auditor.Start(streamActionRequest.Method, streamActionRequest.Endpoint, streamActionRequest.Headers, streamActionRequest.LogId, streamActionRequest.RequestId)
+
+	if streamActionRequest.StreamBody {
+		reader, writer := io.Pipe()
+		req.Body, req.GetBody, req.ContentLength = reader, nil, -1
+		s.bodyWriter = writer
+
+		// The API server may not respond until it has the whole body, so we can't
+		// wait for it here where we'd stop the daemon from sending us the rest
+		s.tmb.Go(func() error {
+			// unblock anyone still writing the body once we're done with it
+			defer reader.Close()
+
+			res, err := makeRequest(s.cluster.Client(), req)
+			if err != nil {
+				defer cancel()
+				defer close(s.doneChan)
+				rerr := fmt.Errorf("bad response to API request: %s", err)
+				s.logger.Error(rerr)
+				auditRequest.ResponseComplete(0, rerr)
+
+				s.sendHeaders(http.StatusBadGateway, nil, streamActionRequest.LogId)
+				s.sendData(1, []byte(rerr.Error()), streamActionRequest.LogId)
+				s.sendEnd(2, []byte{}, streamActionRequest.LogId)
+				return rerr
+			}
+
+			return s.streamResponse(res, cancel, auditRequest, streamActionRequest)
+		})
+
+		return []byte{}, nil
+	}
+
+	res, err := makeRequest(s.cluster.Client(), req)
 	if err != nil {
 		defer cancel()
 		rerr := fmt.Errorf("bad response to API request: %s", err)
 		s.logger.Error(rerr)
+		auditRequest.ResponseComplete(0, rerr)
 		return []byte{}, rerr
 	}
 
+	s.tmb.Go(func() error {
+		return s.streamResponse(res, cancel, auditRequest, streamActionRequest)
+	})
+
+	return []byte{}, nil
+}
+
+// streamResponse sends the response back to the daemon as we read it, until
+// either the API server or the daemon closes the stream
+func (s *StreamAction) streamResponse(res *http.Response, cancel context.CancelFunc, auditRequest *audit.Request, streamActionRequest stream.KubeStreamActionPayload) error {
+	defer res.Body.Close()
+	defer close(s.doneChan)
+	defer auditRequest.ResponseComplete(res.StatusCode, nil)
+	auditRequest.ResponseStarted(res.StatusCode, nil)
+
+	// Subscribe to our own tomb so we can kill a blocking read
+	go func() {
+		<-s.tmb.Dying()
+		cancel()
+	}()
+
 	// Send our first message with the headers
-	headers := make(map[string][]string)
-	for name, value := range res.Header {
-		headers[name] = value
-	}
-	kubeWatchHeadersPayload := stream.KubeStreamHeadersPayload{
-		Headers: headers,
-	}
-	kubeWatchHeadersPayloadBytes, _ := json.Marshal(kubeWatchHeadersPayload)
-	// Stream the response back
-	switch s.streamMessageVersion {
-	// prior to 202204
-	case "":
-		s.sendStreamMessage(0, smsg.StreamData, true, kubeWatchHeadersPayloadBytes[:], streamActionRequest.LogId)
-	default:
-		s.sendStreamMessage(0, smsg.Data, true, kubeWatchHeadersPayloadBytes[:], streamActionRequest.LogId)
-	}
+	s.sendHeaders(res.StatusCode, res.Header, streamActionRequest.LogId)
 
 	// Create our bufio object
 	buf := make([]byte, 1024)
 	br := bufio.NewReader(res.Body)
 
 	sequenceNumber := 1
+	unacked := 0
 
-	s.tmb.Go(func() error {
-		defer res.Body.Close()
-		defer close(s.doneChan)
-
-		// Subscribe to our own tomb so we can kill a blocking read
-		go func() {
-			<-s.tmb.Dying()
-			cancel()
-		}()
-
-		for {
-			// Read into the buffer
-			if numBytes, err := br.Read(buf); !s.tmb.Alive() {
-				return nil
-			} else if err != nil {
-				switch err {
-				case context.Canceled:
-					s.logger.Info("Stream action stream closed")
-				case io.EOF:
-					s.logger.Info("Received EOF on stream action stream")
-				default:
-					s.logger.Error(fmt.Errorf("could not read HTTP response: %s", err))
-
-					// If the sequenceNumber is 1, this means that we never streamed any data back, if this is a log request attempt
-					// to get the latest logs
-					if sequenceNumber == 1 {
-						// check to see if there are any logs we can stream back, do not attempt to handle any error, this is best effort
-						// Remove the follow from the endpoint
-						if urlObject, err := convertToUrlObject(streamActionRequest.Endpoint); err == nil {
-							// Ensure this is a log request
-							if strings.HasSuffix(urlObject.Path, "/log") {
-								s.handleLastLogStream(urlObject, streamActionRequest, sequenceNumber)
-							}
-						} else {
-							s.logger.Errorf("error converting to url object: %s", err)
+	for {
+		// Don't read any more than the daemon can keep up with
+		var ok bool
+		if unacked, ok = s.waitForWindow(unacked); !ok {
+			return nil
+		}
+
+		// Read into the buffer
+		if numBytes, err := br.Read(buf); !s.tmb.Alive() {
+			return nil
+		} else if err != nil {
+			switch err {
+			case context.Canceled:
+				s.logger.Info("Stream action stream closed")
+			case io.EOF:
+				s.logger.Info("Received EOF on stream action stream")
+			default:
+				s.logger.Error(fmt.Errorf("could not read HTTP response: %s", err))
+
+				// If the sequenceNumber is 1, this means that we never streamed any data back, if this is a log request attempt
+				// to get the latest logs
+				if sequenceNumber == 1 {
+					// check to see if there are any logs we can stream back, do not attempt to handle any error, this is best effort
+					// Remove the follow from the endpoint
+					if urlObject, err := convertToUrlObject(streamActionRequest.Endpoint); err == nil {
+						// Ensure this is a log request
+						if strings.HasSuffix(urlObject.Path, "/log") {
+							s.handleLastLogStream(urlObject, streamActionRequest, sequenceNumber)
 						}
+					} else {
+						s.logger.Errorf("error converting to url object: %s", err)
 					}
 				}
-
-				// Let the daemon know the stream has ended
-				switch s.streamMessageVersion {
-				// prior to 202204
-				case "":
-					s.sendStreamMessage(sequenceNumber, smsg.StreamEnd, false, buf[:numBytes], streamActionRequest.LogId)
-				default:
-					s.sendStreamMessage(sequenceNumber, smsg.Stream, false, buf[:numBytes], streamActionRequest.LogId)
-				}
-				return err
-			} else {
-				// Stream the response back
-				switch s.streamMessageVersion {
-				// prior to 202204
-				case "":
-					s.sendStreamMessage(sequenceNumber, smsg.StreamData, true, buf[:numBytes], streamActionRequest.LogId)
-				default:
-					s.sendStreamMessage(sequenceNumber, smsg.Data, true, buf[:numBytes], streamActionRequest.LogId)
-				}
-				sequenceNumber += 1
 			}
+
+			// Let the daemon know the stream has ended
+			s.sendEnd(sequenceNumber, buf[:numBytes], streamActionRequest.LogId)
+			return err
+		} else {
+			// Stream the response back
+			s.sendData(sequenceNumber, buf[:numBytes], streamActionRequest.LogId)
+			sequenceNumber += 1
+			unacked += numBytes
 		}
-	})
+	}
+}
 
-	return []byte{}, nil
+// waitForWindow takes any acknowledgements we've received off of the number of
+// bytes we've sent and, if the daemon has asked for flow control, blocks until
+// there's room for more. It returns false if we're killed while waiting
+func (s *StreamAction) waitForWindow(unacked int) (int, bool) {
+	for {
+		select {
+		case n := <-s.acks:
+			unacked -= n
+			continue
+		default:
+		}
+
+		if s.windowSize <= 0 || unacked < s.windowSize {
+			return unacked, true
+		}
+
+		select {
+		case n := <-s.acks:
+			unacked -= n
+		case <-s.tmb.Dying():
+			return unacked, false
+		}
+	}
+}
+
+// writeBody passes a chunk of the request body from the daemon on to the API
+// server, blocking until it has been read so that a slow API server slows the
+// daemon down too
+func (s *StreamAction) writeBody(input stream.KubeStreamInputPayload) error {
+	if s.bodyWriter == nil {
+		rerr := fmt.Errorf("received request body for a stream that isn't expecting one")
+		s.logger.Error(rerr)
+		return rerr
+	}
+
+	if len(input.Data) > 0 {
+		if _, err := s.bodyWriter.Write(input.Data); err != nil {
+			// the request has already finished, so there's nobody to send it to
+			s.logger.Debugf("Dropping request body for finished stream: %s", err)
+			return nil
+		}
+	}
+
+	if input.EOF {
+		s.bodyWriter.Close()
+	}
+	return nil
 }
 
 func (s *StreamAction) buildHttpRequest(endpoint, body, method string, headers map[string][]string) (*http.Request, error) {
-	if toReturn, err := kubeutils.BuildHttpRequest(s.kubeHost, endpoint, body, method, headers, s.serviceAccountToken, s.targetUser, s.targetGroups); err != nil {
+	if toReturn, err := kubeutils.BuildHttpRequest(s.cluster.Host(), endpoint, body, method, headers, s.targetUser, s.targetGroups); err != nil {
 		return nil, err
 	} else {
 		return toReturn, nil
@@ -230,18 +337,12 @@ func (s *StreamAction) handleLastLogStream(url *url.URL, streamActionRequest str
 	url.RawQuery = q.Encode()
 
 	// Build our http request
-	if noFollowReq, err := kubeutils.BuildHttpRequest(s.kubeHost, url.String(), streamActionRequest.Body, streamActionRequest.Method, streamActionRequest.Headers, s.serviceAccountToken, s.targetUser, s.targetGroups); err == nil {
-		if noFollowRes, err := makeRequest(noFollowReq); err == nil {
+	if noFollowReq, err := kubeutils.BuildHttpRequest(s.cluster.Host(), url.String(), streamActionRequest.Body, streamActionRequest.Method, streamActionRequest.Headers, s.targetUser, s.targetGroups); err == nil {
+		if noFollowRes, err := makeRequest(s.cluster.Client(), noFollowReq); err == nil {
 			// Parse out the body
 			if bodyBytes, err := io.ReadAll(noFollowRes.Body); err == nil {
 				// Stream the context back to the user
-				switch s.streamMessageVersion {
-				// prior to 202204
-				case "":
-					s.sendStreamMessage(sequenceNumber, smsg.StreamData, true, bodyBytes, streamActionRequest.LogId)
-				default:
-					s.sendStreamMessage(sequenceNumber, smsg.Data, true, bodyBytes, streamActionRequest.LogId)
-				}
+				s.sendData(sequenceNumber, bodyBytes, streamActionRequest.LogId)
 			} else {
 				s.logger.Errorf("error reading body of http request: %s", err)
 			}
@@ -262,6 +363,40 @@ func convertToUrlObject(inURL string) (*url.URL, error) {
 	return u, nil
 }
 
+func (s *StreamAction) sendHeaders(statusCode int, header http.Header, logId string) {
+	headers := make(map[string][]string)
+	for name, value := range header {
+		headers[name] = value
+	}
+	kubeWatchHeadersPayload := stream.KubeStreamHeadersPayload{
+		Headers:     headers,
+		StatusCode:  statusCode,
+		FlowControl: s.windowSize > 0,
+	}
+	kubeWatchHeadersPayloadBytes, _ := json.Marshal(kubeWatchHeadersPayload)
+	s.sendData(0, kubeWatchHeadersPayloadBytes, logId)
+}
+
+func (s *StreamAction) sendData(sequenceNumber int, contentBytes []byte, logId string) {
+	switch s.streamMessageVersion {
+	// prior to 202204
+	case "":
+		s.sendStreamMessage(sequenceNumber, smsg.StreamData, true, contentBytes, logId)
+	default:
+		s.sendStreamMessage(sequenceNumber, smsg.Data, true, contentBytes, logId)
+	}
+}
+
+func (s *StreamAction) sendEnd(sequenceNumber int, contentBytes []byte, logId string) {
+	switch s.streamMessageVersion {
+	// prior to 202204
+	case "":
+		s.sendStreamMessage(sequenceNumber, smsg.StreamEnd, false, contentBytes, logId)
+	default:
+		s.sendStreamMessage(sequenceNumber, smsg.Stream, false, contentBytes, logId)
+	}
+}
+
 func (s *StreamAction) sendStreamMessage(
 	sequenceNumber int,
 	streamType smsg.StreamType,
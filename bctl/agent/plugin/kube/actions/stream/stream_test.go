@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -11,7 +12,9 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
 
+	"bastionzero.com/agent/plugin/kube/cluster"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin/kube/actions/stream"
 	smsg "bastionzero.com/bzerolib/stream/message"
@@ -19,6 +22,10 @@ import (
 
 // what stream action will receive from "bastion"
 func buildActionPayload(headers map[string][]string, requestId string, version smsg.SchemaVersion) []byte {
+	return buildFlowControlActionPayload(headers, requestId, version, 0, false)
+}
+
+func buildFlowControlActionPayload(headers map[string][]string, requestId string, version smsg.SchemaVersion, windowSize int, streamBody bool) []byte {
 	payloadBytes, _ := json.Marshal(stream.KubeStreamActionPayload{
 		Endpoint:             "test/endpoint",
 		Headers:              headers,
@@ -28,13 +35,15 @@ func buildActionPayload(headers map[string][]string, requestId string, version s
 		StreamMessageVersion: version,
 		LogId:                "lid",
 		CommandBeingRun:      "command",
+		WindowSize:           windowSize,
+		StreamBody:           streamBody,
 	})
 	return payloadBytes
 }
 
 // inject logic for what happens when stream makes an HTTP request
 func setMakeRequest(statusCode int, headers map[string][]string, bodyText string) {
-	makeRequest = func(req *http.Request) (*http.Response, error) {
+	makeRequest = func(_ *http.Client, req *http.Request) (*http.Response, error) {
 		return &http.Response{
 			StatusCode: statusCode,
 			Header:     headers,
@@ -43,6 +52,13 @@ func setMakeRequest(statusCode int, headers map[string][]string, bodyText string
 	}
 }
 
+// save stream action the trouble of trying to read a nonexsitent config
+func testCluster() *cluster.Cluster {
+	testCluster, err := cluster.New("test", &rest.Config{Host: "https://kubeHost"})
+	Expect(err).ToNot(HaveOccurred())
+	return testCluster
+}
+
 func TestStream(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Agent Stream Suite")
@@ -63,7 +79,7 @@ var _ = Describe("Agent Stream action", Ordered, func() {
 		outputChan := make(chan smsg.StreamMessage, 10)
 		// respond with a 4kb string
 		setMakeRequest(200, headers, strings.Repeat(testString, 1024))
-		s := New(logger, outputChan, doneChan, "serviceAccountToken", "kubeHost", make([]string, 0), "test user")
+		s := New(logger, outputChan, doneChan, testCluster(), make([]string, 0), "test user", nil)
 
 		It("streams a 4kb message in chunks", func() {
 			By("receiving a stream request without error")
@@ -80,7 +96,8 @@ var _ = Describe("Agent Stream action", Ordered, func() {
 			json.Unmarshal(contentBytes, &kubestreamHeadersPayload)
 
 			Expect(kubestreamHeadersPayload).To(Equal(stream.KubeStreamHeadersPayload{
-				Headers: headers,
+				Headers:    headers,
+				StatusCode: 200,
 			}))
 
 			By("breaking up the stream into 1kb chunks")
@@ -98,4 +115,95 @@ var _ = Describe("Agent Stream action", Ordered, func() {
 			Expect(finalMessage.More).To(BeFalse())
 		})
 	})
+
+	Context("Flow control", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan smsg.StreamMessage, 10)
+		s := New(logger, outputChan, doneChan, testCluster(), make([]string, 0), "test user", nil)
+
+		It("stops reading once the daemon falls a window behind", func() {
+			setMakeRequest(200, headers, strings.Repeat(testString, 1024))
+
+			By("receiving a stream request with a 2kb window")
+			payload := buildFlowControlActionPayload(make(map[string][]string), requestId, smsg.CurrentSchema, 2048, false)
+			_, err := s.Receive(string(stream.StreamStart), payload)
+			Expect(err).To(BeNil())
+
+			By("telling the daemon that we support flow control")
+			headerMessage := <-outputChan
+			var kubestreamHeadersPayload stream.KubeStreamHeadersPayload
+			contentBytes, _ := base64.StdEncoding.DecodeString(headerMessage.Content)
+			json.Unmarshal(contentBytes, &kubestreamHeadersPayload)
+			Expect(kubestreamHeadersPayload.FlowControl).To(BeTrue())
+
+			By("sending no more than the window before we're acknowledged")
+			Eventually(outputChan).Should(Receive())
+			Eventually(outputChan).Should(Receive())
+			Consistently(outputChan).ShouldNot(Receive())
+
+			By("sending the rest once the daemon has caught up")
+			ack, _ := json.Marshal(stream.KubeStreamAckPayload{RequestId: requestId, LogId: "lid", Bytes: 2048})
+			_, err = s.Receive(string(stream.StreamAck), ack)
+			Expect(err).To(BeNil())
+
+			Eventually(outputChan).Should(Receive())
+			Eventually(outputChan).Should(Receive())
+			Consistently(outputChan).ShouldNot(Receive())
+
+			_, err = s.Receive(string(stream.StreamAck), ack)
+			Expect(err).To(BeNil())
+			var finalMessage smsg.StreamMessage
+			Eventually(outputChan).Should(Receive(&finalMessage))
+			Expect(finalMessage.More).To(BeFalse())
+			Eventually(doneChan).Should(BeClosed())
+		})
+	})
+
+	Context("Streamed request body", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan smsg.StreamMessage, 10)
+		s := New(logger, outputChan, doneChan, testCluster(), make([]string, 0), "test user", nil)
+
+		It("forwards the body from the daemon as it arrives", func() {
+			// echo the request body back once we've read all of it
+			makeRequest = func(_ *http.Client, req *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				return &http.Response{
+					StatusCode: 201,
+					Header:     headers,
+					Body:       io.NopCloser(bytes.NewReader(body)),
+				}, nil
+			}
+
+			payload := buildFlowControlActionPayload(make(map[string][]string), requestId, smsg.CurrentSchema, 0, true)
+			_, err := s.Receive(string(stream.StreamStart), payload)
+			Expect(err).To(BeNil())
+
+			for _, chunk := range []string{"hello ", "world"} {
+				input, _ := json.Marshal(stream.KubeStreamInputPayload{RequestId: requestId, Data: []byte(chunk)})
+				_, err = s.Receive(string(stream.StreamInput), input)
+				Expect(err).To(BeNil())
+			}
+			input, _ := json.Marshal(stream.KubeStreamInputPayload{RequestId: requestId, EOF: true})
+			_, err = s.Receive(string(stream.StreamInput), input)
+			Expect(err).To(BeNil())
+
+			By("passing through the API server's status code")
+			var headerMessage smsg.StreamMessage
+			Eventually(outputChan).Should(Receive(&headerMessage))
+			var kubestreamHeadersPayload stream.KubeStreamHeadersPayload
+			contentBytes, _ := base64.StdEncoding.DecodeString(headerMessage.Content)
+			json.Unmarshal(contentBytes, &kubestreamHeadersPayload)
+			Expect(kubestreamHeadersPayload.StatusCode).To(Equal(201))
+
+			var bodyMessage smsg.StreamMessage
+			Eventually(outputChan).Should(Receive(&bodyMessage))
+			contentBytes, _ = base64.StdEncoding.DecodeString(bodyMessage.Content)
+			Expect(string(contentBytes)).To(Equal("hello world"))
+			Eventually(doneChan).Should(BeClosed())
+		})
+	})
 })
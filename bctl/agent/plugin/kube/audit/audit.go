@@ -0,0 +1,225 @@
+/*
+This package emits a Kubernetes audit event (https://kubernetes.io/docs/tasks/debug/debug-cluster/audit/)
+for every request the kube agent makes on a user's behalf, so that BastionZero
+activity can be merged into a cluster's existing audit pipeline.
+
+Events are in the audit.k8s.io/v1 Event format at the Metadata level. The user
+is the BastionZero user who made the request, the impersonated user is the
+target user and groups we made it as, and BastionZero specific details are
+added as annotations. Long-running requests such as watches, execs and port
+forwards get a ResponseStarted event once they've connected as well as a
+ResponseComplete event when they're finished, in the same way as the API server.
+*/
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"bastionzero.com/agent/plugin/kube/requestinfo"
+)
+
+const (
+	apiVersion = "audit.k8s.io/v1"
+	eventKind  = "Event"
+	eventList  = "EventList"
+
+	levelMetadata = "Metadata"
+
+	StageResponseStarted  = "ResponseStarted"
+	StageResponseComplete = "ResponseComplete"
+
+	annotationPrefix = "bastionzero.com/"
+)
+
+// Identity describes who a kube plugin is making requests for and as
+type Identity struct {
+	// Who we impersonate when making the request
+	TargetUser   string
+	TargetGroups []string
+
+	// Identity from the user's verified BZCert
+	Subject string
+	Email   string
+}
+
+type Event struct {
+	Kind                     string            `json:"kind"`
+	APIVersion               string            `json:"apiVersion"`
+	Level                    string            `json:"level"`
+	AuditID                  string            `json:"auditID"`
+	Stage                    string            `json:"stage"`
+	RequestURI               string            `json:"requestURI"`
+	Verb                     string            `json:"verb"`
+	User                     UserInfo          `json:"user"`
+	ImpersonatedUser         *UserInfo         `json:"impersonatedUser,omitempty"`
+	UserAgent                string            `json:"userAgent,omitempty"`
+	ObjectRef                *ObjectReference  `json:"objectRef,omitempty"`
+	ResponseStatus           *Status           `json:"responseStatus,omitempty"`
+	RequestReceivedTimestamp microTime         `json:"requestReceivedTimestamp"`
+	StageTimestamp           microTime         `json:"stageTimestamp"`
+	Annotations              map[string]string `json:"annotations,omitempty"`
+}
+
+type UserInfo struct {
+	Username string              `json:"username,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+type ObjectReference struct {
+	Resource    string `json:"resource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+	APIGroup    string `json:"apiGroup,omitempty"`
+	APIVersion  string `json:"apiVersion,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+}
+
+type Status struct {
+	Code    int    `json:"code,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// microTime marshals the same way as metav1.MicroTime
+type microTime time.Time
+
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func (t microTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).UTC().Format(microTimeFormat))
+}
+
+func (t *microTime) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	parsed, err := time.Parse(microTimeFormat, str)
+	*t = microTime(parsed)
+	return err
+}
+
+// Auditor emits events for all of the requests made by a single kube plugin
+type Auditor struct {
+	sink     Sink
+	identity Identity
+}
+
+// New returns an Auditor for the given identity, or nil if sink is nil so that
+// auditing can be left disabled without any checks at the call sites
+func New(sink Sink, identity Identity) *Auditor {
+	if sink == nil {
+		return nil
+	}
+
+	return &Auditor{
+		sink:     sink,
+		identity: identity,
+	}
+}
+
+// Request tracks a single request from when we received it until we're done
+// responding to it
+type Request struct {
+	sink     Sink
+	event    Event
+	received time.Time
+}
+
+// Start begins auditing a request to the given endpoint. It is safe to call on
+// a nil Auditor, in which case it returns a nil Request which does nothing
+func (a *Auditor) Start(method string, endpoint string, headers map[string][]string, logId string, requestId string) *Request {
+	if a == nil {
+		return nil
+	}
+
+	info := requestinfo.Parse(method, endpoint)
+	received := time.Now()
+
+	var objectRef *ObjectReference
+	if info.IsResourceRequest {
+		objectRef = &ObjectReference{
+			Resource:    info.Resource,
+			Namespace:   info.Namespace,
+			Name:        info.Name,
+			APIGroup:    info.APIGroup,
+			APIVersion:  info.APIVersion,
+			Subresource: info.Subresource,
+		}
+	}
+
+	event := Event{
+		Kind:       eventKind,
+		APIVersion: apiVersion,
+		Level:      levelMetadata,
+		AuditID:    uuid.New().String(),
+		RequestURI: endpoint,
+		Verb:       info.Verb,
+		User: UserInfo{
+			Username: a.identity.Email,
+			Extra: map[string][]string{
+				annotationPrefix + "subject": {a.identity.Subject},
+			},
+		},
+		ImpersonatedUser: &UserInfo{
+			Username: a.identity.TargetUser,
+			Groups:   a.identity.TargetGroups,
+		},
+		UserAgent:                http.Header(headers).Get("User-Agent"),
+		ObjectRef:                objectRef,
+		RequestReceivedTimestamp: microTime(received),
+		Annotations: map[string]string{
+			annotationPrefix + "email":      a.identity.Email,
+			annotationPrefix + "log-id":     logId,
+			annotationPrefix + "request-id": requestId,
+		},
+	}
+
+	return &Request{
+		sink:     a.sink,
+		event:    event,
+		received: received,
+	}
+}
+
+// ResponseStarted records that a long-running request has connected
+func (r *Request) ResponseStarted(code int, err error) {
+	r.emit(StageResponseStarted, code, err)
+}
+
+// ResponseComplete records that we're done with the request. Code should be
+// zero if we never got a response from the API server
+func (r *Request) ResponseComplete(code int, err error) {
+	r.emit(StageResponseComplete, code, err)
+}
+
+func (r *Request) emit(stage string, code int, err error) {
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+
+	event := r.event
+	event.Stage = stage
+	event.StageTimestamp = microTime(now)
+	event.ResponseStatus = &Status{Code: code}
+	if err != nil {
+		event.ResponseStatus.Status = "Failure"
+		event.ResponseStatus.Message = err.Error()
+	}
+
+	event.Annotations = make(map[string]string, len(r.event.Annotations)+1)
+	for key, value := range r.event.Annotations {
+		event.Annotations[key] = value
+	}
+	event.Annotations[annotationPrefix+"latency"] = now.Sub(r.received).String()
+
+	r.sink.Emit(event)
+}
@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+func TestAudit(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Kube Audit Suite")
+}
+
+var _ = Describe("Kube Audit", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	identity := Identity{
+		TargetUser:   "alice",
+		TargetGroups: []string{"developers"},
+		Subject:      "1234",
+		Email:        "alice@example.com",
+	}
+
+	Context("writing events", func() {
+		var output *bytes.Buffer
+		var auditor *Auditor
+
+		BeforeEach(func() {
+			output = &bytes.Buffer{}
+			auditor = New(&writerSink{logger: logger, writer: output}, identity)
+		})
+
+		readEvents := func() []Event {
+			events := []Event{}
+			for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+				Expect(line).To(MatchRegexp(`"stageTimestamp":"\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z"`))
+
+				var event Event
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				events = append(events, event)
+			}
+			return events
+		}
+
+		It("records who made the request, who we made it as, and how it went", func() {
+			headers := map[string][]string{"User-Agent": {"kubectl/v1.26.1"}}
+			auditor.Start("GET", "/api/v1/namespaces/default/secrets/db-password", headers, "lid", "rid").ResponseComplete(http.StatusForbidden, nil)
+
+			events := readEvents()
+			Expect(events).To(HaveLen(1))
+
+			event := events[0]
+			Expect(event.Kind).To(Equal("Event"))
+			Expect(event.APIVersion).To(Equal("audit.k8s.io/v1"))
+			Expect(event.Stage).To(Equal(StageResponseComplete))
+			Expect(event.Verb).To(Equal("get"))
+			Expect(event.User.Username).To(Equal("alice@example.com"))
+			Expect(event.ImpersonatedUser).To(Equal(&UserInfo{Username: "alice", Groups: []string{"developers"}}))
+			Expect(event.UserAgent).To(Equal("kubectl/v1.26.1"))
+			Expect(event.ObjectRef.Resource).To(Equal("secrets"))
+			Expect(event.ResponseStatus.Code).To(Equal(http.StatusForbidden))
+			Expect(event.Annotations).To(HaveKeyWithValue("bastionzero.com/log-id", "lid"))
+			Expect(event.Annotations).To(HaveKey("bastionzero.com/latency"))
+		})
+
+		It("records both stages of a long-running request under one id", func() {
+			request := auditor.Start("GET", "/api/v1/namespaces/default/pods?watch=true", nil, "lid", "rid")
+			request.ResponseStarted(http.StatusOK, nil)
+			request.ResponseComplete(http.StatusOK, nil)
+
+			events := readEvents()
+			Expect(events).To(HaveLen(2))
+			Expect(events[0].Stage).To(Equal(StageResponseStarted))
+			Expect(events[1].Stage).To(Equal(StageResponseComplete))
+			Expect(events[0].AuditID).To(Equal(events[1].AuditID))
+		})
+
+		It("records requests which failed", func() {
+			auditor.Start("GET", "/api/v1/pods", nil, "lid", "rid").ResponseComplete(0, errors.New("connection refused"))
+
+			events := readEvents()
+			Expect(events[0].ResponseStatus.Status).To(Equal("Failure"))
+			Expect(events[0].ResponseStatus.Message).To(Equal("connection refused"))
+		})
+
+		It("does nothing when auditing is disabled", func() {
+			auditor = New(nil, identity)
+			Expect(auditor).To(BeNil())
+			auditor.Start("GET", "/api/v1/pods", nil, "lid", "rid").ResponseComplete(http.StatusOK, nil)
+		})
+	})
+
+	Context("sending events to a webhook", func() {
+		It("posts them as an EventList", func() {
+			var lock sync.Mutex
+			received := []Event{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var list struct {
+					Kind  string  `json:"kind"`
+					Items []Event `json:"items"`
+				}
+				Expect(json.NewDecoder(r.Body).Decode(&list)).To(Succeed())
+				Expect(list.Kind).To(Equal("EventList"))
+
+				lock.Lock()
+				received = append(received, list.Items...)
+				lock.Unlock()
+			}))
+			defer server.Close()
+
+			sink, err := NewSink(logger, server.URL)
+			Expect(err).ToNot(HaveOccurred())
+
+			auditor := New(sink, identity)
+			auditor.Start("GET", "/api/v1/pods", nil, "lid", "rid").ResponseComplete(http.StatusOK, nil)
+			auditor.Start("GET", "/api/v1/services", nil, "lid", "rid").ResponseComplete(http.StatusOK, nil)
+
+			Eventually(func() int {
+				lock.Lock()
+				defer lock.Unlock()
+				return len(received)
+			}).Should(Equal(2))
+		})
+	})
+
+	It("refuses sinks it doesn't understand", func() {
+		_, err := NewSink(logger, "relative/path.log")
+		Expect(err).To(HaveOccurred())
+	})
+})
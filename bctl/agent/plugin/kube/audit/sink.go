@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+const (
+	// how many events we'll hold onto while a webhook is slow or unreachable
+	webhookQueueSize = 1000
+
+	// most events we'll send to a webhook in a single request
+	webhookBatchSize = 100
+
+	webhookTimeout = 10 * time.Second
+)
+
+// Sink is somewhere we send audit events to. Emit must not block the request
+// being audited for long
+type Sink interface {
+	Emit(event Event)
+}
+
+// NewSink parses a sink from the agent's config, which must be one of
+//
+//	stdout                  - one JSON event per line, alongside our logs
+//	/path/to/file           - one JSON event per line, appended to the file
+//	https://example.com/... - batches of events POSTed as an EventList, like
+//	                          the API server's audit webhook backend
+//
+// A nil sink is returned if target is empty, meaning auditing is disabled
+func NewSink(logger *logger.Logger, target string) (Sink, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case target == "stdout":
+		return &writerSink{logger: logger, writer: os.Stdout}, nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		if _, err := url.Parse(target); err != nil {
+			return nil, fmt.Errorf("invalid kube audit webhook url %s: %w", target, err)
+		}
+		return newWebhookSink(logger, target), nil
+	case strings.HasPrefix(target, "/"):
+		if file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+			return nil, fmt.Errorf("failed to open kube audit log %s: %w", target, err)
+		} else {
+			return &writerSink{logger: logger, writer: file}, nil
+		}
+	default:
+		return nil, fmt.Errorf("kube audit sink must be 'stdout', an absolute file path or an http(s) url: %s", target)
+	}
+}
+
+// writerSink writes each event as a line of JSON
+type writerSink struct {
+	lock   sync.Mutex
+	logger *logger.Logger
+	writer io.Writer
+}
+
+func (w *writerSink) Emit(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		w.logger.Errorf("failed to marshal kube audit event: %s", err)
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := w.writer.Write(append(line, '\n')); err != nil {
+		w.logger.Errorf("failed to write kube audit event: %s", err)
+	}
+}
+
+// webhookSink queues events and sends them in the background so that a slow
+// webhook never holds up a kube request
+type webhookSink struct {
+	logger *logger.Logger
+	url    string
+	client *http.Client
+	queue  chan Event
+}
+
+func newWebhookSink(logger *logger.Logger, url string) *webhookSink {
+	w := &webhookSink{
+		logger: logger,
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan Event, webhookQueueSize),
+	}
+	go w.run()
+
+	return w
+}
+
+func (w *webhookSink) Emit(event Event) {
+	select {
+	case w.queue <- event:
+	default:
+		w.logger.Errorf("dropping kube audit event %s for %s, the webhook is not keeping up", event.AuditID, event.RequestURI)
+	}
+}
+
+func (w *webhookSink) run() {
+	for event := range w.queue {
+		batch := []Event{event}
+
+	drain:
+		for len(batch) < webhookBatchSize {
+			select {
+			case event := <-w.queue:
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+
+		if err := w.send(batch); err != nil {
+			w.logger.Errorf("failed to send %d kube audit events: %s", len(batch), err)
+		}
+	}
+}
+
+func (w *webhookSink) send(events []Event) error {
+	body, err := json.Marshal(struct {
+		Kind       string  `json:"kind"`
+		APIVersion string  `json:"apiVersion"`
+		Items      []Event `json:"items"`
+	}{
+		Kind:       eventList,
+		APIVersion: apiVersion,
+		Items:      events,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+/*
+This package knows which Kubernetes API servers a kube agent makes requests to
+and with what credentials. Every kube agent serves its local cluster as its own
+target. That's the cluster it's running in, or for agents running outside of
+it, the one BASTIONZERO_KUBECONFIG points at. It can also serve other clusters
+it can reach, such as vclusters or clusters behind a jump pod, by registering
+each of them as a virtual target and listing them in a file pointed at by
+KUBE_CLUSTERS_CONFIG:
+
+	kubeconfig: /etc/bastionzero/clusters/kubeconfig
+	clusters:
+	  - targetId: 6f3b1c0e-3e1a-4d5b-9c7e-2a8f1d9b0c4a
+	    context: vcluster-dev
+	  - targetId: 0d2c9a71-8b4e-4f6a-a1c3-5e7b9d0f2a68
+	    context: staging
+
+Each entry maps the id of a virtual target to the kubeconfig context whose API
+server and user we should use for it. BastionZero tells us which target it
+authorized each connection for, and datachannels on a virtual target's
+connection are routed to its cluster.
+*/
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	clientcmdlatest "k8s.io/client-go/tools/clientcmd/api/latest"
+)
+
+// Cluster is an API server we make requests to, along with the credentials we
+// make them with. We always impersonate the target user on top of these
+type Cluster struct {
+	// The kubeconfig context we loaded this cluster from, or "in-cluster"
+	Name string
+
+	// The virtual target this cluster is served as, empty for the agent's local
+	// cluster
+	TargetId string
+
+	config *rest.Config
+	client *http.Client
+}
+
+func New(name string, config *rest.Config) (*Cluster, error) {
+	// this is also what client-go uses for its own clients, so it takes care of
+	// verifying the API server and adding (and refreshing) our credentials
+	client, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for the %s cluster: %w", name, err)
+	}
+
+	return &Cluster{
+		Name:   name,
+		config: config,
+		client: client,
+	}, nil
+}
+
+// InCluster loads the cluster the agent is running in, which we talk to as
+// the agent's service account
+func InCluster() (*Cluster, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error getting in-cluster config: %w", err)
+	}
+	return New("in-cluster", config)
+}
+
+// OutOfCluster loads the cluster for an agent that isn't running in it from
+// the kubeconfig at path, using contextName or the kubeconfig's current
+// context if that's empty
+func OutOfCluster(path string, contextName string) (*Cluster, error) {
+	kubeconfig, err := LoadKubeconfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if contextName == "" {
+		if contextName = kubeconfig.CurrentContext; contextName == "" {
+			return nil, fmt.Errorf("kubeconfig %s has no current context, please say which one to use", path)
+		}
+	}
+	return FromKubeconfig(kubeconfig, contextName)
+}
+
+// Host is the URL of the API server that request paths are appended to
+func (c *Cluster) Host() string {
+	return strings.TrimSuffix(c.config.Host, "/")
+}
+
+// Config returns a copy of our config that callers can add impersonation to
+func (c *Cluster) Config() *rest.Config {
+	return rest.CopyConfig(c.config)
+}
+
+// Client makes requests with our credentials. Requests should not have their
+// own Authorization header or ours won't be added
+func (c *Cluster) Client() *http.Client {
+	return c.client
+}
+
+// LoadKubeconfig reads the kubeconfig file at path. Relative paths in the file
+// are resolved against the directory it's in, the same as kubectl does
+func LoadKubeconfig(path string) (*clientcmdapi.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+
+	kubeconfig := clientcmdapi.NewConfig()
+	if len(data) == 0 {
+		return kubeconfig, nil
+	}
+
+	defaultGVK := &schema.GroupVersionKind{Version: clientcmdlatest.Version, Kind: "Config"}
+	if _, _, err := clientcmdlatest.Codec.Decode(data, defaultGVK, kubeconfig); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %w", path, err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(file *string) {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+
+	for _, cluster := range kubeconfig.Clusters {
+		resolve(&cluster.CertificateAuthority)
+	}
+	for _, user := range kubeconfig.AuthInfos {
+		resolve(&user.ClientCertificate)
+		resolve(&user.ClientKey)
+		resolve(&user.TokenFile)
+
+		// bare commands are looked up on our PATH
+		if user.Exec != nil && strings.ContainsRune(user.Exec.Command, filepath.Separator) {
+			resolve(&user.Exec.Command)
+		}
+	}
+
+	return kubeconfig, nil
+}
+
+// FromKubeconfig loads the cluster and user of one of a kubeconfig's contexts.
+// The context's namespace and any impersonation its user is set up for are
+// ignored, since every request says where it's for and who it's made as
+func FromKubeconfig(kubeconfig *clientcmdapi.Config, contextName string) (*Cluster, error) {
+	context, ok := kubeconfig.Contexts[contextName]
+	if !ok {
+		return nil, fmt.Errorf("context %s not found in kubeconfig", contextName)
+	}
+
+	cluster, ok := kubeconfig.Clusters[context.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %s for context %s not found in kubeconfig", context.Cluster, contextName)
+	} else if cluster.Server == "" {
+		return nil, fmt.Errorf("cluster %s for context %s has no server", context.Cluster, contextName)
+	}
+
+	config := &rest.Config{
+		Host: cluster.Server,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure:   cluster.InsecureSkipTLSVerify,
+			ServerName: cluster.TLSServerName,
+			CAFile:     cluster.CertificateAuthority,
+			CAData:     cluster.CertificateAuthorityData,
+		},
+	}
+
+	if cluster.ProxyURL != "" {
+		proxyUrl, err := url.Parse(cluster.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy-url for cluster %s: %w", context.Cluster, err)
+		}
+		config.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	if context.AuthInfo != "" {
+		user, ok := kubeconfig.AuthInfos[context.AuthInfo]
+		if !ok {
+			return nil, fmt.Errorf("user %s for context %s not found in kubeconfig", context.AuthInfo, contextName)
+		}
+
+		config.BearerToken = user.Token
+		config.BearerTokenFile = user.TokenFile
+		config.CertFile = user.ClientCertificate
+		config.CertData = user.ClientCertificateData
+		config.KeyFile = user.ClientKey
+		config.KeyData = user.ClientKeyData
+		config.Username = user.Username
+		config.Password = user.Password
+		config.ExecProvider = user.Exec
+		config.AuthProvider = user.AuthProvider
+	}
+
+	return New(contextName, config)
+}
+
+// Clusters are all of the clusters an agent serves
+type Clusters struct {
+	// the cluster the agent is running in or pointed at, served as the agent's
+	// own target
+	local         *Cluster
+	localTargetId string
+
+	// any other clusters we serve as virtual targets, in the order they're
+	// configured
+	virtual []*Cluster
+}
+
+type clustersConfig struct {
+	Kubeconfig string          `yaml:"kubeconfig"`
+	Clusters   []virtualConfig `yaml:"clusters"`
+}
+
+type virtualConfig struct {
+	TargetId string `yaml:"targetId"`
+	Context  string `yaml:"context"`
+}
+
+// Load returns the clusters an agent registered as targetId serves. If path
+// is empty, that's only its local cluster
+func Load(path string, local *Cluster, targetId string) (*Clusters, error) {
+	clusters := &Clusters{
+		local:         local,
+		localTargetId: targetId,
+	}
+	if path == "" {
+		return clusters, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kube clusters config: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var config clustersConfig
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse kube clusters config: %w", err)
+	} else if config.Kubeconfig == "" {
+		return nil, fmt.Errorf("kube clusters config %s does not say which kubeconfig to use", path)
+	}
+
+	// the kubeconfig is relative to the config that mentions it
+	if !filepath.IsAbs(config.Kubeconfig) {
+		config.Kubeconfig = filepath.Join(filepath.Dir(path), config.Kubeconfig)
+	}
+	kubeconfig, err := LoadKubeconfig(config.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{targetId: true}
+	for i, virtual := range config.Clusters {
+		if virtual.TargetId == "" || virtual.Context == "" {
+			return nil, fmt.Errorf("kube cluster %d needs both a targetId and a context", i+1)
+		} else if seen[virtual.TargetId] {
+			return nil, fmt.Errorf("kube cluster %d has the same targetId as another cluster this agent serves: %s", i+1, virtual.TargetId)
+		}
+		seen[virtual.TargetId] = true
+
+		cluster, err := FromKubeconfig(kubeconfig, virtual.Context)
+		if err != nil {
+			return nil, err
+		}
+		cluster.TargetId = virtual.TargetId
+		clusters.virtual = append(clusters.virtual, cluster)
+	}
+
+	return clusters, nil
+}
+
+// Get returns the cluster that requests for the target with the given id should
+// go to. Older versions of BastionZero don't tell us which target a connection
+// is for, but they only know about the agent's own target so we send those to
+// our cluster
+func (c *Clusters) Get(targetId string) (*Cluster, error) {
+	if c == nil {
+		return nil, fmt.Errorf("this agent is not configured to serve any kube clusters")
+	}
+
+	if targetId == "" || targetId == c.localTargetId {
+		return c.local, nil
+	}
+
+	for _, cluster := range c.virtual {
+		if cluster.TargetId == targetId {
+			return cluster, nil
+		}
+	}
+
+	// an agent that only serves its own cluster has never needed to check
+	if len(c.virtual) == 0 {
+		return c.local, nil
+	}
+	return nil, fmt.Errorf("this agent does not serve kube target %s", targetId)
+}
+
+// ForConnection returns the cluster for a datachannel on a connection that
+// BastionZero opened for connectionTargetId. That's the only thing that decides
+// it, since the daemon could ask for anything. We only check what the daemon
+// asked for, so that it finds out if it's not getting the cluster it expects
+func (c *Clusters) ForConnection(connectionTargetId string, requestedTargetId string) (*Cluster, error) {
+	cluster, err := c.Get(connectionTargetId)
+	if err != nil {
+		return nil, err
+	}
+
+	if requestedTargetId != "" {
+		if requested, err := c.Get(requestedTargetId); err != nil || requested != cluster {
+			return nil, fmt.Errorf("daemon asked for kube target %s on a connection that is not for it", requestedTargetId)
+		}
+	}
+	return cluster, nil
+}
+
+// Local returns the cluster the agent serves as its own target
+func (c *Clusters) Local() *Cluster {
+	if c == nil {
+		return nil
+	}
+	return c.local
+}
+
+// Virtual returns the clusters we serve as virtual targets
+func (c *Clusters) Virtual() []*Cluster {
+	if c == nil {
+		return nil
+	}
+	return c.virtual
+}
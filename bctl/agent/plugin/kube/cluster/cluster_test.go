@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
+)
+
+func TestCluster(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Kube Cluster Suite")
+}
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+  - name: dev
+    cluster:
+      server: %s
+  - name: staging
+    cluster:
+      server: https://staging.example.com:6443/
+      insecure-skip-tls-verify: true
+  - name: prod
+    cluster:
+      server: https://prod.example.com
+      certificate-authority: certs/ca.crt
+users:
+  - name: dev-admin
+    user:
+      token: dev-token
+  - name: staging-admin
+    user:
+      tokenFile: tokens/staging
+  - name: prod-admin
+    user:
+      client-certificate: certs/client.crt
+      client-key: /etc/keys/client.key
+contexts:
+  - name: vcluster-dev
+    context:
+      cluster: dev
+      user: dev-admin
+  - name: staging
+    context:
+      cluster: staging
+      user: staging-admin
+  - name: missing-user
+    context:
+      cluster: dev
+      user: nobody
+`
+
+var _ = Describe("Agent Kube Cluster", func() {
+	var dir string
+	var server *httptest.Server
+	var authorization chan string
+
+	local, _ := New("in-cluster", &rest.Config{Host: "https://10.0.0.1:443"})
+
+	writeFile := func(name string, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		authorization = make(chan string, 1)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization <- r.Header.Get("Authorization")
+		}))
+		writeFile("kubeconfig", fmt.Sprintf(testKubeconfig, server.URL))
+		Expect(os.Mkdir(filepath.Join(dir, "tokens"), 0700)).To(Succeed())
+		writeFile("tokens/staging", "staging-token")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("Loading a kubeconfig", func() {
+		It("resolves relative paths against the kubeconfig's directory", func() {
+			kubeconfig, err := LoadKubeconfig(filepath.Join(dir, "kubeconfig"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(kubeconfig.Clusters["prod"].CertificateAuthority).To(Equal(filepath.Join(dir, "certs/ca.crt")))
+			Expect(kubeconfig.AuthInfos["staging-admin"].TokenFile).To(Equal(filepath.Join(dir, "tokens/staging")))
+			Expect(kubeconfig.AuthInfos["prod-admin"].ClientCertificate).To(Equal(filepath.Join(dir, "certs/client.crt")))
+			Expect(kubeconfig.AuthInfos["prod-admin"].ClientKey).To(Equal("/etc/keys/client.key"))
+		})
+
+		It("makes requests to a context's server with its user's credentials", func() {
+			kubeconfig, err := LoadKubeconfig(filepath.Join(dir, "kubeconfig"))
+			Expect(err).ToNot(HaveOccurred())
+
+			cluster, err := FromKubeconfig(kubeconfig, "vcluster-dev")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Name).To(Equal("vcluster-dev"))
+			Expect(cluster.Host()).To(Equal(server.URL))
+
+			req, _ := http.NewRequest(http.MethodGet, cluster.Host()+"/api", nil)
+			res, err := cluster.Client().Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(<-authorization).To(Equal("Bearer dev-token"))
+		})
+
+		It("refuses contexts it can't use", func() {
+			kubeconfig, err := LoadKubeconfig(filepath.Join(dir, "kubeconfig"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = FromKubeconfig(kubeconfig, "prod")
+			Expect(err).To(MatchError(ContainSubstring("context prod not found")))
+
+			_, err = FromKubeconfig(kubeconfig, "missing-user")
+			Expect(err).To(MatchError(ContainSubstring("user nobody for context missing-user not found")))
+		})
+
+		It("uses the current context for agents running outside of the cluster unless told otherwise", func() {
+			path := filepath.Join(dir, "kubeconfig")
+			_, err := OutOfCluster(path, "")
+			Expect(err).To(MatchError(ContainSubstring("has no current context")))
+
+			cluster, err := OutOfCluster(path, "staging")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Name).To(Equal("staging"))
+
+			writeFile("kubeconfig", fmt.Sprintf(testKubeconfig, server.URL)+"current-context: vcluster-dev\n")
+			cluster, err = OutOfCluster(path, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Host()).To(Equal(server.URL))
+		})
+	})
+
+	Context("Loading the clusters we serve", func() {
+		It("only serves the local cluster if there's no config", func() {
+			clusters, err := Load("", local, "agent-target")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(clusters.Virtual()).To(BeEmpty())
+
+			By("sending every target to the local cluster, since we've never been told about others")
+			for _, targetId := range []string{"", "agent-target", "some-other-target"} {
+				cluster, err := clusters.Get(targetId)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cluster).To(Equal(local))
+			}
+		})
+
+		It("routes virtual targets to their own clusters", func() {
+			path := writeFile("clusters.yaml", `
+kubeconfig: kubeconfig
+clusters:
+  - targetId: dev-target
+    context: vcluster-dev
+  - targetId: staging-target
+    context: staging
+`)
+			clusters, err := Load(path, local, "agent-target")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(clusters.Virtual()).To(HaveLen(2))
+
+			cluster, err := clusters.Get("dev-target")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Name).To(Equal("vcluster-dev"))
+			Expect(cluster.TargetId).To(Equal("dev-target"))
+
+			cluster, err = clusters.Get("staging-target")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Host()).To(Equal("https://staging.example.com:6443"))
+
+			By("sending our own target and older daemons to the local cluster")
+			for _, targetId := range []string{"", "agent-target"} {
+				cluster, err := clusters.Get(targetId)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cluster).To(Equal(local))
+			}
+
+			By("refusing targets we don't serve")
+			_, err = clusters.Get("some-other-target")
+			Expect(err).To(MatchError(ContainSubstring("does not serve kube target some-other-target")))
+
+			By("only going by the target BastionZero opened the connection for")
+			cluster, err = clusters.ForConnection("dev-target", "dev-target")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Name).To(Equal("vcluster-dev"))
+
+			for connectionTargetId, requestedTargetId := range map[string]string{
+				"agent-target": "dev-target",
+				"":             "staging-target",
+				"dev-target":   "agent-target",
+			} {
+				_, err = clusters.ForConnection(connectionTargetId, requestedTargetId)
+				Expect(err).To(MatchError(ContainSubstring("connection that is not for it")))
+			}
+
+			By("letting older daemons use the cluster their connection is for")
+			cluster, err = clusters.ForConnection("staging-target", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.Name).To(Equal("staging"))
+		})
+
+		It("refuses configs it can't use", func() {
+			for config, expected := range map[string]string{
+				"clusters: []":                                      "does not say which kubeconfig to use",
+				"kubeconfig: kubeconfig\nclusterz: []":              "field clusterz not found",
+				"kubeconfig: kubeconfig\nclusters: [{targetId: a}]": "needs both a targetId and a context",
+				"kubeconfig: kubeconfig\nclusters: [{targetId: agent-target, context: staging}]":                            "same targetId",
+				"kubeconfig: kubeconfig\nclusters: [{targetId: a, context: staging}, {targetId: a, context: vcluster-dev}]": "same targetId",
+				"kubeconfig: kubeconfig\nclusters: [{targetId: a, context: prod}]":                                          "context prod not found",
+				"kubeconfig: missing\nclusters: []":                                                                         "failed to read kubeconfig",
+			} {
+				_, err := Load(writeFile("clusters.yaml", config), local, "agent-target")
+				Expect(err).To(MatchError(ContainSubstring(expected)), config)
+			}
+		})
+	})
+})
@@ -0,0 +1,276 @@
+/*
+This package lets the kube agent refuse requests before it makes them, as
+defense in depth on top of whatever RBAC allows the impersonated user. Rules
+are read from the policy.yaml key of a ConfigMap in the agent's namespace,
+which we watch so that changes take effect without restarting the agent:
+
+	deny:
+	  - reason: developers can't read secrets
+	    groups: [developers]
+	    verbs: [get, list, watch]
+	    resources: [secrets]
+	  - reason: nobody execs into production
+	    namespaces: ["prod-*"]
+	    resources: [pods/exec, pods/attach]
+
+A request is denied if it matches every field set on any rule. Fields match
+if any of their values match, and values may be glob patterns as understood by
+path.Match. Users and groups are the target user and groups the request would
+be made as. Resources are written the same way as in RBAC rules, so "pods" does
+not cover "pods/exec", and "*" covers every resource and subresource.
+
+If the ConfigMap does not exist every request is allowed, and if it cannot be
+parsed every request is denied until it is fixed.
+*/
+package filter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"bastionzero.com/agent/plugin/kube/requestinfo"
+	"bastionzero.com/bzerolib/logger"
+)
+
+const (
+	// the ConfigMap key we read our policy from
+	PolicyKey = "policy.yaml"
+
+	// how long we'll wait to load the ConfigMap at startup
+	syncTimeout = 30 * time.Second
+)
+
+type Policy struct {
+	Deny []Rule `yaml:"deny"`
+}
+
+type Rule struct {
+	// Returned to the user when this rule denies their request
+	Reason string `yaml:"reason"`
+
+	Verbs      []string `yaml:"verbs"`
+	Resources  []string `yaml:"resources"`
+	Namespaces []string `yaml:"namespaces"`
+	Users      []string `yaml:"users"`
+	Groups     []string `yaml:"groups"`
+}
+
+// Parse reads a policy, refusing any fields or patterns we don't understand so
+// that a typo can't quietly disable a rule
+func Parse(data string) (*Policy, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.KnownFields(true)
+
+	var policy Policy
+	if err := decoder.Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse kube request filter: %w", err)
+	}
+
+	for i, rule := range policy.Deny {
+		for _, patterns := range [][]string{rule.Verbs, rule.Resources, rule.Namespaces, rule.Users, rule.Groups} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern %q in kube request filter rule %d: %w", pattern, i+1, err)
+				}
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// Evaluate returns an error if a request made as user and groups is denied by
+// any of our rules
+func (p *Policy) Evaluate(info requestinfo.RequestInfo, user string, groups []string) error {
+	resource := info.Resource
+	if info.Subresource != "" {
+		resource += "/" + info.Subresource
+	}
+
+	for i, rule := range p.Deny {
+		if matchesAny(rule.Verbs, info.Verb) &&
+			matchesResource(rule.Resources, info, resource) &&
+			matchesAny(rule.Namespaces, info.Namespace) &&
+			matchesAny(rule.Users, user) &&
+			matchesAnyOf(rule.Groups, groups) {
+
+			reason := rule.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("rule %d", i+1)
+			}
+			return fmt.Errorf("denied by kube request filter: %s", reason)
+		}
+	}
+
+	return nil
+}
+
+// matchesAny returns true if there are no patterns, or if any of them match
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyOf returns true if there are no patterns, or if any of them match
+// any of the values
+func matchesAnyOf(patterns []string, values []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		if matchesAny(patterns, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesResource(patterns []string, info requestinfo.RequestInfo, resource string) bool {
+	if len(patterns) == 0 {
+		return true
+	} else if !info.IsResourceRequest {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		} else if matched, _ := path.Match(pattern, resource); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter holds the latest policy from the ConfigMap we're watching
+type Filter struct {
+	logger *logger.Logger
+	name   string
+
+	lock   sync.RWMutex
+	policy *Policy
+
+	// set while the ConfigMap can't be used, in which case we deny everything
+	err error
+}
+
+func newFilter(logger *logger.Logger, name string) *Filter {
+	return &Filter{
+		logger: logger,
+		name:   name,
+		err:    fmt.Errorf("the %s ConfigMap has not been loaded yet", name),
+	}
+}
+
+// Watch loads our policy from the named ConfigMap and keeps it up to date until
+// ctx is cancelled. It fails if we can't list the ConfigMap within a reasonable
+// time, which usually means the agent's service account isn't allowed to read it
+func Watch(ctx context.Context, logger *logger.Logger, kubeConfig *rest.Config, namespace string, name string) (*Filter, error) {
+	// agents running outside of the cluster have no namespace of their own
+	if namespace == "" {
+		return nil, fmt.Errorf("no namespace to read the %s ConfigMap from, please set NAMESPACE", name)
+	}
+
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating new config: %w", err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metaV1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	f := newFilter(logger, name)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    f.update,
+		UpdateFunc: func(_, obj interface{}) { f.update(obj) },
+		DeleteFunc: func(_ interface{}) { f.update(nil) },
+	})
+	factory.Start(ctx.Done())
+
+	syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("timed out loading the %s ConfigMap, make sure the agent's service account can list and watch configmaps in the %s namespace", name, namespace)
+	}
+
+	// we won't be told about a ConfigMap that doesn't exist
+	if obj, exists, err := informer.GetStore().GetByKey(namespace + "/" + name); err != nil {
+		return nil, fmt.Errorf("failed to read the %s ConfigMap: %w", name, err)
+	} else if exists {
+		f.update(obj)
+	} else {
+		f.update(nil)
+	}
+
+	return f, nil
+}
+
+// update replaces our policy with the one in obj, which is nil if the ConfigMap
+// has been deleted
+func (f *Filter) update(obj interface{}) {
+	var policy *Policy
+	var err error
+
+	if configMap, ok := obj.(*coreV1.ConfigMap); ok {
+		policy, err = Parse(configMap.Data[PolicyKey])
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.policy, f.err = policy, err
+	if err != nil {
+		f.logger.Errorf("Denying all kube requests until the %s ConfigMap is fixed: %s", f.name, err)
+	} else if policy == nil {
+		f.logger.Infof("The %s ConfigMap does not exist, no kube requests will be filtered", f.name)
+	} else {
+		f.logger.Infof("Loaded %d kube request filter rules from the %s ConfigMap", len(policy.Deny), f.name)
+	}
+}
+
+// Evaluate returns an error if a request made as user and groups should not be
+// made. It is safe to call on a nil Filter, which allows everything
+func (f *Filter) Evaluate(info requestinfo.RequestInfo, user string, groups []string) error {
+	if f == nil {
+		return nil
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.err != nil {
+		return fmt.Errorf("denied by kube request filter: %w", f.err)
+	} else if f.policy == nil {
+		return nil
+	}
+	return f.policy.Evaluate(info, user, groups)
+}
@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	coreV1 "k8s.io/api/core/v1"
+
+	"bastionzero.com/agent/plugin/kube/requestinfo"
+	"bastionzero.com/bzerolib/logger"
+)
+
+func TestFilter(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Kube Request Filter Suite")
+}
+
+const testPolicy = `
+deny:
+  - reason: developers can't read secrets
+    groups: [developers]
+    verbs: [get, list, watch]
+    resources: [secrets]
+  - reason: nobody execs into production
+    namespaces: ["prod-*"]
+    resources: [pods/exec, pods/attach]
+  - users: ["contractor-*"]
+    resources: ["*"]
+    verbs: [delete, deletecollection]
+`
+
+var _ = Describe("Kube Request Filter", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	configMap := func(policy string) *coreV1.ConfigMap {
+		return &coreV1.ConfigMap{Data: map[string]string{PolicyKey: policy}}
+	}
+
+	var filter *Filter
+
+	BeforeEach(func() {
+		filter = newFilter(logger, "bzero-kube-filter")
+	})
+
+	evaluate := func(method string, endpoint string, user string, groups ...string) error {
+		return filter.Evaluate(requestinfo.Parse(method, endpoint), user, groups)
+	}
+
+	It("denies everything until the ConfigMap has been loaded", func() {
+		Expect(evaluate("GET", "/api/v1/namespaces/default/pods", "alice")).ToNot(Succeed())
+	})
+
+	It("allows everything if there is no ConfigMap", func() {
+		filter.update(nil)
+		Expect(evaluate("GET", "/api/v1/namespaces/default/secrets/db", "alice", "developers")).To(Succeed())
+	})
+
+	When("the ConfigMap has a policy", func() {
+		BeforeEach(func() {
+			filter.update(configMap(testPolicy))
+		})
+
+		It("denies requests matching a rule, with its reason", func() {
+			err := evaluate("GET", "/api/v1/namespaces/default/secrets/db", "alice", "system:authenticated", "developers")
+			Expect(err).To(MatchError(ContainSubstring("developers can't read secrets")))
+
+			err = evaluate("GET", "/api/v1/secrets?watch=true", "alice", "developers")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("allows requests which only match part of a rule", func() {
+			Expect(evaluate("GET", "/api/v1/namespaces/default/secrets/db", "alice", "admins")).To(Succeed())
+			Expect(evaluate("DELETE", "/api/v1/namespaces/default/secrets/db", "alice", "developers")).To(Succeed())
+		})
+
+		It("matches subresources the same way as RBAC", func() {
+			Expect(evaluate("POST", "/api/v1/namespaces/prod-eu/pods/web-0/exec?command=sh", "alice")).ToNot(Succeed())
+			Expect(evaluate("GET", "/api/v1/namespaces/prod-eu/pods/web-0", "alice")).To(Succeed())
+			Expect(evaluate("POST", "/api/v1/namespaces/staging/pods/web-0/exec?command=sh", "alice")).To(Succeed())
+
+			err := evaluate("DELETE", "/api/v1/namespaces/default/pods/web-0/ephemeralcontainers", "contractor-bob")
+			Expect(err).To(MatchError(ContainSubstring("rule 3")))
+		})
+
+		It("doesn't apply resource rules to non-resource urls", func() {
+			Expect(evaluate("DELETE", "/healthz", "contractor-bob")).To(Succeed())
+		})
+
+		It("picks up changes to the ConfigMap", func() {
+			filter.update(configMap("deny: []\n"))
+			Expect(evaluate("GET", "/api/v1/namespaces/default/secrets/db", "alice", "developers")).To(Succeed())
+		})
+
+		It("stops filtering once the ConfigMap is deleted", func() {
+			filter.update(nil)
+			Expect(evaluate("POST", "/api/v1/namespaces/prod-eu/pods/web-0/exec", "alice")).To(Succeed())
+		})
+	})
+
+	When("the ConfigMap is malformed", func() {
+		It("denies everything when it isn't YAML", func() {
+			filter.update(configMap("deny: ["))
+			Expect(evaluate("GET", "/api/v1/namespaces/default/pods", "alice")).ToNot(Succeed())
+		})
+
+		It("denies everything when a field is misspelt", func() {
+			filter.update(configMap("deny:\n  - resource: [secrets]\n"))
+			Expect(evaluate("GET", "/api/v1/namespaces/default/pods", "alice")).ToNot(Succeed())
+		})
+
+		It("denies everything when a pattern is invalid", func() {
+			filter.update(configMap("deny:\n  - namespaces: [\"[\"]\n"))
+			Expect(evaluate("GET", "/api/v1/namespaces/default/pods", "alice")).ToNot(Succeed())
+		})
+	})
+
+	It("allows everything when filtering is disabled", func() {
+		var disabled *Filter
+		Expect(disabled.Evaluate(requestinfo.Parse("GET", "/api/v1/secrets"), "alice", nil)).To(Succeed())
+	})
+})
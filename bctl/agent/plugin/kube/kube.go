@@ -3,17 +3,26 @@ package kube
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"net/http"
 	"strings"
 
-	kuberest "k8s.io/client-go/rest"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/plugin/kube/actions/exec"
 	"bastionzero.com/agent/plugin/kube/actions/portforward"
 	"bastionzero.com/agent/plugin/kube/actions/restapi"
 	"bastionzero.com/agent/plugin/kube/actions/stream"
+	"bastionzero.com/agent/plugin/kube/audit"
+	"bastionzero.com/agent/plugin/kube/cluster"
+	"bastionzero.com/agent/plugin/kube/filter"
+	"bastionzero.com/agent/plugin/kube/requestinfo"
 	"bastionzero.com/bzerolib/logger"
 	bzkube "bastionzero.com/bzerolib/plugin/kube"
+	bzexec "bastionzero.com/bzerolib/plugin/kube/actions/exec"
+	bzportforward "bastionzero.com/bzerolib/plugin/kube/actions/portforward"
+	bzrestapi "bastionzero.com/bzerolib/plugin/kube/actions/restapi"
+	bzstream "bastionzero.com/bzerolib/plugin/kube/actions/stream"
 	smsg "bastionzero.com/bzerolib/stream/message"
 )
 
@@ -29,10 +38,15 @@ type KubePlugin struct {
 	streamOutputChan chan smsg.StreamMessage
 	action           IKubeAction
 
-	serviceAccountToken string
-	kubeHost            string
-	targetUser          string
-	targetGroups        []string
+	cluster      *cluster.Cluster
+	targetUser   string
+	targetGroups []string
+
+	// optional, refuses requests before we make them if set
+	filter *filter.Filter
+
+	// emits audit events for our requests, nil if auditing is disabled
+	auditor *audit.Auditor
 }
 
 func New(
@@ -40,6 +54,8 @@ func New(
 	ch chan smsg.StreamMessage,
 	action string,
 	payload []byte,
+	pluginConfig pluginconfig.PluginConfig,
+	session pluginconfig.Session,
 ) (*KubePlugin, error) {
 
 	// Unmarshal the Syn payload
@@ -48,41 +64,45 @@ func New(
 		return nil, fmt.Errorf("malformed Kube plugin SYN payload %v", string(payload))
 	}
 
-	// First load in our Kube variables
-	config, err := kuberest.InClusterConfig()
+	// First figure out which cluster we're talking to
+	kubeCluster, err := pluginConfig.KubeClusters.ForConnection(pluginConfig.TargetId, synPayload.TargetId)
 	if err != nil {
-		cerr := fmt.Errorf("error getting incluser config: %s", err)
-		logger.Error(cerr)
-		return nil, cerr
+		logger.Error(err)
+		return nil, err
 	}
-
-	serviceAccountToken := config.BearerToken
-	kubeHost := "https://" + os.Getenv("KUBERNETES_SERVICE_HOST")
+	logger.Infof("Kube plugin connecting to the %s cluster", kubeCluster.Name)
 
 	plugin := &KubePlugin{
-		logger:              logger,
-		doneChan:            make(chan struct{}),
-		streamOutputChan:    ch,
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		targetUser:          synPayload.TargetUser,
-		targetGroups:        synPayload.TargetGroups,
+		logger:           logger,
+		doneChan:         make(chan struct{}),
+		streamOutputChan: ch,
+		cluster:          kubeCluster,
+		targetUser:       synPayload.TargetUser,
+		targetGroups:     synPayload.TargetGroups,
+		filter:           pluginConfig.KubeFilter,
 	}
 
+	plugin.auditor = audit.New(pluginConfig.KubeAudit, audit.Identity{
+		TargetUser:   synPayload.TargetUser,
+		TargetGroups: synPayload.TargetGroups,
+		Subject:      session.Subject,
+		Email:        session.Email,
+	})
+
 	// Start up the action for this plugin
 	subLogger := plugin.logger.GetActionLogger(action)
 	if parsedAction, err := parseAction(action); err != nil {
 		return nil, err
 	} else {
 		switch parsedAction {
-		case bzkube.Exec:
-			plugin.action = exec.New(subLogger, ch, plugin.doneChan, serviceAccountToken, kubeHost, synPayload.TargetGroups, synPayload.TargetUser)
+		case bzkube.Exec, bzkube.Attach:
+			plugin.action = exec.New(subLogger, ch, plugin.doneChan, parsedAction, kubeCluster, synPayload.TargetGroups, synPayload.TargetUser, pluginConfig.KubeRecording, session, plugin.auditor)
 		case bzkube.PortForward:
-			plugin.action = portforward.New(subLogger, ch, plugin.doneChan, serviceAccountToken, kubeHost, synPayload.TargetGroups, synPayload.TargetUser)
+			plugin.action = portforward.New(subLogger, ch, plugin.doneChan, kubeCluster, synPayload.TargetGroups, synPayload.TargetUser, plugin.auditor)
 		case bzkube.RestApi:
-			plugin.action = restapi.New(subLogger, plugin.doneChan, serviceAccountToken, kubeHost, synPayload.TargetGroups, synPayload.TargetUser)
+			plugin.action = restapi.New(subLogger, plugin.doneChan, kubeCluster, synPayload.TargetGroups, synPayload.TargetUser, plugin.auditor)
 		case bzkube.Stream:
-			plugin.action = stream.New(subLogger, ch, plugin.doneChan, serviceAccountToken, kubeHost, synPayload.TargetGroups, synPayload.TargetUser)
+			plugin.action = stream.New(subLogger, ch, plugin.doneChan, kubeCluster, synPayload.TargetGroups, synPayload.TargetUser, plugin.auditor)
 		default:
 			return nil, fmt.Errorf("unhandled Kube action")
 		}
@@ -102,9 +122,22 @@ func (k *KubePlugin) Kill() {
 	}
 }
 
+// SynAckPayload tells the daemon which of our newer features it can use
+func (k *KubePlugin) SynAckPayload() []byte {
+	payload, _ := json.Marshal(bzkube.KubeSynAckPayload{
+		StreamBodies: true,
+		Attach:       true,
+	})
+	return payload
+}
+
 func (k *KubePlugin) Receive(action string, actionPayload []byte) ([]byte, error) {
 	k.logger.Debugf("Kube plugin received message with %s action", action)
 
+	if payload, denied, err := k.filterRequest(action, actionPayload); denied {
+		return payload, err
+	}
+
 	if payload, err := k.action.Receive(action, actionPayload); err != nil {
 		return []byte{}, err
 	} else {
@@ -112,6 +145,68 @@ func (k *KubePlugin) Receive(action string, actionPayload []byte) ([]byte, error
 	}
 }
 
+// filterRequest checks the request an action is about to make against the
+// agent's kube request filter. If it's denied, we audit it as forbidden and
+// return what we should respond with instead of passing it to the action
+func (k *KubePlugin) filterRequest(action string, actionPayload []byte) ([]byte, bool, error) {
+	if k.filter == nil {
+		return nil, false, nil
+	}
+
+	// only these start a request, everything else is about one that's already
+	// been allowed. Exec and port forward requests are always POSTs
+	var request struct {
+		Endpoint  string              `json:"endpoint"`
+		Method    string              `json:"method"`
+		Headers   map[string][]string `json:"headers"`
+		RequestId string              `json:"requestId"`
+		LogId     string              `json:"logId"`
+	}
+	switch action {
+	case string(bzrestapi.RestRequest), string(bzstream.StreamStart), string(bzexec.ExecStart), string(bzportforward.StartPortForward):
+		if err := json.Unmarshal(actionPayload, &request); err != nil {
+			// let the action report the malformed payload
+			return nil, false, nil
+		} else if request.Method == "" {
+			request.Method = http.MethodPost
+		}
+	default:
+		return nil, false, nil
+	}
+
+	info := requestinfo.Parse(request.Method, request.Endpoint)
+	err := k.filter.Evaluate(info, k.targetUser, k.targetGroups)
+	if err == nil {
+		return nil, false, nil
+	}
+
+	k.logger.Errorf("Refusing to %s %s: %s", request.Method, request.Endpoint, err)
+	k.auditor.Start(request.Method, request.Endpoint, request.Headers, request.LogId, request.RequestId).ResponseComplete(http.StatusForbidden, err)
+
+	if action != string(bzrestapi.RestRequest) {
+		return []byte{}, true, err
+	}
+
+	// rest api requests get a response kubectl understands, and they're over
+	// once they've been answered
+	defer close(k.doneChan)
+
+	status, _ := json.Marshal(metaV1.Status{
+		TypeMeta: metaV1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metaV1.StatusFailure,
+		Message:  err.Error(),
+		Reason:   metaV1.StatusReasonForbidden,
+		Code:     http.StatusForbidden,
+	})
+	response, _ := json.Marshal(bzrestapi.KubeRestApiActionResponsePayload{
+		StatusCode: http.StatusForbidden,
+		RequestId:  request.RequestId,
+		Headers:    map[string][]string{"Content-Type": {"application/json"}},
+		Content:    status,
+	})
+	return response, true, nil
+}
+
 func parseAction(action string) (bzkube.KubeAction, error) {
 	parsedAction := strings.Split(action, "/")
 	if len(parsedAction) < 2 {
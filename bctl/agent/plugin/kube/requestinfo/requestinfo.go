@@ -0,0 +1,113 @@
+// This package works out what a kube API request is doing from its method and
+// endpoint, following the same rules as the API server, so that we can audit
+// and filter requests the same way Kubernetes would
+package requestinfo
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type RequestInfo struct {
+	// False for non-resource URLs like /healthz, in which case only Verb is set
+	IsResourceRequest bool
+
+	// The lowercased method for non-resource requests
+	Verb string
+
+	APIGroup    string
+	APIVersion  string
+	Namespace   string
+	Resource    string
+	Subresource string
+	Name        string
+}
+
+// Parse returns what the request to endpoint is doing. Requests we can't parse
+// are treated as non-resource requests
+func Parse(method string, endpoint string) RequestInfo {
+	nonResource := RequestInfo{Verb: strings.ToLower(method)}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nonResource
+	}
+
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+
+	info := RequestInfo{IsResourceRequest: true}
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		info.APIVersion = parts[1]
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		info.APIGroup = parts[1]
+		info.APIVersion = parts[2]
+		parts = parts[3:]
+	default:
+		return nonResource
+	}
+
+	// deprecated watch endpoints look like /api/v1/watch/namespaces/default/pods
+	isWatch := false
+	if len(parts) > 0 && parts[0] == "watch" {
+		isWatch = true
+		parts = parts[1:]
+	}
+
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		info.Namespace = parts[1]
+
+		// a namespace on its own is the namespace object
+		if len(parts) == 2 {
+			parts = []string{"namespaces", info.Namespace}
+		} else {
+			parts = parts[2:]
+		}
+	}
+
+	if len(parts) == 0 {
+		return nonResource
+	}
+
+	info.Resource = parts[0]
+	if len(parts) > 1 {
+		info.Name = parts[1]
+	}
+	if len(parts) > 2 {
+		info.Subresource = parts[2]
+	}
+
+	if watch := parsed.Query().Get("watch"); watch == "true" || watch == "1" {
+		isWatch = true
+	}
+
+	info.Verb = resourceVerb(method, info.Name, isWatch)
+	return info
+}
+
+func resourceVerb(method string, name string, isWatch bool) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if isWatch {
+			return "watch"
+		} else if name == "" {
+			return "list"
+		}
+		return "get"
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		if name == "" {
+			return "deletecollection"
+		}
+		return "delete"
+	default:
+		return strings.ToLower(method)
+	}
+}
@@ -0,0 +1,38 @@
+package requestinfo
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRequestInfo(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Kube Request Info Suite")
+}
+
+var _ = Describe("Kube Request Info", func() {
+	DescribeTable("works out the verb and object",
+		func(method string, endpoint string, expected RequestInfo) {
+			Expect(Parse(method, endpoint)).To(Equal(expected))
+		},
+		Entry("get", "GET", "/api/v1/namespaces/default/secrets/db-password",
+			RequestInfo{IsResourceRequest: true, Verb: "get", APIVersion: "v1", Namespace: "default", Resource: "secrets", Name: "db-password"}),
+		Entry("list across namespaces", "GET", "/apis/apps/v1/deployments?limit=500",
+			RequestInfo{IsResourceRequest: true, Verb: "list", APIGroup: "apps", APIVersion: "v1", Resource: "deployments"}),
+		Entry("watch", "GET", "/api/v1/namespaces/default/pods?watch=true",
+			RequestInfo{IsResourceRequest: true, Verb: "watch", APIVersion: "v1", Namespace: "default", Resource: "pods"}),
+		Entry("deprecated watch", "GET", "/api/v1/watch/namespaces/default/pods",
+			RequestInfo{IsResourceRequest: true, Verb: "watch", APIVersion: "v1", Namespace: "default", Resource: "pods"}),
+		Entry("exec", "POST", "/api/v1/namespaces/default/pods/web-0/exec?command=sh&stdin=true",
+			RequestInfo{IsResourceRequest: true, Verb: "create", APIVersion: "v1", Namespace: "default", Resource: "pods", Name: "web-0", Subresource: "exec"}),
+		Entry("a namespace", "DELETE", "/api/v1/namespaces/staging",
+			RequestInfo{IsResourceRequest: true, Verb: "delete", APIVersion: "v1", Namespace: "staging", Resource: "namespaces", Name: "staging"}),
+		Entry("a collection", "DELETE", "/api/v1/namespaces/default/pods",
+			RequestInfo{IsResourceRequest: true, Verb: "deletecollection", APIVersion: "v1", Namespace: "default", Resource: "pods"}),
+		Entry("a patch", "PATCH", "/apis/apps/v1/namespaces/default/deployments/web/scale",
+			RequestInfo{IsResourceRequest: true, Verb: "patch", APIGroup: "apps", APIVersion: "v1", Namespace: "default", Resource: "deployments", Name: "web", Subresource: "scale"}),
+		Entry("a non-resource url", "GET", "/version", RequestInfo{Verb: "get"}),
+	)
+})
@@ -3,11 +3,14 @@ package defaultshell
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"time"
 
+	"bastionzero.com/agent/localpolicy"
 	"bastionzero.com/agent/plugin/shell/actions/defaultshell/pseudoterminal"
+	"bastionzero.com/agent/plugin/shell/actions/defaultshell/restrictedterminal"
 	"bastionzero.com/bzerolib/logger"
 	bzshell "bastionzero.com/bzerolib/plugin/shell"
 	"bastionzero.com/bzerolib/ringbuffer"
@@ -56,6 +59,15 @@ type IPseudoTerminal interface {
 	Kill()
 }
 
+// ISessionRecorder persists everything that happens in the shell so that it
+// can be replayed later
+type ISessionRecorder interface {
+	Input(data []byte)
+	Output(data []byte)
+	Resize(cols, rows uint32)
+	Close() error
+}
+
 type DefaultShell struct {
 	logger *logger.Logger
 
@@ -70,20 +82,32 @@ type DefaultShell struct {
 
 	// interface for interacting with pty
 	terminal IPseudoTerminal
+
+	// optional, records the session if set
+	recorder ISessionRecorder
+
+	// optional, limits what the user can run if set
+	restriction *localpolicy.ShellRestriction
 }
 
-// New returns a new instance of the DefaultShell
+// New returns a new instance of the DefaultShell. The recorder may be nil if
+// the session should not be recorded, and the restriction may be nil if the
+// user should get a normal login shell
 func New(
 	logger *logger.Logger,
 	ch chan smsg.StreamMessage,
 	doneChan chan struct{},
-	runAsUser string) *DefaultShell {
+	runAsUser string,
+	recorder ISessionRecorder,
+	restriction *localpolicy.ShellRestriction) *DefaultShell {
 	return &DefaultShell{
 		logger:               logger,
 		runAsUser:            runAsUser,
 		doneChan:             doneChan,
 		streamOutputChan:     ch,
 		streamSequenceNumber: 1,
+		recorder:             recorder,
+		restriction:          restriction,
 	}
 }
 
@@ -95,6 +119,12 @@ func (d *DefaultShell) Kill() {
 		// Wait for done channel to be closed by writePump
 		<-d.doneChan
 	}
+
+	if d.recorder != nil {
+		if err := d.recorder.Close(); err != nil {
+			d.logger.Errorf("failed to close session recording: %s", err)
+		}
+	}
 }
 
 // Receive takes input from a client using the MrTAP datachannel and returns output via the MrTAP datachannel
@@ -167,7 +197,7 @@ func (d *DefaultShell) open() error {
 		return fmt.Errorf("attempted to start the shell but a call to open a shell has already been made")
 	}
 
-	if terminal, err := NewPseudoTerminal(d.logger, d.runAsUser, ""); err != nil {
+	if terminal, err := d.newTerminal(); err != nil {
 		return err
 	} else {
 		d.terminal = terminal
@@ -178,6 +208,22 @@ func (d *DefaultShell) open() error {
 	return nil
 }
 
+func (d *DefaultShell) newTerminal() (IPseudoTerminal, error) {
+	switch {
+	case d.restriction == nil:
+		return NewPseudoTerminal(d.logger, d.runAsUser, "")
+	case d.restriction.ForceCommand != "":
+		d.logger.Infof("Running forced command for restricted user %s", d.runAsUser)
+		return NewPseudoTerminal(d.logger, d.runAsUser, d.restriction.ForceCommand)
+	default:
+		d.logger.Infof("Starting restricted terminal for %s", d.runAsUser)
+		start := func(command string) (restrictedterminal.Terminal, error) {
+			return NewPseudoTerminal(d.logger, d.runAsUser, command)
+		}
+		return restrictedterminal.New(d.logger, d.restriction.Allow, start), nil
+	}
+}
+
 // writeToTerminal passes payload byte stream to shell stdin
 func (d *DefaultShell) writeToTerminal(keystrokes []byte) error {
 	if d.terminal == nil {
@@ -186,6 +232,9 @@ func (d *DefaultShell) writeToTerminal(keystrokes []byte) error {
 		d.logger.Errorf("Unable to write to stdin: %s", err)
 		return err
 	} else {
+		if d.recorder != nil {
+			d.recorder.Input(keystrokes)
+		}
 		return nil
 	}
 }
@@ -199,6 +248,9 @@ func (d *DefaultShell) setSize(cols, rows uint32) error {
 	} else if err := d.terminal.SetSize(cols, rows); err != nil {
 		return err
 	} else {
+		if d.recorder != nil {
+			d.recorder.Resize(cols, rows)
+		}
 		return nil
 	}
 }
@@ -224,12 +276,19 @@ func (d *DefaultShell) writePump() {
 			d.sendStreamMessage(smsg.Stop, []byte{})
 			return
 		default:
-			if stdoutBytesLen, err := stdOut.Read(stdoutBuff); err != nil {
+			var violation *restrictedterminal.Violation
+			if stdoutBytesLen, err := stdOut.Read(stdoutBuff); errors.As(err, &violation) {
+				// the user is still connected, they just can't run that
+				d.sendStreamMessage(smsg.Error, []byte(violation.Error()))
+			} else if err != nil {
 				d.sendStreamMessage(smsg.Stop, stdoutBuff[:stdoutBytesLen])
 				d.logger.Errorf("error reading from stdout: %s", err)
 				return
 			} else {
 				d.ringBuffer.Write(stdoutBuff[:stdoutBytesLen])
+				if d.recorder != nil {
+					d.recorder.Output(stdoutBuff[:stdoutBytesLen])
+				}
 				d.sendStreamMessage(smsg.StdOut, stdoutBuff[:stdoutBytesLen])
 			}
 
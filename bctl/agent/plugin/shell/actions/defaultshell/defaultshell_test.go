@@ -11,6 +11,7 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"bastionzero.com/agent/localpolicy"
 	"bastionzero.com/agent/plugin/shell/actions/defaultshell/pseudoterminal"
 	"bastionzero.com/bzerolib/logger"
 	bzshell "bastionzero.com/bzerolib/plugin/shell"
@@ -33,7 +34,7 @@ var _ = Describe("Default Shell", Ordered, func() {
 
 	mockPT := createPseudoTerminal()
 
-	shell := New(logger, streamMessageChan, doneChan, runAsUser)
+	shell := New(logger, streamMessageChan, doneChan, runAsUser, nil, nil)
 
 	Context("Happy Path", func() {
 
@@ -95,6 +96,40 @@ var _ = Describe("Default Shell", Ordered, func() {
 			<-mockPT.Done()
 		})
 	})
+
+	Context("Restricted Shell", func() {
+
+		It("tells the Daemon when the user runs something they aren't allowed to", func() {
+			restrictedStreamMessageChan := make(chan smsg.StreamMessage, 100)
+			restrictedDoneChan := make(chan struct{})
+			restriction := &localpolicy.ShellRestriction{Allow: []string{"/usr/bin/uptime"}}
+			restrictedShell := New(logger, restrictedStreamMessageChan, restrictedDoneChan, runAsUser, nil, restriction)
+
+			By("starting without error")
+			actionPayload, _ := json.Marshal(bzshell.ShellOpenMessage{})
+			_, err := restrictedShell.Receive(string(bzshell.ShellOpen), actionPayload)
+			Expect(err).To(BeNil())
+
+			By("sending an error stream message for a command that isn't allowed")
+			actionPayload, _ = json.Marshal(bzshell.ShellInputMessage{Data: []byte("bash\r")})
+			_, err = restrictedShell.Receive(string(bzshell.ShellInput), actionPayload)
+			Expect(err).To(BeNil())
+
+			var msg smsg.StreamMessage
+			Eventually(func() smsg.StreamType {
+				msg = <-restrictedStreamMessageChan
+				return msg.Type
+			}).Should(Equal(smsg.Error))
+
+			content, err := base64.StdEncoding.DecodeString(string(msg.Content))
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(ContainSubstring("not on this session's allow list"))
+
+			By("closing when it's told to")
+			_, err = restrictedShell.Receive(string(bzshell.ShellClose), []byte{})
+			Expect(err).To(BeNil())
+		})
+	})
 })
 
 func setMakePseudoTerminal(mockPT pseudoterminal.MockPseudoTerminal) {
@@ -20,25 +20,21 @@
 package pseudoterminal
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"runtime"
 	"strings"
-	"syscall"
 
+	"bastionzero.com/agent/plugin/shell/actions/runas"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/unix/unixuser"
 	"github.com/creack/pty"
 )
 
 const (
-	termEnvVariable     = "TERM=xterm-256color"
-	langEnvVariable     = "LANG=C.UTF-8"
-	langEnvVariableKey  = "LANG"
-	defaultShellCommand = "sh"
-	homeEnvVariableName = "HOME="
+	termEnvVariable = "TERM=xterm-256color"
 )
 
 type PseudoTerminal struct {
@@ -53,14 +49,8 @@ func New(logger *logger.Logger, runAsUser *unixuser.UnixUser, commandstr string)
 	logger.Info("Starting up pseudo terminal")
 
 	// Attempt to get default shell to use for the runAsUser
-	var shellCommand string
-	if runAsUser.Shell != "" {
-		shellCommand = runAsUser.Shell
-		logger.Infof("Found preferred shell for %s: %s", runAsUser.Username, shellCommand)
-	} else {
-		logger.Infof("%s does not have a preferred shell, falling back on default: %s", runAsUser.Username, defaultShellCommand)
-		shellCommand = defaultShellCommand
-	}
+	shellCommand := runas.Shell(runAsUser)
+	logger.Infof("Using %s as the shell for %s", shellCommand, runAsUser.Username)
 
 	if cmd, err := buildCommand(runAsUser, commandstr, shellCommand); err != nil {
 		return nil, err
@@ -94,6 +84,7 @@ func New(logger *logger.Logger, runAsUser *unixuser.UnixUser, commandstr string)
 
 func buildCommand(runAsUser *unixuser.UnixUser, customCommand string, shellCommand string) (*exec.Cmd, error) {
 	var cmd *exec.Cmd
+	var err error
 
 	if strings.TrimSpace(customCommand) == "" {
 		// if customCommand not provided then default to launching an interactive login shell
@@ -101,55 +92,19 @@ func buildCommand(runAsUser *unixuser.UnixUser, customCommand string, shellComma
 		// Add --login option to shell command so that this is a login shell and
 		// will source shell profile dot files automatically
 		// https://unix.stackexchange.com/a/46856
-		cmd = exec.Command(shellCommand, "-l")
+		cmd, err = runas.Command(context.Background(), runAsUser, shellCommand, "-l")
 	} else {
 		// else if customCommand is provided then run the command in a shell with the -c option
-		commandArgs := []string{"-c", customCommand}
-		cmd = exec.Command(shellCommand, commandArgs...)
+		cmd, err = runas.Command(context.Background(), runAsUser, shellCommand, "-c", customCommand)
 	}
 
-	// TERM is set as linux by pty which has an issue where vi editor screen does not get cleared.
-	// Setting TERM as xterm-256color as used by standard terminals to fix this issue
-	cmd.Env = append(os.Environ(), termEnvVariable)
-
-	// If LANG environment variable is not set, shell defaults to POSIX which can contain 256 single-byte characters.
-	// Setting C.UTF-8 as default LANG environment variable as Session Manager supports UTF-8 encoding only.
-	langEnvVariableValue := os.Getenv(langEnvVariableKey)
-	if langEnvVariableValue == "" {
-		cmd.Env = append(cmd.Env, langEnvVariable)
-	}
-
-	gids, err := runAsUser.GroupIds()
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve users group ids: %s", err)
-	}
-
-	usr, err := unixuser.Current()
 	if err != nil {
 		return nil, err
 	}
 
-	// Only set groups if agent is running as root and this is a linux machine
-	isRootOnLinux := usr.Uid == 0 && runtime.GOOS == "linux"
-
-	// run command as user
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid:    runAsUser.Uid,
-			Gid:    runAsUser.Gid,
-			Groups: gids,
-
-			// Setting supplementary group IDs is a privileged action only the root user can do.
-			// if this is set to true, users may have to use sudo to run commands they should have access to
-			NoSetGroups: !isRootOnLinux,
-		},
-	}
-
-	// Setting home environment variable for RunAs user
-	cmd.Env = append(cmd.Env, homeEnvVariableName+runAsUser.HomeDir)
-
-	// Setting cwd of the command to be the user's home directory
-	cmd.Dir = runAsUser.HomeDir
+	// TERM is set as linux by pty which has an issue where vi editor screen does not get cleared.
+	// Setting TERM as xterm-256color as used by standard terminals to fix this issue
+	cmd.Env = append(cmd.Env, termEnvVariable)
 
 	return cmd, nil
 }
@@ -0,0 +1,65 @@
+package restrictedterminal
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// AllowList decides whether a command line only runs an allowed binary
+type AllowList struct {
+	// allowed binaries, keyed by both their full path and their name
+	allowed map[string]string
+}
+
+func NewAllowList(allow []string) AllowList {
+	allowed := make(map[string]string)
+	for _, binary := range allow {
+		binary = path.Clean(binary)
+		allowed[binary] = binary
+		allowed[path.Base(binary)] = binary
+	}
+
+	return AllowList{allowed: allowed}
+}
+
+// Command returns the command to start, quoted for the shell, or why we won't
+func (a AllowList) Command(line string) (string, *Violation) {
+	if i := strings.IndexAny(line, shellMetacharacters); i >= 0 {
+		return "", &Violation{Command: line, Reason: fmt.Sprintf("%q is not allowed in restricted sessions", line[i])}
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "", &Violation{Command: line, Reason: "no command given"}
+	}
+
+	binary, ok := a.allowed[args[0]]
+	if !ok {
+		// relative paths can't sneak past us by naming an allowed binary
+		binary, ok = a.allowed[path.Clean(args[0])]
+		if !ok || !path.IsAbs(args[0]) {
+			return "", &Violation{Command: line, Reason: fmt.Sprintf("%s is not on this session's allow list", args[0])}
+		}
+	}
+
+	quoted := []string{"'" + binary + "'"}
+	for _, arg := range args[1:] {
+		quoted = append(quoted, "'"+arg+"'")
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// Binaries returns the full path of every allowed binary
+func (a AllowList) Binaries() []string {
+	binaries := []string{}
+	for name, binary := range a.allowed {
+		if name == binary {
+			binaries = append(binaries, binary)
+		}
+	}
+	sort.Strings(binaries)
+
+	return binaries
+}
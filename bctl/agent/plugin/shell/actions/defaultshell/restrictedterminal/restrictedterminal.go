@@ -0,0 +1,308 @@
+/*
+This package wraps a pseudo terminal so that a user can only run the binaries on
+an allow list. Rather than giving the user a real shell, we give them a minimal
+prompt of our own: we do the line editing, check the command they enter against
+the allow list and only then start it in its own pseudo terminal. Once it exits
+they get our prompt back.
+
+Commands are only ever a binary followed by plain arguments; we refuse anything
+with quotes, globs, redirection, variables or any other character a shell would
+interpret, so there's no way to smuggle a second command past the allow list.
+*/
+package restrictedterminal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+const (
+	prompt = "$ "
+
+	// any of these would let the user do more than run the binary they named
+	shellMetacharacters = "`$;&|<>(){}[]*?~!#\\'\""
+
+	ctrlC     = 0x03
+	ctrlD     = 0x04
+	backspace = 0x08
+	escape    = 0x1b
+	del       = 0x7f
+)
+
+// Terminal is everything our caller needs from a pseudo terminal, so that we
+// can stand in for one
+type Terminal interface {
+	StdIn() io.Writer
+	StdOut() io.Reader
+	SetSize(cols, rows uint32) error
+	Done() <-chan struct{}
+	Kill()
+}
+
+// StartFunc starts the given command line in a new pseudo terminal
+type StartFunc func(command string) (Terminal, error)
+
+// Violation is returned from our StdOut when the user tried to run something
+// they aren't allowed to. It doesn't end the session, they can carry on reading
+type Violation struct {
+	Command string
+	Reason  string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("%s: %s", v.Command, v.Reason)
+}
+
+type chunk struct {
+	data      []byte
+	violation *Violation
+}
+
+type RestrictedTerminal struct {
+	logger *logger.Logger
+	start  StartFunc
+
+	allowed AllowList
+
+	stateLock  sync.Mutex
+	line       []byte
+	inEscape   bool
+	child      Terminal
+	cols, rows uint32
+
+	output   chan chunk
+	leftover []byte
+
+	doneChan chan struct{}
+	doneOnce sync.Once
+}
+
+func New(logger *logger.Logger, allow []string, start StartFunc) *RestrictedTerminal {
+	t := &RestrictedTerminal{
+		logger:   logger,
+		start:    start,
+		allowed:  NewAllowList(allow),
+		output:   make(chan chunk, 64),
+		doneChan: make(chan struct{}),
+	}
+
+	t.write([]byte("This session is restricted. Type 'help' to see what you can run.\r\n" + prompt))
+	return t
+}
+
+func (t *RestrictedTerminal) StdIn() io.Writer {
+	return stdIn{t}
+}
+
+func (t *RestrictedTerminal) StdOut() io.Reader {
+	return stdOut{t}
+}
+
+func (t *RestrictedTerminal) SetSize(cols, rows uint32) error {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	t.cols, t.rows = cols, rows
+	if t.child != nil {
+		return t.child.SetSize(cols, rows)
+	}
+	return nil
+}
+
+func (t *RestrictedTerminal) Done() <-chan struct{} {
+	return t.doneChan
+}
+
+func (t *RestrictedTerminal) Kill() {
+	// we have to be done before we take the stateLock: whoever holds it may be
+	// stuck sending output that nobody is going to read
+	t.exit()
+
+	t.stateLock.Lock()
+	child := t.child
+	t.child = nil
+	t.stateLock.Unlock()
+
+	if child != nil {
+		child.Kill()
+	}
+}
+
+func (t *RestrictedTerminal) exit() {
+	t.doneOnce.Do(func() {
+		close(t.doneChan)
+	})
+}
+
+// write queues output for our reader, unless we're already done
+func (t *RestrictedTerminal) write(data []byte) {
+	t.send(chunk{data: data})
+}
+
+func (t *RestrictedTerminal) send(c chunk) {
+	select {
+	case t.output <- c:
+	case <-t.doneChan:
+	}
+}
+
+type stdIn struct {
+	t *RestrictedTerminal
+}
+
+func (s stdIn) Write(p []byte) (int, error) {
+	t := s.t
+
+	t.stateLock.Lock()
+	if child := t.child; child != nil {
+		// whatever's running gets our input untouched
+		t.stateLock.Unlock()
+		return child.StdIn().Write(p)
+	}
+	defer t.stateLock.Unlock()
+
+	for _, b := range p {
+		t.keypress(b)
+	}
+	return len(p), nil
+}
+
+// keypress does our line editing; it must be called with the stateLock held
+func (t *RestrictedTerminal) keypress(b byte) {
+	// skip over escape sequences such as the arrow keys; we don't do history
+	if t.inEscape {
+		if b != '[' && b >= 0x40 && b <= 0x7e {
+			t.inEscape = false
+		}
+		return
+	}
+
+	switch b {
+	case escape:
+		t.inEscape = true
+	case '\r', '\n':
+		line := strings.TrimSpace(string(t.line))
+		t.line = t.line[:0]
+		t.write([]byte("\r\n"))
+		t.run(line)
+	case backspace, del:
+		if len(t.line) > 0 {
+			t.line = t.line[:len(t.line)-1]
+			t.write([]byte("\b \b"))
+		}
+	case ctrlC:
+		t.line = t.line[:0]
+		t.write([]byte("^C\r\n" + prompt))
+	case ctrlD:
+		if len(t.line) == 0 {
+			t.write([]byte("\r\n"))
+			t.exit()
+		}
+	default:
+		if b >= 0x20 {
+			t.line = append(t.line, b)
+			t.write([]byte{b})
+		}
+	}
+}
+
+// run checks the line against our allow list and starts it if it passes; it
+// must be called with the stateLock held
+func (t *RestrictedTerminal) run(line string) {
+	switch line {
+	case "":
+		t.write([]byte(prompt))
+		return
+	case "exit", "logout":
+		t.exit()
+		return
+	case "help":
+		t.write([]byte("You may run:\r\n  " + strings.Join(t.allowed.Binaries(), "\r\n  ") + "\r\n" + prompt))
+		return
+	}
+
+	command, violation := t.allowed.Command(line)
+	if violation != nil {
+		t.logger.Infof("Refused to run restricted command: %s", violation)
+		t.send(chunk{violation: violation})
+		t.write([]byte(prompt))
+		return
+	}
+
+	t.logger.Infof("Running restricted command: %s", command)
+	child, err := t.start(command)
+	if err != nil {
+		t.send(chunk{violation: &Violation{Command: line, Reason: fmt.Sprintf("failed to start: %s", err)}})
+		t.write([]byte(prompt))
+		return
+	}
+
+	if t.cols != 0 && t.rows != 0 {
+		if err := child.SetSize(t.cols, t.rows); err != nil {
+			t.logger.Errorf("failed to size restricted command's terminal: %s", err)
+		}
+	}
+
+	t.child = child
+	go t.pump(child)
+}
+
+// pump relays the child's output until it exits and then gives the user our
+// prompt back
+func (t *RestrictedTerminal) pump(child Terminal) {
+	buf := make([]byte, 1024)
+	stdOut := child.StdOut()
+	for {
+		n, err := stdOut.Read(buf)
+		if n > 0 {
+			t.write(append([]byte{}, buf[:n]...))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-child.Done():
+	case <-t.doneChan:
+		return
+	}
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if t.child == child {
+		t.child = nil
+		t.write([]byte("\r\n" + prompt))
+	}
+}
+
+type stdOut struct {
+	t *RestrictedTerminal
+}
+
+// Read returns our output or, if the user tried to run something they
+// shouldn't have, a *Violation
+func (s stdOut) Read(p []byte) (int, error) {
+	t := s.t
+
+	if len(t.leftover) == 0 {
+		select {
+		case c := <-t.output:
+			if c.violation != nil {
+				return 0, c.violation
+			}
+			t.leftover = c.data
+		case <-t.doneChan:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, t.leftover)
+	t.leftover = t.leftover[n:]
+	return n, nil
+}
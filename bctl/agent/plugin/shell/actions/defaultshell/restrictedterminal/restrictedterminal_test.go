@@ -0,0 +1,174 @@
+package restrictedterminal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+func TestRestrictedTerminal(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Restricted Terminal Suite")
+}
+
+// fakeCommand stands in for a pseudo terminal running an allowed command. It
+// echoes its input and exits when it reads a newline
+type fakeCommand struct {
+	reader   *io.PipeReader
+	writer   *io.PipeWriter
+	doneChan chan struct{}
+	once     sync.Once
+}
+
+func newFakeCommand() *fakeCommand {
+	reader, writer := io.Pipe()
+	return &fakeCommand{reader: reader, writer: writer, doneChan: make(chan struct{})}
+}
+
+func (f *fakeCommand) Write(p []byte) (int, error) {
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		f.writer.Write(p[:i])
+		f.Kill()
+		return len(p), nil
+	}
+	return f.writer.Write(p)
+}
+
+func (f *fakeCommand) StdIn() io.Writer                { return f }
+func (f *fakeCommand) StdOut() io.Reader               { return f.reader }
+func (f *fakeCommand) SetSize(cols, rows uint32) error { return nil }
+func (f *fakeCommand) Done() <-chan struct{}           { return f.doneChan }
+func (f *fakeCommand) Kill() {
+	f.once.Do(func() {
+		f.writer.Close()
+		close(f.doneChan)
+	})
+}
+
+var _ = Describe("Restricted Terminal", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var terminal *RestrictedTerminal
+	var started []string
+	var output *bytes.Buffer
+	var outputLock sync.Mutex
+	var violations chan *Violation
+
+	BeforeEach(func() {
+		started = []string{}
+		start := func(command string) (Terminal, error) {
+			started = append(started, command)
+			return newFakeCommand(), nil
+		}
+		terminal = New(logger, []string{"/opt/scripts/deploy.sh", "/usr/bin/uptime"}, start)
+
+		// read everything the user would see, the same way the default shell does
+		output = &bytes.Buffer{}
+		violations = make(chan *Violation, 10)
+		go func(stdOut io.Reader, output *bytes.Buffer, violations chan *Violation) {
+			buf := make([]byte, 1024)
+			for {
+				n, err := stdOut.Read(buf)
+				var violation *Violation
+				if errors.As(err, &violation) {
+					violations <- violation
+				} else if err != nil {
+					return
+				}
+				outputLock.Lock()
+				output.Write(buf[:n])
+				outputLock.Unlock()
+			}
+		}(terminal.StdOut(), output, violations)
+
+		DeferCleanup(func() {
+			terminal.Kill()
+		})
+	})
+
+	typeLine := func(line string) {
+		_, err := terminal.StdIn().Write([]byte(line + "\r"))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	It("runs allowed binaries by name or full path", func() {
+		typeLine("deploy.sh prod")
+		Eventually(func() []string { return started }).Should(Equal([]string{"'/opt/scripts/deploy.sh' 'prod'"}))
+
+		// the fake command exits when it gets a newline
+		terminal.StdIn().Write([]byte("\n"))
+		Eventually(func() bool {
+			terminal.stateLock.Lock()
+			defer terminal.stateLock.Unlock()
+			return terminal.child == nil
+		}).Should(BeTrue())
+
+		typeLine("/usr/bin/uptime")
+		Eventually(func() []string { return started }).Should(HaveLen(2))
+		Expect(started[1]).To(Equal("'/usr/bin/uptime'"))
+	})
+
+	It("refuses binaries which aren't on the allow list", func() {
+		typeLine("bash")
+		Eventually(violations).Should(Receive(HaveField("Reason", ContainSubstring("not on this session's allow list"))))
+		Expect(started).To(BeEmpty())
+	})
+
+	It("refuses relative paths to allowed binaries", func() {
+		typeLine("./deploy.sh")
+		Eventually(violations).Should(Receive())
+		Expect(started).To(BeEmpty())
+	})
+
+	It("refuses shell metacharacters", func() {
+		for _, line := range []string{"deploy.sh; bash", "uptime && bash", "deploy.sh $(bash)", "deploy.sh `bash`", "uptime > /etc/passwd", "deploy.sh 'x"} {
+			typeLine(line)
+			Eventually(violations).Should(Receive())
+		}
+		Expect(started).To(BeEmpty())
+	})
+
+	It("lets the user edit the line before running it", func() {
+		terminal.StdIn().Write([]byte("bash\x7f\x7f\x7f\x7fuptime\x1b[A\r"))
+		Eventually(func() []string { return started }).Should(Equal([]string{"'/usr/bin/uptime'"}))
+	})
+
+	It("lists what the user can run", func() {
+		typeLine("help")
+		read := func() string {
+			outputLock.Lock()
+			defer outputLock.Unlock()
+			return output.String()
+		}
+		Eventually(read).Should(And(ContainSubstring("/opt/scripts/deploy.sh"), ContainSubstring("/usr/bin/uptime")))
+		Expect(strings.Count(read(), "/usr/bin/uptime")).To(Equal(1))
+	})
+
+	It("ends the session when the user exits", func() {
+		typeLine("exit")
+		Eventually(terminal.Done()).Should(BeClosed())
+	})
+
+	It("can be killed while nobody is reading its output", func() {
+		unread := New(logger, []string{"/usr/bin/uptime"}, nil)
+
+		// every keypress is echoed, so this fills up the output and blocks
+		go unread.StdIn().Write(bytes.Repeat([]byte("a"), 1000))
+		Eventually(func() int { return len(unread.output) }).Should(Equal(cap(unread.output)))
+
+		killed := make(chan struct{})
+		go func() {
+			unread.Kill()
+			close(killed)
+		}()
+		Eventually(killed).Should(BeClosed())
+	})
+})
@@ -0,0 +1,98 @@
+//go:build unix
+
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may not
+// use this file except in compliance with the License. A copy of the
+// License is located at
+//
+// http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// This code has been modified from the code covered by the Apache License 2.0.
+// Modifications Copyright (C) 2023 BastionZero Inc.  The BastionZero Agent
+// is licensed under the Apache 2.0 License.
+
+/*
+This package builds commands which run as another user on the target, in their
+home directory and with their groups, for the shell plugin's actions.
+*/
+package runas
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"bastionzero.com/bzerolib/unix/unixuser"
+)
+
+const (
+	langEnvVariable     = "LANG=C.UTF-8"
+	langEnvVariableKey  = "LANG"
+	defaultShellCommand = "sh"
+	homeEnvVariableName = "HOME="
+)
+
+// Shell returns the user's preferred shell or, if they don't have one, sh
+func Shell(runAsUser *unixuser.UnixUser) string {
+	if runAsUser.Shell != "" {
+		return runAsUser.Shell
+	}
+	return defaultShellCommand
+}
+
+// Command returns a command which will run as the given user and be killed
+// when the context is done
+func Command(ctx context.Context, runAsUser *unixuser.UnixUser, name string, args ...string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = os.Environ()
+
+	// If LANG environment variable is not set, shell defaults to POSIX which can contain 256 single-byte characters.
+	// Setting C.UTF-8 as default LANG environment variable as Session Manager supports UTF-8 encoding only.
+	langEnvVariableValue := os.Getenv(langEnvVariableKey)
+	if langEnvVariableValue == "" {
+		cmd.Env = append(cmd.Env, langEnvVariable)
+	}
+
+	gids, err := runAsUser.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve users group ids: %s", err)
+	}
+
+	usr, err := unixuser.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only set groups if agent is running as root and this is a linux machine
+	isRootOnLinux := usr.Uid == 0 && runtime.GOOS == "linux"
+
+	// run command as user
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    runAsUser.Uid,
+			Gid:    runAsUser.Gid,
+			Groups: gids,
+
+			// Setting supplementary group IDs is a privileged action only the root user can do.
+			// if this is set to true, users may have to use sudo to run commands they should have access to
+			NoSetGroups: !isRootOnLinux,
+		},
+	}
+
+	// Setting home environment variable for RunAs user
+	cmd.Env = append(cmd.Env, homeEnvVariableName+runAsUser.HomeDir)
+
+	// Setting cwd of the command to be the user's home directory
+	cmd.Dir = runAsUser.HomeDir
+
+	return cmd, nil
+}
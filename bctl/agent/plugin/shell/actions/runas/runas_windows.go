@@ -0,0 +1,19 @@
+//go:build windows
+
+package runas
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"bastionzero.com/bzerolib/unix/unixuser"
+)
+
+func Shell(runAsUser *unixuser.UnixUser) string {
+	return ""
+}
+
+func Command(ctx context.Context, runAsUser *unixuser.UnixUser, name string, args ...string) (*exec.Cmd, error) {
+	return nil, fmt.Errorf("operation not supported yet on windows")
+}
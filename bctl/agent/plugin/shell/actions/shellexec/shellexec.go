@@ -0,0 +1,329 @@
+package shellexec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"bastionzero.com/agent/localpolicy"
+	"bastionzero.com/agent/plugin/shell/actions/defaultshell/restrictedterminal"
+	"bastionzero.com/agent/plugin/shell/actions/runas"
+	"bastionzero.com/bzerolib/logger"
+	bzshell "bastionzero.com/bzerolib/plugin/shell"
+	smsg "bastionzero.com/bzerolib/stream/message"
+	"bastionzero.com/bzerolib/unix/unixuser"
+)
+
+// ShellExec - Runs a single command as the target user without a pty, for automation rather than people. Implements IShellAction.
+//
+//     shell/exec/start - starts the command, optionally with a timeout
+//     shell/exec/input - writes to the command's stdin and optionally closes it
+//
+// The command's stdout and stderr are streamed back separately as StdOut and
+// StdErr stream messages. Once both are closed and the command has exited, we
+// send a final Stop stream message whose content is a ShellExecExitMessage.
+
+// for testing purposes this needs to be a variable so that we can overwrite it
+var NewCommand = func(ctx context.Context, runAsUser string, command string) (*exec.Cmd, error) {
+	// Create will create the user with the given username if it is allowed, or it will return the existing user
+	if usr, err := unixuser.LookupOrCreateFromList(runAsUser); err != nil {
+		return nil, fmt.Errorf("failed to log in as user %s: %w", runAsUser, err)
+	} else {
+		return runas.Command(ctx, usr, runas.Shell(usr), "-c", command)
+	}
+}
+
+const (
+	streamDataPayloadSize = 1024
+
+	// what timeout(1) exits with, so that scripts can tell we killed it
+	timedOutExitCode = 124
+
+	waitDelay = 5 * time.Second
+)
+
+// ISessionRecorder persists everything that goes in and out of the command
+type ISessionRecorder interface {
+	Input(data []byte)
+	Output(data []byte)
+	Close() error
+}
+
+type ShellExec struct {
+	logger *logger.Logger
+
+	runAsUser        string
+	doneChan         chan struct{}
+	streamOutputChan chan smsg.StreamMessage
+
+	// stdout and stderr are copied separately, so we need to take turns sending
+	streamLock           sync.Mutex
+	streamSequenceNumber int
+	streamMessageVersion smsg.SchemaVersion
+
+	// optional, records the session if set
+	recorder ISessionRecorder
+
+	// optional, limits what the user can run if set
+	restriction *localpolicy.ShellRestriction
+
+	// we're killed from a different goroutine than the one that starts the command
+	cmdLock sync.Mutex
+	cmd     *exec.Cmd
+	stdIn   io.WriteCloser
+	cancel  context.CancelFunc
+	killed  bool
+}
+
+// New returns a new instance of ShellExec. The recorder may be nil if the
+// session should not be recorded, and the restriction may be nil if the user
+// may run whatever they like
+func New(
+	logger *logger.Logger,
+	ch chan smsg.StreamMessage,
+	doneChan chan struct{},
+	runAsUser string,
+	recorder ISessionRecorder,
+	restriction *localpolicy.ShellRestriction) *ShellExec {
+	return &ShellExec{
+		logger:               logger,
+		runAsUser:            runAsUser,
+		doneChan:             doneChan,
+		streamOutputChan:     ch,
+		streamSequenceNumber: 1,
+		recorder:             recorder,
+		restriction:          restriction,
+	}
+}
+
+func (s *ShellExec) Kill() {
+	s.cmdLock.Lock()
+	cmd, cancel, killed := s.cmd, s.cancel, s.killed
+	s.killed = true
+	s.cmdLock.Unlock()
+
+	if cmd != nil {
+		cancel()
+
+		// Wait for done channel to be closed once the command has been reaped
+		<-s.doneChan
+	} else if !killed {
+		// there's no command to close the done channel for us
+		if s.recorder != nil {
+			if err := s.recorder.Close(); err != nil {
+				s.logger.Errorf("failed to close session recording: %s", err)
+			}
+		}
+		close(s.doneChan)
+	}
+}
+
+func (s *ShellExec) Receive(action string, actionPayload []byte) ([]byte, error) {
+	s.logger.Infof("Plugin received Data message with %v action", action)
+
+	switch bzshell.ShellSubAction(action) {
+	case bzshell.ShellExecStart:
+		var execStart bzshell.ShellExecStartMessage
+		if err := json.Unmarshal(actionPayload, &execStart); err != nil {
+			rerr := fmt.Errorf("malformed shell exec start payload: %s %+v", err, actionPayload)
+			s.logger.Error(rerr)
+			return []byte{}, rerr
+		}
+		s.streamMessageVersion = execStart.StreamMessageVersion
+
+		if err := s.start(execStart); err != nil {
+			s.logger.Error(err)
+			return []byte{}, err
+		}
+	case bzshell.ShellExecInput:
+		var execInput bzshell.ShellExecInputMessage
+		if err := json.Unmarshal(actionPayload, &execInput); err != nil {
+			rerr := fmt.Errorf("malformed shell exec input payload: %s %+v", err, actionPayload)
+			s.logger.Error(rerr)
+			return []byte{}, rerr
+		}
+
+		if err := s.writeToStdIn(execInput); err != nil {
+			s.logger.Error(err)
+			return []byte{}, err
+		}
+	case bzshell.ShellClose:
+		s.Kill()
+	default:
+		return []byte{}, fmt.Errorf("unrecognized shell exec action received: %s", action)
+	}
+
+	return []byte{}, nil
+}
+
+func (s *ShellExec) start(execStart bzshell.ShellExecStartMessage) error {
+	s.cmdLock.Lock()
+	defer s.cmdLock.Unlock()
+
+	if s.killed {
+		return fmt.Errorf("attempted to start a command after being killed")
+	} else if s.cmd != nil {
+		return fmt.Errorf("attempted to start a command but one has already been started")
+	}
+
+	command, err := s.restrict(execStart.Command)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if execStart.TimeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(execStart.TimeoutSeconds)*time.Second)
+	}
+
+	cmd, err := NewCommand(ctx, s.runAsUser, command)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	stdIn, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to open command's stdin: %s", err)
+	}
+	cmd.Stdout = &streamWriter{s: s, streamType: smsg.StdOut}
+	cmd.Stderr = &streamWriter{s: s, streamType: smsg.StdErr}
+
+	// if the command leaves something running which holds onto its stdout or
+	// stderr, don't wait forever for them to close once it's exited
+	cmd.WaitDelay = waitDelay
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start command: %s", err)
+	}
+	s.logger.Infof("Started command as %s", s.runAsUser)
+
+	s.cmd = cmd
+	s.stdIn = stdIn
+	s.cancel = cancel
+
+	go s.wait(ctx, cancel, cmd)
+	return nil
+}
+
+// restrict returns the command to run, if the user is allowed to run it
+func (s *ShellExec) restrict(command string) (string, error) {
+	if s.restriction == nil {
+		return command, nil
+	} else if s.restriction.ForceCommand != "" {
+		return "", fmt.Errorf("%s may only run their forced command", s.runAsUser)
+	} else if allowed, violation := restrictedterminal.NewAllowList(s.restriction.Allow).Command(command); violation != nil {
+		return "", violation
+	} else {
+		return allowed, nil
+	}
+}
+
+func (s *ShellExec) writeToStdIn(execInput bzshell.ShellExecInputMessage) error {
+	s.cmdLock.Lock()
+	stdIn := s.stdIn
+	s.cmdLock.Unlock()
+
+	if stdIn == nil {
+		return fmt.Errorf("could not process input; no command has been started")
+	}
+
+	if len(execInput.Data) > 0 {
+		if _, err := stdIn.Write(execInput.Data); err != nil {
+			return fmt.Errorf("unable to write to stdin: %s", err)
+		} else if s.recorder != nil {
+			s.recorder.Input(execInput.Data)
+		}
+	}
+
+	if execInput.EOF {
+		if err := stdIn.Close(); err != nil {
+			return fmt.Errorf("unable to close stdin: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// wait sends the command's exit code once it has exited and we've sent all of
+// its output
+func (s *ShellExec) wait(ctx context.Context, cancel context.CancelFunc, cmd *exec.Cmd) {
+	defer close(s.doneChan)
+	defer func() {
+		if s.recorder != nil {
+			if err := s.recorder.Close(); err != nil {
+				s.logger.Errorf("failed to close session recording: %s", err)
+			}
+		}
+	}()
+
+	waitErr := cmd.Wait()
+	exit := bzshell.ShellExecExitMessage{
+		ExitCode: cmd.ProcessState.ExitCode(),
+		TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+	}
+
+	if exit.TimedOut {
+		exit.ExitCode = timedOutExitCode
+	} else if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		// follow the shell's convention for commands killed by a signal
+		exit.ExitCode = 128 + int(status.Signal())
+	}
+
+	var exitError *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitError) {
+		exit.Error = waitErr.Error()
+	}
+
+	s.logger.Infof("Command exited with exit code %d", exit.ExitCode)
+	cancel()
+
+	content, _ := json.Marshal(exit)
+	s.sendStreamMessage(smsg.Stop, content, false)
+}
+
+// streamWriter sends everything the command writes to stdout or stderr as
+// stream messages of that type
+type streamWriter struct {
+	s          *ShellExec
+	streamType smsg.StreamType
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.s.recorder != nil {
+		w.s.recorder.Output(p)
+	}
+
+	for start := 0; start < len(p); start += streamDataPayloadSize {
+		end := start + streamDataPayloadSize
+		if end > len(p) {
+			end = len(p)
+		}
+		w.s.sendStreamMessage(w.streamType, p[start:end], true)
+	}
+	return len(p), nil
+}
+
+func (s *ShellExec) sendStreamMessage(streamType smsg.StreamType, content []byte, more bool) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+
+	s.streamOutputChan <- smsg.StreamMessage{
+		SchemaVersion:  s.streamMessageVersion,
+		Action:         "shell/" + string(bzshell.Exec),
+		Type:           streamType,
+		SequenceNumber: s.streamSequenceNumber,
+		More:           more,
+		Content:        base64.StdEncoding.EncodeToString(content),
+	}
+	s.streamSequenceNumber++
+}
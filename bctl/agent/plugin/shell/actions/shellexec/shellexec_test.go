@@ -0,0 +1,163 @@
+package shellexec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os/exec"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/agent/localpolicy"
+	"bastionzero.com/bzerolib/logger"
+	bzshell "bastionzero.com/bzerolib/plugin/shell"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestShellExec(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Shell Exec Suite")
+}
+
+var _ = Describe("Shell Exec", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var shellExec *ShellExec
+	var streamMessageChan chan smsg.StreamMessage
+	var doneChan chan struct{}
+	var started []string
+
+	// run commands as ourselves, since we can't switch users in a test
+	NewCommand = func(ctx context.Context, runAsUser string, command string) (*exec.Cmd, error) {
+		started = append(started, command)
+		return exec.CommandContext(ctx, "sh", "-c", command), nil
+	}
+
+	BeforeEach(func() {
+		started = []string{}
+		streamMessageChan = make(chan smsg.StreamMessage, 100)
+		doneChan = make(chan struct{})
+		shellExec = New(logger, streamMessageChan, doneChan, "test", nil, nil)
+	})
+
+	start := func(command string, timeoutSeconds int) error {
+		payload, _ := json.Marshal(bzshell.ShellExecStartMessage{Command: command, TimeoutSeconds: timeoutSeconds})
+		_, err := shellExec.Receive(string(bzshell.ShellExecStart), payload)
+		return err
+	}
+
+	input := func(data string, eof bool) {
+		payload, _ := json.Marshal(bzshell.ShellExecInputMessage{Data: []byte(data), EOF: eof})
+		_, err := shellExec.Receive(string(bzshell.ShellExecInput), payload)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	// collects everything the command sent until it exited
+	finish := func() (map[smsg.StreamType]string, bzshell.ShellExecExitMessage) {
+		Eventually(doneChan, 10*time.Second).Should(BeClosed())
+		close(streamMessageChan)
+
+		output := map[smsg.StreamType]string{}
+		var exit bzshell.ShellExecExitMessage
+		sequenceNumber := 1
+		for msg := range streamMessageChan {
+			Expect(msg.SequenceNumber).To(Equal(sequenceNumber))
+			sequenceNumber++
+
+			content, err := base64.StdEncoding.DecodeString(msg.Content)
+			Expect(err).ToNot(HaveOccurred())
+
+			if msg.Type == smsg.Stop {
+				Expect(msg.More).To(BeFalse())
+				Expect(json.Unmarshal(content, &exit)).To(Succeed())
+			} else {
+				output[msg.Type] += string(content)
+			}
+		}
+		return output, exit
+	}
+
+	It("streams stdout and stderr separately and returns the exit code", func() {
+		Expect(start("echo out; echo err >&2; exit 3", 0)).To(Succeed())
+
+		output, exit := finish()
+		Expect(output[smsg.StdOut]).To(Equal("out\n"))
+		Expect(output[smsg.StdErr]).To(Equal("err\n"))
+		Expect(exit.ExitCode).To(Equal(3))
+		Expect(exit.TimedOut).To(BeFalse())
+	})
+
+	It("forwards stdin until it's closed", func() {
+		Expect(start("cat", 0)).To(Succeed())
+		input("hello ", false)
+		input("world", true)
+
+		output, exit := finish()
+		Expect(output[smsg.StdOut]).To(Equal("hello world"))
+		Expect(exit.ExitCode).To(Equal(0))
+	})
+
+	It("kills the command when it times out", func() {
+		Expect(start("exec sleep 30", 1)).To(Succeed())
+
+		_, exit := finish()
+		Expect(exit.TimedOut).To(BeTrue())
+		Expect(exit.ExitCode).To(Equal(timedOutExitCode))
+	})
+
+	It("refuses to start a second command", func() {
+		Expect(start("cat", 0)).To(Succeed())
+		Expect(start("cat", 0)).ToNot(Succeed())
+		shellExec.Kill()
+	})
+
+	It("kills the command while it's running", func() {
+		Expect(start("exec sleep 30", 0)).To(Succeed())
+
+		killed := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			shellExec.Kill()
+			close(killed)
+		}()
+		Eventually(killed, 10*time.Second).Should(BeClosed())
+		Expect(doneChan).To(BeClosed())
+	})
+
+	It("is done once it's killed, even if no command was started", func() {
+		shellExec.Kill()
+		Expect(doneChan).To(BeClosed())
+
+		shellExec.Kill()
+		Expect(start("echo hi", 0)).ToNot(Succeed())
+	})
+
+	When("the user is restricted to an allow list", func() {
+		BeforeEach(func() {
+			shellExec = New(logger, streamMessageChan, doneChan, "test", nil, &localpolicy.ShellRestriction{Allow: []string{"/bin/echo"}})
+		})
+
+		It("runs allowed commands", func() {
+			Expect(start("echo hi", 0)).To(Succeed())
+			output, _ := finish()
+			Expect(output[smsg.StdOut]).To(Equal("hi\n"))
+			Expect(started).To(Equal([]string{"'/bin/echo' 'hi'"}))
+		})
+
+		It("refuses anything else", func() {
+			Expect(start("echo hi; cat /etc/shadow", 0)).ToNot(Succeed())
+			Expect(start("cat /etc/shadow", 0)).ToNot(Succeed())
+			Expect(started).To(BeEmpty())
+		})
+	})
+
+	When("the user is restricted to a forced command", func() {
+		It("refuses to run anything", func() {
+			shellExec = New(logger, streamMessageChan, doneChan, "test", nil, &localpolicy.ShellRestriction{ForceCommand: "/bin/true"})
+			Expect(start("echo hi", 0)).ToNot(Succeed())
+		})
+	})
+})
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"strings"
 
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/plugin/shell/actions/defaultshell"
+	"bastionzero.com/agent/plugin/shell/actions/shellexec"
+	"bastionzero.com/agent/recording"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin/shell"
 	smsg "bastionzero.com/bzerolib/stream/message"
@@ -31,6 +34,8 @@ func New(
 	ch chan smsg.StreamMessage,
 	action string,
 	payload []byte,
+	config pluginconfig.PluginConfig,
+	session pluginconfig.Session,
 ) (*ShellPlugin, error) {
 
 	// Unmarshal the Syn payload
@@ -52,9 +57,32 @@ func New(
 	if parsedAction, err := parseAction(action); err != nil {
 		return nil, err
 	} else {
+		restriction, err := config.LocalPolicy.ShellRestriction(plugin.runAsUser)
+		if err != nil {
+			return nil, err
+		}
+
 		switch parsedAction {
 		case shell.DefaultShell:
-			plugin.action = defaultshell.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.runAsUser)
+			var recorder defaultshell.ISessionRecorder
+			if config.ShellRecording.Enabled() {
+				if recorder, err = newRecorder(subLogger, config.ShellRecording, session, plugin.runAsUser); err != nil {
+					return nil, err
+				}
+			}
+
+			plugin.action = defaultshell.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.runAsUser, recorder, restriction)
+			plugin.logger.Infof("Shell plugin started %v action", action)
+			return plugin, nil
+		case shell.Exec:
+			var recorder shellexec.ISessionRecorder
+			if config.ShellRecording.Enabled() {
+				if recorder, err = newRecorder(subLogger, config.ShellRecording, session, plugin.runAsUser); err != nil {
+					return nil, err
+				}
+			}
+
+			plugin.action = shellexec.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.runAsUser, recorder, restriction)
 			plugin.logger.Infof("Shell plugin started %v action", action)
 			return plugin, nil
 		default:
@@ -73,6 +101,24 @@ func (s *ShellPlugin) Receive(action string, actionPayload []byte) ([]byte, erro
 	}
 }
 
+// newRecorder starts recording this session. If the agent has been configured to
+// record sessions and we can't, we refuse to start the shell rather than allow
+// an unrecorded session
+func newRecorder(logger *logger.Logger, config recording.Config, session pluginconfig.Session, runAsUser string) (*recording.Recorder, error) {
+	metadata := map[string]string{
+		"datachannelId": session.DataChannelId,
+		"targetUser":    runAsUser,
+		"subject":       session.Subject,
+		"email":         session.Email,
+	}
+
+	if recorder, err := recording.New(logger.GetComponentLogger("Recorder"), config, session.DataChannelId, "", metadata); err != nil {
+		return nil, fmt.Errorf("failed to start session recording: %w", err)
+	} else {
+		return recorder, nil
+	}
+}
+
 func parseAction(action string) (shell.ShellAction, error) {
 	parsedAction := strings.Split(action, "/")
 	if len(parsedAction) < 2 {
@@ -2,6 +2,7 @@ package webdial
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 
 	"gopkg.in/tomb.v2"
 
+	"bastionzero.com/agent/plugin/web/headerpolicy"
+	"bastionzero.com/agent/plugin/web/upstreamtls"
 	"bastionzero.com/bzerolib/bzhttp"
 	"bastionzero.com/bzerolib/logger"
 	webaction "bastionzero.com/bzerolib/plugin/web"
@@ -33,19 +36,26 @@ type WebDial struct {
 	streamOutputChan     chan smsg.StreamMessage
 	streamMessageVersion smsg.SchemaVersion
 
-	interruptChan chan bool
-
 	remoteHost string
 	remotePort int
 
-	requestBody []byte
+	// how the target wants its request headers, and how we reach it
+	headers  *headerpolicy.Rewriter
+	upstream *upstreamtls.Upstream
+
+	// where we write the request body as it arrives, once the request has
+	// started. Nil if we were sent the whole body at once
+	bodyWriter *io.PipeWriter
+	started    bool
 }
 
 func New(logger *logger.Logger,
 	streamChan chan smsg.StreamMessage,
 	doneChan chan struct{},
 	remoteHost string,
-	remotePort int) (*WebDial, error) {
+	remotePort int,
+	headers *headerpolicy.Rewriter,
+	upstream *upstreamtls.Upstream) (*WebDial, error) {
 
 	return &WebDial{
 		logger:           logger,
@@ -53,13 +63,16 @@ func New(logger *logger.Logger,
 		streamOutputChan: streamChan,
 		remoteHost:       remoteHost,
 		remotePort:       remotePort,
-		requestBody:      []byte{},
+		headers:          headers,
+		upstream:         upstream,
 	}, nil
 }
 
 func (w *WebDial) Kill() {
 	w.tmb.Killf("we've been told to stop")
-	w.tmb.Wait()
+	if w.started {
+		w.tmb.Wait()
+	}
 }
 
 func (w *WebDial) Receive(action string, actionPayload []byte) ([]byte, error) {
@@ -81,7 +94,10 @@ func (w *WebDial) Receive(action string, actionPayload []byte) ([]byte, error) {
 			return []byte{}, w.handleRequest(input)
 		}
 	case bzwebdial.WebDialInterrupt:
-		w.interruptChan <- true
+		// the request is cancelled when we die, which also stops it reading
+		// the body we've got so far
+		w.logger.Info("Request interrupted by the daemon")
+		w.tmb.Killf("request interrupted")
 		return actionPayload, nil
 	default:
 		rerr = fmt.Errorf("unhandled stream action: %v", action)
@@ -100,137 +116,192 @@ func (w *WebDial) start(webDialActionRequest bzwebdial.WebDialActionPayload) {
 }
 
 func (w *WebDial) handleRequest(requestPayload bzwebdial.WebInputActionPayload) error {
-	w.requestBody = append(w.requestBody, requestPayload.Body...)
-	if requestPayload.More {
+	if !w.started {
+		if err := w.startHttpRequest(requestPayload); err != nil {
+			return err
+		}
+	}
+
+	if w.bodyWriter == nil {
 		return nil
-	} else {
+	}
+
+	// this blocks until the target has read the chunk, and we don't ack it until
+	// then, so the daemon can't send us more than the target is ready for. If
+	// it's stopped reading then it's already responded, and the rest of the
+	// body has nowhere to go
+	if len(requestPayload.Body) > 0 {
+		if _, err := w.bodyWriter.Write(requestPayload.Body); err != nil {
+			w.logger.Debugf("Target is no longer reading the request body: %s", err)
+			return nil
+		}
+	}
+
+	if !requestPayload.More {
 		w.logger.Debugf("Received request in %d part(s)", requestPayload.SequenceNumber+1)
-		return w.handleNewHttpRequest(requestPayload)
+		w.bodyWriter.Close()
 	}
+	return nil
 }
 
-func (w *WebDial) handleNewHttpRequest(requestPayload bzwebdial.WebInputActionPayload) error {
+// startHttpRequest makes the request as soon as we get the first chunk of its
+// body, rather than holding the whole thing in memory until we've got it all
+func (w *WebDial) startHttpRequest(requestPayload bzwebdial.WebInputActionPayload) error {
+	var body io.Reader
+	var bodyReader *io.PipeReader
+	contentLength := int64(len(requestPayload.Body))
+	if requestPayload.More {
+		bodyReader, w.bodyWriter = io.Pipe()
+		body = bodyReader
+
+		// we'll send the body chunked unless the daemon knows how long it is
+		contentLength = -1
+		if requestPayload.ContentLength > 0 {
+			contentLength = requestPayload.ContentLength
+		}
+	} else {
+		body = bytes.NewReader(requestPayload.Body)
+	}
 
-	if request, err := w.buildHttpRequest(requestPayload.Endpoint, w.requestBody, requestPayload.Method, requestPayload.Headers); err != nil {
+	request, err := w.buildHttpRequest(requestPayload.Endpoint, body, requestPayload.Method, requestPayload.Headers)
+	if err != nil {
 		return err
-	} else {
+	}
+	request.ContentLength = contentLength
+	w.headers.Rewrite(request)
+	w.started = true
+
+	// cancelling the request doesn't stop it waiting for the rest of the body,
+	// so we stop waiting for it ourselves. Our tomb dies once we're done anyway
+	if bodyReader != nil {
+		go func() {
+			<-w.tmb.Dying()
+			bodyReader.CloseWithError(fmt.Errorf("request interrupted"))
+		}()
+	}
+
+	w.tmb.Go(func() error {
+		defer close(w.doneChan)
 
 		// We don't want to attempt to follow any redirect, we want to allow the browser/client to decided to
 		// redirect if they choose too
 		// Ref: https://stackoverflow.com/questions/23297520/how-can-i-make-the-go-http-client-not-follow-redirects-automatically
 		httpClient := &http.Client{
+			Transport: w.upstream.Transport(upstreamtls.HTTP),
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 		}
 
 		if response, err := httpClient.Do(request); err != nil {
-			rerr := fmt.Errorf("bad response to http request: %s", err)
-			w.logger.Error(rerr)
+			w.logger.Errorf("bad response to http request: %s", err)
 
 			responsePayload := &bzwebdial.WebOutputActionPayload{
 				StatusCode: http.StatusBadGateway,
 				RequestId:  requestPayload.RequestId,
 				Headers:    map[string][]string{},
-				Content:    []byte{},
+				Content:    []byte(err.Error()),
 			}
 
-			switch w.streamMessageVersion {
+			// tell the daemon if it was the target's TLS that we couldn't get past
+			tlsErrorType, isTLSError := upstreamtls.ErrorType(err)
+			switch {
 			// prior to 202204
-			case "":
+			case w.streamMessageVersion == "":
 				w.sendStreamMessage(0, smsg.WebError, false, responsePayload)
+			case isTLSError:
+				w.sendStreamMessage(0, tlsErrorType, false, responsePayload)
 			default:
 				w.sendStreamMessage(0, smsg.Error, false, responsePayload)
 			}
-			return rerr
+			return nil
 		} else {
+			return w.proxyResponse(response)
+		}
+	})
+
+	return nil
+}
+
+func (w *WebDial) proxyResponse(response *http.Response) error {
+	defer response.Body.Close()
+
+	// Build the header response
+	header := make(map[string][]string)
+	for key, value := range response.Header {
+		header[key] = value
+	}
 
-			// listen and process stream messages
-			w.tmb.Go(func() error {
-				defer response.Body.Close()
-				defer close(w.doneChan)
+	sequenceNumber := 0
+	buf := make([]byte, chunkSize)
+	var responsePayload *bzwebdial.WebOutputActionPayload
+
+	for {
+		select {
+		case <-w.tmb.Dying():
+			return nil
+		default:
+
+			// golang does the chunking for us, here. We just need to read from the body in the chunk size we want
+			// "The response body is streamed on demand as the Body field is read"
+			// ref: https://go.dev/src/net/http/response.go
+			numBytes, err := response.Body.Read(buf)
+
+			// check for error and if it's serious then report it
+			if err != nil && err != io.EOF {
+				w.logger.Errorf("error reading response body: %s", err)
+
+				// Do not quit, just return the user the api request info
+				responsePayload = &bzwebdial.WebOutputActionPayload{
+					StatusCode: http.StatusBadGateway,
+					RequestId:  w.requestId,
+					Headers:    map[string][]string{},
+					Content:    buf[:numBytes],
+				}
 
-				// Build the header response
-				header := make(map[string][]string)
-				for key, value := range response.Header {
-					header[key] = value
+				switch w.streamMessageVersion {
+				// prior to 202204
+				case "":
+					w.sendStreamMessage(sequenceNumber, smsg.WebError, false, responsePayload)
+				default:
+					w.sendStreamMessage(sequenceNumber, smsg.Error, false, responsePayload)
 				}
+			}
+
+			w.logger.Tracef("Building response for chunk #%d of size %d", sequenceNumber, numBytes)
+
+			// Now we need to send that data back to the client
+			responsePayload = &bzwebdial.WebOutputActionPayload{
+				StatusCode: response.StatusCode,
+				RequestId:  w.requestId,
+				Headers:    header,
+				Content:    buf[:numBytes],
+			}
 
-				sequenceNumber := 0
-				buf := make([]byte, chunkSize)
-				var responsePayload *bzwebdial.WebOutputActionPayload
-
-				for {
-					select {
-					case <-w.tmb.Dying():
-						return nil
-					default:
-
-						// golang does the chunking for us, here. We just need to read from the body in the chunk size we want
-						// "The response body is streamed on demand as the Body field is read"
-						// ref: https://go.dev/src/net/http/response.go
-						numBytes, err := response.Body.Read(buf)
-
-						// check for error and if it's serious then report it
-						if err != nil && err != io.EOF {
-							w.logger.Errorf("error reading response body: %s", err)
-
-							// Do not quit, just return the user the api request info
-							responsePayload = &bzwebdial.WebOutputActionPayload{
-								StatusCode: http.StatusBadGateway,
-								RequestId:  w.requestId,
-								Headers:    map[string][]string{},
-								Content:    buf[:numBytes],
-							}
-
-							switch w.streamMessageVersion {
-							// prior to 202204
-							case "":
-								w.sendStreamMessage(sequenceNumber, smsg.WebError, false, responsePayload)
-							default:
-								w.sendStreamMessage(sequenceNumber, smsg.Error, false, responsePayload)
-							}
-						}
-
-						w.logger.Tracef("Building response for chunk #%d of size %d", sequenceNumber, numBytes)
-
-						// Now we need to send that data back to the client
-						responsePayload = &bzwebdial.WebOutputActionPayload{
-							StatusCode: response.StatusCode,
-							RequestId:  w.requestId,
-							Headers:    header,
-							Content:    buf[:numBytes],
-						}
-
-						// we get io.EOFs on whichever read call processes the final byte
-						if err == io.EOF {
-							// this is the final message so let the daemon know
-							switch w.streamMessageVersion {
-							// prior to 202204
-							case "":
-								w.sendStreamMessage(sequenceNumber, smsg.WebStreamEnd, false, responsePayload)
-							default:
-								w.sendStreamMessage(sequenceNumber, smsg.Stream, false, responsePayload)
-							}
-							return nil
-						} else {
-							switch w.streamMessageVersion {
-							// prior to 202204
-							case "":
-								w.sendStreamMessage(sequenceNumber, smsg.WebStream, true, responsePayload)
-							default:
-								w.sendStreamMessage(sequenceNumber, smsg.Stream, true, responsePayload)
-							}
-						}
-
-						sequenceNumber += 1
-					}
+			// we get io.EOFs on whichever read call processes the final byte
+			if err == io.EOF {
+				// this is the final message so let the daemon know
+				switch w.streamMessageVersion {
+				// prior to 202204
+				case "":
+					w.sendStreamMessage(sequenceNumber, smsg.WebStreamEnd, false, responsePayload)
+				default:
+					w.sendStreamMessage(sequenceNumber, smsg.Stream, false, responsePayload)
 				}
-			})
+				return nil
+			} else {
+				switch w.streamMessageVersion {
+				// prior to 202204
+				case "":
+					w.sendStreamMessage(sequenceNumber, smsg.WebStream, true, responsePayload)
+				default:
+					w.sendStreamMessage(sequenceNumber, smsg.Stream, true, responsePayload)
+				}
+			}
+
+			sequenceNumber += 1
 		}
 	}
-
-	return nil
 }
 
 func (w *WebDial) sendStreamMessage(sequenceNumber int, streamType smsg.StreamType, more bool, payload *bzwebdial.WebOutputActionPayload) {
@@ -245,7 +316,7 @@ func (w *WebDial) sendStreamMessage(sequenceNumber int, streamType smsg.StreamTy
 	}
 }
 
-func (w *WebDial) buildHttpRequest(endpoint string, body []byte, method string, headers map[string][]string) (*http.Request, error) {
+func (w *WebDial) buildHttpRequest(endpoint string, body io.Reader, method string, headers map[string][]string) (*http.Request, error) {
 
 	// Build the endpoint given the remoteHost
 	remoteUrl := fmt.Sprintf("%s:%v", w.remoteHost, w.remotePort)
@@ -256,8 +327,8 @@ func (w *WebDial) buildHttpRequest(endpoint string, body []byte, method string,
 		w.logger.Error(fmt.Errorf("error parsing remote host url %s", w.remoteHost))
 		return nil, err
 	} else {
-		bodyBytesReader := bytes.NewReader(body)
-		req, _ := http.NewRequest(method, endpoint, bodyBytesReader)
+		// the request is cancelled if we're killed before it's done
+		req, _ := http.NewRequestWithContext(w.tmb.Context(context.Background()), method, endpoint, body)
 
 		// Add any headers
 		for name, values := range headers {
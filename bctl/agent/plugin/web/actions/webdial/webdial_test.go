@@ -0,0 +1,138 @@
+package webdial
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/agent/plugin/web/upstreamtls"
+	"bastionzero.com/bzerolib/logger"
+	bzwebdial "bastionzero.com/bzerolib/plugin/web/actions/webdial"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestWebDial(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Web Dial Suite")
+}
+
+var _ = Describe("Agent Web Dial action", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var streamChan chan smsg.StreamMessage
+	var doneChan chan struct{}
+	var server *httptest.Server
+	var webDial *WebDial
+
+	// the target tells us when it's got the request, and what was in its body
+	var requests chan *http.Request
+	var bodies chan string
+
+	receive := func(action bzwebdial.WebDialSubAction, payload interface{}) {
+		payloadBytes, _ := json.Marshal(payload)
+		_, err := webDial.Receive(string(action), payloadBytes)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	input := func(sequenceNumber int, body string, more bool) bzwebdial.WebInputActionPayload {
+		return bzwebdial.WebInputActionPayload{
+			RequestId:      "1234",
+			Endpoint:       "/upload",
+			Method:         http.MethodPost,
+			Headers:        map[string][]string{"Content-Type": {"application/octet-stream"}},
+			SequenceNumber: sequenceNumber,
+			Body:           []byte(body),
+			More:           more,
+		}
+	}
+
+	BeforeEach(func() {
+		streamChan = make(chan smsg.StreamMessage, 10)
+		doneChan = make(chan struct{})
+		requests = make(chan *http.Request, 1)
+		bodies = make(chan string, 1)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+			bodies <- string(body)
+			w.Write([]byte("uploaded"))
+		}))
+
+		serverUrl, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(serverUrl.Port())
+
+		var err error
+		webDial, err = New(logger, streamChan, doneChan, "http://"+serverUrl.Hostname(), port, nil, &upstreamtls.Upstream{})
+		Expect(err).ToNot(HaveOccurred())
+
+		receive(bzwebdial.WebDialStart, bzwebdial.WebDialActionPayload{
+			RequestId:            "1234",
+			StreamMessageVersion: smsg.CurrentSchema,
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("starts the request before it has the whole body", func() {
+		first := input(0, "hello ", true)
+		first.ContentLength = 11
+		receive(bzwebdial.WebDialInput, first)
+
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		Expect(request.ContentLength).To(Equal(int64(11)))
+
+		second := input(1, "world", false)
+		second.ContentLength = 11
+		receive(bzwebdial.WebDialInput, second)
+		Eventually(bodies).Should(Receive(Equal("hello world")))
+
+		var message smsg.StreamMessage
+		Eventually(streamChan).Should(Receive(&message))
+		for message.More {
+			Eventually(streamChan).Should(Receive(&message))
+		}
+
+		var output bzwebdial.WebOutputActionPayload
+		contentBytes, _ := base64.StdEncoding.DecodeString(message.Content)
+		Expect(json.Unmarshal(contentBytes, &output)).To(Succeed())
+		Expect(output.StatusCode).To(Equal(http.StatusOK))
+		Eventually(doneChan).Should(BeClosed())
+	})
+
+	It("sends bodies that arrive all at once with their length", func() {
+		receive(bzwebdial.WebDialInput, input(0, "hello world", false))
+
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		Expect(request.ContentLength).To(Equal(int64(11)))
+		Expect(request.TransferEncoding).To(BeEmpty())
+		Eventually(bodies).Should(Receive(Equal("hello world")))
+		Eventually(doneChan).Should(BeClosed())
+	})
+
+	It("cancels the request when the daemon interrupts the upload", func() {
+		receive(bzwebdial.WebDialInput, input(0, "hello ", true))
+		Eventually(requests).Should(Receive())
+
+		receive(bzwebdial.WebDialInterrupt, bzwebdial.WebInterruptActionPayload{RequestId: "1234"})
+		Eventually(doneChan).Should(BeClosed())
+		Consistently(bodies).ShouldNot(Receive())
+
+		webDial.Kill()
+	})
+})
@@ -0,0 +1,319 @@
+package webstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/tomb.v2"
+
+	"bastionzero.com/agent/plugin/web/headerpolicy"
+	"bastionzero.com/agent/plugin/web/upstreamtls"
+	"bastionzero.com/bzerolib/bzhttp"
+	"bastionzero.com/bzerolib/logger"
+	webaction "bastionzero.com/bzerolib/plugin/web"
+	bzwebstream "bastionzero.com/bzerolib/plugin/web/actions/webstream"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+const (
+	chunkSize = 64 * 1024
+)
+
+// WebStream makes a single request upstream, sending its body as we receive it
+// and returning its response as we read it. This lets us proxy HTTP/2 services
+// like gRPC, which can stream in both directions at once
+type WebStream struct {
+	tmb       tomb.Tomb
+	logger    *logger.Logger
+	requestId string
+
+	doneChan chan struct{}
+
+	// output channel to send all of our stream messages directly to datachannel
+	streamOutputChan     chan smsg.StreamMessage
+	streamMessageVersion smsg.SchemaVersion
+
+	remoteHost string
+	remotePort int
+
+	// how the target wants its request headers, and how we reach it
+	headers  *headerpolicy.Rewriter
+	upstream *upstreamtls.Upstream
+
+	// the request we're making, and where we write its body as it arrives
+	request                *http.Request
+	bodyWriter             *io.PipeWriter
+	expectedSequenceNumber int
+	started                bool
+}
+
+func New(logger *logger.Logger,
+	streamChan chan smsg.StreamMessage,
+	doneChan chan struct{},
+	remoteHost string,
+	remotePort int,
+	headers *headerpolicy.Rewriter,
+	upstream *upstreamtls.Upstream) (*WebStream, error) {
+
+	return &WebStream{
+		logger:           logger,
+		doneChan:         doneChan,
+		streamOutputChan: streamChan,
+		remoteHost:       remoteHost,
+		remotePort:       remotePort,
+		headers:          headers,
+		upstream:         upstream,
+	}, nil
+}
+
+func (w *WebStream) Kill() {
+	w.tmb.Killf("we've been told to stop")
+	if w.bodyWriter != nil {
+		w.bodyWriter.CloseWithError(fmt.Errorf("request interrupted"))
+	}
+	if w.started {
+		w.tmb.Wait()
+	}
+}
+
+func (w *WebStream) Receive(action string, actionPayload []byte) ([]byte, error) {
+	var rerr error
+	switch bzwebstream.WebStreamSubAction(action) {
+	case bzwebstream.WebStreamStart:
+		var startPayload bzwebstream.WebStreamStartActionPayload
+		if err := json.Unmarshal(actionPayload, &startPayload); err != nil {
+			rerr = fmt.Errorf("malformed web stream start payload: %s", err)
+		} else if err := w.start(startPayload); err != nil {
+			rerr = err
+		} else {
+			return []byte{}, nil
+		}
+	case bzwebstream.WebStreamInput:
+		var input bzwebstream.WebStreamInputActionPayload
+		if err := json.Unmarshal(actionPayload, &input); err != nil {
+			rerr = fmt.Errorf("unable to unmarshal web stream input message: %s", err)
+		} else if err := w.handleInput(input); err != nil {
+			rerr = err
+		} else {
+			return []byte{}, nil
+		}
+	case bzwebstream.WebStreamInterrupt:
+		w.logger.Info("Request interrupted by the daemon")
+		w.Kill()
+		return actionPayload, nil
+	default:
+		rerr = fmt.Errorf("unhandled stream action: %v", action)
+	}
+
+	w.logger.Error(rerr)
+	return []byte{}, rerr
+}
+
+func (w *WebStream) start(startPayload bzwebstream.WebStreamStartActionPayload) error {
+	if w.started {
+		return fmt.Errorf("web stream request has already been started")
+	}
+
+	// keep track of who we're talking to
+	w.requestId = startPayload.RequestId
+	w.logger.Infof("Setting request id: %s", w.requestId)
+	w.streamMessageVersion = startPayload.StreamMessageVersion
+	w.logger.Infof("Setting stream message version: %s", w.streamMessageVersion)
+
+	remoteHostUrl, err := url.Parse(w.remoteHost)
+	if err != nil {
+		return fmt.Errorf("error parsing remote host url %s: %s", w.remoteHost, err)
+	}
+
+	endpoint, err := bzhttp.BuildEndpoint(fmt.Sprintf("%s:%v", w.remoteHost, w.remotePort), startPayload.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	// the body is written to the pipe as the daemon sends it to us, and the
+	// upstream request reads it from there as it goes
+	bodyReader, bodyWriter := io.Pipe()
+	request, err := http.NewRequestWithContext(w.tmb.Context(context.Background()), startPayload.Method, endpoint, bodyReader)
+	if err != nil {
+		return fmt.Errorf("failed to build web stream request: %s", err)
+	}
+
+	// we send the body as it comes, in chunks or frames unless the client told
+	// us how long it is
+	request.ContentLength = startPayload.ContentLength
+	if request.ContentLength == 0 {
+		request.Body = http.NoBody
+	}
+	for name, values := range startPayload.Headers {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	request.Header.Del("Content-Length")
+	request.Host = remoteHostUrl.Host
+	w.headers.Rewrite(request)
+
+	// trailers have to be declared before the request is sent, and their values
+	// are filled in when the body's done
+	if len(startPayload.Trailers) > 0 {
+		request.Trailer = http.Header{}
+		for _, name := range startPayload.Trailers {
+			request.Trailer[http.CanonicalHeaderKey(name)] = nil
+		}
+	}
+
+	w.request = request
+	w.bodyWriter = bodyWriter
+	w.started = true
+
+	client := newClient(remoteHostUrl.Scheme, startPayload.ProtoMajor, w.upstream)
+	w.tmb.Go(func() error {
+		defer close(w.doneChan)
+		defer bodyReader.Close()
+
+		return w.proxy(client)
+	})
+
+	return nil
+}
+
+// newClient returns a client that speaks HTTP/2 to upstreams that support it.
+// Those with TLS tell us so while we're connecting to them, but for those
+// without it we assume they do if the client spoke HTTP/2 to the daemon, since
+// that's the only way gRPC is spoken without TLS
+func newClient(scheme string, protoMajor int, upstream *upstreamtls.Upstream) *http.Client {
+	protocol := upstreamtls.HTTP
+	if scheme == "http" && protoMajor == 2 {
+		protocol = upstreamtls.H2C
+	}
+
+	return &http.Client{
+		Transport: upstream.Transport(protocol),
+
+		// We don't want to attempt to follow any redirect, we want to allow the browser/client to decided to
+		// redirect if they choose too
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (w *WebStream) handleInput(input bzwebstream.WebStreamInputActionPayload) error {
+	if !w.started {
+		return fmt.Errorf("received web stream input before the request was started")
+	} else if input.SequenceNumber != w.expectedSequenceNumber {
+		return fmt.Errorf("received web stream input out of order, expected %d but got %d", w.expectedSequenceNumber, input.SequenceNumber)
+	}
+	w.expectedSequenceNumber += 1
+
+	// this blocks until the upstream has read it, so we don't take in more
+	// than it's ready for. If it's stopped reading then the response has
+	// already been sent or has failed, and there's nothing more to do with this
+	if len(input.Body) > 0 && w.request.Body != http.NoBody {
+		if _, err := w.bodyWriter.Write(input.Body); err != nil {
+			w.logger.Debugf("Upstream is no longer reading the request body: %s", err)
+			return nil
+		}
+	}
+
+	if !input.More {
+		// we can only send the trailers the client declared up front
+		for name, values := range input.Trailers {
+			if _, ok := w.request.Trailer[http.CanonicalHeaderKey(name)]; ok {
+				w.request.Trailer[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		w.logger.Debugf("Received request body in %d part(s)", input.SequenceNumber+1)
+		w.bodyWriter.Close()
+	}
+
+	return nil
+}
+
+func (w *WebStream) proxy(client *http.Client) error {
+	response, err := client.Do(w.request)
+	if err != nil {
+		w.logger.Errorf("bad response to http request: %s", err)
+
+		// tell the daemon if it was the target's TLS that we couldn't get past
+		errorType := smsg.Error
+		if tlsErrorType, ok := upstreamtls.ErrorType(err); ok {
+			errorType = tlsErrorType
+		}
+		w.sendStreamMessage(0, errorType, false, &bzwebstream.WebStreamOutputPayload{
+			RequestId:  w.requestId,
+			StatusCode: http.StatusBadGateway,
+			Content:    []byte(err.Error()),
+		})
+		return nil
+	}
+	defer response.Body.Close()
+
+	// send the status and headers straight away, since streaming services may
+	// not send any of the body for a while
+	headers := make(map[string][]string)
+	for name, values := range response.Header {
+		headers[name] = values
+	}
+	w.sendStreamMessage(0, smsg.Stream, true, &bzwebstream.WebStreamOutputPayload{
+		RequestId:  w.requestId,
+		StatusCode: response.StatusCode,
+		Headers:    headers,
+		Content:    []byte{},
+	})
+
+	sequenceNumber := 1
+	buf := make([]byte, chunkSize)
+	for {
+		select {
+		case <-w.tmb.Dying():
+			return nil
+		default:
+		}
+
+		numBytes, err := response.Body.Read(buf)
+		if err != nil && err != io.EOF {
+			w.logger.Errorf("error reading response body: %s", err)
+			w.sendStreamMessage(sequenceNumber, smsg.Error, false, &bzwebstream.WebStreamOutputPayload{
+				RequestId:  w.requestId,
+				StatusCode: http.StatusBadGateway,
+				Content:    []byte(err.Error()),
+			})
+			return nil
+		}
+
+		w.logger.Tracef("Building response for chunk #%d of size %d", sequenceNumber, numBytes)
+		responsePayload := &bzwebstream.WebStreamOutputPayload{
+			RequestId:  w.requestId,
+			StatusCode: response.StatusCode,
+			Content:    buf[:numBytes],
+		}
+
+		// trailers are only filled in once we've read the whole body
+		if err == io.EOF {
+			responsePayload.Trailers = response.Trailer
+			w.sendStreamMessage(sequenceNumber, smsg.Stream, false, responsePayload)
+			return nil
+		} else if numBytes > 0 {
+			w.sendStreamMessage(sequenceNumber, smsg.Stream, true, responsePayload)
+			sequenceNumber += 1
+		}
+	}
+}
+
+func (w *WebStream) sendStreamMessage(sequenceNumber int, streamType smsg.StreamType, more bool, payload *bzwebstream.WebStreamOutputPayload) {
+	responsePayloadBytes, _ := json.Marshal(payload)
+	w.streamOutputChan <- smsg.StreamMessage{
+		SchemaVersion:  w.streamMessageVersion,
+		SequenceNumber: sequenceNumber,
+		Action:         string(webaction.Stream),
+		Type:           streamType,
+		More:           more,
+		Content:        base64.StdEncoding.EncodeToString(responsePayloadBytes),
+	}
+}
@@ -0,0 +1,151 @@
+package webstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"bastionzero.com/agent/plugin/web/upstreamtls"
+	"bastionzero.com/bzerolib/logger"
+	bzwebstream "bastionzero.com/bzerolib/plugin/web/actions/webstream"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestWebStream(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Web Stream Suite")
+}
+
+var _ = Describe("Agent Web Stream action", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var streamChan chan smsg.StreamMessage
+	var doneChan chan struct{}
+
+	receive := func(webStream *WebStream, action bzwebstream.WebStreamSubAction, payload interface{}) {
+		payloadBytes, _ := json.Marshal(payload)
+		_, err := webStream.Receive(string(action), payloadBytes)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	nextOutput := func() (smsg.StreamMessage, bzwebstream.WebStreamOutputPayload) {
+		var message smsg.StreamMessage
+		Eventually(streamChan).Should(Receive(&message))
+
+		var output bzwebstream.WebStreamOutputPayload
+		contentBytes, err := base64.StdEncoding.DecodeString(message.Content)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(contentBytes, &output)).To(Succeed())
+		return message, output
+	}
+
+	BeforeEach(func() {
+		streamChan = make(chan smsg.StreamMessage, 10)
+		doneChan = make(chan struct{})
+	})
+
+	It("streams a request and its response to an HTTP/2 server without TLS", func() {
+		requests := make(chan *http.Request, 1)
+		bodies := make(chan string, 1)
+		server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			requests <- r
+			bodies <- string(body)
+
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Header().Set("Content-Type", "application/grpc")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("pong"))
+			w.Header().Set("Grpc-Status", "0")
+		}), &http2.Server{}))
+		defer server.Close()
+
+		serverUrl, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(serverUrl.Port())
+		webStream, err := New(logger, streamChan, doneChan, "http://"+serverUrl.Hostname(), port, nil, &upstreamtls.Upstream{})
+		Expect(err).ToNot(HaveOccurred())
+
+		receive(webStream, bzwebstream.WebStreamStart, bzwebstream.WebStreamStartActionPayload{
+			RequestId:            "1234",
+			StreamMessageVersion: smsg.CurrentSchema,
+			Endpoint:             "/grpc.health.v1.Health/Check",
+			Method:               http.MethodPost,
+			Headers:              map[string][]string{"Content-Type": {"application/grpc"}},
+			ContentLength:        -1,
+			Trailers:             []string{"X-Checksum"},
+			ProtoMajor:           2,
+		})
+		receive(webStream, bzwebstream.WebStreamInput, bzwebstream.WebStreamInputActionPayload{
+			RequestId:      "1234",
+			SequenceNumber: 0,
+			Body:           []byte("pi"),
+			More:           true,
+		})
+		receive(webStream, bzwebstream.WebStreamInput, bzwebstream.WebStreamInputActionPayload{
+			RequestId:      "1234",
+			SequenceNumber: 1,
+			Body:           []byte("ng"),
+			More:           false,
+			Trailers:       map[string][]string{"X-Checksum": {"abc"}, "X-Undeclared": {"def"}},
+		})
+
+		By("sending the whole body and its declared trailers upstream over HTTP/2")
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		Expect(<-bodies).To(Equal("ping"))
+		Expect(request.ProtoMajor).To(Equal(2))
+		Expect(request.URL.Path).To(Equal("/grpc.health.v1.Health/Check"))
+		Expect(request.Trailer).To(Equal(http.Header{"X-Checksum": {"abc"}}))
+
+		By("sending the status and headers before the body")
+		message, output := nextOutput()
+		Expect(message.SequenceNumber).To(Equal(0))
+		Expect(message.Type).To(Equal(smsg.Stream))
+		Expect(message.More).To(BeTrue())
+		Expect(output.StatusCode).To(Equal(http.StatusOK))
+		Expect(output.Headers["Content-Type"]).To(Equal([]string{"application/grpc"}))
+
+		By("sending the response trailers after the body")
+		var body []byte
+		for message.More {
+			message, output = nextOutput()
+			body = append(body, output.Content...)
+		}
+		Expect(string(body)).To(Equal("pong"))
+		Expect(output.Trailers).To(Equal(map[string][]string{"Grpc-Status": {"0"}}))
+		Eventually(doneChan).Should(BeClosed())
+	})
+
+	It("reports upstreams we can't reach as a bad gateway", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		serverUrl, _ := url.Parse(server.URL)
+		server.Close()
+
+		port, _ := strconv.Atoi(serverUrl.Port())
+		webStream, err := New(logger, streamChan, doneChan, "http://"+serverUrl.Hostname(), port, nil, &upstreamtls.Upstream{})
+		Expect(err).ToNot(HaveOccurred())
+
+		receive(webStream, bzwebstream.WebStreamStart, bzwebstream.WebStreamStartActionPayload{
+			RequestId:            "1234",
+			StreamMessageVersion: smsg.CurrentSchema,
+			Endpoint:             "/",
+			Method:               http.MethodGet,
+			ProtoMajor:           1,
+		})
+
+		message, output := nextOutput()
+		Expect(message.Type).To(Equal(smsg.Error))
+		Expect(output.StatusCode).To(Equal(http.StatusBadGateway))
+		Eventually(doneChan).Should(BeClosed())
+	})
+})
@@ -1,11 +1,15 @@
 package webwebsocket
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 
+	"bastionzero.com/agent/plugin/web/headerpolicy"
+	"bastionzero.com/agent/plugin/web/upstreamtls"
 	"bastionzero.com/bzerolib/logger"
 	"gopkg.in/tomb.v2"
 
@@ -29,13 +33,20 @@ type WebWebsocket struct {
 	remoteHost string
 	remotePort int
 	requestId  string
+
+	// how the target wants its request headers, and its TLS if it needs
+	// more than the defaults
+	headers   *headerpolicy.Rewriter
+	tlsConfig *tls.Config
 }
 
 func New(logger *logger.Logger,
 	streamChan chan smsg.StreamMessage,
 	doneChan chan struct{},
 	remoteHost string,
-	remotePort int) (*WebWebsocket, error) {
+	remotePort int,
+	headers *headerpolicy.Rewriter,
+	tlsConfig *tls.Config) (*WebWebsocket, error) {
 
 	return &WebWebsocket{
 		logger:           logger,
@@ -43,6 +54,8 @@ func New(logger *logger.Logger,
 		streamOutputChan: streamChan,
 		remoteHost:       remoteHost,
 		remotePort:       remotePort,
+		headers:          headers,
+		tlsConfig:        tlsConfig,
 	}, nil
 }
 
@@ -142,14 +155,29 @@ func (w *WebWebsocket) startWebsocket(webWebsocketStartRequest webwebsocket.WebW
 	u := url.URL{Scheme: scheme, Host: remoteHostUrl.Host, Path: webWebsocketStartRequest.Endpoint}
 	w.logger.Infof("Connecting to %s", u.String())
 
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	// we don't pass on the client's headers, but the target may still want
+	// to know who's connecting
+	upgradeRequest := &http.Request{Method: http.MethodGet, URL: &u, Header: http.Header{}}
+	w.headers.Rewrite(upgradeRequest)
+	if upgradeRequest.Host != "" {
+		upgradeRequest.Header.Set("Host", upgradeRequest.Host)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = w.tlsConfig
+
+	ws, _, err := dialer.Dial(u.String(), upgradeRequest.Header)
 	if err != nil {
 		w.logger.Errorf("dial error: %s", err)
 		// Do not return an error incase the user wants to try again in making this connection, rather send a close message
-		switch w.streamMessageVersion {
+		switch tlsErrorType, isTLSError := upstreamtls.ErrorType(err); {
 		// prior to 202204
-		case "":
+		case w.streamMessageVersion == "":
 			w.sendStreamMessage(0, smsg.AgentStop, false, []byte{})
+		case isTLSError:
+			// daemons which don't know why we failed still close when we stop
+			w.sendStreamMessage(0, tlsErrorType, true, []byte(err.Error()))
+			w.sendStreamMessage(1, smsg.Stop, false, []byte{})
 		default:
 			w.sendStreamMessage(0, smsg.Stop, false, []byte{})
 		}
@@ -0,0 +1,194 @@
+/*
+This package lets the owner of a web target decide which headers the agent
+sends it, and have the agent tell it who the user is. The agent reads an
+optional YAML file such as:
+
+	host: grafana.internal
+	remove: [Cookie, X-Forwarded-Host]
+	set:
+	  X-Environment: production
+	identity: true
+	sign: true
+
+host replaces the Host header, which is otherwise the address of the target.
+remove drops headers the client sent, and set adds headers, replacing any the
+client sent with the same name.
+
+With identity set, every request carries the user from their verified BZCert:
+
+	X-Forwarded-User: <the IdP subject>
+	X-Forwarded-Email: <their email, if the IdP provided one>
+	X-Forwarded-Groups: <a comma-separated list of their groups, if the IdP provided one>
+
+and any of these the client sent itself are dropped, so an app that trusts them
+can only be reached through the agent. With sign set as well, the agent adds
+
+	X-Forwarded-Timestamp: <unix seconds>
+	X-Forwarded-Signature: <base64 ed25519 signature>
+
+signed with the agent's key, so an app that can also be reached some other way
+can check them against the agent's public key. The signature is over the
+following lines, each ending in a newline:
+
+	bzero-web-identity-v1
+	<method>
+	<request uri>
+	<host>
+	<user>
+	<email>
+	<groups>
+	<timestamp>
+
+The agent signs other things with the same key, and the method and request uri
+are up to the user, so the first line makes sure that nothing else the agent
+signs can be passed off as an identity, or the other way around.
+
+The file is read every time a web request starts (see the policyfile package).
+If it doesn't exist then requests are passed on as they are, but if it can't be
+read or parsed then web requests fail.
+*/
+package headerpolicy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bastionzero.com/agent/config/policyfile"
+	"bastionzero.com/bzerolib/keypair"
+)
+
+const (
+	UserHeader      = "X-Forwarded-User"
+	EmailHeader     = "X-Forwarded-Email"
+	GroupsHeader    = "X-Forwarded-Groups"
+	TimestampHeader = "X-Forwarded-Timestamp"
+	SignatureHeader = "X-Forwarded-Signature"
+
+	// the first line of everything we sign for an identity
+	signatureContext = "bzero-web-identity-v1\n"
+)
+
+type Config struct {
+	// Path to the policy file; headers are passed on as they are if this is
+	// empty
+	Path string
+
+	// The agent's key, which we sign identity headers with
+	SigningKey *keypair.PrivateKey
+}
+
+type Policy struct {
+	Host     string            `yaml:"host"`
+	Remove   []string          `yaml:"remove"`
+	Set      map[string]string `yaml:"set"`
+	Identity bool              `yaml:"identity"`
+	Sign     bool              `yaml:"sign"`
+}
+
+// Identity is who we tell the target the user is
+type Identity struct {
+	Subject string
+	Email   string
+	Groups  []string
+}
+
+// Rewriter applies a policy to the requests we make for a single user. A nil
+// Rewriter leaves requests as they are
+type Rewriter struct {
+	policy   Policy
+	identity Identity
+	key      *keypair.PrivateKey
+
+	// so that we can fix the time in tests
+	now func() time.Time
+}
+
+// Load reads the policy file and returns a Rewriter that applies it to
+// requests made for the given user, or nil if there's no policy
+func (c Config) Load(identity Identity) (*Rewriter, error) {
+	if c.Path == "" {
+		return nil, nil
+	}
+
+	var policy Policy
+	if found, err := policyfile.Load(c.Path, &policy); err != nil {
+		return nil, fmt.Errorf("failed to load web header policy: %w", err)
+	} else if !found {
+		return nil, nil
+	}
+
+	if policy.Sign && !policy.Identity {
+		return nil, fmt.Errorf("web header policy %s signs identity headers without adding them", c.Path)
+	} else if policy.Sign && c.SigningKey == nil {
+		return nil, fmt.Errorf("web header policy %s signs identity headers but the agent has no key to sign them with", c.Path)
+	}
+
+	return &Rewriter{
+		policy:   policy,
+		identity: identity,
+		key:      c.SigningKey,
+		now:      time.Now,
+	}, nil
+}
+
+// Rewrite applies our policy to a request that's about to be made
+func (r *Rewriter) Rewrite(request *http.Request) {
+	if r == nil {
+		return
+	}
+
+	if r.policy.Host != "" {
+		request.Host = r.policy.Host
+	}
+
+	for _, name := range r.policy.Remove {
+		request.Header.Del(name)
+	}
+	for name, value := range r.policy.Set {
+		request.Header.Set(name, value)
+	}
+
+	if !r.policy.Identity {
+		return
+	}
+
+	// these are ours to set, whatever the client sent
+	for _, name := range []string{UserHeader, EmailHeader, GroupsHeader, TimestampHeader, SignatureHeader} {
+		request.Header.Del(name)
+	}
+
+	groups := strings.Join(r.identity.Groups, ",")
+	request.Header.Set(UserHeader, r.identity.Subject)
+	if r.identity.Email != "" {
+		request.Header.Set(EmailHeader, r.identity.Email)
+	}
+	if groups != "" {
+		request.Header.Set(GroupsHeader, groups)
+	}
+
+	if r.policy.Sign {
+		timestamp := strconv.FormatInt(r.now().Unix(), 10)
+		request.Header.Set(TimestampHeader, timestamp)
+		request.Header.Set(SignatureHeader, r.key.Sign(signedContent(request, r.identity.Subject, r.identity.Email, groups, timestamp)))
+	}
+}
+
+// signedContent is what we sign for an identity. It starts with a fixed line
+// so that it can't be confused with anything else signed with the agent's key
+func signedContent(request *http.Request, fields ...string) []byte {
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+
+	var content strings.Builder
+	content.WriteString(signatureContext)
+	for _, line := range append([]string{request.Method, request.URL.RequestURI(), host}, fields...) {
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+	return []byte(content.String())
+}
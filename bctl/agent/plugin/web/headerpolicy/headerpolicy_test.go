@@ -0,0 +1,129 @@
+package headerpolicy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/keypair"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Web Header Policy Suite")
+}
+
+var _ = Describe("Web Header Policy", func() {
+	alice := Identity{
+		Subject: "1234",
+		Email:   "alice@example.com",
+		Groups:  []string{"devs", "admins"},
+	}
+
+	var path string
+	var publicKey *keypair.PublicKey
+	var privateKey *keypair.PrivateKey
+
+	writePolicy := func(contents string) {
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	newRequest := func() *http.Request {
+		request, _ := http.NewRequest(http.MethodGet, "http://10.0.0.5:3000/d/abc?orgId=1", nil)
+		request.Header.Set("Cookie", "session=abc")
+		request.Header.Set(UserHeader, "someone-else")
+		request.Header.Set(SignatureHeader, "forged")
+		return request
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "web-headers.yaml")
+
+		var err error
+		publicKey, privateKey, err = keypair.GenerateKeyPair()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("leaves requests alone if there's no policy", func() {
+		for _, config := range []Config{{}, {Path: path}} {
+			rewriter, err := config.Load(alice)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rewriter).To(BeNil())
+
+			request := newRequest()
+			rewriter.Rewrite(request)
+			Expect(request.Header.Get(UserHeader)).To(Equal("someone-else"))
+		}
+	})
+
+	It("refuses policies it can't use", func() {
+		for policy, expected := range map[string]string{
+			"host: [a":                   "failed to parse",
+			"hosts: grafana.internal":    "field hosts not found",
+			"sign: true":                 "without adding them",
+			"identity: true\nsign: true": "no key to sign them with",
+		} {
+			writePolicy(policy)
+			_, err := Config{Path: path}.Load(alice)
+			Expect(err).To(MatchError(ContainSubstring(expected)), policy)
+		}
+	})
+
+	It("rewrites the host and headers", func() {
+		writePolicy(`
+host: grafana.internal
+remove: [cookie]
+set:
+  X-Environment: production
+`)
+		rewriter, err := Config{Path: path}.Load(alice)
+		Expect(err).ToNot(HaveOccurred())
+
+		request := newRequest()
+		rewriter.Rewrite(request)
+		Expect(request.Host).To(Equal("grafana.internal"))
+		Expect(request.Header.Get("Cookie")).To(BeEmpty())
+		Expect(request.Header.Get("X-Environment")).To(Equal("production"))
+
+		By("passing on identity headers as they are unless we're asked to set them")
+		Expect(request.Header.Get(UserHeader)).To(Equal("someone-else"))
+	})
+
+	It("adds the user's identity in place of any the client sent", func() {
+		writePolicy("identity: true")
+		rewriter, err := Config{Path: path}.Load(Identity{Subject: "5678"})
+		Expect(err).ToNot(HaveOccurred())
+
+		request := newRequest()
+		rewriter.Rewrite(request)
+		Expect(request.Header.Values(UserHeader)).To(Equal([]string{"5678"}))
+		Expect(request.Header.Values(EmailHeader)).To(BeEmpty())
+		Expect(request.Header.Values(GroupsHeader)).To(BeEmpty())
+		Expect(request.Header.Values(SignatureHeader)).To(BeEmpty())
+	})
+
+	It("signs the user's identity with the agent's key", func() {
+		writePolicy("host: grafana.internal\nidentity: true\nsign: true")
+		rewriter, err := Config{Path: path, SigningKey: privateKey}.Load(alice)
+		Expect(err).ToNot(HaveOccurred())
+		rewriter.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+		request := newRequest()
+		rewriter.Rewrite(request)
+		Expect(request.Header.Get(UserHeader)).To(Equal("1234"))
+		Expect(request.Header.Get(EmailHeader)).To(Equal("alice@example.com"))
+		Expect(request.Header.Get(GroupsHeader)).To(Equal("devs,admins"))
+		Expect(request.Header.Get(TimestampHeader)).To(Equal("1700000000"))
+
+		signed := "GET\n/d/abc?orgId=1\ngrafana.internal\n1234\nalice@example.com\ndevs,admins\n1700000000\n"
+		Expect(publicKey.Verify([]byte("bzero-web-identity-v1\n"+signed), request.Header.Get(SignatureHeader))).To(BeTrue())
+
+		By("not signing anything that could be mistaken for something else the agent signs")
+		Expect(publicKey.Verify([]byte(signed), request.Header.Get(SignatureHeader))).To(BeFalse())
+	})
+})
@@ -0,0 +1,94 @@
+package upstreamtls
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+type Protocol int
+
+const (
+	// HTTP/1.1, or HTTP/2 if the target offers it while we make a TLS
+	// connection to it
+	HTTP Protocol = iota
+
+	// HTTP/2 without TLS, which is how gRPC is spoken to targets without it
+	H2C
+)
+
+// Transports keeps the transports we've made for each web target, so that
+// requests to the same target share its connections rather than each making
+// their own
+type Transports struct {
+	lock       sync.Mutex
+	transports map[transportKey]cachedTransport
+}
+
+type transportKey struct {
+	remoteHost string
+	remotePort int
+	protocol   Protocol
+}
+
+type cachedTransport struct {
+	settings  string
+	transport http.RoundTripper
+}
+
+func NewTransports() *Transports {
+	return &Transports{
+		transports: make(map[transportKey]cachedTransport),
+	}
+}
+
+// Transport returns the transport to make requests to the target with
+func (u *Upstream) Transport(protocol Protocol) http.RoundTripper {
+	if u.transports == nil {
+		return u.newTransport(protocol)
+	}
+	return u.transports.get(u, protocol)
+}
+
+func (t *Transports) get(upstream *Upstream, protocol Protocol) http.RoundTripper {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := transportKey{remoteHost: upstream.remoteHost, remotePort: upstream.remotePort, protocol: protocol}
+	if cached, ok := t.transports[key]; ok {
+		if cached.settings == upstream.settings {
+			return cached.transport
+		}
+
+		// the target's settings have changed; requests already using the old
+		// transport can finish, but its idle connections won't be used again
+		if closer, ok := cached.transport.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+
+	transport := upstream.newTransport(protocol)
+	t.transports[key] = cachedTransport{settings: upstream.settings, transport: transport}
+	return transport
+}
+
+func (u *Upstream) newTransport(protocol Protocol) http.RoundTripper {
+	if protocol == H2C {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig = u.TLSConfig
+	return transport
+}
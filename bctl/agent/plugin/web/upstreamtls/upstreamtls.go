@@ -0,0 +1,203 @@
+/*
+This package lets the agent reach web targets that use a private CA, or that
+want a client certificate, over TLS. The agent reads an optional YAML file of
+settings for each target such as:
+
+	targets:
+	  - host: vault.internal
+	    port: 8200
+	    caPath: /etc/bzero/tls/internal-ca.pem
+	    certPath: /etc/bzero/tls/agent.pem
+	    keyPath: /etc/bzero/tls/agent-key.pem
+	    serverName: vault.service.consul
+	    minVersion: "1.2"
+
+A target's settings apply to requests to its host, the remote host of the web
+target without its scheme, on its port, or on any port if port isn't set. The
+first target which matches is used, and requests to targets which don't match
+any use the system's CAs and Go's defaults.
+
+caPath is a PEM bundle of the only CAs we trust for the target, certPath and
+keyPath are the PEM client certificate and key we present to it, serverName is
+the name we expect on its certificate and send in SNI if it isn't the host we
+connect to, and minVersion is the lowest version of TLS we'll speak to it, one
+of 1.0, 1.1, 1.2 or 1.3.
+
+The file is read every time a web request starts (see the policyfile package).
+If it doesn't exist then every target uses the defaults, but if it can't be
+read or parsed, or a target's files can't be loaded, then requests to web
+targets fail. Requests to the same target share its transport, and so its
+connections, for as long as its settings and the files they name don't change.
+*/
+package upstreamtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"bastionzero.com/agent/config/policyfile"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+type Config struct {
+	// Path to the settings file; every target uses the defaults if this is
+	// empty
+	Path string
+
+	// The transports we share between requests to the same target; every
+	// request gets a new one if this is nil
+	Transports *Transports
+}
+
+// Upstream is how we reach a single web target
+type Upstream struct {
+	// The TLS config to reach the target with, or nil if it should use the
+	// defaults
+	TLSConfig *tls.Config
+
+	remoteHost string
+	remotePort int
+
+	// a hash of the target's settings and the files they name, so that we can
+	// tell when they change
+	settings   string
+	transports *Transports
+}
+
+type Settings struct {
+	Targets []Target `yaml:"targets"`
+}
+
+type Target struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	CAPath     string `yaml:"caPath"`
+	CertPath   string `yaml:"certPath"`
+	KeyPath    string `yaml:"keyPath"`
+	ServerName string `yaml:"serverName"`
+	MinVersion string `yaml:"minVersion"`
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Load returns how to reach the given web target
+func (c Config) Load(remoteHost string, remotePort int) (*Upstream, error) {
+	upstream := &Upstream{
+		remoteHost: remoteHost,
+		remotePort: remotePort,
+		transports: c.Transports,
+	}
+	if c.Path == "" {
+		return upstream, nil
+	}
+
+	var settings Settings
+	if _, err := policyfile.Load(c.Path, &settings); err != nil {
+		return nil, fmt.Errorf("failed to load web TLS settings: %w", err)
+	}
+
+	// remote hosts are given to us with their scheme, e.g. https://vault.internal
+	host := remoteHost
+	if remoteHostUrl, err := url.Parse(remoteHost); err == nil && remoteHostUrl.Hostname() != "" {
+		host = remoteHostUrl.Hostname()
+	}
+
+	for _, target := range settings.Targets {
+		if strings.EqualFold(target.Host, host) && (target.Port == 0 || target.Port == remotePort) {
+			if tlsConfig, settings, err := target.tlsConfig(); err != nil {
+				return nil, fmt.Errorf("failed to load web TLS settings for %s: %w", target.Host, err)
+			} else {
+				upstream.TLSConfig, upstream.settings = tlsConfig, settings
+				return upstream, nil
+			}
+		}
+	}
+	return upstream, nil
+}
+
+// tlsConfig returns the TLS config for the target, along with a hash of its
+// settings and the files they name
+func (t Target) tlsConfig() (*tls.Config, string, error) {
+	tlsConfig := &tls.Config{
+		ServerName: t.ServerName,
+	}
+
+	settings := sha256.New()
+	fmt.Fprintf(settings, "%#v\n", t)
+
+	if t.CAPath != "" {
+		if pem, err := os.ReadFile(t.CAPath); err != nil {
+			return nil, "", fmt.Errorf("failed to read CA bundle: %w", err)
+		} else {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, "", fmt.Errorf("no certificates found in CA bundle %s", t.CAPath)
+			}
+			settings.Write(pem)
+		}
+	}
+
+	if t.CertPath != "" || t.KeyPath != "" {
+		certPEM, err := os.ReadFile(t.CertPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		keyPEM, err := os.ReadFile(t.KeyPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		if cert, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return nil, "", fmt.Errorf("failed to load client certificate: %w", err)
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+			settings.Write(certPEM)
+			settings.Write(keyPEM)
+		}
+	}
+
+	if t.MinVersion != "" {
+		if version, ok := versions[t.MinVersion]; !ok {
+			return nil, "", fmt.Errorf("unknown minimum TLS version %s, must be one of 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		} else {
+			tlsConfig.MinVersion = version
+		}
+	}
+
+	return tlsConfig, hex.EncodeToString(settings.Sum(nil)), nil
+}
+
+// ErrorType tells apart the ways we can fail to make a TLS connection to a
+// target, so that the daemon can tell the user which it was. Returns false if
+// err has nothing to do with TLS
+func ErrorType(err error) (smsg.StreamType, bool) {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &verificationErr), errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return smsg.TLSCertificateError, true
+	case errors.As(err, &recordHeaderErr), strings.Contains(err.Error(), "tls: "):
+		// most of the handshake's errors, including the alerts the target
+		// sends us, are only told apart by their messages
+		return smsg.TLSHandshakeError, true
+	default:
+		return "", false
+	}
+}
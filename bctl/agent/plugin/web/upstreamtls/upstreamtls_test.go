@@ -0,0 +1,147 @@
+package upstreamtls
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Web Upstream TLS Suite")
+}
+
+var _ = Describe("Web Upstream TLS", func() {
+	var dir, path string
+	var server *httptest.Server
+
+	writeSettings := func(contents string) {
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	get := func(tlsConfig *tls.Config) error {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		response, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		path = filepath.Join(dir, "web-tls.yaml")
+
+		server = httptest.NewTLSServer(http.NotFoundHandler())
+		caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		Expect(os.WriteFile(filepath.Join(dir, "ca.pem"), caPem, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("uses the defaults if there are no settings for the target", func() {
+		writeSettings("targets:\n  - host: vault.internal\n")
+		for _, config := range []Config{{}, {Path: filepath.Join(dir, "missing.yaml")}, {Path: path}} {
+			upstream, err := config.Load("https://grafana.internal", 443)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(upstream.TLSConfig).To(BeNil())
+		}
+	})
+
+	It("refuses settings it can't use", func() {
+		for settings, expected := range map[string]string{
+			"targets: [a": "failed to parse",
+			"targets:\n  - host: vault.internal\n    ca: ca.pem":          "field ca not found",
+			"targets:\n  - host: vault.internal\n    caPath: missing.pem": "failed to read CA bundle",
+			"targets:\n  - host: vault.internal\n    caPath: " + path:     "no certificates found",
+			"targets:\n  - host: vault.internal\n    certPath: " + path:   "failed to load client certificate",
+			"targets:\n  - host: vault.internal\n    minVersion: \"2.0\"": "unknown minimum TLS version",
+		} {
+			writeSettings(settings)
+			_, err := Config{Path: path}.Load("https://vault.internal", 8200)
+			Expect(err).To(MatchError(ContainSubstring(expected)), settings)
+		}
+	})
+
+	It("uses the first target which matches the host and port", func() {
+		writeSettings(`
+targets:
+  - host: vault.internal
+    port: 8200
+    serverName: first
+  - host: VAULT.internal
+    serverName: second
+    minVersion: "1.3"
+`)
+		upstream, err := Config{Path: path}.Load("https://vault.internal", 8200)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upstream.TLSConfig.ServerName).To(Equal("first"))
+
+		upstream, err = Config{Path: path}.Load("https://vault.internal", 443)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upstream.TLSConfig.ServerName).To(Equal("second"))
+		Expect(upstream.TLSConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+	})
+
+	It("trusts a target's CA and tells apart why we couldn't connect", func() {
+		By("not trusting a private CA by default")
+		streamType, ok := ErrorType(get(nil))
+		Expect(ok).To(BeTrue())
+		Expect(streamType).To(Equal(smsg.TLSCertificateError))
+
+		By("trusting the CA we're given for the target")
+		writeSettings("targets:\n  - host: 127.0.0.1\n    caPath: " + filepath.Join(dir, "ca.pem"))
+		upstream, err := Config{Path: path}.Load("https://127.0.0.1", 443)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(get(upstream.TLSConfig)).To(Succeed())
+
+		By("failing the handshake if we can't agree on a version")
+		upstream.TLSConfig.MaxVersion = tls.VersionTLS11
+		streamType, ok = ErrorType(get(upstream.TLSConfig))
+		Expect(ok).To(BeTrue())
+		Expect(streamType).To(Equal(smsg.TLSHandshakeError))
+
+		_, ok = ErrorType(errors.New("connection refused"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("shares a target's transport until its settings change", func() {
+		config := Config{Path: path, Transports: NewTransports()}
+		transport := func(remoteHost string, remotePort int, protocol Protocol) http.RoundTripper {
+			upstream, err := config.Load(remoteHost, remotePort)
+			Expect(err).ToNot(HaveOccurred())
+			return upstream.Transport(protocol)
+		}
+
+		writeSettings("targets:\n  - host: 127.0.0.1\n    caPath: " + filepath.Join(dir, "ca.pem"))
+		shared := transport("https://127.0.0.1", 443, HTTP)
+		Expect(transport("https://127.0.0.1", 443, HTTP)).To(BeIdenticalTo(shared))
+		Expect(transport("https://127.0.0.1", 8443, HTTP)).ToNot(BeIdenticalTo(shared))
+		Expect(transport("https://127.0.0.1", 443, H2C)).ToNot(BeIdenticalTo(shared))
+
+		By("making a new one when the files the settings name change")
+		caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		Expect(os.WriteFile(filepath.Join(dir, "ca.pem"), append(caPem, caPem...), 0600)).To(Succeed())
+
+		changed := transport("https://127.0.0.1", 443, HTTP)
+		Expect(changed).ToNot(BeIdenticalTo(shared))
+		Expect(transport("https://127.0.0.1", 443, HTTP)).To(BeIdenticalTo(changed))
+
+		By("making a new one when the settings change")
+		writeSettings("targets:\n  - host: 127.0.0.1\n    serverName: vault.internal\n    caPath: " + filepath.Join(dir, "ca.pem"))
+		Expect(transport("https://127.0.0.1", 443, HTTP)).ToNot(BeIdenticalTo(changed))
+	})
+})
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"strings"
 
+	"bastionzero.com/agent/config/pluginconfig"
 	"bastionzero.com/agent/plugin/web/actions/webdial"
+	"bastionzero.com/agent/plugin/web/actions/webstream"
 	"bastionzero.com/agent/plugin/web/actions/webwebsocket"
+	"bastionzero.com/agent/plugin/web/headerpolicy"
 	"bastionzero.com/bzerolib/logger"
 	bzweb "bastionzero.com/bzerolib/plugin/web"
 	smsg "bastionzero.com/bzerolib/stream/message"
@@ -34,6 +37,8 @@ func New(
 	ch chan smsg.StreamMessage,
 	action string,
 	payload []byte,
+	pluginConfig pluginconfig.PluginConfig,
+	session pluginconfig.Session,
 ) (*WebPlugin, error) {
 
 	// Unmarshal the Syn payload
@@ -50,6 +55,22 @@ func New(
 		remoteHost:       actionPayload.RemoteHost,
 	}
 
+	// the target's owner may want to know who's making each request
+	headers, err := pluginConfig.WebHeaders.Load(headerpolicy.Identity{
+		Subject: session.Subject,
+		Email:   session.Email,
+		Groups:  session.Groups,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// and may have its own CA or want a client certificate
+	upstream, err := pluginConfig.WebTLS.Load(plugin.remoteHost, plugin.remotePort)
+	if err != nil {
+		return nil, err
+	}
+
 	// start the action for the plugin
 	subLogger := plugin.logger.GetActionLogger(action)
 
@@ -59,9 +80,11 @@ func New(
 	} else {
 		switch parsedAction {
 		case bzweb.Dial:
-			plugin.action, rerr = webdial.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.remoteHost, plugin.remotePort)
+			plugin.action, rerr = webdial.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.remoteHost, plugin.remotePort, headers, upstream)
 		case bzweb.Websocket:
-			plugin.action, rerr = webwebsocket.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.remoteHost, plugin.remotePort)
+			plugin.action, rerr = webwebsocket.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.remoteHost, plugin.remotePort, headers, upstream.TLSConfig)
+		case bzweb.Stream:
+			plugin.action, rerr = webstream.New(subLogger, plugin.streamOutputChan, plugin.doneChan, plugin.remoteHost, plugin.remotePort, headers, upstream)
 		default:
 			rerr = fmt.Errorf("unhandled Web action")
 		}
@@ -85,6 +108,14 @@ func (w *WebPlugin) Kill() {
 	}
 }
 
+// SynAckPayload tells the daemon which of our newer actions it can use
+func (w *WebPlugin) SynAckPayload() []byte {
+	payload, _ := json.Marshal(bzweb.WebSynAckPayload{
+		Stream: true,
+	})
+	return payload
+}
+
 func (w *WebPlugin) Receive(action string, actionPayload []byte) ([]byte, error) {
 	w.logger.Debugf("Web plugin received message with %v action", action)
 
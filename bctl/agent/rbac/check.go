@@ -0,0 +1,173 @@
+package rbac
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Result is everything that a kube agent running with some credentials would
+// be missing, for when it's checked on demand rather than at startup
+type Result struct {
+	// the rules we need but don't have, one verb each
+	Missing []rule
+
+	// users and groups we were asked about but aren't allowed to impersonate
+	Users  []string
+	Groups []string
+}
+
+// Check runs the same access reviews as CheckPermissions, and also makes sure
+// we're allowed to impersonate each of the given users and groups
+func Check(ctx context.Context, kubeConfig *rest.Config, namespace string, inCluster bool, users []string, groups []string) (*Result, error) {
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	if result.Missing, err = missingRules(ctx, clientset, namespace, inCluster, reqs); err != nil {
+		return nil, err
+	}
+
+	// RBAC can limit impersonation to particular names, so being allowed to
+	// impersonate someone doesn't mean we're allowed to impersonate everyone
+	if result.Users, err = unimpersonatable(ctx, clientset, "users", users); err != nil {
+		return nil, err
+	}
+	if result.Groups, err = unimpersonatable(ctx, clientset, "groups", groups); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func unimpersonatable(ctx context.Context, clientset kubernetes.Interface, resource string, names []string) ([]string, error) {
+	refused := []string{}
+	for _, name := range names {
+		ok, err := allowed(ctx, clientset, authorizationv1.ResourceAttributes{
+			Verb:     "impersonate",
+			Resource: resource,
+			Name:     name,
+		})
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			refused = append(refused, name)
+		}
+	}
+	return refused, nil
+}
+
+// Ok is true if the agent has every permission we checked for
+func (r *Result) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Users) == 0 && len(r.Groups) == 0
+}
+
+type manifest struct {
+	ApiVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Metadata   metadata `yaml:"metadata"`
+	Rules      []rule   `yaml:"rules"`
+}
+
+type metadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// Manifest is a ClusterRole, and a Role in namespace if we're missing anything
+// there, that would grant everything we found missing. They still need to be
+// bound to the agent's service account or kubeconfig user
+func (r *Result) Manifest(name string, namespace string) (string, error) {
+	clusterRules, namespacedRules := []rule{}, []rule{}
+	for _, missing := range r.Missing {
+		if missing.Namespaced {
+			namespacedRules = mergeRule(namespacedRules, missing)
+		} else {
+			clusterRules = mergeRule(clusterRules, missing)
+		}
+	}
+
+	// there's no need to list names if we're missing impersonation altogether
+	for _, refused := range []struct {
+		resource string
+		names    []string
+	}{{"users", r.Users}, {"groups", r.Groups}} {
+		if len(refused.names) > 0 && !hasRule(clusterRules, refused.resource, "impersonate") {
+			clusterRules = append(clusterRules, rule{
+				ApiGroups:     []string{""},
+				Resources:     []string{refused.resource},
+				Verbs:         []string{"impersonate"},
+				ResourceNames: refused.names,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+
+	if len(clusterRules) > 0 {
+		if err := encoder.Encode(manifest{
+			ApiVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRole",
+			Metadata:   metadata{Name: name},
+			Rules:      clusterRules,
+		}); err != nil {
+			return "", fmt.Errorf("failed to write ClusterRole: %w", err)
+		}
+	}
+
+	if len(namespacedRules) > 0 {
+		if err := encoder.Encode(manifest{
+			ApiVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "Role",
+			Metadata:   metadata{Name: name, Namespace: namespace},
+			Rules:      namespacedRules,
+		}); err != nil {
+			return "", fmt.Errorf("failed to write Role: %w", err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// mergeRule adds the verbs in r to the rule for the same resource, if there is
+// one, so that the manifest reads the way someone would write it by hand
+func mergeRule(rules []rule, r rule) []rule {
+	for i := range rules {
+		if rules[i].ApiGroups[0] == r.ApiGroups[0] && rules[i].Resources[0] == r.Resources[0] {
+			rules[i].Verbs = append(rules[i].Verbs, r.Verbs...)
+			return rules
+		}
+	}
+	return append(rules, r)
+}
+
+func hasRule(rules []rule, resource string, verb string) bool {
+	for _, r := range rules {
+		if r.Resources[0] != resource {
+			continue
+		}
+		for _, v := range r.Verbs {
+			if v == verb {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -15,10 +15,18 @@ import (
 	"k8s.io/client-go/rest"
 )
 
+// ServiceAccountNamespacePath is where the namespace of an agent running in the
+// cluster is mounted
+const ServiceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 type rule struct {
-	ApiGroups []string `json:"apiGroups"`
-	Resources []string `json:"resources"`
-	Verbs     []string `json:"verbs"`
+	ApiGroups     []string `json:"apiGroups" yaml:"apiGroups"`
+	Resources     []string `json:"resources" yaml:"resources"`
+	Verbs         []string `json:"verbs" yaml:"verbs"`
+	ResourceNames []string `json:"resourceNames,omitempty" yaml:"resourceNames,omitempty"`
+
+	Namespaced    bool `json:"namespaced,omitempty" yaml:"-"`
+	InClusterOnly bool `json:"inClusterOnly,omitempty" yaml:"-"`
 }
 
 type requirements struct {
@@ -33,126 +41,99 @@ func loadConfig() (requirements, error) {
 	return parsedConfig, nil
 }
 
-func createMissing(reqs requirements) map[string]map[string]map[string]bool {
-	// create a dictionary so we can be specific about the permissions they're missing
-	missing := make(map[string]map[string]map[string]bool)
-	for _, ruleReq := range reqs.Rules {
-		for _, apiGroupReq := range ruleReq.ApiGroups {
-			if _, ok := missing[apiGroupReq]; !ok {
-				missing[apiGroupReq] = make(map[string]map[string]bool)
-			}
-			for _, resourceReq := range ruleReq.Resources {
-				if _, ok := missing[apiGroupReq][resourceReq]; !ok {
-					missing[apiGroupReq][resourceReq] = make(map[string]bool)
-				}
-				for _, verbReq := range ruleReq.Verbs {
-					if _, ok := missing[apiGroupReq][resourceReq][verbReq]; !ok {
-						missing[apiGroupReq][resourceReq][verbReq] = false
-					}
-				}
-			}
-		}
+// allowed asks the API server whether we're allowed to do one thing
+func allowed(ctx context.Context, clientset kubernetes.Interface, attributes authorizationv1.ResourceAttributes) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+		},
 	}
-	return missing
+
+	result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("could not review agent permissions: %s", err)
+	}
+	return result.Status.Allowed, nil
 }
 
-func prettyPrintMissing(missing map[string]map[string]map[string]bool) []rule {
-	// put it back into a permissions rule format so it's easier for users to understand
-	prettyPrint := []rule{}
-	for apiGroup, resources := range missing {
-		for resource, verbs := range resources {
-			for verb := range verbs {
-				prettyPrint = append(prettyPrint, rule{
-					ApiGroups: []string{apiGroup},
-					Resources: []string{resource},
-					Verbs:     []string{verb},
-				})
+// missingRules asks the API server whether we can do everything in rules,
+// one verb at a time, and returns the ones we can't. We use access reviews
+// rather than listing our rules because they're answered by every authorizer,
+// including the webhooks used by managed clusters
+func missingRules(ctx context.Context, clientset kubernetes.Interface, namespace string, inCluster bool, reqs requirements) ([]rule, error) {
+	missing := []rule{}
+	for _, ruleReq := range reqs.Rules {
+		if ruleReq.InClusterOnly && !inCluster {
+			continue
+		}
+
+		ruleNamespace := ""
+		if ruleReq.Namespaced {
+			ruleNamespace = namespace
+		}
+
+		for _, apiGroup := range ruleReq.ApiGroups {
+			for _, resource := range ruleReq.Resources {
+				for _, verb := range ruleReq.Verbs {
+					ok, err := allowed(ctx, clientset, authorizationv1.ResourceAttributes{
+						Namespace: ruleNamespace,
+						Verb:      verb,
+						Group:     apiGroup,
+						Resource:  resource,
+					})
+					if err != nil {
+						return nil, err
+					} else if !ok {
+						// put it back into a permissions rule format so it's easier for users to understand
+						missing = append(missing, rule{
+							ApiGroups:  []string{apiGroup},
+							Resources:  []string{resource},
+							Verbs:      []string{verb},
+							Namespaced: ruleReq.Namespaced,
+						})
+					}
+				}
 			}
 		}
 	}
-	return prettyPrint
+	return missing, nil
 }
 
-func CheckPermissions(logger *logger.Logger, namespace string) error {
+// CheckPermissions makes sure that the credentials in kubeConfig let us do
+// everything the agent needs to. Agents running outside of the cluster aren't
+// in a namespace of their own, and don't need the permissions we use to keep
+// our config in the cluster
+func CheckPermissions(logger *logger.Logger, kubeConfig *rest.Config, namespace string, inCluster bool) error {
 	// verify the current namespace matches what was passed in
-	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
-		if ns := strings.TrimSpace(string(data)); len(ns) > 0 && ns != namespace {
-			return fmt.Errorf("current namespace %s does not match expected %s", ns, namespace)
+	if inCluster {
+		if data, err := ioutil.ReadFile(ServiceAccountNamespacePath); err == nil {
+			if ns := strings.TrimSpace(string(data)); len(ns) > 0 && ns != namespace {
+				return fmt.Errorf("current namespace %s does not match expected %s", ns, namespace)
+			}
 		}
 	}
 
-	// check for correct service account permissions
-	kubeConfig, err := rest.InClusterConfig()
-	if err != nil {
-		return err
-	}
+	// check for correct permissions
 	clientset, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
 		return err
 	}
 
-	sar := &authorizationv1.SelfSubjectRulesReview{
-		Spec: authorizationv1.SelfSubjectRulesReviewSpec{
-			Namespace: namespace,
-		},
-	}
-
-	// all rules as provided by the system
-	rules, rerr := clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(context.TODO(), sar, metav1.CreateOptions{})
-	if rerr != nil {
-		return fmt.Errorf("could not review service account permissions: %s", rerr)
-	}
-
 	// all required rules
 	reqs, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	// create a dictionary so we can be specific about the permissions they're missing
-	missing := createMissing(reqs)
-
-	// iterate through the list of provided rules and requirements, and delete from the dictionary of missing permissions.
-	for _, rule := range rules.Status.ResourceRules {
-		for _, apiGroup := range rule.APIGroups {
-			for _, resource := range rule.Resources {
-				for _, verb := range rule.Verbs {
-					for _, ruleReq := range reqs.Rules {
-						for _, apiGroupReq := range ruleReq.ApiGroups {
-							if apiGroup == apiGroupReq {
-								for _, resourceReq := range ruleReq.Resources {
-									if resource == resourceReq {
-										for _, verbReq := range ruleReq.Verbs {
-											if verb == verbReq {
-												if _, ok := missing[apiGroup][resource][verb]; ok {
-													delete(missing[apiGroup][resource], verb)
-
-													// cleanup apigroups and resources as we go
-													if len(missing[apiGroup][resource]) == 0 {
-														delete(missing[apiGroup], resource)
-														if len(missing[apiGroup]) == 0 {
-															delete(missing, apiGroup)
-														}
-													}
-												}
-											}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-
-	if len(missing) == 0 {
+	missing, err := missingRules(context.TODO(), clientset, namespace, inCluster, reqs)
+	if err != nil {
+		return err
+	} else if len(missing) == 0 {
 		return nil
-	} else {
-		// put it back into a permissions rule format so it's easier for users to understand
-		prettyPrint := prettyPrintMissing(missing)
+	}
 
-		return fmt.Errorf("service account lacks sufficient permissions, missing: %+v", prettyPrint)
+	if inCluster {
+		return fmt.Errorf("service account lacks sufficient permissions, missing: %+v", missing)
 	}
+	return fmt.Errorf("kubeconfig user lacks sufficient permissions, missing: %+v", missing)
 }
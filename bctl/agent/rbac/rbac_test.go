@@ -0,0 +1,220 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+func TestRbac(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent RBAC Suite")
+}
+
+// fakeApiServer answers access reviews by looking them up in allowed, keyed by
+// namespace/group/resource/verb, followed by /name for reviews of a single
+// resource
+func fakeApiServer(allowed map[string]bool, reviewed *[]authorizationv1.ResourceAttributes) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+		Expect(r.URL.Path).To(Equal("/apis/authorization.k8s.io/v1/selfsubjectaccessreviews"))
+
+		var review authorizationv1.SelfSubjectAccessReview
+		Expect(json.NewDecoder(r.Body).Decode(&review)).To(Succeed())
+
+		attributes := review.Spec.ResourceAttributes
+		*reviewed = append(*reviewed, *attributes)
+		key := attributes.Namespace + "/" + attributes.Group + "/" + attributes.Resource + "/" + attributes.Verb
+		if attributes.Name != "" {
+			key += "/" + attributes.Name
+		}
+		review.Status.Allowed = allowed[key]
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(review)
+	}))
+}
+
+func testConfig(server *httptest.Server) *rest.Config {
+	return &rest.Config{
+		Host:          server.URL,
+		ContentConfig: rest.ContentConfig{ContentType: "application/json"},
+	}
+}
+
+var _ = Describe("Agent RBAC", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	everything := map[string]bool{
+		"//users/impersonate":                                 true,
+		"//groups/impersonate":                                true,
+		"bastionzero//secrets/get":                            true,
+		"bastionzero//secrets/update":                         true,
+		"bastionzero//serviceaccounts/create":                 true,
+		"bastionzero//serviceaccounts/delete":                 true,
+		"bastionzero//serviceaccounts/list":                   true,
+		"bastionzero//serviceaccounts/get":                    true,
+		"/rbac.authorization.k8s.io/clusterrolebindings/list": true,
+		"/rbac.authorization.k8s.io/rolebindings/list":        true,
+	}
+
+	var reviewed []authorizationv1.ResourceAttributes
+
+	BeforeEach(func() {
+		reviewed = nil
+	})
+
+	It("passes if we're allowed to do everything", func() {
+		server := fakeApiServer(everything, &reviewed)
+		defer server.Close()
+
+		Expect(CheckPermissions(logger, testConfig(server), "bastionzero", true)).To(Succeed())
+		Expect(reviewed).To(HaveLen(len(everything)))
+	})
+
+	It("lists what we're missing", func() {
+		allowed := map[string]bool{}
+		for permission := range everything {
+			allowed[permission] = true
+		}
+		delete(allowed, "//groups/impersonate")
+		delete(allowed, "bastionzero//secrets/update")
+
+		server := fakeApiServer(allowed, &reviewed)
+		defer server.Close()
+
+		err := CheckPermissions(logger, testConfig(server), "bastionzero", true)
+		Expect(err).To(MatchError(ContainSubstring("service account lacks sufficient permissions")))
+		Expect(err.Error()).To(ContainSubstring("Resources:[groups] Verbs:[impersonate]"))
+		Expect(err.Error()).To(ContainSubstring("Resources:[secrets] Verbs:[update]"))
+		Expect(err.Error()).ToNot(ContainSubstring("Resources:[users]"))
+	})
+
+	It("only checks cluster-wide permissions for agents running outside of the cluster", func() {
+		server := fakeApiServer(map[string]bool{
+			"//users/impersonate":                                 true,
+			"//groups/impersonate":                                true,
+			"/rbac.authorization.k8s.io/clusterrolebindings/list": true,
+			"/rbac.authorization.k8s.io/rolebindings/list":        true,
+		}, &reviewed)
+		defer server.Close()
+
+		Expect(CheckPermissions(logger, testConfig(server), "", false)).To(Succeed())
+		for _, attributes := range reviewed {
+			Expect(attributes.Resource).ToNot(BeElementOf("secrets", "serviceaccounts"))
+		}
+	})
+
+	Context("Checking on demand", func() {
+		It("checks the users and groups we'll impersonate", func() {
+			allowed := map[string]bool{
+				"//users/impersonate/alice": true,
+				"//groups/impersonate/devs": true,
+			}
+			for permission := range everything {
+				allowed[permission] = true
+			}
+			delete(allowed, "//users/impersonate")
+			delete(allowed, "//groups/impersonate")
+
+			server := fakeApiServer(allowed, &reviewed)
+			defer server.Close()
+
+			result, err := Check(context.Background(), testConfig(server), "bastionzero", true, []string{"alice", "bob"}, []string{"devs", "admins"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Ok()).To(BeFalse())
+			Expect(result.Users).To(Equal([]string{"bob"}))
+			Expect(result.Groups).To(Equal([]string{"admins"}))
+
+			By("only asking for the names we can't impersonate, since we'd otherwise ask for impersonation altogether")
+			manifest, err := result.Manifest("bastionzero-agent", "bastionzero")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest).To(Equal(`apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: bastionzero-agent
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - users
+    verbs:
+      - impersonate
+  - apiGroups:
+      - ""
+    resources:
+      - groups
+    verbs:
+      - impersonate
+`))
+		})
+
+		It("writes a manifest that grants what we're missing", func() {
+			server := fakeApiServer(map[string]bool{
+				"//users/impersonate":                                 true,
+				"//groups/impersonate":                                true,
+				"bastionzero//secrets/get":                            true,
+				"bastionzero//serviceaccounts/list":                   true,
+				"bastionzero//serviceaccounts/get":                    true,
+				"/rbac.authorization.k8s.io/clusterrolebindings/list": true,
+			}, &reviewed)
+			defer server.Close()
+
+			result, err := Check(context.Background(), testConfig(server), "bastionzero", true, []string{"alice"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Users).To(Equal([]string{"alice"}))
+
+			manifest, err := result.Manifest("bastionzero-agent", "bastionzero")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest).To(Equal(`apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: bastionzero-agent
+rules:
+  - apiGroups:
+      - rbac.authorization.k8s.io
+    resources:
+      - rolebindings
+    verbs:
+      - list
+  - apiGroups:
+      - ""
+    resources:
+      - users
+    verbs:
+      - impersonate
+    resourceNames:
+      - alice
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: bastionzero-agent
+  namespace: bastionzero
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - update
+  - apiGroups:
+      - ""
+    resources:
+      - serviceaccounts
+    verbs:
+      - create
+      - delete
+`))
+		})
+	})
+})
@@ -1,5 +1,9 @@
 package rbac
 
+// Rules are checked across the cluster unless they're namespaced, in which case
+// we only need them in the agent's own namespace. Rules for secrets are only
+// needed by agents that keep their config in them, which are those running in
+// the cluster
 var rulesConfig = `{ 
     "rules":[
         {
@@ -10,12 +14,16 @@ var rulesConfig = `{
         {
             "apiGroups": [""],
             "resources": ["secrets"],
-            "verbs": ["get", "update"]
+            "verbs": ["get", "update"],
+            "namespaced": true,
+            "inClusterOnly": true
         },
         {
             "apiGroups": [""],
             "resources": ["serviceaccounts"],
-            "verbs": ["create", "delete", "list", "get"]
+            "verbs": ["create", "delete", "list", "get"],
+            "namespaced": true,
+            "inClusterOnly": true
         },
         {
             "apiGroups": ["rbac.authorization.k8s.io"],
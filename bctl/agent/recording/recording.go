@@ -0,0 +1,231 @@
+/*
+This package records interactive sessions on the agent as asciicast v2 files
+(https://docs.asciinema.org/manual/asciicast/v2/) so that they can be replayed
+without needing to reach BastionZero.
+
+Each session gets its own file in the configured directory. The first line of
+the file is a JSON header describing the session, and every following line is
+an event of the form [seconds since start, type, data] where the type is one of:
+
+	"o" - output written by the session
+	"i" - input received from the user
+	"r" - a terminal resize, with data of the form "{cols}x{rows}"
+
+Old recordings are pruned every time a new recording is started so that the
+directory never grows past the configured age and size limits.
+*/
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+const (
+	asciicastVersion = 2
+	fileExtension    = ".cast"
+
+	// used when we haven't received a resize before the first event
+	defaultCols = 80
+	defaultRows = 24
+
+	outputEvent = "o"
+	inputEvent  = "i"
+	resizeEvent = "r"
+)
+
+type Config struct {
+	// Directory to write recordings to; recording is disabled if this is empty
+	Dir string
+
+	// Recordings older than this are deleted, zero means keep forever
+	MaxAge time.Duration
+
+	// Oldest recordings are deleted until the directory is smaller than this
+	// many bytes, zero means no limit
+	MaxSize int64
+}
+
+func (c Config) Enabled() bool {
+	return c.Dir != ""
+}
+
+type header struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	// BastionZero specific metadata about who opened this session
+	Metadata map[string]string `json:"bastionzero,omitempty"`
+}
+
+type Recorder struct {
+	lock   sync.Mutex
+	logger *logger.Logger
+
+	file  *os.File
+	start time.Time
+
+	// we hold off on writing the header until the first event so that we can
+	// use the first resize as the initial terminal size
+	header        header
+	headerWritten bool
+
+	// trailing bytes of incomplete utf8 characters, by event type
+	partial map[string][]byte
+
+	// we stop recording after the first write failure
+	failed bool
+}
+
+// New prunes any expired recordings and then starts a new recording called
+// name in the configured directory. Metadata is written to the recording's
+// header and should identify the session and the user who opened it
+func New(logger *logger.Logger, config Config, name string, command string, metadata map[string]string) (*Recorder, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory %s: %w", config.Dir, err)
+	}
+
+	if err := prune(logger, config); err != nil {
+		// we still want to record this session even if we couldn't clean up
+		logger.Errorf("failed to prune old session recordings: %s", err)
+	}
+
+	start := time.Now()
+	fileName := fmt.Sprintf("%s-%s%s", start.UTC().Format("20060102T150405Z"), name, fileExtension)
+	path := filepath.Join(config.Dir, fileName)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file %s: %w", path, err)
+	}
+
+	logger.Infof("Recording session to %s", path)
+
+	return &Recorder{
+		logger: logger,
+		file:   file,
+		start:  start,
+		header: header{
+			Version:   asciicastVersion,
+			Width:     defaultCols,
+			Height:    defaultRows,
+			Timestamp: start.Unix(),
+			Command:   command,
+			Title:     name,
+			Metadata:  metadata,
+		},
+		partial: make(map[string][]byte),
+	}, nil
+}
+
+// Output records bytes written by the session
+func (r *Recorder) Output(data []byte) {
+	r.writeData(outputEvent, data)
+}
+
+// Input records bytes sent to the session by the user
+func (r *Recorder) Input(data []byte) {
+	r.writeData(inputEvent, data)
+}
+
+// Resize records a change in terminal size
+func (r *Recorder) Resize(cols, rows uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// if nothing has happened yet, this is our starting size
+	if !r.headerWritten {
+		r.header.Width = cols
+		r.header.Height = rows
+		return
+	}
+
+	r.writeEvent(resizeEvent, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close flushes any buffered partial characters and closes the recording
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	for eventType, leftover := range r.partial {
+		if len(leftover) > 0 {
+			r.writeEvent(eventType, string(leftover))
+		}
+	}
+
+	// always make sure we at least have a header so the file is playable
+	if !r.headerWritten {
+		r.writeHeader()
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *Recorder) writeData(eventType string, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// reads from a terminal can split multi-byte characters, so we hold on to
+	// any incomplete character until the rest of it arrives
+	buf := append(r.partial[eventType], data...)
+	complete := len(buf)
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+
+	r.partial[eventType] = append([]byte{}, buf[complete:]...)
+	if complete > 0 {
+		r.writeEvent(eventType, string(buf[:complete]))
+	}
+}
+
+func (r *Recorder) writeEvent(eventType string, data string) {
+	if r.file == nil || r.failed {
+		return
+	}
+
+	if !r.headerWritten {
+		r.writeHeader()
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	r.writeLine([]interface{}{elapsed, eventType, data})
+}
+
+func (r *Recorder) writeHeader() {
+	r.headerWritten = true
+	r.writeLine(r.header)
+}
+
+func (r *Recorder) writeLine(v interface{}) {
+	if line, err := json.Marshal(v); err != nil {
+		r.logger.Errorf("failed to marshal session recording event: %s", err)
+	} else if _, err := r.file.Write(append(line, '\n')); err != nil {
+		r.logger.Errorf("failed to write to session recording, no further events will be recorded: %s", err)
+		r.failed = true
+	}
+}
@@ -0,0 +1,151 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+func TestRecording(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Agent Session Recording Suite")
+}
+
+func readRecording(path string) (header, [][]interface{}) {
+	file, err := os.Open(path)
+	Expect(err).ToNot(HaveOccurred())
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	Expect(scanner.Scan()).To(BeTrue())
+
+	var h header
+	Expect(json.Unmarshal(scanner.Bytes(), &h)).To(Succeed())
+
+	events := [][]interface{}{}
+	for scanner.Scan() {
+		var event []interface{}
+		Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+		events = append(events, event)
+	}
+
+	return h, events
+}
+
+func recordings(dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+fileExtension))
+	Expect(err).ToNot(HaveOccurred())
+	return matches
+}
+
+var _ = Describe("Session Recording", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	When("recording a session", func() {
+		var path string
+
+		BeforeEach(func() {
+			metadata := map[string]string{
+				"datachannelId": "dc-id",
+				"targetUser":    "bob",
+				"subject":       "1234",
+			}
+
+			recorder, err := New(logger, Config{Dir: dir}, "dc-id", "", metadata)
+			Expect(err).ToNot(HaveOccurred())
+
+			recorder.Resize(100, 40)
+			recorder.Input([]byte("ls\r"))
+			recorder.Output([]byte("file\r\n"))
+			recorder.Resize(120, 50)
+
+			// split a multi-byte character across two reads
+			snowman := []byte("☃")
+			recorder.Output(snowman[:1])
+			recorder.Output(snowman[1:])
+
+			Expect(recorder.Close()).To(Succeed())
+
+			files := recordings(dir)
+			Expect(files).To(HaveLen(1))
+			path = files[0]
+		})
+
+		It("writes an asciicast v2 header with the session metadata", func() {
+			h, _ := readRecording(path)
+			Expect(h.Version).To(Equal(2))
+			Expect(h.Width).To(BeEquivalentTo(100))
+			Expect(h.Height).To(BeEquivalentTo(40))
+			Expect(h.Metadata).To(HaveKeyWithValue("datachannelId", "dc-id"))
+			Expect(h.Metadata).To(HaveKeyWithValue("targetUser", "bob"))
+			Expect(h.Metadata).To(HaveKeyWithValue("subject", "1234"))
+		})
+
+		It("records input, output and resize events in order", func() {
+			_, events := readRecording(path)
+			Expect(events).To(HaveLen(4))
+
+			Expect(events[0][1:]).To(Equal([]interface{}{inputEvent, "ls\r"}))
+			Expect(events[1][1:]).To(Equal([]interface{}{outputEvent, "file\r\n"}))
+			Expect(events[2][1:]).To(Equal([]interface{}{resizeEvent, "120x50"}))
+			Expect(events[3][1:]).To(Equal([]interface{}{outputEvent, "☃"}))
+		})
+
+		It("only allows the agent to read the recording", func() {
+			info, err := os.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+	})
+
+	When("starting a new recording", func() {
+		writeOldRecording := func(name string, size int, age time.Duration) string {
+			path := filepath.Join(dir, name+fileExtension)
+			Expect(os.WriteFile(path, make([]byte, size), 0600)).To(Succeed())
+
+			modTime := time.Now().Add(-age)
+			Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+			return path
+		}
+
+		It("deletes recordings older than the max age", func() {
+			old := writeOldRecording("old", 10, 48*time.Hour)
+			recent := writeOldRecording("recent", 10, time.Minute)
+
+			recorder, err := New(logger, Config{Dir: dir, MaxAge: 24 * time.Hour}, "new", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer recorder.Close()
+
+			Expect(old).ToNot(BeAnExistingFile())
+			Expect(recent).To(BeAnExistingFile())
+		})
+
+		It("deletes the oldest recordings until under the max size", func() {
+			oldest := writeOldRecording("oldest", 100, 3*time.Hour)
+			older := writeOldRecording("older", 100, 2*time.Hour)
+			newest := writeOldRecording("newest", 100, time.Hour)
+
+			recorder, err := New(logger, Config{Dir: dir, MaxSize: 250}, "new", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer recorder.Close()
+
+			Expect(oldest).ToNot(BeAnExistingFile())
+			Expect(older).To(BeAnExistingFile())
+			Expect(newest).To(BeAnExistingFile())
+		})
+	})
+})
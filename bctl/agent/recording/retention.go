@@ -0,0 +1,74 @@
+package recording
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+type recordingFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// prune deletes every recording older than the configured max age and then
+// deletes the oldest remaining recordings until we are under the max size
+func prune(logger *logger.Logger, config Config) error {
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read recording directory %s: %w", config.Dir, err)
+	}
+
+	files := []recordingFile{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), fileExtension) {
+			continue
+		}
+
+		if info, err := entry.Info(); err != nil {
+			logger.Errorf("failed to stat session recording %s: %s", entry.Name(), err)
+		} else {
+			files = append(files, recordingFile{
+				path:    filepath.Join(config.Dir, entry.Name()),
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
+		}
+	}
+
+	// oldest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var totalSize int64
+	for _, file := range files {
+		totalSize += file.size
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		expired := config.MaxAge > 0 && now.Sub(file.modTime) > config.MaxAge
+		tooBig := config.MaxSize > 0 && totalSize > config.MaxSize
+
+		if !expired && !tooBig {
+			// since we're sorted by age, nothing after this can be expired either
+			break
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			logger.Errorf("failed to remove session recording %s: %s", file.path, err)
+		} else {
+			logger.Infof("Removed session recording %s", file.path)
+			totalSize -= file.size
+		}
+	}
+
+	return nil
+}
@@ -17,6 +17,13 @@ const (
 	PLUGIN                        = "PLUGIN"                        // Plugin to activate
 	AGENT_PUB_KEY                 = "AGENT_PUB_KEY"                 // Base64 encoded string of agent's public key
 	DEBUG                         = "DEBUG"                         // Flag to indicate if we should start the daemon in debug mode
+	MESSENGER                     = "MESSENGER"                     // One of ['signalr', 'json'], the protocol to speak to the connection node
+
+	// direct mode, for connecting straight to the agent instead of through the connection node
+	DIRECT_AGENT_ADDRESS = "DIRECT_AGENT_ADDRESS" // host:port the agent is listening for direct connections on
+	DIRECT_CERT_PATH     = "DIRECT_CERT_PATH"     // Path to the cert we present to the agent
+	DIRECT_KEY_PATH      = "DIRECT_KEY_PATH"      // Path to the key for DIRECT_CERT_PATH
+	DIRECT_CA_PATH       = "DIRECT_CA_PATH"       // Path to the CA that signed the agent's cert
 
 	// for interacting with the user and the ZLI
 	LOCAL_PORT            = "LOCAL_PORT"            // Used to serve the selected plugin
@@ -39,6 +46,9 @@ const (
 
 	// shell plugin variables
 	DATACHANNEL_ID = "DATACHANNEL_ID" // The datachannel id to attach to an existing shell connection
+	SHELL_ACTION   = "SHELL_ACTION"   // One of ['default', 'exec'], defaults to 'default'
+	SHELL_COMMAND  = "SHELL_COMMAND"  // The command to run with the exec action
+	SHELL_TIMEOUT  = "SHELL_TIMEOUT"  // Seconds the exec action's command may run for before it is killed, 0 for no limit
 
 	// ssh plugin variables
 	IDENTITY_FILE    = "IDENTITY_FILE"    // Path to an SSH IdentityFile
@@ -46,14 +56,22 @@ const (
 	SSH_ACTION       = "SSH_ACTION"       // One of ['opaque', 'transparent']
 	HOSTNAMES        = "HOSTNAMES"        // Comma-separated list of hostNames to use for this target
 
+	// web plugin variables
+	MAX_REQUEST_SIZE  = "MAX_REQUEST_SIZE"  // Largest request body in bytes the web plugin will send to the target, 0 for no limit. Defaults to 10MB, or 150MB for uploads
+	REWRITE_RESPONSES = "REWRITE_RESPONSES" // One of ['', 'headers', 'html'], how much of the target's responses to point at the daemon instead
+	REWRITE_HOSTS     = "REWRITE_HOSTS"     // Comma-separated list of other host[:port]s the target thinks it's at
+
 	// db plugin variables
-	DB_ACTION = "DB_ACTION" // One of ['dial', 'pwdb']
-	TCP_APP   = "TCP_APP"   // ['rdp', 'db', 'sqlserver']
+	DB_ACTION        = "DB_ACTION"        // One of ['dial', 'pwdb', 'udp']
+	TCP_APP          = "TCP_APP"          // ['rdp', 'db', 'sqlserver']
+	UDP_IDLE_TIMEOUT = "UDP_IDLE_TIMEOUT" // Seconds a udp flow can go without a datagram before it is closed, 0 for the agent's default
 )
 
 var (
 	requriedGlobalVars = []string{CONNECTION_ID, CONNECTION_SERVICE_URL, CONNECTION_SERVICE_AUTH_TOKEN, SESSION_ID, SESSION_TOKEN, AUTH_HEADER, LOG_PATH, CONFIG_PATH, AGENT_PUB_KEY, REFRESH_TOKEN_COMMAND}
 
+	requiredDirectVars = []string{DIRECT_AGENT_ADDRESS, DIRECT_CERT_PATH, DIRECT_KEY_PATH, DIRECT_CA_PATH, LOG_PATH, CONFIG_PATH, AGENT_PUB_KEY, REFRESH_TOKEN_COMMAND}
+
 	requriedPluginVars = map[bzplugin.PluginName][]string{
 		bzplugin.Kube:  {LOCAL_PORT, TARGET_USER, TARGET_ID, LOCALHOST_TOKEN, CERT_PATH, KEY_PATH},
 		bzplugin.Db:    {LOCAL_PORT, REMOTE_HOST, REMOTE_PORT, DB_ACTION},
@@ -83,6 +101,13 @@ var config = map[string]EnvVar{
 	PLUGIN:                        {},
 	AGENT_PUB_KEY:                 {},
 	DEBUG:                         {},
+	MESSENGER:                     {},
+
+	// direct mode
+	DIRECT_AGENT_ADDRESS: {},
+	DIRECT_CERT_PATH:     {},
+	DIRECT_KEY_PATH:      {},
+	DIRECT_CA_PATH:       {},
 
 	// for interacting with the user and the ZLI
 	LOCAL_PORT:            {},
@@ -105,6 +130,9 @@ var config = map[string]EnvVar{
 
 	// shell plugin variables
 	DATACHANNEL_ID: {},
+	SHELL_ACTION:   {},
+	SHELL_COMMAND:  {},
+	SHELL_TIMEOUT:  {},
 
 	// ssh plugin variables
 	IDENTITY_FILE:    {},
@@ -112,7 +140,13 @@ var config = map[string]EnvVar{
 	SSH_ACTION:       {},
 	HOSTNAMES:        {},
 
+	// web plugin variables
+	MAX_REQUEST_SIZE:  {},
+	REWRITE_RESPONSES: {},
+	REWRITE_HOSTS:     {},
+
 	// db plugin variables
 	DB_ACTION: {},
 	TCP_APP: {},
+	UDP_IDLE_TIMEOUT: {},
 }
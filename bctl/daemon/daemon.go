@@ -13,10 +13,14 @@ import (
 	"time"
 
 	"bastionzero.com/bzerolib/bzos"
+	"bastionzero.com/bzerolib/connection/messenger"
+	"bastionzero.com/bzerolib/connection/transporter/tlsconn"
+	"bastionzero.com/bzerolib/connection/transporter/websocket"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/plugin/db"
 	"bastionzero.com/bzerolib/report"
 	"bastionzero.com/daemon/exit"
+	"bastionzero.com/daemon/mrtap"
 	"bastionzero.com/daemon/mrtap/bzcert"
 	"bastionzero.com/daemon/mrtap/bzcert/zliconfig"
 	"bastionzero.com/daemon/servers/controlserver"
@@ -26,9 +30,11 @@ import (
 	"bastionzero.com/daemon/servers/shellserver"
 	"bastionzero.com/daemon/servers/sshserver"
 	"bastionzero.com/daemon/servers/webserver"
+	"bastionzero.com/daemon/servers/webserver/rewrite"
 
 	bzlogger "bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
+	bzshell "bastionzero.com/bzerolib/plugin/shell"
 )
 
 const (
@@ -54,8 +60,11 @@ func main() {
 			// how the zli tells the daemon to stop
 			daemonShutdownChan := make(chan struct{})
 
+			// the pipeline windows of our datachannels, which the control server reports on
+			metrics := mrtap.NewMetrics()
+
 			// initialize the server used to control the daemon
-			controlServer := controlserver.New(logger, config[CONTROL_PORT].Value, daemonShutdownChan)
+			controlServer := controlserver.New(logger, config[CONTROL_PORT].Value, daemonShutdownChan, metrics)
 			controlServer.Start()
 
 			// how the daemon tells the plugin server to stop
@@ -63,7 +72,7 @@ func main() {
 			// any server that experiences a fatal error writes to this channel
 			// additionally, ephemeral servers write to this channel when their datachannel is done
 			serverErrChan := make(chan error)
-			go startPluginServer(logger, pluginShutdownChan, serverErrChan)
+			go startPluginServer(logger, metrics, pluginShutdownChan, serverErrChan)
 
 			for {
 				select {
@@ -122,7 +131,7 @@ func reportError(logger *bzlogger.Logger, err error) {
 	}
 }
 
-func startPluginServer(logger *bzlogger.Logger, pluginShutdownChan chan struct{}, errChan chan error) {
+func startPluginServer(logger *bzlogger.Logger, metrics *mrtap.Metrics, pluginShutdownChan chan struct{}, errChan chan error) {
 	plugin := config[PLUGIN].Value
 	logger.Infof("Opening connection to the Connection Node: %s for %s plugin", config[CONNECTION_SERVICE_URL].Value, plugin)
 
@@ -167,15 +176,15 @@ func startPluginServer(logger *bzlogger.Logger, pluginShutdownChan chan struct{}
 
 	switch bzplugin.PluginName(plugin) {
 	case bzplugin.Db:
-		server, err = newDbServer(logger, publicKey, errChan, headers, params, cert)
+		server, err = newDbServer(logger, publicKey, errChan, headers, params, cert, metrics)
 	case bzplugin.Kube:
-		server, err = newKubeServer(logger, publicKey, errChan, headers, params, cert)
+		server, err = newKubeServer(logger, publicKey, errChan, headers, params, cert, metrics)
 	case bzplugin.Shell:
-		server, err = newShellServer(logger, publicKey, errChan, headers, params, cert)
+		server, err = newShellServer(logger, publicKey, errChan, headers, params, cert, metrics)
 	case bzplugin.Ssh:
-		server, err = newSshServer(logger, publicKey, errChan, headers, params, cert)
+		server, err = newSshServer(logger, publicKey, errChan, headers, params, cert, metrics)
 	case bzplugin.Web:
-		server, err = newWebServer(logger, publicKey, errChan, headers, params, cert)
+		server, err = newWebServer(logger, publicKey, errChan, headers, params, cert, metrics)
 	default:
 		errChan <- fmt.Errorf("unhandled plugin passed when trying to start server: %s", plugin)
 	}
@@ -199,9 +208,37 @@ func listenForShutdown(shutdownChan <-chan struct{}, server PluginServer) {
 	}
 }
 
-func newSshServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert) (*sshserver.SshServer, error) {
+// newMessenger creates the messenger a plugin server uses to reach the agent,
+// either through the connection node or, in direct mode, straight to the agent
+func newMessenger(logger *bzlogger.Logger) (messenger.Messenger, error) {
+	if config[DIRECT_AGENT_ADDRESS].Value != "" {
+		tlsConfig, err := tlsconn.ClientConfig(config[DIRECT_CERT_PATH].Value, config[DIRECT_KEY_PATH].Value, config[DIRECT_CA_PATH].Value)
+		if err != nil {
+			return nil, err
+		}
+
+		// TLS has no message boundaries so we always need to frame our own
+		tlsLogger := logger.GetComponentLogger("TLS")
+		return messenger.New(messenger.JsonFrame, logger, tlsconn.New(tlsLogger, tlsConfig))
+	}
+
+	protocol, err := messenger.ParseProtocol(config[MESSENGER].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	wsLogger := logger.GetComponentLogger("Websocket")
+	return messenger.New(protocol, logger, websocket.New(wsLogger))
+}
+
+func newSshServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert, metrics *mrtap.Metrics) (*sshserver.SshServer, error) {
 	subLogger := logger.GetComponentLogger("sshserver")
 
+	client, err := newMessenger(subLogger)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if remote port is valid
 	remotePort, err := strconv.Atoi(config[REMOTE_PORT].Value)
 	if err != nil {
@@ -220,10 +257,12 @@ func newSshServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan
 		config[TARGET_USER].Value,
 		config[DATACHANNEL_ID].Value,
 		cert,
+		metrics,
 		config[CONNECTION_SERVICE_URL].Value,
 		params,
 		headers,
 		publicKey,
+		client,
 		config[IDENTITY_FILE].Value,
 		config[KNOWN_HOSTS_FILE].Value,
 		strings.Split(config[HOSTNAMES].Value, ","),
@@ -234,32 +273,84 @@ func newSshServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan
 	)
 }
 
-func newShellServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert) (*shellserver.ShellServer, error) {
+func newShellServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert, metrics *mrtap.Metrics) (*shellserver.ShellServer, error) {
 	subLogger := logger.GetComponentLogger("shellserver")
 
+	client, err := newMessenger(subLogger)
+	if err != nil {
+		return nil, err
+	}
+
 	params["connectionType"] = []string{string(dataconnection.Shell)}
 
+	action := bzshell.DefaultShell
+	if config[SHELL_ACTION].Value != "" {
+		action = bzshell.ShellAction(config[SHELL_ACTION].Value)
+	}
+
+	if action != bzshell.DefaultShell && action != bzshell.Exec {
+		return nil, fmt.Errorf("unhandled shell action: %s", action)
+	} else if action == bzshell.Exec && config[SHELL_COMMAND].Value == "" {
+		return nil, fmt.Errorf("the exec shell action requires a command")
+	}
+
+	timeout := 0
+	if config[SHELL_TIMEOUT].Value != "" {
+		if timeout, err = strconv.Atoi(config[SHELL_TIMEOUT].Value); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("failed to parse shell timeout: %s", config[SHELL_TIMEOUT].Value)
+		}
+	}
+
 	return shellserver.New(
 		subLogger,
 		errChan,
 		config[TARGET_USER].Value,
 		config[DATACHANNEL_ID].Value,
 		cert,
+		metrics,
 		config[CONNECTION_SERVICE_URL].Value,
 		params,
 		headers,
 		publicKey,
+		client,
+		action,
+		config[SHELL_COMMAND].Value,
+		time.Duration(timeout)*time.Second,
 	)
 }
 
-func newWebServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert) (*webserver.WebServer, error) {
+func newWebServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert, metrics *mrtap.Metrics) (*webserver.WebServer, error) {
 	subLogger := logger.GetComponentLogger("webserver")
 
+	client, err := newMessenger(subLogger)
+	if err != nil {
+		return nil, err
+	}
+
 	remotePort, err := strconv.Atoi(config[REMOTE_PORT].Value)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse remote port: %w", err)
 	}
 
+	// we only lift the default limits if we're told to
+	maxRequestSize := int64(webserver.DefaultMaxRequestSize)
+	maxUploadSize := int64(webserver.DefaultMaxUploadSize)
+	if config[MAX_REQUEST_SIZE].Value != "" {
+		if maxRequestSize, err = strconv.ParseInt(config[MAX_REQUEST_SIZE].Value, 10, 64); err != nil || maxRequestSize < 0 {
+			return nil, fmt.Errorf("failed to parse max request size: %s", config[MAX_REQUEST_SIZE].Value)
+		}
+		maxUploadSize = maxRequestSize
+	}
+
+	var otherHosts []string
+	if config[REWRITE_HOSTS].Value != "" {
+		otherHosts = strings.Split(config[REWRITE_HOSTS].Value, ",")
+	}
+	rewriter, err := rewrite.New(rewrite.Mode(config[REWRITE_RESPONSES].Value), config[REMOTE_HOST].Value, remotePort, otherHosts)
+	if err != nil {
+		return nil, err
+	}
+
 	params["connectionType"] = []string{string(dataconnection.Web)}
 	params["target_id"] = []string{config[TARGET_ID].Value}
 
@@ -270,17 +361,27 @@ func newWebServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan
 		config[LOCAL_HOST].Value,
 		remotePort,
 		config[REMOTE_HOST].Value,
+		maxRequestSize,
+		maxUploadSize,
+		rewriter,
 		cert,
+		metrics,
 		config[CONNECTION_SERVICE_URL].Value,
 		params,
 		headers,
 		publicKey,
+		client,
 	)
 }
 
-func newDbServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert) (*dbserver.DbServer, error) {
+func newDbServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert, metrics *mrtap.Metrics) (*dbserver.DbServer, error) {
 	subLogger := logger.GetComponentLogger("dbserver")
 
+	client, err := newMessenger(subLogger)
+	if err != nil {
+		return nil, err
+	}
+
 	remotePort, err := strconv.Atoi(config[REMOTE_PORT].Value)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse remote port: %s", err)
@@ -297,6 +398,13 @@ func newDbServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan
 		return nil, fmt.Errorf("failed to parse tcp application type: %s", config[TCP_APP].Value)
 	}
 	
+	idleTimeout := 0
+	if config[UDP_IDLE_TIMEOUT].Value != "" {
+		if idleTimeout, err = strconv.Atoi(config[UDP_IDLE_TIMEOUT].Value); err != nil || idleTimeout < 0 {
+			return nil, fmt.Errorf("failed to parse udp idle timeout: %s", config[UDP_IDLE_TIMEOUT].Value)
+		}
+	}
+
 	params["target_id"] = []string{config[TARGET_ID].Value}
 	params["target_user"] = []string{config[TARGET_USER].Value}
 
@@ -308,21 +416,29 @@ func newDbServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan
 		remotePort,
 		config[REMOTE_HOST].Value,
 		cert,
+		metrics,
 		config[DB_ACTION].Value,
 		config[TCP_APP].Value,
 		config[TARGET_USER].Value,
 		config[TARGET_ID].Value,
+		time.Duration(idleTimeout)*time.Second,
 		config[CONNECTION_SERVICE_URL].Value,
 		params,
 		headers,
 		publicKey,
+		client,
 	)
 }
 
-func newKubeServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert) (*kubeserver.KubeServer, error) {
+func newKubeServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errChan chan error, headers http.Header, params url.Values, cert *bzcert.DaemonBZCert, metrics *mrtap.Metrics) (*kubeserver.KubeServer, error) {
 
 	subLogger := logger.GetComponentLogger("kubeserver")
 
+	client, err := newMessenger(subLogger)
+	if err != nil {
+		return nil, err
+	}
+
 	targetGroups := []string{}
 	if config[TARGET_GROUPS].Value != "" {
 		targetGroups = strings.Split(config[TARGET_GROUPS].Value, ",")
@@ -341,6 +457,8 @@ func newKubeServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errCha
 		config[CERT_PATH].Value,
 		config[KEY_PATH].Value,
 		cert,
+		metrics,
+		config[TARGET_ID].Value,
 		config[TARGET_USER].Value,
 		targetGroups,
 		config[LOCALHOST_TOKEN].Value,
@@ -348,6 +466,7 @@ func newKubeServer(logger *bzlogger.Logger, publicKey *keypair.PublicKey, errCha
 		params,
 		headers,
 		publicKey,
+		client,
 	)
 }
 
@@ -363,6 +482,17 @@ func loadEnvironment() error {
 		return err
 	}
 
+	// In direct mode we never talk to the connection node, so we need a
+	// different set of global variables and dial the agent in its place
+	globalVars := requriedGlobalVars
+	if config[DIRECT_AGENT_ADDRESS].Value != "" {
+		globalVars = requiredDirectVars
+		config[CONNECTION_SERVICE_URL] = EnvVar{
+			Value: fmt.Sprintf("tls://%s", config[DIRECT_AGENT_ADDRESS].Value),
+			Seen:  true,
+		}
+	}
+
 	// Check we have all required flags
 	// Depending on the plugin ensure we have the correct required flag values
 	var requriedVars []string
@@ -370,7 +500,7 @@ func loadEnvironment() error {
 	if pluginVars, ok := requriedPluginVars[bzplugin.PluginName(plugin)]; !ok {
 		return fmt.Errorf("unhandled plugin passed: %s", plugin)
 	} else {
-		requriedVars = append(requriedGlobalVars, pluginVars...)
+		requriedVars = append(globalVars, pluginVars...)
 	}
 
 	// Check against required dict to find the missing ones
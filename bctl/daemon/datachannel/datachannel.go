@@ -56,6 +56,12 @@ type IPlugin interface {
 	Kill(err error)
 }
 
+// ISynAckReceiver is implemented by plugins which want to hear what the agent's
+// plugin told us in its SynAck
+type ISynAckReceiver interface {
+	ReceiveSynAck(actionPayload []byte)
+}
+
 type DataChannel struct {
 	tmb    tomb.Tomb
 	logger *logger.Logger
@@ -76,7 +82,8 @@ func New(
 	logger *logger.Logger,
 	id string,
 	conn connection.Connection,
-	mrtap *mrtap.Mrtap,
+	mt *mrtap.Mrtap,
+	metrics *mrtap.Metrics,
 	plugin IPlugin,
 	action string,
 	synPayload interface{},
@@ -88,7 +95,7 @@ func New(
 		logger:                     logger,
 		id:                         id,
 		conn:                       conn,
-		mrtap:                      mrtap,
+		mrtap:                      mt,
 		plugin:                     plugin,
 		inputChan:                  make(chan *am.AgentMessage, 50),
 		processInputChanBeforeExit: processInputChanBeforeExit,
@@ -97,6 +104,9 @@ func New(
 	// register with connection so datachannel can send and receive messages
 	conn.Subscribe(id, dc)
 
+	// report on our pipeline window for as long as we're alive
+	metrics.Track(id, dc.mrtap)
+
 	dc.tmb.Go(func() error {
 		var err error
 		defer func() {
@@ -105,6 +115,8 @@ func New(
 				ChannelId:   dc.id,
 				MessageType: am.CloseDataChannel,
 			})
+			dc.logger.Infof("MrTAP pipeline window: %s", dc.mrtap.WindowStats())
+			metrics.Untrack(dc.id)
 			dc.logger.Info("Datachannel done")
 		}()
 
@@ -251,9 +263,19 @@ func (d *DataChannel) sendMrtap() error {
 			return nil
 		case mrtapMessage := <-d.mrtap.Outbox():
 			if mrtapMessage.Type == message.Syn || !d.mrtap.Recovering() {
-				d.logger.Infof("Sending a MrTAP %s message", mrtapMessage.Type)
-				// TODO: CWC-2183; we still send a legacy message to accommodate older agents. Newer ones can handle either
-				d.send(am.MrtapLegacy, mrtapMessage)
+				// Syns are how we agree on an encoding, so they're always JSON
+				encoding := d.mrtap.Encoding()
+				if mrtapMessage.Type == message.Syn {
+					encoding = message.JSON
+				}
+
+				if mrtapBytes, err := mrtapMessage.Encode(encoding); err != nil {
+					d.logger.Errorf("failed to encode MrTAP %s message: %s", mrtapMessage.Type, err)
+				} else {
+					d.logger.Infof("Sending a MrTAP %s message", mrtapMessage.Type)
+					// TODO: CWC-2183; we still send a legacy message to accommodate older agents. Newer ones can handle either
+					d.sendBytes(am.MrtapLegacy, mrtapBytes)
+				}
 			}
 		}
 	}
@@ -289,6 +311,32 @@ func (d *DataChannel) Close(reason error) {
 	d.tmb.Wait()
 }
 
+// Resume is called by our connection once it has reconnected. Anything we or
+// the agent sent while it was down is lost, so we redo the MrTAP handshake on
+// our existing session, which lets the agent's plugin carry on where it left
+// off and tells us which of our messages we need to resend
+func (d *DataChannel) Resume() {
+	if !d.tmb.Alive() {
+		return
+	}
+
+	// we're called by the connection, which we mustn't block
+	go func() {
+		if err := d.mrtap.Resume(); err != nil {
+			d.logger.Errorf("failed to resume datachannel: %s", err)
+			return
+		}
+
+		select {
+		case <-d.tmb.Dying():
+		case <-time.After(handshakeTimeout):
+			if d.mrtap.Recovering() {
+				d.tmb.Kill(fmt.Errorf("timed out waiting for the agent to resume our session"))
+			}
+		}
+	}()
+}
+
 func (d *DataChannel) start(attach bool, action string, synPayload interface{}) error {
 	// if we're attaching to an existing datachannel vs if we are creating a new one
 	if !attach {
@@ -344,19 +392,23 @@ func (d *DataChannel) send(messageType am.MessageType, messagePayload interface{
 	if messageBytes, err := json.Marshal(messagePayload); err != nil {
 		return fmt.Errorf("failed to marshal the provided agent message payload: %s", messageBytes)
 	} else {
-		agentMessage := am.AgentMessage{
-			ChannelId:      d.id,
-			MessageType:    messageType,
-			SchemaVersion:  am.CurrentVersion,
-			MessagePayload: messageBytes,
-		}
-
-		// Push message to connection channel output
-		d.conn.Send(agentMessage)
+		d.sendBytes(messageType, messageBytes)
 		return nil
 	}
 }
 
+func (d *DataChannel) sendBytes(messageType am.MessageType, messageBytes []byte) {
+	agentMessage := am.AgentMessage{
+		ChannelId:      d.id,
+		MessageType:    messageType,
+		SchemaVersion:  am.CurrentVersion,
+		MessagePayload: messageBytes,
+	}
+
+	// Push message to connection channel output
+	d.conn.Send(agentMessage)
+}
+
 func (d *DataChannel) Receive(agentMessage am.AgentMessage) {
 	if d.tmb.Alive() {
 		d.inputChan <- &agentMessage
@@ -414,8 +466,8 @@ func (d *DataChannel) handleStream(agentMessage *am.AgentMessage) error {
 func (d *DataChannel) handleMrtap(agentMessage *am.AgentMessage) error {
 	// unmarshal the MrTAP message
 	d.logger.Debugf("Handling MrTAP message")
-	var mrtapMessage message.MrtapMessage
-	if err := json.Unmarshal(agentMessage.MessagePayload, &mrtapMessage); err != nil {
+	mrtapMessage, err := message.Decode(agentMessage.MessagePayload)
+	if err != nil {
 		return fmt.Errorf("malformed MrTAP message")
 	}
 
@@ -426,6 +478,9 @@ func (d *DataChannel) handleMrtap(agentMessage *am.AgentMessage) error {
 
 	switch mrtapMessage.Payload.(type) {
 	case message.SynAckPayload:
+		if receiver, ok := d.plugin.(ISynAckReceiver); ok {
+			receiver.ReceiveSynAck(mrtapMessage.GetActionPayload())
+		}
 	case message.DataAckPayload:
 		// Send message to plugin's input message handler
 		if err := d.plugin.ReceiveMrtap(mrtapMessage.GetAction(), mrtapMessage.GetActionPayload()); err != nil {
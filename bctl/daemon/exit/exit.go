@@ -52,6 +52,7 @@ func HandleDaemonExit(err error, logger *logger.Logger) {
 	var gracefulShutdown *bzos.ShutdownError
 	var shellQuitError *bzshell.ShellQuitError
 	var shellCancelledError *bzshell.ShellCancelledError
+	var shellExecExitError *bzshell.ShellExecExitError
 	var sshStdinClosedError *bzssh.SshStdinClosedError
 	var userNotFoundError *unixuser.UserNotFoundError
 	var certConfigError *bzcert.CertConfigError
@@ -103,6 +104,11 @@ func HandleDaemonExit(err error, logger *logger.Logger) {
 	} else if errors.As(err, &shellCancelledError) {
 		logger.Infof("%s", err)
 		os.Exit(CancelledByUser)
+	} else if errors.As(err, &shellExecExitError) {
+		// we exit with whatever the remote command did, like ssh would, so
+		// this can overlap with our own exit codes
+		logger.Infof("%s", err)
+		os.Exit(shellExecExitError.ExitCode)
 	} else if errors.As(err, &connectionRefused) {
 		os.Exit(ConnectionRefused)
 	} else if errors.As(err, &connectionFailed) {
@@ -0,0 +1,82 @@
+package mrtap
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Metrics reports on the pipeline windows of a daemon's live datachannels
+type Metrics struct {
+	// the MrTAP instances whose pipeline windows we report on, keyed by datachannel id
+	tracked     map[string]*Mrtap
+	trackedLock sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{tracked: make(map[string]*Mrtap)}
+}
+
+// Track adds a datachannel's MrTAP pipeline window to the metrics we report
+// for as long as that datachannel is alive
+func (m *Metrics) Track(id string, mt *Mrtap) {
+	m.trackedLock.Lock()
+	defer m.trackedLock.Unlock()
+	m.tracked[id] = mt
+}
+
+// Untrack stops reporting on a datachannel once it has closed
+func (m *Metrics) Untrack(id string) {
+	m.trackedLock.Lock()
+	defer m.trackedLock.Unlock()
+	delete(m.tracked, id)
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	measure func(WindowStats) float64
+}
+
+var metrics = []metric{
+	{"bzero_mrtap_window_size", "Messages MrTAP will currently pipeline before waiting on an ack.", "gauge",
+		func(s WindowStats) float64 { return float64(s.Size) }},
+	{"bzero_mrtap_window_max", "Largest pipeline window the agent allows.", "gauge",
+		func(s WindowStats) float64 { return float64(s.Max) }},
+	{"bzero_mrtap_smoothed_rtt_seconds", "Smoothed round trip time between sending a message and receiving its ack.", "gauge",
+		func(s WindowStats) float64 { return s.SmoothedRTT.Seconds() }},
+	{"bzero_mrtap_window_grows_total", "Times the pipeline window has grown.", "counter",
+		func(s WindowStats) float64 { return float64(s.Grows) }},
+	{"bzero_mrtap_window_shrinks_total", "Times the pipeline window has shrunk.", "counter",
+		func(s WindowStats) float64 { return float64(s.Shrinks) }},
+	{"bzero_mrtap_retransmits_total", "Messages resent while recovering from an error.", "counter",
+		func(s WindowStats) float64 { return float64(s.Retransmits) }},
+}
+
+// Write writes the current pipeline window of every live datachannel
+// in the Prometheus text exposition format
+func (m *Metrics) Write(w io.Writer) error {
+	m.trackedLock.Lock()
+	ids := make([]string, 0, len(m.tracked))
+	stats := make(map[string]WindowStats, len(m.tracked))
+	for id, mt := range m.tracked {
+		ids = append(ids, id)
+		stats[id] = mt.WindowStats()
+	}
+	m.trackedLock.Unlock()
+	sort.Strings(ids)
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, err := fmt.Fprintf(w, "%s{datachannel=%q} %v\n", metric.name, id, metric.measure(stats[id])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
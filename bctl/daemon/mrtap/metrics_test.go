@@ -0,0 +1,42 @@
+package mrtap
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipeline window metrics", func() {
+	var mt *Mrtap
+	var tracked *Metrics
+
+	BeforeEach(func() {
+		mt = &Mrtap{window: newPipelineWindow()}
+		tracked = NewMetrics()
+		tracked.Track("dc-1", mt)
+	})
+
+	metrics := func() string {
+		var buf bytes.Buffer
+		Expect(tracked.Write(&buf)).To(Succeed())
+		return buf.String()
+	}
+
+	It("reports a live datachannel's window as it changes", func() {
+		Expect(metrics()).To(ContainSubstring(`bzero_mrtap_retransmits_total{datachannel="dc-1"} 0`))
+
+		mt.window.resent()
+		mt.window.resent()
+
+		output := metrics()
+		Expect(output).To(ContainSubstring("# TYPE bzero_mrtap_retransmits_total counter"))
+		Expect(output).To(ContainSubstring(`bzero_mrtap_retransmits_total{datachannel="dc-1"} 2`))
+		Expect(output).To(ContainSubstring(`bzero_mrtap_window_size{datachannel="dc-1"} `))
+	})
+
+	It("stops reporting a datachannel once it's untracked", func() {
+		tracked.Untrack("dc-1")
+		Expect(metrics()).ToNot(ContainSubstring(`datachannel="dc-1"`))
+	})
+})
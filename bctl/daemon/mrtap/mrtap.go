@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Masterminds/semver"
 	orderedmap "github.com/wk8/go-ordered-map"
@@ -20,10 +21,6 @@ import (
 // Max number of times we will try to resend after an error message
 const maxErrorRecoveryTries = 3
 
-// The number of messages we're allowed to precalculate and send without having
-// received an ack
-const maxPipelineLimit = 8
-
 type Mrtap struct {
 	logger *logger.Logger
 
@@ -62,7 +59,11 @@ type Mrtap struct {
 	// agent in the synack
 	schemaVersion      *semver.Version
 	prePipeliningAgent bool
-	pipelineLimit      int
+	// how many Data messages we may have waiting on an ack
+	window *pipelineWindow
+	// how we send everything after the Syn, also based on the agent's
+	// schemaVersion
+	encoding message.Encoding
 }
 
 func New(
@@ -72,13 +73,14 @@ func New(
 ) (*Mrtap, error) {
 
 	mt := &Mrtap{
-		logger:        logger,
-		bzcert:        bzcert,
-		agentPubKey:   agentPubKey,
-		pipelineMap:   orderedmap.New(),
-		outboxQueue:   make(chan *message.MrtapMessage, maxPipelineLimit),
-		synAction:     "initial",
-		pipelineLimit: maxPipelineLimit,
+		logger:      logger,
+		bzcert:      bzcert,
+		agentPubKey: agentPubKey,
+		pipelineMap: orderedmap.New(),
+		outboxQueue: make(chan *message.MrtapMessage, maxPipelineLimit),
+		synAction:   "initial",
+		window:      newPipelineWindow(),
+		encoding:    message.JSON,
 	}
 	mt.pipelineOpen = sync.NewCond(&mt.stateLock)
 
@@ -95,6 +97,21 @@ func (m *Mrtap) Recovering() bool {
 	return m.recovering
 }
 
+// Encoding returns how MrTAP messages should be sent to the agent. Until the
+// handshake completes this is always JSON
+func (m *Mrtap) Encoding() message.Encoding {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.encoding
+}
+
+// WindowStats reports how the pipeline window has adapted to the link so far
+func (m *Mrtap) WindowStats() WindowStats {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.window.Stats()
+}
+
 func (m *Mrtap) Release() {
 	m.pipelineOpen.Broadcast()
 }
@@ -129,8 +146,44 @@ func (m *Mrtap) Recover(errMessage bzerr.ErrorMessage) error {
 		m.logger.Infof("Attempt #%d to recover from error: %s", m.errorRecoveryAttempt, errMessage.Message)
 	}
 
+	// whatever went wrong, we were probably sending too much at once
+	m.window.shrink()
+	m.logger.Infof("Shrunk MrTAP pipeline window to %d", m.window.Size())
+
 	m.recovering = true
-	if _, err := m.buildSyn("", []byte{}, true); err != nil {
+	if _, err := m.buildSyn("", []byte{}, "", true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Resume picks our session back up after our connection to the agent was
+// re-established, during which messages in either direction may have been lost.
+// It works just like recovering from an error, except that there's no error to
+// blame so it doesn't count towards our recovery attempts
+func (m *Mrtap) Resume() error {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	// if we never completed a handshake then there's no session to resume
+	if m.schemaVersion == nil {
+		return fmt.Errorf("no session to resume because the initial handshake never completed")
+	}
+
+	// tell the agent where we think we left off so that it knows to keep going
+	// with the same plugin, as long as it knows how to
+	hPointer := ""
+	if m.lastAckedData != nil {
+		if c, err := semver.NewConstraint(fmt.Sprintf(">= %s", message.ResumptionSchemaVersion)); err != nil {
+			return fmt.Errorf("unable to create versioning constraint")
+		} else if c.Check(m.schemaVersion) {
+			hPointer = m.lastAckedData.Hash()
+		}
+	}
+
+	m.logger.Infof("Resuming session after reconnecting")
+	m.recovering = true
+	if _, err := m.buildSyn("", []byte{}, hPointer, true); err != nil {
 		return err
 	}
 	return nil
@@ -185,6 +238,7 @@ func (m *Mrtap) resend(nonce string) {
 		// we assume we have to resend everything
 		for lostPair := (&recoveryMap).Oldest(); lostPair != nil; lostPair = lostPair.Next() {
 			mrtapMessage := lostPair.Value.(message.MrtapMessage)
+			m.window.resent()
 			m.pipeline(mrtapMessage.GetAction(), mrtapMessage.GetActionPayload())
 		}
 	} else {
@@ -193,6 +247,7 @@ func (m *Mrtap) resend(nonce string) {
 		// referenced by the hpointer
 		for lostPair := pair.Next(); lostPair != nil; lostPair = lostPair.Next() {
 			mrtapMessage := lostPair.Value.(message.MrtapMessage)
+			m.window.resent()
 			m.pipeline(mrtapMessage.GetAction(), mrtapMessage.GetActionPayload())
 		}
 	}
@@ -243,6 +298,16 @@ func (m *Mrtap) Validate(mrtapMessage *message.MrtapMessage) error {
 				}
 				m.schemaVersion = parsedSchemaVersion
 
+				// the same goes for how we encode them; newer agents let us
+				// send something more compact than JSON
+				if c, err := semver.NewConstraint(fmt.Sprintf(">= %s", message.CompactSchemaVersion)); err != nil {
+					return fmt.Errorf("unable to create versioning constraint")
+				} else if c.Check(parsedSchemaVersion) {
+					m.encoding = message.Compact
+				} else {
+					m.encoding = message.JSON
+				}
+
 				// when we recover, we're recovering based on the nonce in the syn/ack because unless
 				// it's not in response to the initial syn, where the nonce is a true random number,
 				// it is an hpointer which refers to the agent's last received and validated message.
@@ -262,7 +327,11 @@ func (m *Mrtap) Validate(mrtapMessage *message.MrtapMessage) error {
 
 					if m.prePipeliningAgent {
 						// Override default
-						m.pipelineLimit = 1
+						m.window.setMax(1)
+					} else {
+						// older agents don't advertise a limit, in which case
+						// we'll stick to the legacy one
+						m.window.setMax(msg.MaxPipelineLimit)
 					}
 				}
 
@@ -277,6 +346,8 @@ func (m *Mrtap) Validate(mrtapMessage *message.MrtapMessage) error {
 			ackedDataMsg := ackedMsg.(message.MrtapMessage)
 			m.lastAckedData = &ackedDataMsg
 
+			m.window.ack(hpointer, time.Now())
+
 			// If we're here, it means that the previous data message that
 			// caused the error was accepted
 			m.errorRecoveryAttempt = 0
@@ -297,8 +368,8 @@ func (m *Mrtap) Inbox(action string, actionPayload []byte) error {
 	defer m.stateLock.Unlock()
 
 	// Wait if pipeline is full OR if handshake is not complete
-	for m.pipelineMap.Len() >= m.pipelineLimit || !m.isHandshakeComplete {
-		m.logger.Debugf("Pipeline full: %t, Handshake complete: %t. Waiting to send next message...", m.pipelineMap.Len() >= m.pipelineLimit, m.isHandshakeComplete)
+	for m.pipelineMap.Len() >= m.window.Size() || !m.isHandshakeComplete {
+		m.logger.Debugf("Pipeline full: %t, Handshake complete: %t. Waiting to send next message...", m.pipelineMap.Len() >= m.window.Size(), m.isHandshakeComplete)
 		m.pipelineOpen.Wait()
 	}
 
@@ -375,6 +446,10 @@ func (m *Mrtap) addToPipelineMap(mrtapMessage message.MrtapMessage) error {
 	} else {
 		m.pipelineMap.Set(hash, mrtapMessage)
 		m.pipelineLength = m.pipelineMap.Len()
+
+		if mrtapMessage.Type == message.Data {
+			m.window.sending(hash, time.Now())
+		}
 		return nil
 	}
 }
@@ -383,11 +458,12 @@ func (m *Mrtap) BuildSyn(action string, payload interface{}, send bool) (*messag
 	m.stateLock.Lock()
 	defer m.stateLock.Unlock()
 
-	return m.buildSyn(action, payload, send)
+	return m.buildSyn(action, payload, "", send)
 }
 
-// It is the caller's responsibility to lock the stateLock mutex before calling this function
-func (m *Mrtap) buildSyn(action string, payload interface{}, send bool) (*message.MrtapMessage, error) {
+// It is the caller's responsibility to lock the stateLock mutex before calling this function.
+// Only a Syn resuming an established session should set hPointer
+func (m *Mrtap) buildSyn(action string, payload interface{}, hPointer string, send bool) (*message.MrtapMessage, error) {
 	// Reset state
 	m.isHandshakeComplete = false
 	m.lastAck = nil
@@ -416,6 +492,7 @@ func (m *Mrtap) buildSyn(action string, payload interface{}, send bool) (*messag
 		TargetId:      m.agentPubKey.String(),
 		Nonce:         util.Nonce(),
 		BZCert:        *m.bzcert.Cert(),
+		HPointer:      hPointer,
 	}
 
 	mrtapMessage := message.MrtapMessage{
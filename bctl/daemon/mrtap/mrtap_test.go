@@ -573,11 +573,95 @@ var _ = Describe("Daemon MrTAP", func() {
 			})
 
 			It("sends Data messages without having received DataAcks for all previous Data messages", func() {
-				for i := 0; i <= maxPipelineLimit-1; i++ {
+				for i := 0; i <= initialPipelineLimit-1; i++ {
 					err := sut.Inbox(testAction, []byte("payload"))
 					Expect(err).ShouldNot(HaveOccurred())
 				}
-				Expect(len(sut.Outbox())).To(Equal(maxPipelineLimit))
+				Expect(len(sut.Outbox())).To(Equal(initialPipelineLimit))
+			})
+		})
+
+		Context("resumption", func() {
+			var sut *Mrtap
+
+			BeforeEach(func() {
+				var err error
+				sut, err = createSUT()
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			When("the initial handshake never completed", func() {
+				It("errors", func() {
+					Expect(sut.Resume()).ShouldNot(Succeed())
+				})
+			})
+
+			When("the agent has acked some of our Data", func() {
+				var acked, lost, resumeSyn *message.MrtapMessage
+
+				BeforeEach(func() {
+					performHandshake(sut)
+					acked = sendData(sut, []byte("acked"))
+					Expect(sut.Validate(buildDataAck(acked))).Should(Succeed())
+					lost = sendData(sut, []byte("lost"))
+
+					Expect(sut.Resume()).Should(Succeed())
+					Expect(sut.Outbox()).Should(Receive(&resumeSyn))
+				})
+
+				It("sends a Syn pointing at the last acked Data", func() {
+					Expect(resumeSyn.Type).Should(Equal(message.Syn))
+					Expect(resumeSyn.Payload.(message.SynPayload).HPointer).Should(Equal(acked.Hash()))
+				})
+
+				It("does not count as an attempt to recover from an error", func() {
+					Expect(sut.errorRecoveryAttempt).Should(Equal(0))
+				})
+
+				It("resends the lost Data once the agent acks the Syn", func() {
+					synAck := buildSynAckWithNonce(resumeSyn, message.SchemaVersion, acked.Hash())
+					Expect(sut.Validate(synAck)).Should(Succeed())
+
+					var resent *message.MrtapMessage
+					Expect(sut.Outbox()).Should(Receive(&resent))
+					Expect(resent.Type).Should(Equal(message.Data))
+					Expect(resent.GetActionPayload()).Should(Equal(lost.GetActionPayload()))
+				})
+			})
+
+			When("the agent doesn't know how to resume", func() {
+				It("sends a Syn the agent will recognize", func() {
+					performHandshakeWithVersion(sut, "2.4")
+					acked := sendData(sut, []byte("acked"))
+					Expect(sut.Validate(buildDataAckWithVersion(acked, "2.4"))).Should(Succeed())
+
+					Expect(sut.Resume()).Should(Succeed())
+
+					var resumeSyn *message.MrtapMessage
+					Expect(sut.Outbox()).Should(Receive(&resumeSyn))
+					Expect(resumeSyn.Payload.(message.SynPayload).HPointer).Should(BeEmpty())
+				})
+			})
+
+			When("we're recovering from an error instead", func() {
+				It("doesn't ask the agent to resume", func() {
+					performHandshake(sut)
+					acked := sendData(sut, []byte("acked"))
+					Expect(sut.Validate(buildDataAck(acked))).Should(Succeed())
+					lost := sendData(sut, []byte("lost"))
+
+					Expect(sut.Recover(bzerr.ErrorMessage{
+						SchemaVersion: bzerr.CurrentVersion,
+						Timestamp:     time.Now().Unix(),
+						Type:          bzerr.MrtapValidationError,
+						Message:       "agent error message",
+						HPointer:      lost.Hash(),
+					})).Should(Succeed())
+
+					var recoverySyn *message.MrtapMessage
+					Expect(sut.Outbox()).Should(Receive(&recoverySyn))
+					Expect(recoverySyn.Payload.(message.SynPayload).HPointer).Should(BeEmpty())
+				})
 			})
 		})
 
@@ -0,0 +1,169 @@
+package mrtap
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// The number of Data messages we're allowed to precalculate and send
+	// without having received an ack before we know anything about the link
+	initialPipelineLimit = 8
+
+	// The most messages we'll ever have in flight, no matter what the agent
+	// advertises
+	maxPipelineLimit = 128
+
+	// Agents which don't advertise a maximum get the fixed window they've
+	// always had
+	legacyPipelineLimit = 8
+
+	// An ack which took more than this many times our smoothed round trip time
+	// to arrive means something is queueing up, so it doesn't grow the window
+	lateAckFactor = 2
+)
+
+// pipelineWindow decides how many Data messages may be waiting on a DataAck at
+// once. Rather than a fixed limit, it grows while DataAcks keep arriving
+// promptly and halves whenever we have to recover, in the style of TCP's slow
+// start and congestion avoidance. On a high latency link this keeps far more
+// than 8 messages in flight per round trip.
+//
+// It is not thread safe; callers must hold the Mrtap stateLock.
+type pipelineWindow struct {
+	size int
+	max  int
+
+	// below this size we grow by one for every timely ack, which doubles the
+	// window every round trip; at or above it we only grow by one per round trip
+	threshold int
+	// timely acks since we last grew above the threshold
+	timelyAcks int
+
+	// when each unacknowledged message was sent, keyed by hash
+	sent map[string]time.Time
+	// smoothed round trip time, zero until we've had our first ack
+	srtt time.Duration
+
+	stats WindowStats
+}
+
+// WindowStats describes how a datachannel's pipeline window has behaved
+type WindowStats struct {
+	Size        int
+	Max         int
+	Peak        int
+	Grows       int
+	Shrinks     int
+	Retransmits int
+	SmoothedRTT time.Duration
+}
+
+func (s WindowStats) String() string {
+	return fmt.Sprintf("size %d (peak %d, max %d), grew %d times, shrank %d times, resent %d messages, smoothed RTT %s",
+		s.Size, s.Peak, s.Max, s.Grows, s.Shrinks, s.Retransmits, s.SmoothedRTT.Round(time.Millisecond))
+}
+
+func newPipelineWindow() *pipelineWindow {
+	w := &pipelineWindow{
+		threshold: maxPipelineLimit,
+		sent:      make(map[string]time.Time),
+	}
+	w.setMax(legacyPipelineLimit)
+	w.stats.Peak = w.size
+
+	return w
+}
+
+// setMax caps the window at what the agent told us it can handle
+func (w *pipelineWindow) setMax(limit int) {
+	if limit <= 0 {
+		limit = legacyPipelineLimit
+	} else if limit > maxPipelineLimit {
+		limit = maxPipelineLimit
+	}
+
+	w.max = limit
+	if w.size == 0 {
+		w.size = initialPipelineLimit
+	}
+	if w.size > limit {
+		w.size = limit
+	}
+}
+
+func (w *pipelineWindow) Size() int {
+	return w.size
+}
+
+func (w *pipelineWindow) sending(hash string, now time.Time) {
+	w.sent[hash] = now
+}
+
+// roundTrip updates our round trip time and returns whether the ack was timely
+func (w *pipelineWindow) roundTrip(hash string, now time.Time) bool {
+	sentAt, ok := w.sent[hash]
+	if !ok {
+		return false
+	}
+	delete(w.sent, hash)
+
+	rtt := now.Sub(sentAt)
+	timely := w.srtt == 0 || rtt <= lateAckFactor*w.srtt
+
+	if w.srtt == 0 {
+		w.srtt = rtt
+	} else {
+		w.srtt = (7*w.srtt + rtt) / 8
+	}
+
+	return timely
+}
+
+// ack handles a DataAck and grows the window if it was timely
+func (w *pipelineWindow) ack(hash string, now time.Time) {
+	if !w.roundTrip(hash, now) || w.size >= w.max {
+		return
+	}
+
+	if w.size < w.threshold {
+		w.grow()
+	} else if w.timelyAcks++; w.timelyAcks >= w.size {
+		w.timelyAcks = 0
+		w.grow()
+	}
+}
+
+func (w *pipelineWindow) grow() {
+	w.size++
+	w.stats.Grows++
+	if w.size > w.stats.Peak {
+		w.stats.Peak = w.size
+	}
+}
+
+// shrink halves the window after a message was lost or rejected. Everything in
+// flight is about to be resent so we forget when it was first sent
+func (w *pipelineWindow) shrink() {
+	w.threshold = w.size / 2
+	if w.threshold < 1 {
+		w.threshold = 1
+	}
+	w.size = w.threshold
+	w.timelyAcks = 0
+	w.sent = make(map[string]time.Time)
+	w.stats.Shrinks++
+}
+
+// resent counts a message we had to send again while recovering
+func (w *pipelineWindow) resent() {
+	w.stats.Retransmits++
+}
+
+func (w *pipelineWindow) Stats() WindowStats {
+	stats := w.stats
+	stats.Size = w.size
+	stats.Max = w.max
+	stats.SmoothedRTT = w.srtt
+	return stats
+}
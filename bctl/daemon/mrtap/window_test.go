@@ -0,0 +1,113 @@
+package mrtap
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipeline window", func() {
+	var window *pipelineWindow
+	var now time.Time
+	rtt := 200 * time.Millisecond
+
+	// sends and acks a full window of messages, each taking the given time to
+	// be acked
+	roundTrip := func(ackAfter time.Duration) {
+		size := window.Size()
+		for i := 0; i < size; i++ {
+			window.sending(fmt.Sprint(i), now)
+		}
+		now = now.Add(ackAfter)
+		for i := 0; i < size; i++ {
+			window.ack(fmt.Sprint(i), now)
+		}
+	}
+
+	BeforeEach(func() {
+		window = newPipelineWindow()
+		now = time.Now()
+	})
+
+	When("the agent doesn't advertise a limit", func() {
+		It("never grows past the legacy limit", func() {
+			window.setMax(0)
+			for i := 0; i < 5; i++ {
+				roundTrip(rtt)
+			}
+			Expect(window.Size()).To(Equal(legacyPipelineLimit))
+		})
+	})
+
+	When("the agent advertises a limit", func() {
+		advertised := 64
+
+		BeforeEach(func() {
+			window.setMax(advertised)
+		})
+
+		It("starts at the initial limit", func() {
+			Expect(window.Size()).To(Equal(initialPipelineLimit))
+		})
+
+		It("doubles every round trip while acks are timely", func() {
+			roundTrip(rtt)
+			Expect(window.Size()).To(Equal(2 * initialPipelineLimit))
+			roundTrip(rtt)
+			Expect(window.Size()).To(Equal(4 * initialPipelineLimit))
+		})
+
+		It("never grows past the advertised limit", func() {
+			for i := 0; i < 10; i++ {
+				roundTrip(rtt)
+			}
+			Expect(window.Size()).To(Equal(advertised))
+			Expect(window.Stats().Peak).To(Equal(advertised))
+		})
+
+		It("doesn't grow when an ack is late", func() {
+			roundTrip(rtt)
+			size := window.Size()
+
+			window.sending("late", now)
+			now = now.Add(lateAckFactor * 5 * rtt)
+			window.ack("late", now)
+			Expect(window.Size()).To(Equal(size))
+		})
+
+		It("ignores acks for messages it didn't see sent", func() {
+			window.ack("unknown", now)
+			Expect(window.Size()).To(Equal(initialPipelineLimit))
+		})
+
+		When("we have to recover", func() {
+			BeforeEach(func() {
+				roundTrip(rtt)
+				roundTrip(rtt)
+				window.shrink()
+			})
+
+			It("halves the window", func() {
+				Expect(window.Size()).To(Equal(2 * initialPipelineLimit))
+				Expect(window.Stats().Shrinks).To(Equal(1))
+			})
+
+			It("only grows by one each round trip afterwards", func() {
+				roundTrip(rtt)
+				Expect(window.Size()).To(Equal(2*initialPipelineLimit + 1))
+			})
+		})
+	})
+
+	When("the agent advertises more than we'll ever allow", func() {
+		It("caps the window at our own limit", func() {
+			window.setMax(10 * maxPipelineLimit)
+			for i := 0; i < 20; i++ {
+				roundTrip(rtt)
+			}
+			Expect(window.Size()).To(Equal(maxPipelineLimit))
+		})
+	})
+})
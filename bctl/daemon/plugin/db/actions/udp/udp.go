@@ -0,0 +1,177 @@
+package udp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
+	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/bzerolib/plugin"
+	"bastionzero.com/bzerolib/plugin/db/actions/udp"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+const (
+	// the largest datagram UDP can carry
+	maxDatagramSize = 64 * 1024
+)
+
+type UdpAction struct {
+	logger    *logger.Logger
+	tmb       tomb.Tomb
+	requestId string
+
+	// how long the agent waits for a datagram before closing the flow
+	idleTimeout time.Duration
+
+	// input and output channels relative to this plugin
+	outputChan      chan plugin.ActionWrapper
+	streamInputChan chan smsg.StreamMessage
+
+	// done channel for letting the plugin know we're done
+	doneChan chan struct{}
+	err      error
+}
+
+func New(
+	logger *logger.Logger,
+	requestId string,
+	outboxQueue chan plugin.ActionWrapper,
+	doneChan chan struct{},
+	idleTimeout time.Duration,
+) *UdpAction {
+
+	return &UdpAction{
+		logger:      logger,
+		requestId:   requestId,
+		idleTimeout: idleTimeout,
+
+		outputChan:      outboxQueue,
+		streamInputChan: make(chan smsg.StreamMessage, 256),
+		doneChan:        doneChan,
+	}
+}
+
+// Start forwards the datagrams of a single flow. Every read from lconn must
+// return exactly one datagram, and every write to it sends one
+func (u *UdpAction) Start(lconn net.Conn) error {
+	// Build and send the action payload to start the flow on the agent
+	payload := udp.UdpActionPayload{
+		RequestId:            u.requestId,
+		StreamMessageVersion: smsg.CurrentSchema,
+		IdleTimeout:          int(u.idleTimeout.Seconds()),
+	}
+	u.sendOutputMessage(udp.UdpStart, payload)
+
+	// Listen to stream messages coming from the agent, and forward them to the flow
+	u.tmb.Go(func() error {
+		defer lconn.Close()
+
+		u.tmb.Go(func() error {
+			defer close(u.doneChan)
+
+			// listen to datagrams coming from the flow and send them to the agent
+			buf := make([]byte, maxDatagramSize)
+			sequenceNumber := 0
+
+			for {
+				if n, err := lconn.Read(buf); !u.tmb.Alive() {
+					return nil
+				} else if err != nil {
+					if err == io.EOF {
+						u.logger.Info("local udp flow has been closed")
+					} else {
+						u.logger.Errorf("error reading from local udp flow: %s", err)
+					}
+
+					// let the agent know we need to stop
+					payload := udp.UdpActionPayload{
+						RequestId: u.requestId,
+					}
+					u.sendOutputMessage(udp.UdpStop, payload)
+
+					return nil
+				} else {
+					payload := udp.UdpInputActionPayload{
+						RequestId:      u.requestId,
+						SequenceNumber: sequenceNumber,
+						Datagram:       buf[:n],
+					}
+					u.sendOutputMessage(udp.UdpInput, payload)
+
+					sequenceNumber += 1
+				}
+			}
+		})
+
+		// UDP doesn't promise to deliver datagrams in order, so we pass them on as they come
+		for {
+			select {
+			case <-u.tmb.Dying():
+				return nil
+			case streamMessage := <-u.streamInputChan:
+				switch streamMessage.Type {
+				case smsg.Stream:
+					if !streamMessage.More {
+						u.logger.Infof("agent has closed the udp flow, closing local udp flow")
+						return nil
+					}
+
+					if datagram, err := base64.StdEncoding.DecodeString(streamMessage.Content); err != nil {
+						u.logger.Errorf("could not decode udp stream content: %s", err)
+					} else if _, err := lconn.Write(datagram); err != nil && u.tmb.Alive() {
+						u.logger.Errorf("error writing to local udp flow: %s", err)
+					}
+				case smsg.Error:
+					if contentBytes, err := base64.StdEncoding.DecodeString(streamMessage.Content); err != nil {
+						u.logger.Errorf("could not decode udp stream content: %s", err)
+					} else {
+						u.logger.Errorf("agent hit an error trying to read from remote udp address: %s", string(contentBytes))
+					}
+					return nil
+				default:
+					u.logger.Debugf("unhandled stream type: %s", streamMessage.Type)
+				}
+			}
+		}
+	})
+	return nil
+}
+
+func (u *UdpAction) Done() <-chan struct{} {
+	return u.doneChan
+}
+
+func (u *UdpAction) Err() error {
+	return u.err
+}
+
+func (u *UdpAction) Kill(err error) {
+	if u.tmb.Alive() {
+		u.tmb.Kill(err) // kills all datachannel, plugin, and action goroutines
+		u.tmb.Wait()
+	}
+}
+
+func (u *UdpAction) sendOutputMessage(action udp.UdpSubAction, payload interface{}) {
+	// Send payload to plugin output queue
+	payloadBytes, _ := json.Marshal(payload)
+	u.outputChan <- plugin.ActionWrapper{
+		Action:        string(action),
+		ActionPayload: payloadBytes,
+	}
+}
+
+func (u *UdpAction) ReceiveStream(smessage smsg.StreamMessage) {
+	u.logger.Debugf("Udp action received %v stream, message count: %d", smessage.Type, len(u.streamInputChan)+1)
+	u.streamInputChan <- smessage
+}
+
+func (u *UdpAction) ReceiveMrtap(action string, actionPayload []byte) error {
+	// the only MrTAP message that we would receive is the ack from the agent after stopping the flow
+	return nil
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -12,6 +13,7 @@ import (
 	smsg "bastionzero.com/bzerolib/stream/message"
 	"bastionzero.com/daemon/plugin/db/actions/dial"
 	"bastionzero.com/daemon/plugin/db/actions/pwdb"
+	"bastionzero.com/daemon/plugin/db/actions/udp"
 )
 
 // Perhaps unnecessary but it is nice to make sure that each action is implementing a common function set
@@ -34,6 +36,9 @@ type DbDaemonPlugin struct {
 	targetUser string
 	targetId   string
 
+	// how long udp flows can be idle for, or 0 for the agent's default
+	udpIdleTimeout time.Duration
+
 	// outbox
 	outboxQueue chan plugin.ActionWrapper
 
@@ -41,12 +46,13 @@ type DbDaemonPlugin struct {
 	sequenceNumber int
 }
 
-func New(logger *logger.Logger, targetUser string, targetId string) *DbDaemonPlugin {
+func New(logger *logger.Logger, targetUser string, targetId string, udpIdleTimeout time.Duration) *DbDaemonPlugin {
 	return &DbDaemonPlugin{
 		logger:         logger,
 		doneChan:       make(chan struct{}),
 		targetUser:     targetUser,
 		targetId:       targetId,
+		udpIdleTimeout: udpIdleTimeout,
 		outboxQueue:    make(chan plugin.ActionWrapper, 5),
 		sequenceNumber: 0,
 	}
@@ -63,6 +69,8 @@ func (d *DbDaemonPlugin) StartAction(action bzdb.DbAction, tcpApp bzdb.TCPApplic
 	switch action {
 	case bzdb.Dial:
 		d.action = dial.New(actLogger, requestId, d.outboxQueue, d.doneChan)
+	case bzdb.Udp:
+		d.action = udp.New(actLogger, requestId, d.outboxQueue, d.doneChan, d.udpIdleTimeout)
 	case bzdb.Pwdb:
 		d.action = pwdb.New(actLogger, d.targetUser, d.targetId, d.outboxQueue, d.doneChan)
 	default:
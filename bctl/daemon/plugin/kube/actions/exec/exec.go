@@ -79,9 +79,8 @@ func (e *ExecAction) ReceiveStream(stream smsg.StreamMessage) {
 }
 
 func (e *ExecAction) Start(writer http.ResponseWriter, request *http.Request) error {
-	// create new SPDY service for exec communication
-	subLogger := e.logger.GetComponentLogger("SPDY")
-	spdy, err := NewSPDYService(subLogger, writer, request)
+	// upgrade the request to whichever protocol kubectl asked for
+	service, err := NewRemoteCommandService(e.logger, writer, request)
 	if err != nil {
 		e.logger.Error(err)
 		return err
@@ -97,7 +96,7 @@ func (e *ExecAction) Start(writer http.ResponseWriter, request *http.Request) er
 	// Set up a go function for stdout
 	e.tmb.Go(func() error {
 		defer close(e.doneChan)
-		closeChan := spdy.conn.CloseChan()
+		closeChan := service.CloseChan()
 
 		for {
 			select {
@@ -113,30 +112,32 @@ func (e *ExecAction) Start(writer http.ResponseWriter, request *http.Request) er
 					// For backwards compatibility check for stdout message with
 					// EscChar but for newer agents we should always be sending
 					// an empty StreamMessage with more = false to indicate the
-					// stream ended
-					if string(contentBytes) == exec.EscChar || !streamMessage.More {
+					// stream ended. Only unversioned agents sent EscChar, and we
+					// mustn't look for it otherwise since binary output (e.g. from
+					// kubectl cp) can contain it
+					if !streamMessage.More || (streamMessage.SchemaVersion == "" && string(contentBytes) == exec.EscChar) {
 						e.logger.Info("exec stream ended")
-						spdy.conn.Close()
+						service.Close()
 						return nil
 					}
-					if n, err := spdy.stdoutStream.Write(contentBytes); err != nil {
-						e.logger.Errorf("error writing stdout bytes to spdy stream: %s", err)
+					if n, err := service.Stdout().Write(contentBytes); err != nil {
+						e.logger.Errorf("error writing stdout bytes to kubectl: %s", err)
 					} else if n != len(contentBytes) {
-						e.logger.Errorf("error writing %d stdout bytes to spdy stream - only wrote %d instead", len(contentBytes), n)
+						e.logger.Errorf("error writing %d stdout bytes to kubectl - only wrote %d instead", len(contentBytes), n)
 					}
 				case smsg.StdErr:
-					if n, err := spdy.stderrStream.Write(contentBytes); err != nil {
-						e.logger.Errorf("error writing stderr bytes to spdy stream: %s", err)
+					if n, err := service.Stderr().Write(contentBytes); err != nil {
+						e.logger.Errorf("error writing stderr bytes to kubectl: %s", err)
 					} else if n != len(contentBytes) {
-						e.logger.Errorf("error writing %d stderr bytes to spdy stream - only wrote %d instead", len(contentBytes), n)
+						e.logger.Errorf("error writing %d stderr bytes to kubectl - only wrote %d instead", len(contentBytes), n)
 					}
 				case smsg.Error:
 					errMsg := string(contentBytes)
-					spdy.writeStatus(&StatusError{ErrStatus: metav1.Status{
+					service.WriteStatus(&StatusError{ErrStatus: metav1.Status{
 						Status:  metav1.StatusFailure,
 						Message: errMsg,
 					}})
-					spdy.conn.Close()
+					service.Close()
 					return fmt.Errorf("error in kube exec on agent: %s", errMsg)
 				default:
 					e.logger.Errorf("unrecognized stream type: %s", streamMessage.Type)
@@ -174,7 +175,7 @@ func (e *ExecAction) Start(writer http.ResponseWriter, request *http.Request) er
 				default:
 					// Keep reading from our stdin stream if we see multiple chunks coming in
 					for {
-						if n, err := spdy.stdinStream.Read(chunkSizeBuffer); !e.tmb.Alive() {
+						if n, err := service.Stdin().Read(chunkSizeBuffer); !e.tmb.Alive() {
 							return
 						} else if err != nil {
 							if err == io.EOF {
@@ -222,7 +223,7 @@ func (e *ExecAction) Start(writer http.ResponseWriter, request *http.Request) er
 				case <-e.tmb.Dying():
 					return
 				default:
-					decoder := json.NewDecoder(spdy.resizeStream)
+					decoder := json.NewDecoder(service.Resize())
 
 					size := TerminalSize{}
 					if err := decoder.Decode(&size); err != nil {
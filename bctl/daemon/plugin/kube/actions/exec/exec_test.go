@@ -113,4 +113,42 @@ var _ = Describe("Daemon Exec action", Ordered, func() {
 			writer.AssertExpectations(GinkgoT())
 		})
 	})
+
+	Context("Binary output", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan plugin.ActionWrapper, 1)
+		e := New(logger, outputChan, doneChan, requestId, logId, command)
+
+		binaryStdoutStream := tests.MockStream{}
+		binaryStdoutStream.On("Write", []byte(exec.EscChar)).Return(len(exec.EscChar), nil)
+
+		It("only treats the old end marker as the end for unversioned agents", func() {
+			setNewSPDYService(&SPDYService{
+				logger:       logger,
+				stdoutStream: binaryStdoutStream,
+				conn:         mockStreamConnection,
+			})
+
+			Expect(e.Start(&writer, &request)).To(Succeed())
+			<-outputChan
+
+			e.ReceiveStream(smsg.StreamMessage{
+				SchemaVersion:  smsg.CurrentSchema,
+				Type:           smsg.StdOut,
+				SequenceNumber: 0,
+				More:           true,
+				Content:        base64.StdEncoding.EncodeToString([]byte(exec.EscChar)),
+			})
+			Consistently(doneChan).ShouldNot(BeClosed())
+
+			e.ReceiveStream(smsg.StreamMessage{
+				SchemaVersion:  smsg.CurrentSchema,
+				Type:           smsg.StdOut,
+				SequenceNumber: 1,
+				More:           false,
+			})
+			Eventually(doneChan).Should(BeClosed())
+			binaryStdoutStream.AssertExpectations(GinkgoT())
+		})
+	})
 })
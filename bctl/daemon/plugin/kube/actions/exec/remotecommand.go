@@ -0,0 +1,42 @@
+package exec
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+// RemoteCommandService is our end of the remote command protocol kubectl uses
+// for exec and attach, which it speaks over either SPDY or WebSocket
+type RemoteCommandService interface {
+	// Stdin and Resize are nil if the client didn't ask for them
+	Stdin() io.Reader
+	Stdout() io.Writer
+	Stderr() io.Writer
+	Resize() io.Reader
+
+	WriteStatus(status *StatusError) error
+	CloseChan() <-chan bool
+	Close() error
+}
+
+// NewRemoteCommandService upgrades the request using whichever protocol the
+// client asked for. Newer versions of kubectl try WebSocket first
+func NewRemoteCommandService(logger *logger.Logger, writer http.ResponseWriter, request *http.Request) (RemoteCommandService, error) {
+	if websocket.IsWebSocketUpgrade(request) {
+		if service, err := NewWebSocketService(logger.GetComponentLogger("WebSocket"), writer, request); err != nil {
+			return nil, err
+		} else {
+			return service, nil
+		}
+	}
+
+	if service, err := NewSPDYService(logger.GetComponentLogger("SPDY"), writer, request); err != nil {
+		return nil, err
+	} else {
+		return service, nil
+	}
+}
@@ -205,3 +205,31 @@ func extractExecOptions(r *http.Request) Options {
 		Command:         r.URL.Query()["command"],
 	}
 }
+
+func (s *SPDYService) Stdin() io.Reader {
+	return s.stdinStream
+}
+
+func (s *SPDYService) Stdout() io.Writer {
+	return s.stdoutStream
+}
+
+func (s *SPDYService) Stderr() io.Writer {
+	return s.stderrStream
+}
+
+func (s *SPDYService) Resize() io.Reader {
+	return s.resizeStream
+}
+
+func (s *SPDYService) WriteStatus(status *StatusError) error {
+	return s.writeStatus(status)
+}
+
+func (s *SPDYService) CloseChan() <-chan bool {
+	return s.conn.CloseChan()
+}
+
+func (s *SPDYService) Close() error {
+	return s.conn.Close()
+}
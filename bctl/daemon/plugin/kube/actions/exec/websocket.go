@@ -0,0 +1,246 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"bastionzero.com/bzerolib/logger"
+	kubeutils "bastionzero.com/bzerolib/plugin/kube/utils"
+)
+
+// The WebSocket remote command protocol sends every message with a leading byte
+// saying which stream it's for
+// Ref: https://github.com/kubernetes/enhancements/tree/master/keps/sig-api-machinery/4006-transition-spdy-to-websockets
+const (
+	wsStdin  byte = 0
+	wsStdout byte = 1
+	wsStderr byte = 2
+	wsError  byte = 3
+	wsResize byte = 4
+
+	// In v5, followed by the stream the client is done writing to, which is
+	// how it lets us know stdin has hit EOF
+	wsStreamClose byte = 255
+
+	wsProtocolV5 = "v5.channel.k8s.io"
+	wsProtocolV4 = "v4.channel.k8s.io"
+
+	wsCloseTimeout = 1 * time.Second
+)
+
+// in order of preference. Earlier versions encode errors differently, and
+// kubectl has never used them over WebSocket
+var wsProtocols = []string{wsProtocolV5, wsProtocolV4}
+
+type WebSocketService struct {
+	logger *logger.Logger
+	conn   *websocket.Conn
+
+	// gorilla only allows one concurrent writer
+	writeLock sync.Mutex
+
+	// what the client sends is written to these as we read it
+	stdin        *io.PipeReader
+	stdinWriter  *io.PipeWriter
+	resize       *io.PipeReader
+	resizeWriter *io.PipeWriter
+
+	closeChan chan bool
+	closeOnce sync.Once
+}
+
+func NewWebSocketService(logger *logger.Logger, writer http.ResponseWriter, request *http.Request) (*WebSocketService, error) {
+	// Extract the options of the exec
+	options := extractExecOptions(request)
+
+	logger.Infof("Starting Exec for command: %s", options.Command)
+
+	protocol := negotiateWebSocketProtocol(websocket.Subprotocols(request))
+	if protocol == "" {
+		err := fmt.Errorf("unsupported remote command protocol, expected one of: %s", strings.Join(wsProtocols, ", "))
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	logger.Tracef("Using protocol: %s", protocol)
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{protocol}}
+	conn, err := upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		// the upgrader has already responded to the client
+		return nil, fmt.Errorf("unable to upgrade request: %s", err)
+	}
+
+	service := &WebSocketService{
+		logger:    logger,
+		conn:      conn,
+		closeChan: make(chan bool),
+	}
+	if options.Stdin {
+		service.stdin, service.stdinWriter = io.Pipe()
+	}
+	if options.TTY {
+		service.resize, service.resizeWriter = io.Pipe()
+	}
+
+	go service.read(protocol == wsProtocolV5)
+
+	return service, nil
+}
+
+func negotiateWebSocketProtocol(requested []string) string {
+	for _, supported := range wsProtocols {
+		for _, protocol := range requested {
+			if protocol == supported {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// read passes everything the client sends on to the stream it's for until the
+// connection closes
+func (w *WebSocketService) read(supportsStreamClose bool) {
+	defer w.closeStreams()
+
+	// Set our idle timeout to match SPDY. kubectl pings us every few seconds, so
+	// those count as activity as well
+	w.conn.SetReadDeadline(time.Now().Add(kubeutils.DefaultIdleTimeout))
+	w.conn.SetPingHandler(func(data string) error {
+		w.conn.SetReadDeadline(time.Now().Add(kubeutils.DefaultIdleTimeout))
+		return w.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsCloseTimeout))
+	})
+
+	for {
+		messageType, data, err := w.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				w.logger.Infof("WebSocket connection closed: %s", err)
+			}
+			return
+		}
+		w.conn.SetReadDeadline(time.Now().Add(kubeutils.DefaultIdleTimeout))
+
+		// All remote command protocols only send binary messages
+		if messageType != websocket.BinaryMessage || len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case wsStdin:
+			w.writeStream(w.stdinWriter, data[1:])
+		case wsResize:
+			w.writeStream(w.resizeWriter, data[1:])
+		case wsStreamClose:
+			if !supportsStreamClose || len(data) != 2 {
+				w.logger.Errorf("malformed stream close message: %v", data)
+				continue
+			}
+
+			switch data[1] {
+			case wsStdin:
+				w.logger.Infof("Client closed stdin")
+				closeStream(w.stdinWriter)
+			case wsResize:
+				closeStream(w.resizeWriter)
+			}
+		default:
+			w.logger.Tracef("Ignoring message for unexpected stream: %d", data[0])
+		}
+	}
+}
+
+// writeStream blocks until the exec has read data, so that we read from the
+// client no faster than we can send it on
+func (w *WebSocketService) writeStream(writer *io.PipeWriter, data []byte) {
+	if writer == nil {
+		return
+	} else if _, err := writer.Write(data); err != nil {
+		w.logger.Tracef("Dropping %d bytes for closed stream: %s", len(data), err)
+	}
+}
+
+func closeStream(writer *io.PipeWriter) {
+	if writer != nil {
+		writer.Close()
+	}
+}
+
+func (w *WebSocketService) closeStreams() {
+	w.closeOnce.Do(func() {
+		closeStream(w.stdinWriter)
+		closeStream(w.resizeWriter)
+		close(w.closeChan)
+	})
+}
+
+func (w *WebSocketService) write(stream byte, data []byte) (int, error) {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, append([]byte{stream}, data...)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// wsStreamWriter writes everything to a single stream
+type wsStreamWriter struct {
+	service *WebSocketService
+	stream  byte
+}
+
+func (s *wsStreamWriter) Write(data []byte) (int, error) {
+	return s.service.write(s.stream, data)
+}
+
+func (w *WebSocketService) Stdin() io.Reader {
+	if w.stdin == nil {
+		return nil
+	}
+	return w.stdin
+}
+
+func (w *WebSocketService) Stdout() io.Writer {
+	return &wsStreamWriter{service: w, stream: wsStdout}
+}
+
+func (w *WebSocketService) Stderr() io.Writer {
+	return &wsStreamWriter{service: w, stream: wsStderr}
+}
+
+func (w *WebSocketService) Resize() io.Reader {
+	if w.resize == nil {
+		return nil
+	}
+	return w.resize
+}
+
+// WriteStatus sends the status of the command in the same format as v4
+func (w *WebSocketService) WriteStatus(status *StatusError) error {
+	bs, err := json.Marshal(status.ErrStatus)
+	if err != nil {
+		return err
+	}
+	_, err = w.write(wsError, bs)
+	return err
+}
+
+func (w *WebSocketService) CloseChan() <-chan bool {
+	return w.closeChan
+}
+
+// Close lets the client know we're done so that it doesn't treat the closed
+// connection as an error
+func (w *WebSocketService) Close() error {
+	w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsCloseTimeout))
+	w.closeStreams()
+	return w.conn.Close()
+}
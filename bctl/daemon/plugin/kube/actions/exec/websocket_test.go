@@ -0,0 +1,96 @@
+package exec
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+)
+
+var _ = Describe("Daemon Exec WebSocket", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var server *httptest.Server
+	var services chan RemoteCommandService
+
+	BeforeEach(func() {
+		services = make(chan RemoteCommandService, 1)
+		server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if service, err := NewRemoteCommandService(logger, writer, request); err == nil {
+				services <- service
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	dial := func(protocols ...string) (*websocket.Conn, *http.Response, error) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/exec?command=sh&stdin=true&stdout=true&tty=true"
+		dialer := websocket.Dialer{Subprotocols: protocols}
+		return dialer.Dial(url, nil)
+	}
+
+	It("speaks the v5 protocol", func() {
+		conn, _, err := dial(wsProtocolV5, wsProtocolV4)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.Subprotocol()).To(Equal(wsProtocolV5))
+
+		var service RemoteCommandService
+		Eventually(services).Should(Receive(&service))
+
+		By("passing on stdin until the client closes it")
+		Expect(conn.WriteMessage(websocket.BinaryMessage, []byte{wsStdin, 'h', 'i'})).To(Succeed())
+		Expect(conn.WriteMessage(websocket.BinaryMessage, []byte{wsStreamClose, wsStdin})).To(Succeed())
+		stdin, err := io.ReadAll(service.Stdin())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stdin)).To(Equal("hi"))
+
+		By("passing on terminal resizes")
+		resize, _ := json.Marshal(TerminalSize{Width: 80, Height: 24})
+		Expect(conn.WriteMessage(websocket.BinaryMessage, append([]byte{wsResize}, resize...))).To(Succeed())
+		var size TerminalSize
+		Expect(json.NewDecoder(service.Resize()).Decode(&size)).To(Succeed())
+		Expect(size).To(Equal(TerminalSize{Width: 80, Height: 24}))
+
+		By("writing stdout on its own stream")
+		_, err = service.Stdout().Write([]byte("out"))
+		Expect(err).ToNot(HaveOccurred())
+		messageType, data, err := conn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messageType).To(Equal(websocket.BinaryMessage))
+		Expect(data).To(Equal([]byte{wsStdout, 'o', 'u', 't'}))
+
+		By("closing the connection cleanly")
+		Expect(service.Close()).To(Succeed())
+		_, _, err = conn.ReadMessage()
+		Expect(websocket.IsCloseError(err, websocket.CloseNormalClosure)).To(BeTrue())
+	})
+
+	It("lets us know when the client goes away", func() {
+		conn, _, err := dial(wsProtocolV4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.Subprotocol()).To(Equal(wsProtocolV4))
+
+		var service RemoteCommandService
+		Eventually(services).Should(Receive(&service))
+
+		conn.Close()
+		Eventually(service.CloseChan()).Should(BeClosed())
+	})
+
+	It("refuses protocols it doesn't speak", func() {
+		_, res, err := dial("channel.k8s.io")
+		Expect(err).To(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -38,6 +38,13 @@ type RequestMapStruct struct {
 	streamMessageContent portforward.KubePortForwardStreamMessageContent
 	streamMessage        smsg.StreamMessage
 }
+
+// portForwardRequest is where we send the agent's messages for one connection
+// to one of the ports being forwarded
+type portForwardRequest struct {
+	messages chan RequestMapStruct
+	done     chan struct{} // closed once we've stopped reading messages
+}
 type PortForwardAction struct {
 	tmb    tomb.Tomb
 	logger *logger.Logger
@@ -57,8 +64,10 @@ type PortForwardAction struct {
 	streamCreationTimeout time.Duration
 	endpoint              string
 
-	// Map of portforardId <-> PortForwardSubAction
-	requestMap map[string]chan RequestMapStruct
+	// Map of portforardId <-> PortForwardSubAction. kubectl makes a request for
+	// every connection to every port it forwards, and each is tracked on its own
+	requestMap     map[string]*portForwardRequest
+	requestMapLock sync.Mutex
 }
 
 // httpStreamPair represents the error and data streams for a port
@@ -90,7 +99,7 @@ func New(
 		streamInputChan:       make(chan smsg.StreamMessage, 10),
 		streamPairs:           make(map[string]*httpStreamPair),
 		streamCreationTimeout: kubeutils.DefaultStreamCreationTimeout,
-		requestMap:            make(map[string]chan RequestMapStruct),
+		requestMap:            make(map[string]*portForwardRequest),
 	}
 }
 
@@ -130,14 +139,21 @@ func (p *PortForwardAction) ReceiveStream(stream smsg.StreamMessage) {
 	}
 
 	// First get the stream
-	streamChan, ok := p.requestMap[kubePortforwardStreamMessageContent.PortForwardRequestId]
+	p.requestMapLock.Lock()
+	request, ok := p.requestMap[kubePortforwardStreamMessageContent.PortForwardRequestId]
+	p.requestMapLock.Unlock()
 	if !ok {
 		p.logger.Error(fmt.Errorf("unable to find stream chan for request: %s", kubePortforwardStreamMessageContent.PortForwardRequestId))
 		return
 	}
-	streamChan <- RequestMapStruct{
+
+	// the request may end while we're waiting for it to take our message
+	select {
+	case request.messages <- RequestMapStruct{
 		streamMessageContent: kubePortforwardStreamMessageContent,
 		streamMessage:        stream,
+	}:
+	case <-request.done:
 	}
 }
 
@@ -184,19 +200,28 @@ readyMessageLoop:
 		}
 	}
 
-	// Perform our http handshake
-	_, err := performHandshake(request, writer, []string{kubeutils.PortForwardProtocolV1Name})
-	if err != nil {
-		return fmt.Errorf("could not perform http handshake: %s", err)
-	}
-
 	// Now create our streamChan (where kubectl requests will come in)
 	streamChan := make(chan httpstream.Stream, 1)
 
-	// Upgrade the response
-	conn := getUpgradedConnection(writer, request, streamChan, kubeutils.DefaultStreamCreationTimeout)
-	if conn == nil {
-		return fmt.Errorf("unable to upgrade websocket connection")
+	var conn httpstream.Connection
+	if isWebSocketRequest(request) {
+		// Newer kubectl tunnels its SPDY connection through a WebSocket
+		var err error
+		if conn, err = getWebSocketConnection(writer, request, streamChan, kubeutils.DefaultStreamCreationTimeout); err != nil {
+			return err
+		}
+	} else {
+		// Perform our http handshake
+		_, err := performHandshake(request, writer, []string{kubeutils.PortForwardProtocolV1Name})
+		if err != nil {
+			return fmt.Errorf("could not perform http handshake: %s", err)
+		}
+
+		// Upgrade the response
+		conn = getUpgradedConnection(writer, request, streamChan, kubeutils.DefaultStreamCreationTimeout)
+		if conn == nil {
+			return fmt.Errorf("unable to upgrade websocket connection")
+		}
 	}
 	conn.SetIdleTimeout(kubeutils.DefaultIdleTimeout)
 	defer conn.Close()
@@ -277,12 +302,37 @@ func (p *PortForwardAction) sendCloseMessage() {
 
 func (p *PortForwardAction) forwardStreamPair(portforwardSession *httpStreamPair, remotePort int64) error {
 	// Make and update the stream channel for this requestId
-	p.requestMap[portforwardSession.requestID] = make(chan RequestMapStruct)
+	request := &portForwardRequest{
+		messages: make(chan RequestMapStruct),
+		done:     make(chan struct{}),
+	}
+	p.requestMapLock.Lock()
+	p.requestMap[portforwardSession.requestID] = request
+	p.requestMapLock.Unlock()
 
 	// set up our defers to close our streams
 	defer portforwardSession.dataStream.Close()
 	defer portforwardSession.errorStream.Close()
 
+	// Delete the stream pair from our mapping once we're done with it
+	defer func() {
+		p.requestMapLock.Lock()
+		delete(p.requestMap, portforwardSession.requestID)
+		p.requestMapLock.Unlock()
+		close(request.done)
+	}()
+
+	// Have the agent connect to the pod's port now rather than when the client
+	// first sends something, so that servers that speak first work and any
+	// problem with the port is reported straight away
+	p.outbox(portforward.DataInPortForward, portforward.KubePortForwardActionPayload{
+		RequestId:            p.requestId,
+		LogId:                p.logId,
+		Data:                 []byte{},
+		PortForwardRequestId: portforwardSession.requestID,
+		PodPort:              remotePort,
+	})
+
 	var tmb tomb.Tomb
 
 	tmb.Go(func() error {
@@ -297,12 +347,12 @@ func (p *PortForwardAction) forwardStreamPair(portforwardSession *httpStreamPair
 				case <-tmb.Dying():
 					return nil
 				default:
-					if n, err := portforwardSession.errorStream.Read(buf); !p.tmb.Alive() {
+					if n, err := portforwardSession.errorStream.Read(buf); !tmb.Alive() {
 						return nil
-					} else if err == io.EOF {
+					} else if err != nil {
 						// Do not close the stream if we close the errorstream
 						return nil
-					} else {
+					} else if n > 0 {
 						// Now send this data to Bastion
 						payload := portforward.KubePortForwardActionPayload{
 							RequestId:            p.requestId,
@@ -364,29 +414,24 @@ func (p *PortForwardAction) forwardStreamPair(portforwardSession *httpStreamPair
 		expectedDataSeqNumber += 1
 	}
 
+	// the agent tells us why a port couldn't be forwarded on its error stream,
+	// which kubectl prints for that port alone
 	processErrorMessage := func(content []byte) {
 		if _, err := io.Copy(portforwardSession.errorStream, bytes.NewReader(content)); err != nil {
 			p.logger.Errorf("error writing to stream error: %s", err)
 			tmb.Kill(nil)
+		} else if len(content) > 0 {
+			p.logger.Errorf("error forwarding port %d for request %s: %s", remotePort, portforwardSession.requestID, content)
 		}
 		expectedErrorSeqNumber += 1
 	}
 
-	// Get our chan
-	requestMapChannel, ok := p.requestMap[portforwardSession.requestID]
-	if !ok {
-		p.logger.Errorf("error getting stream for request: %s", portforwardSession.requestID)
-		return errors.New("unable to find stream channel")
-	}
-
 	// Set up the function to listen to bastion messages and push to the user
 	for {
 		select {
 		case <-tmb.Dying():
-			// Delete the stream pair from our mapping
-			delete(p.requestMap, portforwardSession.requestID)
 			return nil
-		case requestMapStruct := <-requestMapChannel:
+		case requestMapStruct := <-request.messages:
 			// contentBytes, _ := base64.StdEncoding.DecodeString(streamMessage.Content)
 
 			if requestMapStruct.streamMessage.Type == smsg.Data {
@@ -401,8 +446,8 @@ func (p *PortForwardAction) forwardStreamPair(portforwardSession *httpStreamPair
 				// Always attempt to processes out of order messages
 				for oooRequest, ok := dataBuffer[expectedDataSeqNumber]; ok; oooRequest, ok = dataBuffer[expectedDataSeqNumber] {
 					// Keep pulling older messages
+					delete(dataBuffer, expectedDataSeqNumber)
 					processDataMessage(oooRequest.streamMessageContent.Content, oooRequest.streamMessage.More)
-					expectedDataSeqNumber++
 				}
 
 			} else if requestMapStruct.streamMessage.Type == smsg.Error {
@@ -414,10 +459,10 @@ func (p *PortForwardAction) forwardStreamPair(portforwardSession *httpStreamPair
 				}
 
 				// Always attempt to process out of order messages
-				for oooRequest, ok := dataBuffer[expectedErrorSeqNumber]; ok; oooRequest, ok = dataBuffer[expectedErrorSeqNumber] {
+				for oooRequest, ok := errorBuffer[expectedErrorSeqNumber]; ok; oooRequest, ok = errorBuffer[expectedErrorSeqNumber] {
 					// Keep pulling older messages
-					processErrorMessage([]byte(oooRequest.streamMessageContent.Content))
-					expectedErrorSeqNumber++
+					delete(errorBuffer, expectedErrorSeqNumber)
+					processErrorMessage(oooRequest.streamMessageContent.Content)
 				}
 
 			} else {
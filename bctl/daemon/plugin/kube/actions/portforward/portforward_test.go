@@ -133,6 +133,7 @@ var _ = Describe("Daemon PortForward action", Ordered, func() {
 				By("registering incoming data and error streams")
 				// these will come in any order and as many times as we ask for them
 				n := 0
+				receivedOpen := false
 				receivedDataIn := false
 				receivedError := false
 				// technically this is nondeterministic, but it'll only fail one in a million times
@@ -143,8 +144,14 @@ var _ = Describe("Daemon PortForward action", Ordered, func() {
 						var dataInPayload portforward.KubePortForwardActionPayload
 						err = json.Unmarshal(msg.ActionPayload, &dataInPayload)
 						Expect(err).To(BeNil())
-						Expect(dataInPayload.Data).To(Equal([]byte(streamData)))
-						receivedDataIn = true
+						if !receivedOpen {
+							By("asking the agent to open the port before kubectl sends anything")
+							Expect(dataInPayload.Data).To(BeEmpty())
+							receivedOpen = true
+						} else {
+							Expect(dataInPayload.Data).To(Equal([]byte(streamData)))
+							receivedDataIn = true
+						}
 					case string(portforward.ErrorPortForward):
 						var errorInPayload portforward.KubePortForwardActionPayload
 						err = json.Unmarshal(msg.ActionPayload, &errorInPayload)
@@ -154,6 +161,7 @@ var _ = Describe("Daemon PortForward action", Ordered, func() {
 					}
 					n++
 				}
+				Expect(receivedOpen).To(BeTrue())
 				Expect(receivedDataIn).To(BeTrue())
 				Expect(receivedError).To(BeTrue())
 
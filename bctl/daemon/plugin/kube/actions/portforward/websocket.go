@@ -0,0 +1,139 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+
+	kubeutils "bastionzero.com/bzerolib/plugin/kube/utils"
+)
+
+// Newer kubectl doesn't speak SPDY to us directly when it forwards ports. Instead,
+// it sends the very same SPDY connection as binary messages over a WebSocket
+// Ref: https://github.com/kubernetes/enhancements/tree/master/keps/sig-api-machinery/4006-transition-spdy-to-websockets
+const (
+	wsTunnelingPrefix = "SPDY/3.1+"
+	wsProtocolV1      = wsTunnelingPrefix + kubeutils.PortForwardProtocolV1Name
+
+	wsCloseTimeout = 1 * time.Second
+)
+
+func isWebSocketRequest(request *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(request)
+}
+
+// for testing purposes this needs to be a variable so that we can overwrite it
+var getWebSocketConnection = func(w http.ResponseWriter, req *http.Request, streamChan chan httpstream.Stream, pingPeriod time.Duration) (httpstream.Connection, error) {
+	supported := false
+	for _, protocol := range websocket.Subprotocols(req) {
+		supported = supported || protocol == wsProtocolV1
+	}
+	if !supported {
+		err := fmt.Errorf("unsupported port forward protocol, expected %s", wsProtocolV1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{wsProtocolV1}}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already responded to the client
+		return nil, fmt.Errorf("unable to upgrade request: %s", err)
+	}
+
+	tunnel := &tunnelConn{conn: conn}
+	spdyConn, err := spdystream.NewServerConnectionWithPings(tunnel, httpStreamReceived(context.TODO(), streamChan), pingPeriod)
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("unable to start SPDY connection over WebSocket: %s", err)
+	}
+	return spdyConn, nil
+}
+
+// tunnelConn is the SPDY connection that kubectl tunnels through a WebSocket.
+// Messages don't mean anything on their own, they're just pieces of the stream
+type tunnelConn struct {
+	conn *websocket.Conn
+
+	// what's left of the message we're partway through reading
+	message io.Reader
+
+	// gorilla only allows one concurrent writer
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func (t *tunnelConn) Read(p []byte) (int, error) {
+	for {
+		if t.message == nil {
+			messageType, reader, err := t.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			} else if err != nil {
+				return 0, err
+			} else if messageType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("unexpected WebSocket message type: %d", messageType)
+			}
+			t.message = reader
+		}
+
+		if n, err := t.message.Read(p); errors.Is(err, io.EOF) {
+			t.message = nil
+			if n > 0 {
+				return n, nil
+			}
+		} else {
+			return n, err
+		}
+	}
+}
+
+func (t *tunnelConn) Write(p []byte) (int, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if err := t.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close lets the client know we're done so that it doesn't treat the closed
+// connection as an error
+func (t *tunnelConn) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsCloseTimeout))
+		err = t.conn.Close()
+	})
+	return err
+}
+
+func (t *tunnelConn) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *tunnelConn) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *tunnelConn) SetDeadline(deadline time.Time) error {
+	return errors.Join(t.SetReadDeadline(deadline), t.SetWriteDeadline(deadline))
+}
+
+func (t *tunnelConn) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *tunnelConn) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
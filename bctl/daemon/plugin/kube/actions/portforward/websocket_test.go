@@ -0,0 +1,94 @@
+package portforward
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+
+	kubeutils "bastionzero.com/bzerolib/plugin/kube/utils"
+)
+
+var _ = Describe("Daemon PortForward WebSocket", func() {
+	var server *httptest.Server
+	var streamChan chan httpstream.Stream
+	var conns chan httpstream.Connection
+
+	BeforeEach(func() {
+		streamChan = make(chan httpstream.Stream, 1)
+		conns = make(chan httpstream.Connection, 1)
+		server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			Expect(isWebSocketRequest(request)).To(BeTrue())
+			if conn, err := getWebSocketConnection(writer, request, streamChan, time.Minute); err == nil {
+				conns <- conn
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	dial := func(protocols ...string) (*websocket.Conn, *http.Response, error) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/portforward"
+		dialer := websocket.Dialer{Subprotocols: protocols}
+		return dialer.Dial(url, nil)
+	}
+
+	It("serves the SPDY connection kubectl tunnels through it", func() {
+		wsConn, _, err := dial(wsProtocolV1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(wsConn.Subprotocol()).To(Equal(wsProtocolV1))
+
+		var serverConn httpstream.Connection
+		Eventually(conns).Should(Receive(&serverConn))
+		defer serverConn.Close()
+
+		clientConn, err := spdystream.NewClientConnection(&tunnelConn{conn: wsConn})
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+
+		By("passing on the streams the client creates")
+		headers := http.Header{}
+		headers.Set(kubeutils.StreamType, kubeutils.StreamTypeData)
+		headers.Set(kubeutils.PortHeader, "8080")
+		headers.Set(kubeutils.PortForwardRequestIDHeader, "0")
+		clientStream, err := clientConn.CreateStream(headers)
+		Expect(err).ToNot(HaveOccurred())
+
+		var serverStream httpstream.Stream
+		Eventually(streamChan).Should(Receive(&serverStream))
+		Expect(serverStream.Headers().Get(kubeutils.PortHeader)).To(Equal("8080"))
+
+		By("carrying data both ways")
+		_, err = clientStream.Write([]byte("ping"))
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(serverStream, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf)).To(Equal("ping"))
+
+		_, err = serverStream.Write([]byte("pong"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = io.ReadFull(clientStream, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf)).To(Equal("pong"))
+
+		By("letting the server know when the client goes away")
+		clientConn.Close()
+		Eventually(serverConn.CloseChan()).Should(BeClosed())
+	})
+
+	It("refuses clients that don't tunnel SPDY", func() {
+		_, response, err := dial("v5.channel.k8s.io")
+		Expect(err).To(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
@@ -15,6 +16,22 @@ import (
 	smsg "bastionzero.com/bzerolib/stream/message"
 )
 
+const (
+	// How far the agent may read ahead of what we've written to the client
+	streamWindowSize = 256 * 1024
+
+	// We acknowledge what we've written in pieces this big rather than for
+	// every message, so that flow control doesn't double our traffic
+	streamAckSize = streamWindowSize / 4
+
+	// Most of a streamed request body we'll send the agent in one message
+	streamBodyChunkSize = 8 * 1024
+)
+
+// How long we'll wait for the agent's headers once it has our whole request. This
+// needs to be a variable so that we can overwrite it in tests
+var headerTimeout = 30 * time.Second
+
 type StreamAction struct {
 	logger *logger.Logger
 
@@ -30,6 +47,13 @@ type StreamAction struct {
 
 	expectedSequenceNumber int
 	outOfOrderMessages     map[int]smsg.StreamMessage
+
+	// set if the agent will wait for us to acknowledge what we've written
+	flowControl bool
+	unacked     int
+
+	// set if the agent told us it can take request bodies in StreamInput messages
+	streamBodies bool
 }
 
 func New(
@@ -39,6 +63,7 @@ func New(
 	requestId string,
 	logId string,
 	commandBeingRun string,
+	streamBodies bool,
 ) *StreamAction {
 
 	return &StreamAction{
@@ -49,6 +74,7 @@ func New(
 		doneChan:        doneChan,
 		outputChan:      outputChan,
 		streamInputChan: make(chan smsg.StreamMessage, 10),
+		streamBodies:    streamBodies,
 
 		// Start at 1 since we wait for our headers message
 		expectedSequenceNumber: 1,
@@ -79,11 +105,19 @@ func (s *StreamAction) Start(writer http.ResponseWriter, request *http.Request)
 	// First extract the headers out of the request
 	headers := bzhttp.GetHeaders(request.Header)
 
+	// If we don't know how big the body is, it may never end (or not for a long
+	// time) so we stream it to the agent rather than waiting for all of it. Older
+	// agents don't know how to take it, so they get all of it up front
+	streamBody := s.streamBodies && request.ContentLength < 0 && request.Body != nil && request.Body != http.NoBody
+
 	// Now extract the body
-	bodyInBytes, err := bzhttp.GetBodyBytes(request.Body)
-	if err != nil {
-		s.logger.Error(err)
-		return err
+	var bodyInBytes []byte
+	if !streamBody {
+		var err error
+		if bodyInBytes, err = bzhttp.GetBodyBytes(request.Body); err != nil {
+			s.logger.Error(err)
+			return err
+		}
 	}
 
 	// Build the action payload
@@ -96,6 +130,8 @@ func (s *StreamAction) Start(writer http.ResponseWriter, request *http.Request)
 		StreamMessageVersion: smsg.CurrentSchema,
 		LogId:                s.logId,
 		CommandBeingRun:      s.commandBeingRun,
+		WindowSize:           streamWindowSize,
+		StreamBody:           streamBody,
 	}
 
 	// Send payload to plugin output queue
@@ -105,20 +141,35 @@ func (s *StreamAction) Start(writer http.ResponseWriter, request *http.Request)
 		ActionPayload: payloadBytes,
 	}
 
+	bodySent := make(chan struct{})
+	if streamBody {
+		go s.sendBody(request.Body, bodySent)
+	} else {
+		close(bodySent)
+	}
+
 	// Wait for our initial message to determine what headers to use
 	// The first message that comes from the stream is our headers message, wait for it
-	// And keep any other messages that might come before
+	// And keep any other messages that might come before. The agent may not answer
+	// until it has the whole body, so we don't start timing out until it does
+	var timeout <-chan time.Time
+	uploading := bodySent
 waitForHeaders:
 	for {
 		select {
 		case <-s.doneChan:
 			return nil
+		case <-uploading:
+			timeout = time.After(headerTimeout)
+			uploading = nil
 		case watchData := <-s.streamInputChan:
 			contentBytes, _ := base64.StdEncoding.DecodeString(watchData.Content)
 
 			// Attempt to decode contentBytes
 			var kubestreamHeadersPayload stream.KubeStreamHeadersPayload
-			if err := json.Unmarshal(contentBytes, &kubestreamHeadersPayload); err != nil {
+			if watchData.SequenceNumber != 0 {
+				s.outOfOrderMessages[watchData.SequenceNumber] = watchData
+			} else if err := json.Unmarshal(contentBytes, &kubestreamHeadersPayload); err != nil {
 				// If we see an error this must be an early message
 				s.outOfOrderMessages[watchData.SequenceNumber] = watchData
 			} else {
@@ -128,9 +179,29 @@ waitForHeaders:
 						writer.Header().Set(name, value)
 					}
 				}
+				s.flowControl = kubestreamHeadersPayload.FlowControl
+
+				// HTTP/1 clients may not be able to send us any more of their body
+				// once we've started responding
+				if request.ProtoMajor < 2 {
+					select {
+					case <-bodySent:
+					case <-s.doneChan:
+						return nil
+					}
+				}
+
+				// Older agents don't tell us and always meant 200. Flush so that
+				// clients know we're connected before there's anything to watch
+				if kubestreamHeadersPayload.StatusCode != 0 {
+					writer.WriteHeader(kubestreamHeadersPayload.StatusCode)
+					if flush, ok := writer.(http.Flusher); ok {
+						flush.Flush()
+					}
+				}
 				break waitForHeaders
 			}
-		case <-time.After(30 * time.Second):
+		case <-timeout:
 			return fmt.Errorf("timed out waiting for initial header message")
 		}
 	}
@@ -176,7 +247,7 @@ waitForHeaders:
 				if watchData.SequenceNumber == s.expectedSequenceNumber {
 					// If the incoming data is equal to the current expected seqNumber, show the user
 					contentBytes, _ := base64.StdEncoding.DecodeString(watchData.Content)
-					if err := kubeutils.WriteToHttpRequest(contentBytes, writer); err != nil {
+					if err := s.write(contentBytes, writer); err != nil {
 						s.logger.Error(err)
 						close(s.doneChan)
 						return fmt.Errorf("could not write response: %s", err)
@@ -199,7 +270,7 @@ func (s *StreamAction) handleOutOfOrderMessage(writer http.ResponseWriter) {
 	for outOfOrderMessageData, ok := s.outOfOrderMessages[s.expectedSequenceNumber]; ok; outOfOrderMessageData, ok = s.outOfOrderMessages[s.expectedSequenceNumber] {
 		// If we have an early message, show it to the user
 		contentBytes, _ := base64.StdEncoding.DecodeString(outOfOrderMessageData.Content)
-		if err := kubeutils.WriteToHttpRequest(contentBytes, writer); err != nil {
+		if err := s.write(contentBytes, writer); err != nil {
 			return
 		}
 
@@ -207,3 +278,61 @@ func (s *StreamAction) handleOutOfOrderMessage(writer http.ResponseWriter) {
 		s.expectedSequenceNumber += 1
 	}
 }
+
+// write passes the response on to the client and, once we've written enough,
+// lets the agent know it can read more
+func (s *StreamAction) write(contentBytes []byte, writer http.ResponseWriter) error {
+	if err := kubeutils.WriteToHttpRequest(contentBytes, writer); err != nil {
+		return err
+	}
+
+	s.unacked += len(contentBytes)
+	if s.flowControl && s.unacked >= streamAckSize {
+		payloadBytes, _ := json.Marshal(stream.KubeStreamAckPayload{
+			RequestId: s.requestId,
+			LogId:     s.logId,
+			Bytes:     s.unacked,
+		})
+		s.outputChan <- plugin.ActionWrapper{
+			Action:        string(stream.StreamAck),
+			ActionPayload: payloadBytes,
+		}
+		s.unacked = 0
+	}
+	return nil
+}
+
+// sendBody streams the request body to the agent until the client is done
+// sending it. Since the plugin's output queue is bounded, we won't read from the
+// client any faster than we can send it on
+func (s *StreamAction) sendBody(body io.Reader, bodySent chan struct{}) {
+	defer close(bodySent)
+
+	buf := make([]byte, streamBodyChunkSize)
+	for {
+		numBytes, err := body.Read(buf)
+		if err != nil && err != io.EOF {
+			s.logger.Errorf("error reading request body: %s", err)
+		}
+
+		payloadBytes, _ := json.Marshal(stream.KubeStreamInputPayload{
+			RequestId: s.requestId,
+			LogId:     s.logId,
+			Data:      buf[:numBytes],
+			EOF:       err != nil,
+		})
+
+		select {
+		case s.outputChan <- plugin.ActionWrapper{
+			Action:        string(stream.StreamInput),
+			ActionPayload: payloadBytes,
+		}:
+		case <-s.doneChan:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -3,6 +3,8 @@ package stream
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -41,7 +43,7 @@ var _ = Describe("Daemon Stream action", func() {
 		writer.On("Write", []byte(receiveData2)).Return(14, nil)
 		writer.On("Header").Return(make(map[string][]string))
 
-		s := New(logger, outputChan, doneChan, requestId, logId, command)
+		s := New(logger, outputChan, doneChan, requestId, logId, command, true)
 
 		// NOTE: we can't make extensive use of the hierarchy here because we're evaluating messages being passed as state changes
 		It("passes the request and response correctly", func() {
@@ -123,6 +125,205 @@ var _ = Describe("Daemon Stream action", func() {
 			Expect(err).To(BeNil())
 		})
 	})
+
+	Context("Flow control", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan plugin.ActionWrapper, 2)
+		request := tests.MockHttpRequest("GET", urlPath, make(map[string][]string), "")
+		chunk := strings.Repeat("a", streamAckSize)
+		writer := tests.MockResponseWriter{}
+		writer.On("WriteHeader", 403).Return()
+		writer.On("Write", []byte(chunk)).Return(len(chunk), nil)
+
+		s := New(logger, outputChan, doneChan, requestId, logId, command, true)
+
+		It("passes on the status code and acknowledges what it has written", func() {
+			go func() {
+				startMessage := <-outputChan
+
+				By("offering the agent a window to read ahead by")
+				var payload stream.KubeStreamActionPayload
+				Expect(json.Unmarshal(startMessage.ActionPayload, &payload)).To(Succeed())
+				Expect(payload.WindowSize).To(Equal(streamWindowSize))
+				Expect(payload.StreamBody).To(BeFalse())
+
+				headersPayloadBytes, _ := json.Marshal(stream.KubeStreamHeadersPayload{
+					Headers:     map[string][]string{},
+					StatusCode:  403,
+					FlowControl: true,
+				})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 0,
+					More:           true,
+					Content:        base64.StdEncoding.EncodeToString(headersPayloadBytes),
+				})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 1,
+					More:           true,
+					Content:        base64.StdEncoding.EncodeToString([]byte(chunk)),
+				})
+
+				By("acknowledging the data once it's been written")
+				ackMessage := <-outputChan
+				Expect(ackMessage.Action).To(Equal(string(stream.StreamAck)))
+				var ack stream.KubeStreamAckPayload
+				Expect(json.Unmarshal(ackMessage.ActionPayload, &ack)).To(Succeed())
+				Expect(ack.Bytes).To(Equal(streamAckSize))
+
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 2,
+					More:           false,
+				})
+			}()
+
+			Expect(s.Start(&writer, &request)).To(Succeed())
+			writer.AssertExpectations(GinkgoT())
+		})
+	})
+
+	Context("Chunked request body", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan plugin.ActionWrapper, 1)
+		request := tests.MockHttpRequest("POST", urlPath, make(map[string][]string), sendData)
+		request.ContentLength = -1
+		request.ProtoMajor = 1
+		writer := tests.MockResponseWriter{}
+
+		s := New(logger, outputChan, doneChan, requestId, logId, command, true)
+
+		It("streams the body to the agent", func() {
+			go func() {
+				startMessage := <-outputChan
+
+				var payload stream.KubeStreamActionPayload
+				Expect(json.Unmarshal(startMessage.ActionPayload, &payload)).To(Succeed())
+				Expect(payload.StreamBody).To(BeTrue())
+				Expect(payload.Body).To(BeEmpty())
+
+				By("sending the body until the client is done with it")
+				body := ""
+				for {
+					inputMessage := <-outputChan
+					Expect(inputMessage.Action).To(Equal(string(stream.StreamInput)))
+					var input stream.KubeStreamInputPayload
+					Expect(json.Unmarshal(inputMessage.ActionPayload, &input)).To(Succeed())
+					body += string(input.Data)
+					if input.EOF {
+						break
+					}
+				}
+				Expect(body).To(Equal(sendData))
+
+				headersPayloadBytes, _ := json.Marshal(stream.KubeStreamHeadersPayload{Headers: map[string][]string{}})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 0,
+					Content:        base64.StdEncoding.EncodeToString(headersPayloadBytes),
+				})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 1,
+					More:           false,
+				})
+			}()
+
+			Expect(s.Start(&writer, &request)).To(Succeed())
+		})
+	})
+
+	Context("Chunked request body to an older agent", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan plugin.ActionWrapper, 1)
+		request := tests.MockHttpRequest("POST", urlPath, make(map[string][]string), sendData)
+		request.ContentLength = -1
+		writer := tests.MockResponseWriter{}
+
+		s := New(logger, outputChan, doneChan, requestId, logId, command, false)
+
+		It("sends the whole body up front", func() {
+			go func() {
+				defer GinkgoRecover()
+				startMessage := <-outputChan
+
+				var payload stream.KubeStreamActionPayload
+				Expect(json.Unmarshal(startMessage.ActionPayload, &payload)).To(Succeed())
+				Expect(payload.StreamBody).To(BeFalse())
+				Expect(payload.Body).To(Equal(sendData))
+
+				headersPayloadBytes, _ := json.Marshal(stream.KubeStreamHeadersPayload{Headers: map[string][]string{}})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 0,
+					Content:        base64.StdEncoding.EncodeToString(headersPayloadBytes),
+				})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 1,
+					More:           false,
+				})
+			}()
+
+			Expect(s.Start(&writer, &request)).To(Succeed())
+			Consistently(outputChan).ShouldNot(Receive())
+		})
+	})
+
+	Context("Slow chunked request body", func() {
+		doneChan := make(chan struct{})
+		outputChan := make(chan plugin.ActionWrapper, 1)
+		request := tests.MockHttpRequest("POST", urlPath, make(map[string][]string), "")
+		request.ContentLength = -1
+		request.ProtoMajor = 2
+		writer := tests.MockResponseWriter{}
+
+		bodyReader, bodyWriter := io.Pipe()
+		request.Body = bodyReader
+
+		s := New(logger, outputChan, doneChan, requestId, logId, command, true)
+
+		BeforeEach(func() {
+			headerTimeout = 100 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			headerTimeout = 30 * time.Second
+		})
+
+		It("doesn't time out while the body is still being sent", func() {
+			go func() {
+				defer GinkgoRecover()
+				<-outputChan
+
+				time.Sleep(5 * headerTimeout)
+				bodyWriter.Write([]byte(sendData))
+				bodyWriter.Close()
+				for {
+					var input stream.KubeStreamInputPayload
+					Expect(json.Unmarshal((<-outputChan).ActionPayload, &input)).To(Succeed())
+					if input.EOF {
+						break
+					}
+				}
+
+				headersPayloadBytes, _ := json.Marshal(stream.KubeStreamHeadersPayload{Headers: map[string][]string{}})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 0,
+					Content:        base64.StdEncoding.EncodeToString(headersPayloadBytes),
+				})
+				s.ReceiveStream(smsg.StreamMessage{
+					Type:           smsg.Data,
+					SequenceNumber: 1,
+					More:           false,
+				})
+			}()
+
+			Expect(s.Start(&writer, &request)).To(Succeed())
+		})
+	})
 })
 
 // could have a test that ends via Context().Done() or a tomb kill
@@ -1,8 +1,10 @@
 package kube
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin"
@@ -36,9 +38,18 @@ type KubeDaemonPlugin struct {
 	// Kube-specific vars
 	targetUser   string
 	targetGroups []string
+
+	// whether the agent can take streamed request bodies
+	streamBodies bool
+
+	// what the agent told us it can do in its SynAck, which is only set once
+	// synAcked is closed
+	agentCapabilities bzkube.KubeSynAckPayload
+	synAcked          chan struct{}
+	synAckOnce        sync.Once
 }
 
-func New(logger *logger.Logger, targetUser string, targetGroups []string) *KubeDaemonPlugin {
+func New(logger *logger.Logger, targetUser string, targetGroups []string, streamBodies bool) *KubeDaemonPlugin {
 	return &KubeDaemonPlugin{
 		logger:       logger,
 		doneChan:     make(chan struct{}),
@@ -46,6 +57,8 @@ func New(logger *logger.Logger, targetUser string, targetGroups []string) *KubeD
 		outboxQueue:  make(chan plugin.ActionWrapper, 25),
 		targetUser:   targetUser,
 		targetGroups: targetGroups,
+		streamBodies: streamBodies,
+		synAcked:     make(chan struct{}),
 	}
 }
 
@@ -68,6 +81,32 @@ func (k *KubeDaemonPlugin) Outbox() <-chan plugin.ActionWrapper {
 	return k.outboxQueue
 }
 
+// ReceiveSynAck learns what the agent can do from its SynAck. We get one every
+// time we recover or resume our session, but an agent can't change what it
+// can do, so we only need the first
+func (k *KubeDaemonPlugin) ReceiveSynAck(actionPayload []byte) {
+	k.synAckOnce.Do(func() {
+		// older agents don't send anything
+		if len(actionPayload) > 0 {
+			if err := json.Unmarshal(actionPayload, &k.agentCapabilities); err != nil {
+				k.logger.Errorf("malformed kube SynAck payload: %s", err)
+			}
+		}
+		close(k.synAcked)
+	})
+}
+
+// SynAcked is closed once we've heard what the agent can do
+func (k *KubeDaemonPlugin) SynAcked() <-chan struct{} {
+	return k.synAcked
+}
+
+// AgentCapabilities returns what the agent told us it can do. It must not be
+// called before SynAcked is closed
+func (k *KubeDaemonPlugin) AgentCapabilities() bzkube.KubeSynAckPayload {
+	return k.agentCapabilities
+}
+
 func (k *KubeDaemonPlugin) ReceiveStream(smessage smsg.StreamMessage) {
 	if k.action != nil {
 		k.action.ReceiveStream(smessage)
@@ -89,10 +128,10 @@ func (k *KubeDaemonPlugin) StartAction(action bzkube.KubeAction, logId string, c
 	actLogger.AddRequestId(requestId)
 
 	switch action {
-	case bzkube.Exec:
+	case bzkube.Exec, bzkube.Attach:
 		k.action = exec.New(actLogger, k.outboxQueue, k.doneChan, requestId, logId, command)
 	case bzkube.Stream:
-		k.action = stream.New(actLogger, k.outboxQueue, k.doneChan, requestId, logId, command)
+		k.action = stream.New(actLogger, k.outboxQueue, k.doneChan, requestId, logId, command, k.streamBodies)
 	case bzkube.RestApi:
 		k.action = restapi.New(actLogger, k.outboxQueue, k.doneChan, requestId, logId, command)
 	case bzkube.PortForward:
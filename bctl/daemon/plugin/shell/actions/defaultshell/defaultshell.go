@@ -100,6 +100,14 @@ func (d *DefaultShell) ReceiveStream(smessage smsg.StreamMessage) {
 				d.logger.Errorf("Error writing to Stdout: %s", err)
 			}
 		}
+	case smsg.Error:
+		// the agent refused something but the shell is still open, e.g. the
+		// user tried to run a command outside a restricted session's allow list
+		if contentBytes, err := base64.StdEncoding.DecodeString(smessage.Content); err != nil {
+			d.logger.Errorf("Error decoding ShellError stream content: %s", err)
+		} else if _, err = fmt.Fprintf(os.Stderr, "%s\r\n", contentBytes); err != nil {
+			d.logger.Errorf("Error writing to Stderr: %s", err)
+		}
 	case smsg.Stop:
 		d.tmb.Kill(&bzshell.ShellQuitError{})
 		return
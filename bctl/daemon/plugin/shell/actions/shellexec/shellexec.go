@@ -0,0 +1,169 @@
+package shellexec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
+	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/bzerolib/plugin"
+	bzshell "bastionzero.com/bzerolib/plugin/shell"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+const (
+	inputBufferSize = 8 * 1024
+)
+
+// ShellExec runs a single command on the target without a pty. Our stdin is
+// forwarded to the command, its stdout and stderr are written to ours, and we
+// die with the command's exit code once it's done
+type ShellExec struct {
+	tmb    tomb.Tomb
+	logger *logger.Logger
+
+	outputChan chan plugin.ActionWrapper // plugin's output queue
+	doneChan   chan struct{}
+
+	command string
+	timeout time.Duration
+
+	stdIn          io.Reader
+	stdOut, stdErr io.Writer
+}
+
+func New(logger *logger.Logger, outboxQueue chan plugin.ActionWrapper, doneChan chan struct{}, command string, timeout time.Duration) *ShellExec {
+	return &ShellExec{
+		logger:     logger,
+		outputChan: outboxQueue,
+		doneChan:   doneChan,
+		command:    command,
+		timeout:    timeout,
+		stdIn:      os.Stdin,
+		stdOut:     os.Stdout,
+		stdErr:     os.Stderr,
+	}
+}
+
+func (s *ShellExec) Done() <-chan struct{} {
+	return s.doneChan
+}
+
+func (s *ShellExec) Err() error {
+	return s.tmb.Err()
+}
+
+func (s *ShellExec) Kill(err error) {
+	s.tmb.Kill(err)
+}
+
+func (s *ShellExec) Start(attach bool) error {
+	if attach {
+		return fmt.Errorf("cannot attach to a shell exec action")
+	}
+
+	s.sendOutputMessage(bzshell.ShellExecStart, bzshell.ShellExecStartMessage{
+		Command:              s.command,
+		TimeoutSeconds:       int(s.timeout.Seconds()),
+		StreamMessageVersion: smsg.CurrentSchema,
+	})
+
+	go func() {
+		defer close(s.doneChan)
+		<-s.tmb.Dying()
+	}()
+
+	// we don't track this with our tomb because it finishing doesn't mean we
+	// have; the command can carry on running after its stdin has been closed
+	go s.forwardStdIn()
+
+	return nil
+}
+
+func (s *ShellExec) Replay(replayData []byte) error {
+	return fmt.Errorf("shell exec actions cannot be replayed")
+}
+
+func (s *ShellExec) ReceiveStream(smessage smsg.StreamMessage) {
+	s.logger.Debugf("Shell exec received %v stream", smessage.Type)
+
+	content, err := base64.StdEncoding.DecodeString(smessage.Content)
+	if err != nil {
+		s.logger.Errorf("Error decoding %s stream content: %s", smessage.Type, err)
+		return
+	}
+
+	switch smsg.StreamType(smessage.Type) {
+	case smsg.StdOut:
+		if _, err = s.stdOut.Write(content); err != nil {
+			s.logger.Errorf("Error writing to Stdout: %s", err)
+		}
+	case smsg.StdErr, smsg.Error:
+		if _, err = s.stdErr.Write(content); err != nil {
+			s.logger.Errorf("Error writing to Stderr: %s", err)
+		}
+	case smsg.Stop:
+		s.tmb.Kill(exitError(content))
+	default:
+		s.logger.Errorf("unhandled stream type: %s", smessage.Type)
+	}
+}
+
+// exitError turns the agent's final stream message into the error we should die
+// with
+func exitError(content []byte) error {
+	var exit bzshell.ShellExecExitMessage
+	if err := json.Unmarshal(content, &exit); err != nil {
+		return fmt.Errorf("malformed shell exec exit message: %w", err)
+	}
+
+	if exit.Error != "" {
+		return fmt.Errorf("failed to run command: %s", exit.Error)
+	} else if exit.ExitCode != 0 || exit.TimedOut {
+		return &bzshell.ShellExecExitError{ExitCode: exit.ExitCode, TimedOut: exit.TimedOut}
+	} else {
+		return &bzshell.ShellQuitError{}
+	}
+}
+
+func (s *ShellExec) forwardStdIn() {
+	buf := make([]byte, inputBufferSize)
+
+	for {
+		n, err := s.stdIn.Read(buf)
+		if !s.tmb.Alive() {
+			return
+		}
+
+		input := bzshell.ShellExecInputMessage{
+			Data: append([]byte{}, buf[:n]...),
+			EOF:  err != nil,
+		}
+
+		if n > 0 || input.EOF {
+			s.sendOutputMessage(bzshell.ShellExecInput, input)
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.Errorf("error reading from Stdin: %s", err)
+			}
+			return
+		}
+	}
+}
+
+func (s *ShellExec) sendOutputMessage(action bzshell.ShellSubAction, payload interface{}) {
+	// Send payload to plugin output queue
+	payloadBytes, _ := json.Marshal(payload)
+	s.outputChan <- plugin.ActionWrapper{
+		Action:        string(action),
+		ActionPayload: payloadBytes,
+	}
+}
@@ -2,12 +2,14 @@ package shell
 
 import (
 	"fmt"
+	"time"
 
 	"bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
 	bzshell "bastionzero.com/bzerolib/plugin/shell"
 	smsg "bastionzero.com/bzerolib/stream/message"
 	"bastionzero.com/daemon/plugin/shell/actions/defaultshell"
+	"bastionzero.com/daemon/plugin/shell/actions/shellexec"
 )
 
 type ShellAction interface {
@@ -25,14 +27,25 @@ type ShellDaemonPlugin struct {
 	doneChan    chan struct{}
 	killed      bool
 	action      ShellAction
+
+	actionName bzshell.ShellAction
+
+	// only used by the exec action
+	command string
+	timeout time.Duration
 }
 
-func New(logger *logger.Logger) *ShellDaemonPlugin {
+// New returns a shell plugin for the given action. The command and timeout
+// are only used by the exec action, where a zero timeout means none
+func New(logger *logger.Logger, actionName bzshell.ShellAction, command string, timeout time.Duration) *ShellDaemonPlugin {
 	return &ShellDaemonPlugin{
 		logger:      logger,
 		outboxQueue: make(chan bzplugin.ActionWrapper, 10),
 		doneChan:    make(chan struct{}),
 		killed:      false,
+		actionName:  actionName,
+		command:     command,
+		timeout:     timeout,
 	}
 }
 
@@ -41,9 +54,15 @@ func (s *ShellDaemonPlugin) StartAction(attach bool) error {
 		return fmt.Errorf("plugin has already been killed, cannot create a new shell action")
 	}
 
-	// Create the DefaultShell action
-	actLogger := s.logger.GetActionLogger(string(bzshell.DefaultShell))
-	s.action = defaultshell.New(actLogger, s.outboxQueue, s.doneChan)
+	actLogger := s.logger.GetActionLogger(string(s.actionName))
+	switch s.actionName {
+	case bzshell.DefaultShell:
+		s.action = defaultshell.New(actLogger, s.outboxQueue, s.doneChan)
+	case bzshell.Exec:
+		s.action = shellexec.New(actLogger, s.outboxQueue, s.doneChan, s.command, s.timeout)
+	default:
+		return fmt.Errorf("unhandled shell action: %s", s.actionName)
+	}
 
 	// Start the shell action
 	if err := s.action.Start(attach); err != nil {
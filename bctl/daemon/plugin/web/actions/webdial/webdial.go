@@ -3,15 +3,15 @@ package webdial
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"strings"
 
 	"bastionzero.com/bzerolib/bzhttp"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin"
+	bzweb "bastionzero.com/bzerolib/plugin/web"
 	bzwebdial "bastionzero.com/bzerolib/plugin/web/actions/webdial"
 	smsg "bastionzero.com/bzerolib/stream/message"
 	"gopkg.in/tomb.v2"
@@ -52,10 +52,7 @@ func New(logger *logger.Logger, requestId string, outboxQueue chan plugin.Action
 }
 
 func (w *WebDialAction) Kill(err error) {
-	if w.tmb.Alive() {
-		w.tmb.Kill(err)
-		w.tmb.Wait()
-	}
+	w.tmb.Kill(err)
 }
 
 func (w *WebDialAction) Done() <-chan struct{} {
@@ -74,9 +71,15 @@ func (w *WebDialAction) Start(writer http.ResponseWriter, request *http.Request)
 	}
 	w.outbox(bzwebdial.WebDialStart, payload)
 
-	// Listen to stream messages coming from bastion, and forward to our local connection
-	// this signals to the parent plugin that the action is done
-	defer close(w.doneChan)
+	// the body can't be read once we've returned, so we stop sending it and wait
+	// until we have before we signal to the parent plugin that the action is done
+	bodySent := make(chan struct{})
+	defer func() {
+		w.tmb.Kill(nil)
+		request.Body.Close()
+		<-bodySent
+		close(w.doneChan)
+	}()
 
 	// First modify the host header to reflect what we are trying to connect to
 	// Ref: https://hackernoon.com/writing-a-reverse-proxy-in-just-one-line-with-go-c1edfa78c84b
@@ -86,21 +89,34 @@ func (w *WebDialAction) Start(writer http.ResponseWriter, request *http.Request)
 	headers := bzhttp.GetHeaders(request.Header)
 	headerSet := false
 
-	// Send our request, in chunks if the body > chunksize
-	request.ParseForm()
-	if len(request.Form) > 0 {
-		readCloser := ioutil.NopCloser(strings.NewReader(request.Form.Encode()))
-		w.sendRequestChunks(readCloser, request.URL.String(), headers, request.Method)
-	} else {
-		w.sendRequestChunks(request.Body, request.URL.String(), headers, request.Method)
-	}
+	// Send our request, in chunks if the body > chunksize. The agent starts the request as
+	// soon as it gets the first one and doesn't ack the next until the target has read it,
+	// so we never have to hold the whole body, and the target may respond before it's done
+	bodyErrChan := make(chan error, 1)
+	go func() {
+		defer close(bodySent)
+		bodyErrChan <- w.sendRequestChunks(request.Body, request.URL.String(), headers, request.Method, request.ContentLength)
+	}()
 
+	// Listen to stream messages coming from bastion, and forward to our local connection
 	for {
 		select {
 		case <-w.tmb.Dying():
 			return nil
 		case <-w.doneChan:
 			return nil
+		case err := <-bodyErrChan:
+			var maxBytesErr *http.MaxBytesError
+			if err == nil {
+				bodyErrChan = nil
+			} else if errors.As(err, &maxBytesErr) && !headerSet {
+				rerr := fmt.Errorf("BastionZero: Request is too large. Maximum request size is %d bytes", maxBytesErr.Limit)
+				w.logger.Error(rerr)
+				http.Error(writer, rerr.Error(), http.StatusRequestEntityTooLarge)
+				return rerr
+			} else {
+				return err
+			}
 		case <-request.Context().Done():
 			w.logger.Info("HTTP request cancelled. Sending interrupt signal to agent.")
 
@@ -113,7 +129,7 @@ func (w *WebDialAction) Start(writer http.ResponseWriter, request *http.Request)
 		case data := <-w.streamInputChan:
 			// may have gotten an old-fashioned or newfangled message type, depending on what we asked for
 			switch data.Type {
-			case smsg.WebStream, smsg.WebStreamEnd, smsg.Stream:
+			case smsg.WebStream, smsg.WebStreamEnd, smsg.Stream, smsg.Error, smsg.WebError, smsg.TLSCertificateError, smsg.TLSHandshakeError:
 				w.streamMessages[data.SequenceNumber] = data
 				// process the incoming stream messages *in order*
 				for nextMessage, ok := w.streamMessages[w.expectedSequenceNumber]; ok; nextMessage, ok = w.streamMessages[w.expectedSequenceNumber] {
@@ -124,6 +140,14 @@ func (w *WebDialAction) Start(writer http.ResponseWriter, request *http.Request)
 						rerr := fmt.Errorf("could not unmarshal web dial output action payload: %s", err)
 						w.logger.Error(rerr)
 						return rerr
+					} else if isErrorType(nextMessage.Type) {
+						// the agent couldn't get a response from the target, so tell the user why
+						rerr := errors.New(bzweb.ErrorMessage(nextMessage.Type, string(response.Content)))
+						w.logger.Error(rerr)
+						if !headerSet {
+							http.Error(writer, rerr.Error(), http.StatusBadGateway)
+						}
+						return rerr
 					} else {
 						// we only write this header once
 						// ref: https://stackoverflow.com/questions/57828645/how-to-handle-superfluous-response-writeheader-call-in-order-to-return-500
@@ -157,13 +181,15 @@ func (w *WebDialAction) Start(writer http.ResponseWriter, request *http.Request)
 	}
 }
 
-func (w *WebDialAction) sendRequestChunks(body io.ReadCloser, endpoint string, headers map[string][]string, method string) {
+func (w *WebDialAction) sendRequestChunks(body io.ReadCloser, endpoint string, headers map[string][]string, method string, contentLength int64) error {
 	buf := make([]byte, chunkSize)
 	more := true
 	sequenceNumber := 0
 
 	for numBytes, err := body.Read(buf); more; numBytes, err = body.Read(buf) {
-		if err == io.EOF {
+		if !w.tmb.Alive() {
+			return nil
+		} else if err == io.EOF {
 			more = false
 		} else if err != nil {
 			w.logger.Errorf("error chunking http request: %s", err)
@@ -173,7 +199,7 @@ func (w *WebDialAction) sendRequestChunks(body io.ReadCloser, endpoint string, h
 				RequestId: w.requestId,
 			}
 			w.outbox(bzwebdial.WebDialInterrupt, payload)
-			return
+			return err
 		}
 
 		// Build the action payload
@@ -185,19 +211,33 @@ func (w *WebDialAction) sendRequestChunks(body io.ReadCloser, endpoint string, h
 			SequenceNumber: sequenceNumber,
 			Body:           buf[:numBytes],
 			More:           more,
+			ContentLength:  contentLength,
 		}
 		w.outbox(bzwebdial.WebDialInput, dataInPayload)
 
 		sequenceNumber++
 	}
+	return nil
+}
+
+func isErrorType(streamType smsg.StreamType) bool {
+	switch streamType {
+	case smsg.Error, smsg.WebError, smsg.TLSCertificateError, smsg.TLSHandshakeError:
+		return true
+	default:
+		return false
+	}
 }
 
 func (w *WebDialAction) outbox(action bzwebdial.WebDialSubAction, payload interface{}) {
 	// Send payload to plugin output queue
 	payloadBytes, _ := json.Marshal(payload)
-	w.outboxQueue <- plugin.ActionWrapper{
+	select {
+	case w.outboxQueue <- plugin.ActionWrapper{
 		Action:        string(action),
 		ActionPayload: payloadBytes,
+	}:
+	case <-w.tmb.Dying():
 	}
 }
 
@@ -0,0 +1,65 @@
+package webdial
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/bzerolib/plugin"
+	bzwebdial "bastionzero.com/bzerolib/plugin/web/actions/webdial"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestWebDial(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Daemon Web Dial Suite")
+}
+
+var _ = Describe("Daemon Web Dial action", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var outboxQueue chan plugin.ActionWrapper
+	var doneChan chan struct{}
+	var action *WebDialAction
+
+	// what the agent would send us for each chunk of the response
+	respond := func(sequenceNumber int, streamType smsg.StreamType, output bzwebdial.WebOutputActionPayload) {
+		contentBytes, _ := json.Marshal(output)
+		action.ReceiveStream(smsg.StreamMessage{
+			Type:           streamType,
+			SequenceNumber: sequenceNumber,
+			Content:        base64.StdEncoding.EncodeToString(contentBytes),
+		})
+	}
+
+	BeforeEach(func() {
+		outboxQueue = make(chan plugin.ActionWrapper, 10)
+		doneChan = make(chan struct{})
+		action = New(logger, "1234", outboxQueue, doneChan)
+	})
+
+	It("stops reading the body before it returns", func() {
+		bodyReader, bodyWriter := io.Pipe()
+		request := httptest.NewRequest(http.MethodPost, "/", bodyReader)
+		recorder := httptest.NewRecorder()
+
+		respond(0, smsg.WebStreamEnd, bzwebdial.WebOutputActionPayload{
+			RequestId:  "1234",
+			StatusCode: http.StatusNoContent,
+		})
+		Expect(action.Start(recorder, request)).To(Succeed())
+		Expect(doneChan).To(BeClosed())
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+
+		By("leaving nothing to read the rest of the body")
+		_, err := bodyWriter.Write([]byte("too late"))
+		Expect(err).To(MatchError(io.ErrClosedPipe))
+	})
+})
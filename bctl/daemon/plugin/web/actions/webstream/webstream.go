@@ -0,0 +1,237 @@
+package webstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"bastionzero.com/bzerolib/bzhttp"
+	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/bzerolib/plugin"
+	bzweb "bastionzero.com/bzerolib/plugin/web"
+	bzwebstream "bastionzero.com/bzerolib/plugin/web/actions/webstream"
+	smsg "bastionzero.com/bzerolib/stream/message"
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	chunkSize = 64 * 1024 // 64KB
+)
+
+type WebStreamAction struct {
+	tmb       tomb.Tomb
+	logger    *logger.Logger
+	requestId string
+
+	// input and output channels relative to this plugin
+	outboxQueue     chan plugin.ActionWrapper
+	streamInputChan chan smsg.StreamMessage
+
+	// plugin done channel for signalling to the datachannel we're done
+	doneChan chan struct{}
+	err      error
+
+	// keep track of our expected streams
+	expectedSequenceNumber int
+	streamMessages         map[int]smsg.StreamMessage
+}
+
+func New(logger *logger.Logger, requestId string, outboxQueue chan plugin.ActionWrapper, doneChan chan struct{}) *WebStreamAction {
+	return &WebStreamAction{
+		logger:                 logger,
+		requestId:              requestId,
+		outboxQueue:            outboxQueue,
+		streamInputChan:        make(chan smsg.StreamMessage, 25),
+		doneChan:               doneChan,
+		expectedSequenceNumber: 0,
+		streamMessages:         make(map[int]smsg.StreamMessage),
+	}
+}
+
+func (w *WebStreamAction) Kill(err error) {
+	w.tmb.Kill(err)
+}
+
+func (w *WebStreamAction) Done() <-chan struct{} {
+	return w.doneChan
+}
+
+func (w *WebStreamAction) Err() error {
+	return w.err
+}
+
+func (w *WebStreamAction) Start(writer http.ResponseWriter, request *http.Request) error {
+	// the body can't be read once we've returned, so we stop sending it and wait
+	// until we have before we signal to the parent plugin that the action is done
+	bodySent := make(chan struct{})
+	defer func() {
+		w.tmb.Kill(nil)
+		request.Body.Close()
+		<-bodySent
+		close(w.doneChan)
+	}()
+
+	// Ref: https://hackernoon.com/writing-a-reverse-proxy-in-just-one-line-with-go-c1edfa78c84b
+	request.Header.Set("X-Forwarded-Host", request.Host)
+
+	// trailers are declared up front but their values only arrive after the body
+	trailers := []string{}
+	for name := range request.Trailer {
+		trailers = append(trailers, name)
+	}
+
+	w.outbox(bzwebstream.WebStreamStart, bzwebstream.WebStreamStartActionPayload{
+		RequestId:            w.requestId,
+		StreamMessageVersion: smsg.CurrentSchema,
+		Endpoint:             request.URL.String(),
+		Method:               request.Method,
+		Headers:              bzhttp.GetHeaders(request.Header),
+		ContentLength:        request.ContentLength,
+		Trailers:             trailers,
+		ProtoMajor:           request.ProtoMajor,
+	})
+
+	// the response can start before the request is over, so we send the body
+	// while we wait for it. This isn't tracked by our tomb, which would die
+	// as soon as the body was sent
+	go func() {
+		defer close(bodySent)
+		w.sendRequestBody(request)
+	}()
+
+	flusher, canFlush := writer.(http.Flusher)
+	headerSet := false
+
+	for {
+		select {
+		case <-w.tmb.Dying():
+			return nil
+		case <-request.Context().Done():
+			w.logger.Info("HTTP request cancelled. Sending interrupt signal to agent.")
+			w.interrupt()
+			return fmt.Errorf("http request cancelled")
+		case data := <-w.streamInputChan:
+			switch data.Type {
+			case smsg.Stream, smsg.Error, smsg.TLSCertificateError, smsg.TLSHandshakeError:
+				w.streamMessages[data.SequenceNumber] = data
+			default:
+				w.logger.Errorf("unhandled stream type: %s", data.Type)
+				continue
+			}
+
+			// process the incoming stream messages *in order*
+			for nextMessage, ok := w.streamMessages[w.expectedSequenceNumber]; ok; nextMessage, ok = w.streamMessages[w.expectedSequenceNumber] {
+				var response bzwebstream.WebStreamOutputPayload
+				if contentBytes, err := base64.StdEncoding.DecodeString(nextMessage.Content); err != nil {
+					return err
+				} else if err := json.Unmarshal(contentBytes, &response); err != nil {
+					rerr := fmt.Errorf("could not unmarshal web stream output payload: %s", err)
+					w.logger.Error(rerr)
+					return rerr
+				}
+
+				// if we've already started the response, the best we can do is
+				// cut it short so the client knows it didn't get all of it
+				if nextMessage.Type != smsg.Stream {
+					w.err = fmt.Errorf("agent failed to proxy request: %s", response.Content)
+					w.logger.Error(w.err)
+					if !headerSet {
+						http.Error(writer, bzweb.ErrorMessage(nextMessage.Type, string(response.Content)), response.StatusCode)
+					}
+					return w.err
+				}
+
+				// the status and headers come first and only once
+				if !headerSet {
+					for name, values := range response.Headers {
+						if http.CanonicalHeaderKey(name) == "Trailer" {
+							continue
+						}
+						for _, value := range values {
+							writer.Header().Add(name, value)
+						}
+					}
+					writer.WriteHeader(response.StatusCode)
+					headerSet = true
+				}
+
+				w.logger.Tracef("Writing chunk #%d of size %d", w.expectedSequenceNumber, len(response.Content))
+				writer.Write(response.Content)
+
+				if !nextMessage.More {
+					// trailers that weren't declared before the body have to be
+					// written with this prefix instead
+					for name, values := range response.Trailers {
+						for _, value := range values {
+							writer.Header().Add(http.TrailerPrefix+name, value)
+						}
+					}
+					return nil
+				} else if canFlush {
+					flusher.Flush()
+				}
+
+				delete(w.streamMessages, w.expectedSequenceNumber)
+				w.expectedSequenceNumber += 1
+			}
+		}
+	}
+}
+
+func (w *WebStreamAction) sendRequestBody(request *http.Request) {
+	buf := make([]byte, chunkSize)
+	sequenceNumber := 0
+
+	for {
+		numBytes, err := request.Body.Read(buf)
+		if !w.tmb.Alive() {
+			return
+		} else if err != nil && err != io.EOF {
+			w.logger.Errorf("error reading http request body: %s", err)
+			w.interrupt()
+			return
+		}
+
+		// copy the chunk since it's sent after we've read the next one
+		payload := bzwebstream.WebStreamInputActionPayload{
+			RequestId:      w.requestId,
+			SequenceNumber: sequenceNumber,
+			Body:           append([]byte{}, buf[:numBytes]...),
+			More:           err != io.EOF,
+		}
+
+		// the request's trailers are only filled in once we've read its body
+		if err == io.EOF {
+			payload.Trailers = bzhttp.GetHeaders(request.Trailer)
+			w.outbox(bzwebstream.WebStreamInput, payload)
+			return
+		} else if numBytes > 0 {
+			w.outbox(bzwebstream.WebStreamInput, payload)
+			sequenceNumber++
+		}
+	}
+}
+
+func (w *WebStreamAction) interrupt() {
+	w.outbox(bzwebstream.WebStreamInterrupt, bzwebstream.WebStreamInterruptActionPayload{
+		RequestId: w.requestId,
+	})
+}
+
+func (w *WebStreamAction) outbox(action bzwebstream.WebStreamSubAction, payload interface{}) {
+	// Send payload to plugin output queue
+	payloadBytes, _ := json.Marshal(payload)
+	select {
+	case w.outboxQueue <- plugin.ActionWrapper{
+		Action:        string(action),
+		ActionPayload: payloadBytes,
+	}:
+	case <-w.tmb.Dying():
+	}
+}
+
+func (w *WebStreamAction) ReceiveStream(smessage smsg.StreamMessage) {
+	w.streamInputChan <- smessage
+}
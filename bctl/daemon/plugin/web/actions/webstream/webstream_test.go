@@ -0,0 +1,130 @@
+package webstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/bzerolib/plugin"
+	bzwebstream "bastionzero.com/bzerolib/plugin/web/actions/webstream"
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+func TestWebStream(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Daemon Web Stream Suite")
+}
+
+var _ = Describe("Daemon Web Stream action", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var outboxQueue chan plugin.ActionWrapper
+	var doneChan chan struct{}
+	var action *WebStreamAction
+
+	// what the agent would send us for each chunk of the response
+	respond := func(sequenceNumber int, more bool, output bzwebstream.WebStreamOutputPayload) {
+		contentBytes, _ := json.Marshal(output)
+		action.ReceiveStream(smsg.StreamMessage{
+			Type:           smsg.Stream,
+			SequenceNumber: sequenceNumber,
+			More:           more,
+			Content:        base64.StdEncoding.EncodeToString(contentBytes),
+		})
+	}
+
+	nextInput := func() bzwebstream.WebStreamInputActionPayload {
+		var wrapper plugin.ActionWrapper
+		Eventually(outboxQueue).Should(Receive(&wrapper))
+		Expect(wrapper.Action).To(Equal(string(bzwebstream.WebStreamInput)))
+
+		var input bzwebstream.WebStreamInputActionPayload
+		Expect(json.Unmarshal(wrapper.ActionPayload, &input)).To(Succeed())
+		return input
+	}
+
+	BeforeEach(func() {
+		outboxQueue = make(chan plugin.ActionWrapper, 10)
+		doneChan = make(chan struct{})
+		action = New(logger, "1234", outboxQueue, doneChan)
+	})
+
+	It("waits for the response once the whole body has been sent", func() {
+		started := make(chan error, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- action.Start(w, r)
+		}))
+		defer server.Close()
+
+		responses := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			response, err := http.Post(server.URL, "text/plain", strings.NewReader("ping"))
+			Expect(err).ToNot(HaveOccurred())
+			responses <- response
+		}()
+
+		var wrapper plugin.ActionWrapper
+		Eventually(outboxQueue).Should(Receive(&wrapper))
+		Expect(wrapper.Action).To(Equal(string(bzwebstream.WebStreamStart)))
+
+		By("sending the whole body to the agent")
+		var body []byte
+		for input := nextInput(); ; input = nextInput() {
+			body = append(body, input.Body...)
+			if !input.More {
+				break
+			}
+		}
+		Expect(string(body)).To(Equal("ping"))
+		Consistently(doneChan).ShouldNot(BeClosed())
+
+		By("writing the response the agent sends afterwards")
+		respond(0, true, bzwebstream.WebStreamOutputPayload{
+			RequestId:  "1234",
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+		})
+		respond(1, false, bzwebstream.WebStreamOutputPayload{
+			RequestId: "1234",
+			Content:   []byte("pong"),
+		})
+
+		var response *http.Response
+		Eventually(responses).Should(Receive(&response))
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		responseBody, err := io.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(responseBody)).To(Equal("pong"))
+
+		Eventually(started).Should(Receive(BeNil()))
+		Eventually(doneChan).Should(BeClosed())
+	})
+
+	It("stops reading the body before it returns", func() {
+		bodyReader, bodyWriter := io.Pipe()
+		request := httptest.NewRequest(http.MethodPost, "/", bodyReader)
+		recorder := httptest.NewRecorder()
+
+		respond(0, false, bzwebstream.WebStreamOutputPayload{
+			RequestId:  "1234",
+			StatusCode: http.StatusNoContent,
+		})
+		Expect(action.Start(recorder, request)).To(Succeed())
+		Expect(doneChan).To(BeClosed())
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+
+		By("leaving nothing to read the rest of the body")
+		_, err := bodyWriter.Write([]byte("too late"))
+		Expect(err).To(MatchError(io.ErrClosedPipe))
+	})
+})
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"bastionzero.com/bzerolib/bzhttp"
 	"bastionzero.com/bzerolib/logger"
 	"bastionzero.com/bzerolib/plugin"
+	bzweb "bastionzero.com/bzerolib/plugin/web"
 	"bastionzero.com/bzerolib/plugin/web/actions/webwebsocket"
 	smsg "bastionzero.com/bzerolib/stream/message"
 	"github.com/gorilla/websocket"
@@ -16,6 +18,10 @@ import (
 	"gopkg.in/tomb.v2"
 )
 
+// the close code for a gateway that couldn't reach its upstream, which gorilla
+// doesn't have a name for
+const closeBadGateway = 1014
+
 type WebWebsocketAction struct {
 	tmb       tomb.Tomb
 	logger    *logger.Logger
@@ -90,6 +96,10 @@ func (w *WebWebsocketAction) handleWebsocketRequest(writer http.ResponseWriter,
 						w.logger.Error(err)
 						return err
 					}
+				case smsg.TLSCertificateError, smsg.TLSHandshakeError:
+					// tell the user why the agent couldn't connect before we close
+					w.closeWithError(conn, incomingMessage)
+					return nil
 				case smsg.AgentStop, smsg.Stop:
 					// End the local connection
 					w.logger.Infof("Received close message from agent, closing websocket")
@@ -176,6 +186,25 @@ func (w *WebWebsocketAction) writeOutData(conn *websocket.Conn, content string)
 	return nil
 }
 
+func (w *WebWebsocketAction) closeWithError(conn *websocket.Conn, message smsg.StreamMessage) {
+	content, err := base64.StdEncoding.DecodeString(message.Content)
+	if err != nil {
+		w.logger.Errorf("error decoding stream message: %v", err)
+	}
+
+	reason := bzweb.ErrorMessage(message.Type, string(content))
+	w.logger.Errorf("%s", reason)
+
+	// close frames can only carry 123 bytes of reason
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	closeMessage := websocket.FormatCloseMessage(closeBadGateway, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		w.logger.Errorf("error writing to websocket: %s", err)
+	}
+}
+
 func (w *WebWebsocketAction) outbox(action webwebsocket.WebWebsocketSubAction, payload interface{}) {
 	// Send payload to plugin output queue
 	payloadBytes, _ := json.Marshal(payload)
@@ -1,8 +1,10 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/google/uuid"
 
@@ -11,6 +13,7 @@ import (
 	bzweb "bastionzero.com/bzerolib/plugin/web"
 	smsg "bastionzero.com/bzerolib/stream/message"
 	"bastionzero.com/daemon/plugin/web/actions/webdial"
+	"bastionzero.com/daemon/plugin/web/actions/webstream"
 	"bastionzero.com/daemon/plugin/web/actions/webwebsocket"
 )
 
@@ -38,6 +41,12 @@ type WebDaemonPlugin struct {
 
 	// For processing incoming messages in order
 	sequenceNumber int
+
+	// what the agent told us it can do in its SynAck, which is only set once
+	// synAcked is closed
+	agentCapabilities bzweb.WebSynAckPayload
+	synAcked          chan struct{}
+	synAckOnce        sync.Once
 }
 
 func New(logger *logger.Logger, remoteHost string, remotePort int) *WebDaemonPlugin {
@@ -49,6 +58,7 @@ func New(logger *logger.Logger, remoteHost string, remotePort int) *WebDaemonPlu
 		remoteHost:     remoteHost,
 		remotePort:     remotePort,
 		sequenceNumber: 0,
+		synAcked:       make(chan struct{}),
 	}
 }
 
@@ -68,6 +78,8 @@ func (w *WebDaemonPlugin) StartAction(action bzweb.WebAction, writer http.Respon
 		w.action = webdial.New(actLogger, requestId, w.outboxQueue, w.doneChan)
 	case bzweb.Websocket:
 		w.action = webwebsocket.New(actLogger, requestId, w.outboxQueue, w.doneChan)
+	case bzweb.Stream:
+		w.action = webstream.New(actLogger, requestId, w.outboxQueue, w.doneChan)
 	default:
 		rerr := fmt.Errorf("unrecognized web action: %s", action)
 		w.logger.Error(rerr)
@@ -103,6 +115,31 @@ func (w *WebDaemonPlugin) Kill(err error) {
 	}
 }
 
+// ReceiveSynAck learns what the agent can do from its SynAck. We only need the
+// first one, since an agent can't change what it can do
+func (w *WebDaemonPlugin) ReceiveSynAck(actionPayload []byte) {
+	w.synAckOnce.Do(func() {
+		// older agents don't send anything
+		if len(actionPayload) > 0 {
+			if err := json.Unmarshal(actionPayload, &w.agentCapabilities); err != nil {
+				w.logger.Errorf("malformed web SynAck payload: %s", err)
+			}
+		}
+		close(w.synAcked)
+	})
+}
+
+// SynAcked is closed once we've heard what the agent can do
+func (w *WebDaemonPlugin) SynAcked() <-chan struct{} {
+	return w.synAcked
+}
+
+// AgentCapabilities returns what the agent told us it can do. It must not be
+// called before SynAcked is closed
+func (w *WebDaemonPlugin) AgentCapabilities() bzweb.WebSynAckPayload {
+	return w.agentCapabilities
+}
+
 func (w *WebDaemonPlugin) ReceiveStream(smessage smsg.StreamMessage) {
 	// w.logger.Debugf("Web received %v", smessage.Type)
 	if w.action != nil {
@@ -5,16 +5,18 @@ import (
 	"net/http"
 
 	"bastionzero.com/bzerolib/logger"
+	"bastionzero.com/daemon/mrtap"
 )
 
 type ControlServer struct {
 	logger       *logger.Logger
 	port         string
 	shutdownChan chan struct{}
+	mrtapMetrics *mrtap.Metrics
 }
 
-func New(logger *logger.Logger, port string, shutdownChan chan struct{}) *ControlServer {
-	return &ControlServer{logger: logger, port: port, shutdownChan: shutdownChan}
+func New(logger *logger.Logger, port string, shutdownChan chan struct{}, metrics *mrtap.Metrics) *ControlServer {
+	return &ControlServer{logger: logger, port: port, shutdownChan: shutdownChan, mrtapMetrics: metrics}
 }
 
 func (c *ControlServer) ReceivedShutdown() chan struct{} {
@@ -25,9 +27,12 @@ func (c *ControlServer) Start() {
 	go func() {
 		c.logger.Debugf("Starting control server on localhost:%s", c.port)
 
-		http.HandleFunc("/shutdown", c.shutdown)
+		// we keep our own mux so that none of this ends up on the web server's default one
+		mux := http.NewServeMux()
+		mux.HandleFunc("/shutdown", c.shutdown)
+		mux.HandleFunc("/metrics", c.metrics)
 
-		if err := http.ListenAndServe(fmt.Sprintf(":%s", c.port), nil); err != nil {
+		if err := http.ListenAndServe(fmt.Sprintf("localhost:%s", c.port), mux); err != nil {
 			c.logger.Error(err)
 		}
 	}()
@@ -37,3 +42,11 @@ func (c *ControlServer) shutdown(w http.ResponseWriter, req *http.Request) {
 	c.logger.Infof("Received shutdown request")
 	c.shutdownChan <- struct{}{}
 }
+
+// metrics reports on the datachannels that are currently open
+func (c *ControlServer) metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := c.mrtapMetrics.Write(w); err != nil {
+		c.logger.Errorf("failed to write metrics: %s", err)
+	}
+}
@@ -211,6 +211,10 @@ func New(
 				// agentReadyChan to prevent receive() from blocking when it
 				// processes the new AgentConnected message.
 				conn.waitForAgentReady()
+
+				// Anything sent while we were disconnected is gone, so let our
+				// datachannels pick their sessions back up with the agent
+				conn.broker.Resume()
 			case message := <-conn.sendQueue:
 				if err := conn.client.Send(*message); err != nil {
 					conn.logger.Errorf("failed to send message: %s", err)
@@ -5,13 +5,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"bastionzero.com/bzerolib/connection"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
-	"bastionzero.com/bzerolib/connection/transporter/websocket"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
@@ -35,6 +35,12 @@ type DbServer struct {
 	errChan     chan error
 	tcpListener *net.TCPListener
 
+	// for the udp action, which has a flow for every address we get datagrams from
+	udpListener    *net.UDPConn
+	udpFlows       map[string]*udpFlow
+	udpFlowsLock   sync.Mutex
+	udpIdleTimeout time.Duration
+
 	// Db specific vars
 	action     bzdb.DbAction
 	tcpApp     bzdb.TCPApplication
@@ -48,6 +54,7 @@ type DbServer struct {
 	localHost   string
 	agentPubKey *keypair.PublicKey
 	cert        *bzcert.DaemonBZCert
+	metrics     *mrtap.Metrics
 }
 
 func New(logger *logger.Logger,
@@ -57,14 +64,17 @@ func New(logger *logger.Logger,
 	remotePort int,
 	remoteHost string,
 	cert *bzcert.DaemonBZCert,
+	metrics *mrtap.Metrics,
 	action string,
 	tcpApp string,
 	targetUser string,
 	targetId string,
+	udpIdleTimeout time.Duration,
 	connUrl string,
 	params url.Values,
 	headers http.Header,
 	agentPubKey *keypair.PublicKey,
+	client messenger.Messenger,
 ) (*DbServer, error) {
 	act := bzdb.DbAction(action)
 	if act == "" {
@@ -80,6 +90,7 @@ func New(logger *logger.Logger,
 		logger:      logger,
 		errChan:     errChan,
 		cert:        cert,
+		metrics:     metrics,
 		localPort:   localPort,
 		localHost:   localHost,
 		targetUser:  targetUser,
@@ -89,14 +100,13 @@ func New(logger *logger.Logger,
 		action:      act,
 		tcpApp:      tcpApplication,
 		agentPubKey: agentPubKey,
+
+		udpFlows:       make(map[string]*udpFlow),
+		udpIdleTimeout: udpIdleTimeout,
 	}
 
 	// Create our one connection
 	subLogger := logger.GetConnectionLogger(uuid.New().String())
-	wsLogger := logger.GetComponentLogger("Websocket")
-	srLogger := logger.GetComponentLogger("SignalR")
-
-	client := signalr.New(srLogger, websocket.New(wsLogger))
 	if client, err := dataconnection.New(subLogger, connUrl, params, headers, client); err != nil {
 		return nil, fmt.Errorf("failed to create connection: %s", err)
 	} else {
@@ -124,8 +134,12 @@ func (d *DbServer) Start() error {
 		d.logger.Infof("Connection passed all tests")
 	}
 
-	// Now create our local listener for TCP connections
 	addr := fmt.Sprintf("%s:%s", d.localHost, d.localPort)
+	if d.action == bzdb.Udp {
+		return d.startUdp(addr)
+	}
+
+	// Now create our local listener for TCP connections
 	localTcpAddress, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		d.conn.Close(err, connectionCloseTimeout)
@@ -158,6 +172,9 @@ func (d *DbServer) Close(err error) {
 	if d.tcpListener != nil {
 		d.tcpListener.Close()
 	}
+	if d.udpListener != nil {
+		d.udpListener.Close()
+	}
 	d.errChan <- err
 }
 
@@ -193,7 +210,7 @@ func (d *DbServer) newAction(conn net.Conn) error {
 	subLogger := d.logger.GetDatachannelLogger(dcId)
 	pluginLogger := subLogger.GetPluginLogger(bzplugin.Db)
 
-	plugin := db.New(pluginLogger, d.targetUser, d.targetId)
+	plugin := db.New(pluginLogger, d.targetUser, d.targetId, d.udpIdleTimeout)
 
 	if err := d.newDataChannel(dcId, plugin); err != nil {
 		return fmt.Errorf("error starting datachannel: %w", err)
@@ -242,7 +259,7 @@ func (d *DbServer) newDataChannel(dcId string, plugin *db.DbDaemonPlugin) error
 
 	action := "db/" + string(d.action) + "/" + string(d.tcpApp)
 	attach := false
-	_, err = datachannel.New(subLogger, dcId, d.conn, mt, plugin, action, synPayload, attach, true)
+	_, err = datachannel.New(subLogger, dcId, d.conn, mt, d.metrics, plugin, action, synPayload, attach, true)
 	if err != nil {
 		return err
 	}
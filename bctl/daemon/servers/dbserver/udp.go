@@ -0,0 +1,147 @@
+package dbserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// the largest datagram UDP can carry
+	maxDatagramSize = 64 * 1024
+
+	// datagrams we'll hold for a flow before we start dropping them
+	udpFlowBacklog = 64
+)
+
+func (d *DbServer) startUdp(addr string) error {
+	localUdpAddress, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		d.conn.Close(err, connectionCloseTimeout)
+		return fmt.Errorf("failed to resolve address %s: %s", addr, err)
+	}
+
+	d.logger.Infof("Setting up UDP listener")
+	d.udpListener, err = net.ListenUDP("udp", localUdpAddress)
+	if err != nil {
+		d.conn.Close(err, connectionCloseTimeout)
+		return fmt.Errorf("failed to open local port to listen: %s", err)
+	}
+
+	go d.handleDatagrams()
+
+	d.logger.Infof("Listening on %s", addr)
+
+	return nil
+}
+
+func (d *DbServer) handleDatagrams() {
+	buf := make([]byte, maxDatagramSize)
+
+	// Block and keep listening for new datagrams
+	for {
+		n, address, err := d.udpListener.ReadFromUDP(buf)
+		if err != nil {
+			d.logger.Errorf("failed to read datagram: %s", err)
+			return
+		}
+		datagram := append([]byte{}, buf[:n]...)
+
+		// every address we hear from gets its own flow, and with it its own datachannel
+		d.udpFlowsLock.Lock()
+		flow, ok := d.udpFlows[address.String()]
+		if !ok {
+			d.logger.Infof("Accepting new udp flow from %s", address)
+
+			flow = newUdpFlow(d.udpListener, address)
+			flow.onClose = func() {
+				d.udpFlowsLock.Lock()
+				defer d.udpFlowsLock.Unlock()
+				if d.udpFlows[address.String()] == flow {
+					delete(d.udpFlows, address.String())
+				}
+			}
+			d.udpFlows[address.String()] = flow
+
+			go func() {
+				if err := d.newAction(flow); err != nil {
+					d.Close(err)
+				}
+			}()
+		}
+		d.udpFlowsLock.Unlock()
+
+		flow.deliver(datagram)
+	}
+}
+
+// udpFlow is the datagrams we get from, and send to, a single local address.
+// It's a net.Conn so that it can be started like any other db action, but
+// every read returns exactly one datagram, and every write sends one
+type udpFlow struct {
+	listener *net.UDPConn
+	address  *net.UDPAddr
+
+	datagrams chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// lets the server forget about us
+	onClose func()
+}
+
+func newUdpFlow(listener *net.UDPConn, address *net.UDPAddr) *udpFlow {
+	return &udpFlow{
+		listener:  listener,
+		address:   address,
+		datagrams: make(chan []byte, udpFlowBacklog),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (f *udpFlow) deliver(datagram []byte) {
+	select {
+	case <-f.closed:
+	case f.datagrams <- datagram:
+	default:
+		// UDP is allowed to lose datagrams, and this is better than holding up every other flow
+	}
+}
+
+func (f *udpFlow) Read(b []byte) (int, error) {
+	select {
+	case datagram := <-f.datagrams:
+		return copy(b, datagram), nil
+	case <-f.closed:
+		return 0, io.EOF
+	}
+}
+
+func (f *udpFlow) Write(b []byte) (int, error) {
+	return f.listener.WriteToUDP(b, f.address)
+}
+
+func (f *udpFlow) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		if f.onClose != nil {
+			f.onClose()
+		}
+	})
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr {
+	return f.listener.LocalAddr()
+}
+
+func (f *udpFlow) RemoteAddr() net.Addr {
+	return f.address
+}
+
+// the listener is shared by every flow, so we can't set deadlines on it
+func (f *udpFlow) SetDeadline(t time.Time) error      { return nil }
+func (f *udpFlow) SetReadDeadline(t time.Time) error  { return nil }
+func (f *udpFlow) SetWriteDeadline(t time.Time) error { return nil }
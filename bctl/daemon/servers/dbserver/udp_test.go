@@ -0,0 +1,73 @@
+package dbserver
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDbServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Daemon Db Server Suite")
+}
+
+var _ = Describe("Daemon UDP flows", func() {
+	var listener, client *net.UDPConn
+	var flow *udpFlow
+	var closed bool
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		client, err = net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+
+		closed = false
+		flow = newUdpFlow(listener, client.LocalAddr().(*net.UDPAddr))
+		flow.onClose = func() { closed = true }
+	})
+
+	AfterEach(func() {
+		client.Close()
+		listener.Close()
+	})
+
+	It("reads one datagram at a time and writes back to the flow's address", func() {
+		flow.deliver([]byte("first"))
+		flow.deliver([]byte("second"))
+
+		buf := make([]byte, maxDatagramSize)
+		for _, expected := range []string{"first", "second"} {
+			n, err := flow.Read(buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal(expected))
+		}
+
+		_, err := flow.Write([]byte("reply"))
+		Expect(err).ToNot(HaveOccurred())
+		n, err := client.Read(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("reply"))
+	})
+
+	It("drops datagrams rather than block when the flow falls behind", func() {
+		for i := 0; i < udpFlowBacklog+10; i++ {
+			flow.deliver([]byte("datagram"))
+		}
+		Expect(flow.datagrams).To(HaveLen(udpFlowBacklog))
+	})
+
+	It("ends reads once it's closed", func() {
+		Expect(flow.Close()).To(Succeed())
+		Expect(flow.Close()).To(Succeed())
+		Expect(closed).To(BeTrue())
+
+		_, err := flow.Read(make([]byte, maxDatagramSize))
+		Expect(err).To(Equal(io.EOF))
+		flow.deliver([]byte("late"))
+	})
+})
@@ -7,13 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"bastionzero.com/bzerolib/connection"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
-	"bastionzero.com/bzerolib/connection/transporter/websocket"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
@@ -52,15 +52,25 @@ type KubeServer struct {
 
 	// fields for new connections
 	cert     bzcert.IDaemonBZCert
+	metrics  *mrtap.Metrics
 	certPath string
 	keyPath  string
 
 	// fields for new datachannels
+	targetId     string
 	targetUser   string
 	targetGroups []string
 	agentPubKey  *keypair.PublicKey
 	localPort    string
 	localHost    string
+
+	// what the agent told us it can do in the last SynAck we got from it, nil
+	// until we've heard from it
+	agentCapabilities     *bzkube.KubeSynAckPayload
+	agentCapabilitiesLock sync.Mutex
+
+	// so that we only ask the agent what it can do once at a time
+	askAgentLock sync.Mutex
 }
 
 func New(
@@ -71,6 +81,8 @@ func New(
 	certPath string,
 	keyPath string,
 	cert bzcert.IDaemonBZCert,
+	metrics *mrtap.Metrics,
+	targetId string,
 	targetUser string,
 	targetGroups []string,
 	localhostToken string,
@@ -78,6 +90,7 @@ func New(
 	params url.Values,
 	headers http.Header,
 	agentPubKey *keypair.PublicKey,
+	client messenger.Messenger,
 ) (*KubeServer, error) {
 
 	server := &KubeServer{
@@ -86,8 +99,10 @@ func New(
 		exitMessage:    "",
 		localhostToken: localhostToken,
 		cert:           cert,
+		metrics:        metrics,
 		certPath:       certPath,
 		keyPath:        keyPath,
+		targetId:       targetId,
 		targetUser:     targetUser,
 		targetGroups:   targetGroups,
 		agentPubKey:    agentPubKey,
@@ -97,10 +112,6 @@ func New(
 
 	// Create our one connection in the form of a connection
 	subLogger := logger.GetConnectionLogger(uuid.New().String())
-	wsLogger := logger.GetComponentLogger("Websocket")
-	srLogger := logger.GetComponentLogger("SignalR")
-
-	client := signalr.New(srLogger, websocket.New(wsLogger))
 	if client, err := dataconnection.New(subLogger, connUrl, params, headers, client); err != nil {
 		return nil, fmt.Errorf("failed to create connection: %s", err)
 	} else {
@@ -173,7 +184,7 @@ func (k *KubeServer) listenForConnectionDone() {
 }
 
 // for creating new datachannels
-func (k *KubeServer) newDataChannel(dcId string, action string, plugin *kube.KubeDaemonPlugin, writer http.ResponseWriter) error {
+func (k *KubeServer) newDataChannel(dcId string, action string, plugin *kube.KubeDaemonPlugin, writer http.ResponseWriter) (*datachannel.DataChannel, error) {
 	subLogger := k.logger.GetDatachannelLogger(dcId)
 
 	k.logger.Infof("Creating new datachannel id: %s", dcId)
@@ -182,22 +193,89 @@ func (k *KubeServer) newDataChannel(dcId string, action string, plugin *kube.Kub
 	synPayload := bzkube.KubeActionParams{
 		TargetUser:   k.targetUser,
 		TargetGroups: k.targetGroups,
+		TargetId:     k.targetId,
 	}
 
 	mtLogger := k.logger.GetComponentLogger("mrtap")
 	mt, err := mrtap.New(mtLogger, k.agentPubKey, k.cert)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	action = "kube/" + action
 	attach := false
-	_, err = datachannel.New(subLogger, dcId, k.conn, mt, plugin, action, synPayload, attach, true)
+	return datachannel.New(subLogger, dcId, k.conn, mt, k.metrics, plugin, action, synPayload, attach, true)
+}
+
+// getAgentCapabilities returns what the agent can do. We only need to know
+// before we start a datachannel for requests which we handle differently for
+// older agents, so if we haven't heard from the agent yet then we ask it for
+// those and assume it can't do anything new for the rest
+func (k *KubeServer) getAgentCapabilities(request *http.Request) bzkube.KubeSynAckPayload {
+	if capabilities, ok := k.knownAgentCapabilities(); ok || !needsAgentCapabilities(request) {
+		return capabilities
+	}
+
+	k.askAgentLock.Lock()
+	defer k.askAgentLock.Unlock()
+
+	// someone else may have asked while we were waiting
+	if capabilities, ok := k.knownAgentCapabilities(); ok {
+		return capabilities
+	}
+
+	k.askAgentCapabilities()
+	capabilities, _ := k.knownAgentCapabilities()
+	return capabilities
+}
+
+func (k *KubeServer) knownAgentCapabilities() (bzkube.KubeSynAckPayload, bool) {
+	k.agentCapabilitiesLock.Lock()
+	defer k.agentCapabilitiesLock.Unlock()
+
+	if k.agentCapabilities == nil {
+		return bzkube.KubeSynAckPayload{}, false
+	}
+	return *k.agentCapabilities, true
+}
+
+// learnAgentCapabilities remembers what the agent told us in a datachannel's
+// SynAck, if it's told us yet, so that we know what we can ask of it in later
+// datachannels
+func (k *KubeServer) learnAgentCapabilities(plugin *kube.KubeDaemonPlugin) {
+	select {
+	case <-plugin.SynAcked():
+		capabilities := plugin.AgentCapabilities()
+
+		k.agentCapabilitiesLock.Lock()
+		defer k.agentCapabilitiesLock.Unlock()
+		k.agentCapabilities = &capabilities
+	default:
+	}
+}
+
+// askAgentCapabilities opens a datachannel that we close again as soon as the
+// agent has told us what it can do in its SynAck
+func (k *KubeServer) askAgentCapabilities() {
+	dcId := uuid.New().String()
 
+	pluginLogger := k.logger.GetPluginLogger(bzplugin.Kube)
+	pluginLogger = pluginLogger.GetDatachannelLogger(dcId)
+	plugin := kube.New(pluginLogger, k.targetUser, k.targetGroups, false)
+
+	dc, err := k.newDataChannel(dcId, string(bzkube.RestApi), plugin, nil)
 	if err != nil {
-		return err
+		k.logger.Errorf("failed to ask the agent what it can do: %s", err)
+		return
+	}
+	defer dc.Close(nil)
+
+	select {
+	case <-plugin.SynAcked():
+		k.learnAgentCapabilities(plugin)
+	case <-dc.Done():
+		k.logger.Errorf("failed to ask the agent what it can do: %s", dc.Err())
 	}
-	return nil
 }
 
 func (k *KubeServer) bubbleUpError(w http.ResponseWriter, msg string, statusCode int) {
@@ -231,7 +309,8 @@ func (k *KubeServer) rootCallback(logger *logger.Logger, w http.ResponseWriter,
 	}
 
 	// Determine the action
-	action := getAction(r)
+	capabilities := k.getAgentCapabilities(r)
+	action := getAction(r, capabilities.StreamBodies, capabilities.Attach)
 
 	// start up our plugin
 	// every datachannel gets a uuid to distinguish it so a single connection can map to multiple datachannels
@@ -239,28 +318,37 @@ func (k *KubeServer) rootCallback(logger *logger.Logger, w http.ResponseWriter,
 
 	pluginLogger := logger.GetPluginLogger(bzplugin.Kube)
 	pluginLogger = pluginLogger.GetDatachannelLogger(dcId)
-	plugin := kube.New(pluginLogger, k.targetUser, k.targetGroups)
+	plugin := kube.New(pluginLogger, k.targetUser, k.targetGroups, capabilities.StreamBodies)
 
-	if err := k.newDataChannel(dcId, string(action), plugin, w); err != nil {
+	if _, err := k.newDataChannel(dcId, string(action), plugin, w); err != nil {
 		k.logger.Error(err)
 	}
 
 	if err := plugin.StartAction(action, logId, command, w, r); err != nil {
 		logger.Errorf("error starting action: %s", err)
 	}
+
+	k.learnAgentCapabilities(plugin)
 }
 
-func getAction(req *http.Request) bzkube.KubeAction {
+// getAction decides how to handle a request. Agents that can't take a streamed
+// body or tell us the status of a streamed response only get the streams that
+// they always have, and agents that don't know about attach get exec
+func getAction(req *http.Request, streamBodies bool, attach bool) bzkube.KubeAction {
 	// parse action from incoming request
 	switch {
 	// interactive commands that require both stdin and stdout
 	case isExecRequest(req):
 		return bzkube.Exec
+	case isAttachRequest(req) && attach:
+		return bzkube.Attach
+	case isAttachRequest(req):
+		return bzkube.Exec
 
 	// Persistent, yet not interactive commands that serve continual output but only listen for a single, request-cancelling input
 	case isPortForwardRequest(req):
 		return bzkube.PortForward
-	case isStreamRequest(req):
+	case isStreamRequest(req, streamBodies):
 		return bzkube.Stream
 
 	// simple call and response aka restapi requests
@@ -273,10 +361,64 @@ func isPortForwardRequest(request *http.Request) bool {
 	return strings.HasSuffix(request.URL.Path, "/portforward")
 }
 
+// needsAgentCapabilities tells us whether we handle a request differently
+// depending on what the agent can do
+func needsAgentCapabilities(request *http.Request) bool {
+	if isAttachRequest(request) {
+		return true
+	}
+	return !isExecRequest(request) && !isPortForwardRequest(request) &&
+		isStreamRequest(request, true) && !isStreamRequest(request, false)
+}
+
 func isExecRequest(request *http.Request) bool {
-	return strings.HasSuffix(request.URL.Path, "/exec") || strings.HasSuffix(request.URL.Path, "/attach")
+	return strings.HasSuffix(request.URL.Path, "/exec")
+}
+
+func isAttachRequest(request *http.Request) bool {
+	return strings.HasSuffix(request.URL.Path, "/attach")
+}
+
+// isStreamRequest returns true for anything whose response may go on for a long
+// time, or whose body does, which we can't buffer in a single restapi response
+func isStreamRequest(request *http.Request, streamBodies bool) bool {
+	switch {
+	// kubectl logs -f
+	case strings.HasSuffix(request.URL.Path, "/log") && kubeutils.IsQueryParamPresent(request, "follow"):
+		return true
+	// list-watches
+	case kubeutils.IsQueryParamPresent(request, "watch"):
+		return true
+	// older agents would tell the client that everything else succeeded
+	case !streamBodies:
+		return false
+	// the deprecated /api/v1/watch/... form of list-watches
+	case strings.Contains(request.URL.Path, "/watch/"):
+		return true
+	// server-sent events, e.g. from aggregated APIs
+	case strings.Contains(request.Header.Get("Accept"), "text/event-stream"):
+		return true
+	// the pod, service and node proxies can be used for anything
+	case isProxyRequest(request):
+		return true
+	// a chunked request body may never end
+	case request.ContentLength < 0 && request.Body != nil && request.Body != http.NoBody:
+		return true
+	default:
+		return false
+	}
 }
 
-func isStreamRequest(request *http.Request) bool {
-	return (strings.HasSuffix(request.URL.Path, "/log") && kubeutils.IsQueryParamPresent(request, "follow")) || kubeutils.IsQueryParamPresent(request, "watch")
+func isProxyRequest(request *http.Request) bool {
+	// looks like .../{pods,services,nodes}/{name}/proxy[/{path}]
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	for i := 0; i+2 < len(parts); i++ {
+		switch parts[i] {
+		case "pods", "services", "nodes":
+			if parts[i+2] == "proxy" {
+				return true
+			}
+		}
+	}
+	return false
 }
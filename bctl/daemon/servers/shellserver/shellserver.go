@@ -10,8 +10,7 @@ import (
 	"gopkg.in/tomb.v2"
 
 	"bastionzero.com/bzerolib/connection"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
-	"bastionzero.com/bzerolib/connection/transporter/websocket"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
@@ -37,10 +36,16 @@ type ShellServer struct {
 	// Shell specific vars
 	targetUser    string
 	dataChannelId string
+	action        bzshell.ShellAction
+
+	// exec specific vars
+	command string
+	timeout time.Duration
 
 	// fields for new datachannels
 	agentPubKey *keypair.PublicKey
 	cert        *bzcert.DaemonBZCert
+	metrics     *mrtap.Metrics
 
 	tmb tomb.Tomb
 }
@@ -51,27 +56,32 @@ func New(
 	targetUser string,
 	dataChannelId string,
 	cert *bzcert.DaemonBZCert,
+	metrics *mrtap.Metrics,
 	connUrl string,
 	params url.Values,
 	headers http.Header,
 	agentPubKey *keypair.PublicKey,
+	client messenger.Messenger,
+	action bzshell.ShellAction,
+	command string,
+	timeout time.Duration,
 ) (*ShellServer, error) {
 
 	server := &ShellServer{
 		logger:        logger,
 		errChan:       errChan,
 		cert:          cert,
+		metrics:       metrics,
 		targetUser:    targetUser,
 		dataChannelId: dataChannelId,
 		agentPubKey:   agentPubKey,
+		action:        action,
+		command:       command,
+		timeout:       timeout,
 	}
 
 	// Create our one connection
 	subLogger := logger.GetConnectionLogger(uuid.New().String())
-	wsLogger := logger.GetComponentLogger("Websocket")
-	srLogger := logger.GetComponentLogger("SignalR")
-
-	client := signalr.New(srLogger, websocket.New(wsLogger))
 	if client, err := dataconnection.New(subLogger, connUrl, params, headers, client); err != nil {
 		return nil, fmt.Errorf("failed to create connection: %s", err)
 	} else {
@@ -96,7 +106,7 @@ func New(
 }
 
 func (ss *ShellServer) Start() error {
-	if err := ss.newDataChannel(string(bzshell.DefaultShell)); err != nil {
+	if err := ss.newDataChannel(string(ss.action)); err != nil {
 		ss.conn.Close(err, connectionCloseTimeout)
 		return fmt.Errorf("failed to create datachannel: %s", err)
 	}
@@ -135,7 +145,7 @@ func (ss *ShellServer) newDataChannel(action string) error {
 
 	// create our plugin and start the action
 	pluginLogger := subLogger.GetPluginLogger(bzplugin.Shell)
-	plugin := shell.New(pluginLogger)
+	plugin := shell.New(pluginLogger, ss.action, ss.command, ss.timeout)
 	if err := plugin.StartAction(attach); err != nil {
 		return fmt.Errorf("failed to start action: %s", err)
 	}
@@ -152,7 +162,7 @@ func (ss *ShellServer) newDataChannel(action string) error {
 	}
 
 	action = "shell/" + action
-	ss.dc, err = datachannel.New(subLogger, ss.dataChannelId, ss.conn, mt, plugin, action, synPayload, attach, false)
+	ss.dc, err = datachannel.New(subLogger, ss.dataChannelId, ss.conn, mt, ss.metrics, plugin, action, synPayload, attach, false)
 	if err != nil {
 		return err
 	}
@@ -10,8 +10,7 @@ import (
 
 	"bastionzero.com/bzerolib/bzio"
 	"bastionzero.com/bzerolib/connection"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
-	"bastionzero.com/bzerolib/connection/transporter/websocket"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
@@ -48,6 +47,7 @@ type SshServer struct {
 	// fields for new datachannels
 	agentPubKey *keypair.PublicKey
 	cert        *bzcert.DaemonBZCert
+	metrics     *mrtap.Metrics
 
 	tmb tomb.Tomb
 }
@@ -58,10 +58,12 @@ func New(
 	targetUser string,
 	dataChannelId string,
 	cert *bzcert.DaemonBZCert,
+	metrics *mrtap.Metrics,
 	connUrl string,
 	params url.Values,
 	headers http.Header,
 	agentPubKey *keypair.PublicKey,
+	client messenger.Messenger,
 	identityFile string,
 	knownHostsFile string,
 	hostNames []string,
@@ -77,6 +79,7 @@ func New(
 		action:         action,
 		targetUser:     targetUser,
 		cert:           cert,
+		metrics:        metrics,
 		agentPubKey:    agentPubKey,
 		identityFile:   identityFile,
 		knownHostsFile: knownHostsFile,
@@ -88,10 +91,6 @@ func New(
 
 	// Create our one connection
 	subLogger := logger.GetConnectionLogger(uuid.New().String())
-	wsLogger := logger.GetComponentLogger("Websocket")
-	srLogger := logger.GetComponentLogger("SignalR")
-
-	client := signalr.New(srLogger, websocket.New(wsLogger))
 	if client, err := dataconnection.New(subLogger, connUrl, params, headers, client); err != nil {
 		return nil, fmt.Errorf("failed to create connection: %s", err)
 	} else {
@@ -174,7 +173,7 @@ func (s *SshServer) newDataChannel(action string) error {
 	}
 
 	action = "ssh/" + action
-	s.dc, err = datachannel.New(subLogger, dcId, s.conn, mt, plugin, action, synPayload, attach, false)
+	s.dc, err = datachannel.New(subLogger, dcId, s.conn, mt, s.metrics, plugin, action, synPayload, attach, false)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,332 @@
+/*
+This package rewrites the responses of web targets so that they work when
+they're served by the daemon on a local port. Apps send absolute redirects and
+cookies for the hostname they think they're at, which the browser can't reach
+or won't send back to us, and so logins in particular tend to break.
+
+In headers mode we rewrite any Location or Content-Location header that points
+at the target so that it points at the daemon instead, drop the Domain of every
+cookie the target sets so that it belongs to the daemon's host, and drop Secure,
+since the daemon only speaks plain HTTP. In html mode we do all of that and also
+rewrite links to the target in HTML pages, such as their <base href>.
+
+The target is the remote host and port we're connected to, and any other hosts
+the app thinks it's at, such as the public name in its configuration.
+*/
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Mode string
+
+const (
+	Off     Mode = ""
+	Headers Mode = "headers"
+	HTML    Mode = "html"
+)
+
+// there's no host name longer than this, so we can stop looking for its end
+const maxAuthorityLength = 261
+
+type host struct {
+	name string
+
+	// empty if any port will do
+	port string
+}
+
+type Rewriter struct {
+	mode  Mode
+	hosts []host
+
+	// the scheme of the target, which protocol-relative links use
+	scheme string
+}
+
+// New returns a Rewriter for the given target, or nil if we're not rewriting
+// responses. otherHosts are any other host[:port]s the target thinks it's at
+func New(mode Mode, remoteHost string, remotePort int, otherHosts []string) (*Rewriter, error) {
+	switch mode {
+	case Off:
+		return nil, nil
+	case Headers, HTML:
+	default:
+		return nil, fmt.Errorf("unknown response rewriting mode %s, must be one of headers or html", mode)
+	}
+
+	// remote hosts may or may not be given to us with their scheme
+	scheme, name := "http", remoteHost
+	if remoteHostUrl, err := url.Parse(remoteHost); err == nil && remoteHostUrl.Hostname() != "" {
+		scheme, name = remoteHostUrl.Scheme, remoteHostUrl.Hostname()
+	}
+
+	rewriter := &Rewriter{
+		mode:   mode,
+		hosts:  []host{{name: name, port: fmt.Sprint(remotePort)}},
+		scheme: scheme,
+	}
+
+	for _, other := range otherHosts {
+		if other = strings.TrimSpace(other); other == "" {
+			continue
+		}
+
+		if name, port, err := net.SplitHostPort(other); err == nil {
+			rewriter.hosts = append(rewriter.hosts, host{name: name, port: port})
+		} else {
+			rewriter.hosts = append(rewriter.hosts, host{name: other})
+		}
+	}
+
+	return rewriter, nil
+}
+
+// matches tells us whether a URL with the given scheme and authority points at
+// the target
+func (r *Rewriter) matches(scheme string, authority string) bool {
+	name, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		name = authority
+		port = defaultPort(scheme)
+	}
+
+	for _, host := range r.hosts {
+		if strings.EqualFold(host.name, name) && (host.port == "" || host.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// Wrap returns a ResponseWriter which rewrites the response to the request as
+// it's written. It must be closed once the response has been written
+func (r *Rewriter) Wrap(writer http.ResponseWriter, request *http.Request) *ResponseWriter {
+	if r.mode == HTML {
+		// we can't rewrite pages we can't read, and without this the target
+		// will compress them
+		request.Header.Del("Accept-Encoding")
+	}
+
+	return &ResponseWriter{
+		ResponseWriter: writer,
+		rewriter:       r,
+		localHost:      request.Host,
+	}
+}
+
+// ResponseWriter rewrites the headers and, in html mode, HTML pages written to
+// it before passing them on
+type ResponseWriter struct {
+	http.ResponseWriter
+	rewriter *Rewriter
+
+	// the host the user reached us at, which we point them at instead
+	localHost string
+
+	wroteHeader bool
+	html        bool
+
+	// the end of the page we've been given but can't rewrite until we know
+	// what comes after it
+	pending []byte
+}
+
+func (w *ResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	for _, name := range []string{"Location", "Content-Location"} {
+		if location := header.Get(name); location != "" {
+			header.Set(name, w.rewriteLocation(location))
+		}
+	}
+
+	if cookies := header.Values("Set-Cookie"); len(cookies) > 0 {
+		header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			header.Add("Set-Cookie", rewriteCookie(cookie))
+		}
+	}
+
+	if w.rewriter.mode == HTML && isHTML(header) {
+		w.html = true
+		// rewriting changes the length of the page
+		header.Del("Content-Length")
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *ResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.html {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.pending = append(w.pending, data...)
+	if _, err := w.ResponseWriter.Write(w.rewritePage(false)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes whatever's left of the page
+func (w *ResponseWriter) Close() error {
+	if !w.html || len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.rewritePage(true))
+	return err
+}
+
+func (w *ResponseWriter) rewriteLocation(location string) string {
+	locationUrl, err := url.Parse(location)
+	if err != nil || locationUrl.Host == "" {
+		// relative redirects already work
+		return location
+	}
+
+	scheme := locationUrl.Scheme
+	if scheme == "" {
+		scheme = w.rewriter.scheme
+	}
+
+	if !w.rewriter.matches(scheme, locationUrl.Host) {
+		return location
+	}
+
+	if locationUrl.Scheme != "" {
+		locationUrl.Scheme = "http"
+	}
+	locationUrl.Host = w.localHost
+	return locationUrl.String()
+}
+
+// rewriteCookie drops the attributes of a Set-Cookie header that stop it
+// working for the daemon's host, leaving the rest of it as it is
+func rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	rewritten := []string{parts[0]}
+
+	for _, attribute := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+		switch {
+		case strings.EqualFold(name, "Domain"), strings.EqualFold(name, "Secure"):
+			continue
+		case strings.EqualFold(name, "SameSite") && strings.EqualFold(value, "None"):
+			// browsers refuse cookies like this that aren't Secure
+			rewritten = append(rewritten, "SameSite=Lax")
+		default:
+			rewritten = append(rewritten, strings.TrimSpace(attribute))
+		}
+	}
+	return strings.Join(rewritten, "; ")
+}
+
+func isHTML(header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// rewritePage rewrites links to the target in as much of the pending page as
+// we can, and returns it. Unless this is the end of the page, we keep back
+// anything that might be the start of a link until we know where it ends
+func (w *ResponseWriter) rewritePage(final bool) []byte {
+	var rewritten bytes.Buffer
+
+	// how much of the page we've written out
+	written := 0
+	// where we need to keep the page from, if we find a link we can't finish
+	keep := -1
+
+	for search := 0; ; {
+		index := bytes.Index(w.pending[search:], []byte("//"))
+		if index < 0 {
+			break
+		}
+		index += search
+
+		start, scheme := index, ""
+		if bytes.HasSuffix(w.pending[:index], []byte("https:")) {
+			start, scheme = index-len("https:"), "https"
+		} else if bytes.HasSuffix(w.pending[:index], []byte("http:")) {
+			start, scheme = index-len("http:"), "http"
+		}
+
+		end := index + len("//")
+		for end < len(w.pending) && end-index <= maxAuthorityLength && isAuthorityByte(w.pending[end]) {
+			end++
+		}
+
+		if end == len(w.pending) && !final {
+			keep = start
+			break
+		}
+
+		authority := string(w.pending[index+len("//") : end])
+		linkScheme := scheme
+		if linkScheme == "" {
+			linkScheme = w.rewriter.scheme
+		}
+
+		if authority != "" && start >= written && w.rewriter.matches(linkScheme, authority) {
+			rewritten.Write(w.pending[written:start])
+			if scheme != "" {
+				rewritten.WriteString("http:")
+			}
+			rewritten.WriteString("//" + w.localHost)
+			written = end
+		}
+		search = end
+	}
+
+	// hold on to anything which could be the start of a scheme
+	if keep < 0 {
+		keep = len(w.pending)
+		if !final {
+			keep -= len("https:/")
+		}
+	}
+	if keep < written {
+		keep = written
+	}
+
+	rewritten.Write(w.pending[written:keep])
+	w.pending = append([]byte{}, w.pending[keep:]...)
+	return rewritten.Bytes()
+}
+
+func isAuthorityByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '.' || b == '-' || b == ':'
+}
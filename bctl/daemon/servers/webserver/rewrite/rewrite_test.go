@@ -0,0 +1,114 @@
+package rewrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRewrite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Daemon Web Response Rewriting Suite")
+}
+
+var _ = Describe("Web Response Rewriting", func() {
+	var recorder *httptest.ResponseRecorder
+	var request *http.Request
+
+	newWriter := func(mode Mode) *ResponseWriter {
+		rewriter, err := New(mode, "https://jenkins.internal", 443, []string{"jenkins.example.com", " ci.example.com:8443"})
+		Expect(err).ToNot(HaveOccurred())
+		return rewriter.Wrap(recorder, request)
+	}
+
+	BeforeEach(func() {
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest(http.MethodGet, "http://localhost:8080/login", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+	})
+
+	It("leaves responses alone unless we ask for it", func() {
+		rewriter, err := New(Off, "https://jenkins.internal", 443, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rewriter).To(BeNil())
+
+		_, err = New("everything", "https://jenkins.internal", 443, nil)
+		Expect(err).To(MatchError(ContainSubstring("unknown response rewriting mode")))
+	})
+
+	It("points redirects to the target at us", func() {
+		for location, expected := range map[string]string{
+			"https://jenkins.internal/securityRealm/commenceLogin": "http://localhost:8080/securityRealm/commenceLogin",
+			"https://JENKINS.internal:443/?from=%2F":               "http://localhost:8080/?from=%2F",
+			"//jenkins.internal/job/":                              "//localhost:8080/job/",
+			"http://jenkins.example.com:8080/":                     "http://localhost:8080/",
+			"https://ci.example.com:8443/":                         "http://localhost:8080/",
+			"https://ci.example.com/":                              "https://ci.example.com/",
+			"https://jenkins.internal:8443/":                       "https://jenkins.internal:8443/",
+			"https://accounts.google.com/o/oauth2/auth":            "https://accounts.google.com/o/oauth2/auth",
+			"/login": "/login",
+		} {
+			recorder = httptest.NewRecorder()
+			writer := newWriter(Headers)
+			writer.Header().Set("Location", location)
+			writer.WriteHeader(http.StatusFound)
+			Expect(recorder.Header().Get("Location")).To(Equal(expected), location)
+		}
+	})
+
+	It("makes the target's cookies ours", func() {
+		writer := newWriter(Headers)
+		writer.Header().Add("Set-Cookie", "JSESSIONID=abc; Path=/; Domain=.jenkins.internal; Secure; HttpOnly")
+		writer.Header().Add("Set-Cookie", "remember=def; SameSite=None; Secure; Max-Age=3600")
+		writer.WriteHeader(http.StatusOK)
+
+		Expect(recorder.Header().Values("Set-Cookie")).To(Equal([]string{
+			"JSESSIONID=abc; Path=/; HttpOnly",
+			"remember=def; SameSite=Lax; Max-Age=3600",
+		}))
+
+		By("leaving pages alone in headers mode")
+		Expect(request.Header.Get("Accept-Encoding")).To(Equal("gzip"))
+		writer.Write([]byte(`<a href="https://jenkins.internal/">`))
+		Expect(recorder.Body.String()).To(Equal(`<a href="https://jenkins.internal/">`))
+	})
+
+	It("rewrites links in pages however they're split up", func() {
+		writer := newWriter(HTML)
+		Expect(request.Header.Get("Accept-Encoding")).To(BeEmpty())
+
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.Header().Set("Content-Length", "1000")
+		writer.WriteHeader(http.StatusOK)
+		Expect(recorder.Header().Get("Content-Length")).To(BeEmpty())
+
+		page := `<base href="https://jenkins.internal/"><script src="//jenkins.internal:443/static/app.js"></script>` +
+			`<a href="https://jenkins.internal.evil.com/">x</a><a href="https://accounts.google.com/">y</a>` +
+			`<a href="https://jenkins.internal:8443/">z</a><img src="http://jenkins.example.com/logo.png">`
+		for i := 0; i < len(page); i += 5 {
+			end := i + 5
+			if end > len(page) {
+				end = len(page)
+			}
+			_, err := writer.Write([]byte(page[i:end]))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(writer.Close()).To(Succeed())
+
+		Expect(recorder.Body.String()).To(Equal(`<base href="http://localhost:8080/"><script src="//localhost:8080/static/app.js"></script>` +
+			`<a href="https://jenkins.internal.evil.com/">x</a><a href="https://accounts.google.com/">y</a>` +
+			`<a href="https://jenkins.internal:8443/">z</a><img src="http://localhost:8080/logo.png">`))
+	})
+
+	It("leaves pages alone if it can't read them", func() {
+		writer := newWriter(HTML)
+		writer.Header().Set("Content-Type", "text/html")
+		writer.Header().Set("Content-Encoding", "br")
+		writer.Write([]byte("https://jenkins.internal/"))
+		Expect(writer.Close()).To(Succeed())
+		Expect(recorder.Body.String()).To(Equal("https://jenkins.internal/"))
+	})
+})
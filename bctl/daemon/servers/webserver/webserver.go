@@ -5,13 +5,15 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"bastionzero.com/bzerolib/connection"
-	"bastionzero.com/bzerolib/connection/messenger/signalr"
-	"bastionzero.com/bzerolib/connection/transporter/websocket"
+	"bastionzero.com/bzerolib/connection/messenger"
 	"bastionzero.com/bzerolib/keypair"
 	"bastionzero.com/bzerolib/logger"
 	bzplugin "bastionzero.com/bzerolib/plugin"
@@ -21,14 +23,15 @@ import (
 	"bastionzero.com/daemon/mrtap/bzcert"
 	"bastionzero.com/daemon/plugin/web"
 	"bastionzero.com/daemon/servers/dataconnection"
+	"bastionzero.com/daemon/servers/webserver/rewrite"
 )
 
 const (
-	// TODO: make these easily configurable values
-	maxRequestSize = 10 * 1024 * 1024  // 10MB
-	maxFileUpload  = 151 * 1024 * 1024 // 151MB a little extra for request fluff
-
 	connectionCloseTimeout = 10 * time.Second
+
+	// the limits on request bodies if the daemon isn't told otherwise
+	DefaultMaxRequestSize = 10 * 1024 * 1024  // 10MB
+	DefaultMaxUploadSize  = 151 * 1024 * 1024 // 151MB a little extra for request fluff
 )
 
 type WebServer struct {
@@ -42,11 +45,28 @@ type WebServer struct {
 	targetPort int
 	targetHost string
 
+	// the largest request body we'll send to the target, or 0 for no limit.
+	// Uploads, which are multipart/form-data, have their own limit
+	maxRequestSize int64
+	maxUploadSize  int64
+
+	// points the target's redirects, cookies and pages at us, if we want it to
+	rewriter *rewrite.Rewriter
+
 	// fields for new datachannels
 	localPort   string
 	localHost   string
 	agentPubKey *keypair.PublicKey
 	cert        *bzcert.DaemonBZCert
+	metrics     *mrtap.Metrics
+
+	// what the agent told us it can do in the last SynAck we got from it, nil
+	// until we've heard from it
+	agentCapabilities     *bzweb.WebSynAckPayload
+	agentCapabilitiesLock sync.Mutex
+
+	// so that we only ask the agent what it can do once at a time
+	askAgentLock sync.Mutex
 }
 
 func New(
@@ -56,30 +76,35 @@ func New(
 	localHost string,
 	targetPort int,
 	targetHost string,
+	maxRequestSize int64,
+	maxUploadSize int64,
+	rewriter *rewrite.Rewriter,
 	cert *bzcert.DaemonBZCert,
+	metrics *mrtap.Metrics,
 	connUrl string,
 	params url.Values,
 	headers http.Header,
 	agentPubKey *keypair.PublicKey,
+	client messenger.Messenger,
 ) (*WebServer, error) {
 
 	server := &WebServer{
-		logger:      logger,
-		errChan:     errChan,
-		cert:        cert,
-		localPort:   localPort,
-		localHost:   localHost,
-		targetHost:  targetHost,
-		targetPort:  targetPort,
-		agentPubKey: agentPubKey,
+		logger:         logger,
+		errChan:        errChan,
+		cert:           cert,
+		metrics:        metrics,
+		localPort:      localPort,
+		localHost:      localHost,
+		targetHost:     targetHost,
+		targetPort:     targetPort,
+		maxRequestSize: maxRequestSize,
+		maxUploadSize:  maxUploadSize,
+		rewriter:       rewriter,
+		agentPubKey:    agentPubKey,
 	}
 
 	// Create our one connection
 	subLogger := logger.GetConnectionLogger(uuid.New().String())
-	wsLogger := logger.GetComponentLogger("Websocket")
-	srLogger := logger.GetComponentLogger("SignalR")
-
-	client := signalr.New(srLogger, websocket.New(wsLogger))
 	if client, err := dataconnection.New(subLogger, connUrl, params, headers, client); err != nil {
 		return nil, fmt.Errorf("failed to create connection: %s", err)
 	} else {
@@ -96,9 +121,12 @@ func (w *WebServer) Start() error {
 	go func() {
 		// Define our http handlers
 		// library will automatically put each call in its own thread
-		http.HandleFunc("/", w.capRequestSize(w.handleHttp))
+		http.HandleFunc("/", w.capRequestSize(w.rewriteResponses(w.handleHttp)))
 
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%s", w.localHost, w.localPort), nil); err != nil {
+		// we also accept HTTP/2 without TLS, since that's how local gRPC clients
+		// talk to a plaintext server
+		handler := h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
+		if err := http.ListenAndServe(fmt.Sprintf("%s:%s", w.localHost, w.localPort), handler); err != nil {
 			w.logger.Error(err)
 		}
 	}()
@@ -119,34 +147,50 @@ func (w *WebServer) listenForConnectionDone() {
 }
 
 // this function operates as middleware between the http handler and the handleHttp call below
-// it checks to see if someone is trying to send a request body that is far too large
+// it checks to see if someone is trying to send a request body that is larger than we allow. Bodies
+// are streamed to the target rather than held in memory, so this is only a matter of policy
 func (w *WebServer) capRequestSize(h http.HandlerFunc) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
+		maxSize := w.maxRequestSize
 		if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart") {
-			if request.ContentLength > maxFileUpload {
-				// for multipart/form-data type requests, the request body won't exceed our maximum single request size
-				// but we still want to cap the size of uploads because they are stored in their entirety on the target.
-				// Not optimal, here's the ticket: CWC-1647
-				// We shouldn't be relying on content length too much since it can be modified to be whatever.
-				rerr := "BastionZero: Request is too large. Maximum upload is 150MB"
-				w.logger.Errorf(rerr)
-				http.Error(writer, rerr, http.StatusRequestEntityTooLarge)
-				return
-			}
-		} else {
-			request.Body = http.MaxBytesReader(writer, request.Body, maxRequestSize)
-			if err := request.ParseForm(); err != nil {
-				rerr := "BastionZero: Request is too large. Maximum request size is 10MB"
-				w.logger.Errorf(rerr)
-				http.Error(writer, rerr, http.StatusRequestEntityTooLarge)
+			maxSize = w.maxUploadSize
+		}
+
+		// long-lived gRPC streams would run into any limit we set
+		if maxSize > 0 && !isStreamRequest(request) {
+			// We shouldn't be relying on content length too much since it can be modified to be whatever,
+			// but it lets us refuse obviously large requests before we've sent any of them
+			if request.ContentLength > maxSize {
+				rerr := fmt.Errorf("BastionZero: Request is too large. Maximum request size is %d bytes", maxSize)
+				w.logger.Error(rerr)
+				http.Error(writer, rerr.Error(), http.StatusRequestEntityTooLarge)
 				return
 			}
+			request.Body = http.MaxBytesReader(writer, request.Body, maxSize)
 		}
 
 		h(writer, request)
 	}
 }
 
+// this function operates as middleware between the http handler and the handleHttp call below
+// it rewrites the parts of the target's responses that point at the target so they point at us
+func (w *WebServer) rewriteResponses(h http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		// websockets need the connection itself, and there's nothing in them we rewrite
+		if w.rewriter == nil || request.Header.Get("Upgrade") == "websocket" {
+			h(writer, request)
+			return
+		}
+
+		rewriter := w.rewriter.Wrap(writer, request)
+		h(rewriter, request)
+		if err := rewriter.Close(); err != nil {
+			w.logger.Errorf("failed to write rewritten response: %s", err)
+		}
+	}
+}
+
 func (w *WebServer) handleHttp(writer http.ResponseWriter, request *http.Request) {
 	// every datachannel gets a uuid to distinguish it so a single connection can map to multiple datachannels
 	dcId := uuid.New().String()
@@ -163,18 +207,99 @@ func (w *WebServer) handleHttp(writer http.ResponseWriter, request *http.Request
 	isWebsocketRequest := request.Header.Get("Upgrade")
 	if isWebsocketRequest == "websocket" {
 		action = bzweb.Websocket
+	} else if isStreamRequest(request) && w.getAgentCapabilities().Stream {
+		// older agents can still make the request, they just can't stream it
+		action = bzweb.Stream
 	}
 
-	if err := w.newDataChannel(dcId, action, plugin); err != nil {
+	if _, err := w.newDataChannel(dcId, action, plugin); err != nil {
 		w.logger.Errorf("error starting datachannel: %s", err)
 	}
 	if err := plugin.StartAction(action, writer, request); err != nil {
 		w.logger.Errorf("error starting action: %s", err)
 	}
+
+	w.learnAgentCapabilities(plugin)
+}
+
+// HTTP/2 requests, and gRPC in particular, can stream their bodies in both
+// directions at once, so we can't wait for the whole request like dial does.
+// gRPC-Web over HTTP/1.1 doesn't, and works fine with dial
+func isStreamRequest(request *http.Request) bool {
+	return request.ProtoMajor == 2
+}
+
+// getAgentCapabilities returns what the agent can do, asking it if we haven't
+// heard from it yet
+func (w *WebServer) getAgentCapabilities() bzweb.WebSynAckPayload {
+	if capabilities, ok := w.knownAgentCapabilities(); ok {
+		return capabilities
+	}
+
+	w.askAgentLock.Lock()
+	defer w.askAgentLock.Unlock()
+
+	// someone else may have asked while we were waiting
+	if capabilities, ok := w.knownAgentCapabilities(); ok {
+		return capabilities
+	}
+
+	w.askAgentCapabilities()
+	capabilities, _ := w.knownAgentCapabilities()
+	return capabilities
+}
+
+func (w *WebServer) knownAgentCapabilities() (bzweb.WebSynAckPayload, bool) {
+	w.agentCapabilitiesLock.Lock()
+	defer w.agentCapabilitiesLock.Unlock()
+
+	if w.agentCapabilities == nil {
+		return bzweb.WebSynAckPayload{}, false
+	}
+	return *w.agentCapabilities, true
+}
+
+// learnAgentCapabilities remembers what the agent told us in a datachannel's
+// SynAck, if it's told us yet, so that we know what we can ask of it in later
+// datachannels
+func (w *WebServer) learnAgentCapabilities(plugin *web.WebDaemonPlugin) {
+	select {
+	case <-plugin.SynAcked():
+		capabilities := plugin.AgentCapabilities()
+
+		w.agentCapabilitiesLock.Lock()
+		defer w.agentCapabilitiesLock.Unlock()
+		w.agentCapabilities = &capabilities
+	default:
+	}
+}
+
+// askAgentCapabilities opens a datachannel that we close again as soon as the
+// agent has told us what it can do in its SynAck
+func (w *WebServer) askAgentCapabilities() {
+	dcId := uuid.New().String()
+
+	subLogger := w.logger.GetDatachannelLogger(dcId)
+	subLogger = subLogger.GetPluginLogger(bzplugin.Web)
+	plugin := web.New(subLogger, w.targetHost, w.targetPort)
+
+	dc, err := w.newDataChannel(dcId, bzweb.Dial, plugin)
+	if err != nil {
+		w.logger.Errorf("failed to ask the agent what it can do: %s", err)
+		return
+	}
+	defer dc.Close(nil)
+
+	select {
+	case <-plugin.SynAcked():
+		w.learnAgentCapabilities(plugin)
+	case <-dc.Done():
+		w.logger.Errorf("failed to ask the agent what it can do: %s", dc.Err())
+	}
 }
 
 // for creating new datachannels
-func (w *WebServer) newDataChannel(dcId string, action bzweb.WebAction, plugin *web.WebDaemonPlugin) error {
+func (w *WebServer) newDataChannel(dcId string, action bzweb.WebAction, plugin *web.WebDaemonPlugin) (*datachannel.DataChannel, error) {
 
 	attach := false
 	subLogger := w.logger.GetDatachannelLogger(dcId)
@@ -190,13 +315,9 @@ func (w *WebServer) newDataChannel(dcId string, action bzweb.WebAction, plugin *
 	mtLogger := w.logger.GetComponentLogger("mrtap")
 	mt, err := mrtap.New(mtLogger, w.agentPubKey, w.cert)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	actString := "web/" + string(action)
-	_, err = datachannel.New(subLogger, dcId, w.conn, mt, plugin, actString, synPayload, attach, true)
-	if err != nil {
-		return err
-	}
-	return nil
+	return datachannel.New(subLogger, dcId, w.conn, mt, w.metrics, plugin, actString, synPayload, attach, true)
 }
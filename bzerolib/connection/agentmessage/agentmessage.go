@@ -51,6 +51,10 @@ const (
 	// control channel message to update valid cluster users for a kube cluster
 	ClusterUsers MessageType = "clusterusers"
 
+	// control channel message listing the clusters a kube agent serves as
+	// virtual targets
+	KubeClusters MessageType = "kubeclusters"
+
 	// poison pill message - an order from an admin to restart
 	Restart MessageType = "restart"
 
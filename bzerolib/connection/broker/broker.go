@@ -12,6 +12,13 @@ type IChannel interface {
 	Close(reason error)
 }
 
+// IResumableChannel is a channel which can pick up where it left off once its
+// connection has been re-established
+type IResumableChannel interface {
+	IChannel
+	Resume()
+}
+
 type Broker struct {
 	subscribers map[string]IChannel
 	lock        sync.RWMutex
@@ -46,6 +53,18 @@ func (b *Broker) CloseChannel(cId string, reason error) bool {
 	return false
 }
 
+// Resume lets every subscriber that can resume know that the connection is back
+func (b *Broker) Resume() {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, channel := range b.subscribers {
+		if resumable, ok := channel.(IResumableChannel); ok {
+			resumable.Resume()
+		}
+	}
+}
+
 func (b *Broker) NumChannels() int {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
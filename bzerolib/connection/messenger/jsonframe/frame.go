@@ -0,0 +1,100 @@
+package jsonframe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Largest frame we are willing to buffer, anything bigger than this means we
+// are either out of sync with the relay or something is very wrong with it
+const maxFrameLength = 64 * 1024 * 1024
+
+// Separates a frame's length from its JSON body. We use a textual length so
+// that frames are still valid websocket text messages
+const lengthDelimiter = ':'
+
+type FrameType string
+
+const (
+	Invocation FrameType = "invocation"
+	Ping       FrameType = "ping"
+	Close      FrameType = "close"
+)
+
+type Frame struct {
+	Type FrameType `json:"type"`
+
+	// Only set on invocations; which hub method the payload is for
+	Target  string          `json:"target,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Only set on close frames
+	Error string `json:"error,omitempty"`
+}
+
+// encode marshals a frame and prefixes it with its length so the other side
+// knows where it ends
+func encode(frame Frame) ([]byte, error) {
+	frameBytes, err := json.Marshal(frame)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s frame: %w", frame.Type, err)
+	}
+
+	prefix := strconv.Itoa(len(frameBytes)) + string(lengthDelimiter)
+	return append([]byte(prefix), frameBytes...), nil
+}
+
+// decoder reassembles frames from a stream of transport messages. A single
+// message may contain many frames and a single frame may be split across many
+// messages so we hold on to anything we haven't been able to decode yet
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) decode(raw []byte) ([]Frame, error) {
+	d.buf = append(d.buf, raw...)
+
+	frames := []Frame{}
+	for len(d.buf) > 0 {
+		delimiter := bytes.IndexByte(d.buf, lengthDelimiter)
+		if delimiter < 0 {
+			// we haven't received the entire length yet
+			if len(d.buf) > len(strconv.Itoa(maxFrameLength)) {
+				return frames, d.reset(fmt.Errorf("no frame length found in %d bytes", len(d.buf)))
+			}
+			break
+		}
+
+		length, err := strconv.Atoi(string(d.buf[:delimiter]))
+		if err != nil || length < 0 {
+			return frames, d.reset(fmt.Errorf("malformed frame length: %q", d.buf[:delimiter]))
+		} else if length > maxFrameLength {
+			return frames, d.reset(fmt.Errorf("frame length %d exceeds maximum of %d bytes", length, maxFrameLength))
+		}
+
+		end := delimiter + 1 + length
+		if len(d.buf) < end {
+			// we haven't received the entire frame yet
+			break
+		}
+
+		var frame Frame
+		if err := json.Unmarshal(d.buf[delimiter+1:end], &frame); err != nil {
+			return frames, d.reset(fmt.Errorf("error unmarshalling frame: %w", err))
+		}
+
+		frames = append(frames, frame)
+		d.buf = d.buf[end:]
+	}
+
+	return frames, nil
+}
+
+// once we've lost track of where frames begin there's no way to recover
+// anything else in the buffer
+func (d *decoder) reset(err error) error {
+	d.buf = nil
+	return err
+}
@@ -0,0 +1,234 @@
+/*
+The jsonframe package is a protocol handler for talking to a lightweight relay
+in place of the BastionZero connection node. Instead of the SignalR hub
+protocol, every message is written as a single JSON frame prefixed by its
+length in bytes:
+
+	<length>:{"type":"invocation","target":"RequestBastionToAgentV1","payload":{...}}
+
+A frame is one of:
+
+	"invocation" - a message for the named hub target. The payload is the
+	               message itself, which is almost always an AgentMessage
+	"ping"       - a keep-alive, which both sides send when they are idle
+	"close"      - the other side is closing the connection and why
+
+There are no invocation ids or completions; the relay is trusted to either
+deliver a frame or close the connection. Inbound invocations are handed up in
+the same shape as SignalR invocations so that connection managers don't have
+to know which protocol they are speaking.
+*/
+package jsonframe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	am "bastionzero.com/bzerolib/connection/agentmessage"
+	"bastionzero.com/bzerolib/connection/messenger/signalr"
+	"bastionzero.com/bzerolib/connection/transporter"
+	"bastionzero.com/bzerolib/logger"
+	"gopkg.in/tomb.v2"
+)
+
+// How often we send pings to the relay, variable only so it can be modified
+// in unit tests
+var ClientPingRate = 15 * time.Second
+
+// How long we wait without hearing anything from the relay before we assume
+// the connection is dead, variable only so it can be modified in unit tests
+var ServerPingTimeout = 30 * time.Second
+
+type JsonFrame struct {
+	tmb    tomb.Tomb
+	logger *logger.Logger
+
+	client  transporter.Transporter
+	inbound chan *signalr.SignalRMessage
+
+	// Function for choosing target method
+	targetSelectHandler func(am.AgentMessage) (string, error)
+
+	// pings and messages are sent from different goroutines
+	sendLock sync.Mutex
+
+	decoder decoder
+}
+
+func New(
+	logger *logger.Logger,
+	client transporter.Transporter,
+) *JsonFrame {
+	return &JsonFrame{
+		logger:  logger,
+		client:  client,
+		inbound: make(chan *signalr.SignalRMessage, 200),
+	}
+}
+
+func (j *JsonFrame) Close(reason error) {
+	if !j.tmb.Alive() {
+		return
+	}
+
+	j.tmb.Kill(reason)
+	j.tmb.Wait()
+}
+
+func (j *JsonFrame) Err() error {
+	return j.tmb.Err()
+}
+
+func (j *JsonFrame) Done() <-chan struct{} {
+	return j.tmb.Dead()
+}
+
+func (j *JsonFrame) Inbound() <-chan *signalr.SignalRMessage {
+	return j.inbound
+}
+
+func (j *JsonFrame) Connect(
+	ctx context.Context,
+	targetUrl string,
+	headers http.Header,
+	params url.Values,
+	targetSelectHandler func(msg am.AgentMessage) (string, error),
+) error {
+	j.targetSelectHandler = targetSelectHandler
+
+	// Reset variables
+	if !j.tmb.Alive() {
+		j.tmb = tomb.Tomb{}
+	}
+	j.decoder = decoder{}
+
+	u, err := url.ParseRequestURI(targetUrl)
+	if err != nil {
+		return fmt.Errorf("failed to parse relay url %s: %w", targetUrl, err)
+	}
+	u.RawQuery = params.Encode()
+
+	j.logger.Infof("Making connection to relay")
+	if err := j.client.Dial(u, headers, ctx); err != nil {
+		return fmt.Errorf("error connecting to %s: %w", u.String(), err)
+	}
+
+	// There is no handshake, so as soon as we've dialed we can start talking
+	j.tmb.Go(func() error {
+		defer j.logger.Info("JSON frame processing done")
+
+		j.tmb.Go(func() error {
+			ticker := time.NewTicker(ClientPingRate)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-j.tmb.Dying():
+					return nil
+				case <-ticker.C:
+					if err := j.send(Frame{Type: Ping}); err != nil {
+						j.logger.Errorf("Failed to send ping frame. Error: %s", err)
+					}
+				}
+			}
+		})
+
+		ticker := time.NewTicker(ServerPingTimeout)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-j.tmb.Dying(): // death from Close() call
+				// let the relay know we're leaving on purpose
+				if err := j.send(Frame{Type: Close, Error: fmt.Sprint(j.tmb.Err())}); err != nil {
+					j.logger.Errorf("Failed to send close frame. Error: %s", err)
+				}
+
+				j.client.Close(j.Err())
+				return nil
+			case <-j.client.Done():
+				return fmt.Errorf("closed connection")
+			case <-ticker.C:
+				err := fmt.Errorf("server ping timeout: failed to receive any messages from the relay after %s", ServerPingTimeout)
+				j.client.Close(err)
+				return err
+			case messageBytes := <-j.client.Inbound():
+				ticker.Reset(ServerPingTimeout)
+				if err := j.unwrap(*messageBytes); err != nil {
+					j.logger.Errorf("error unwrapping JSON frame: %s", err)
+				}
+			}
+		}
+	})
+
+	return nil
+}
+
+func (j *JsonFrame) unwrap(raw []byte) error {
+	// We may have received many frames, or only part of one
+	frames, err := j.decoder.decode(raw)
+
+	for _, frame := range frames {
+		switch frame.Type {
+		case Ping: // Ignore pings, they only exist to reset the timeout
+		case Close:
+			j.logger.Infof("received frame to close the connection")
+
+			// Connection managers treat a normal closure as a signal not to
+			// reconnect regardless of which protocol they're speaking
+			j.tmb.Kill(&signalr.WebsocketNormalClosure{ServerError: frame.Error})
+		case Invocation:
+			j.inbound <- &signalr.SignalRMessage{
+				Type:      int(signalr.Invocation),
+				Target:    frame.Target,
+				Arguments: []json.RawMessage{frame.Payload},
+			}
+		default:
+			j.logger.Infof("Ignoring %s frame", frame.Type)
+		}
+	}
+
+	return err
+}
+
+func (j *JsonFrame) Send(message am.AgentMessage) error {
+	target, err := j.targetSelectHandler(message)
+	if err != nil {
+		return fmt.Errorf("error in selecting target name: %w", err)
+	}
+
+	return j.Invoke(target, message)
+}
+
+// Invoke sends an arbitrary payload to the given target. Only peers who are
+// standing in for the connection node need this, in order to send its control
+// messages e.g. AgentConnected, which aren't AgentMessages
+func (j *JsonFrame) Invoke(target string, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s payload: %w", target, err)
+	}
+
+	return j.send(Frame{
+		Type:    Invocation,
+		Target:  target,
+		Payload: payloadBytes,
+	})
+}
+
+func (j *JsonFrame) send(frame Frame) error {
+	frameBytes, err := encode(frame)
+	if err != nil {
+		return err
+	}
+
+	j.sendLock.Lock()
+	defer j.sendLock.Unlock()
+
+	return j.client.Send(frameBytes)
+}
@@ -0,0 +1,184 @@
+package jsonframe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"bastionzero.com/bzerolib/connection/agentmessage"
+	"bastionzero.com/bzerolib/connection/messenger/signalr"
+	"bastionzero.com/bzerolib/connection/transporter"
+	"bastionzero.com/bzerolib/logger"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestJsonFrame(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "JSON Frame Suite")
+}
+
+var _ = Describe("JSON Frame", func() {
+	var doneChan chan struct{}
+	var inboundChan chan *[]byte
+	var mockTransport *transporter.MockTransporter
+	var jsonFrame *JsonFrame
+
+	// This needs to be correctly formatted but we don't care what's on the other side
+	fakeUrl := "http://localhost:0"
+
+	logger := logger.MockLogger(GinkgoWriter)
+	ctx := context.Background()
+
+	testTargetFunc := func(msg agentmessage.AgentMessage) (string, error) {
+		return "TestMethod", nil
+	}
+
+	testMessage := agentmessage.AgentMessage{
+		ChannelId:      "1234",
+		MessageType:    agentmessage.Mrtap,
+		SchemaVersion:  agentmessage.CurrentVersion,
+		MessagePayload: []byte("whooopie"),
+	}
+	testMessageBytes, _ := json.Marshal(testMessage)
+
+	mustEncode := func(frame Frame) []byte {
+		frameBytes, err := encode(frame)
+		Expect(err).ToNot(HaveOccurred())
+		return frameBytes
+	}
+
+	setupHappyTransport := func() {
+		mockTransport = &transporter.MockTransporter{}
+		mockTransport.On("Dial").Return(nil)
+		mockTransport.On("Send").Return(nil)
+		mockTransport.On("Close").Return()
+
+		doneChan = make(chan struct{})
+		mockTransport.On("Done").Return(doneChan)
+
+		inboundChan = make(chan *[]byte, 1)
+		mockTransport.On("Inbound").Return(inboundChan)
+
+		jsonFrame = New(logger, mockTransport)
+		err := jsonFrame.Connect(ctx, fakeUrl, http.Header{}, url.Values{}, testTargetFunc)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	Context("Decoding", func() {
+		var d decoder
+
+		BeforeEach(func() {
+			d = decoder{}
+		})
+
+		When("a single message contains multiple frames", func() {
+			It("decodes every frame", func() {
+				raw := append(mustEncode(Frame{Type: Ping}), mustEncode(Frame{Type: Invocation, Target: "TestMethod", Payload: testMessageBytes})...)
+
+				frames, err := d.decode(raw)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(frames).To(HaveLen(2))
+				Expect(frames[0].Type).To(Equal(Ping))
+				Expect(frames[1].Target).To(Equal("TestMethod"))
+				Expect([]byte(frames[1].Payload)).To(MatchJSON(testMessageBytes))
+			})
+		})
+
+		When("a frame is split across multiple messages", func() {
+			It("waits for the rest of the frame before decoding it", func() {
+				raw := mustEncode(Frame{Type: Invocation, Target: "TestMethod", Payload: testMessageBytes})
+
+				frames, err := d.decode(raw[:10])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(frames).To(BeEmpty())
+
+				frames, err = d.decode(raw[10:])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(frames).To(HaveLen(1))
+				Expect(frames[0].Target).To(Equal("TestMethod"))
+			})
+		})
+
+		When("the length prefix is malformed", func() {
+			It("errors and drops what it has buffered", func() {
+				_, err := d.decode([]byte("abc:{}"))
+				Expect(err).To(HaveOccurred())
+				Expect(d.buf).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("Connection", func() {
+		When("the underlying connection fails to connect", func() {
+			It("fails to create the connection", func() {
+				mockTransport = &transporter.MockTransporter{}
+				mockTransport.On("Dial").Return(fmt.Errorf("failure"))
+
+				jsonFrame = New(logger, mockTransport)
+				err := jsonFrame.Connect(ctx, fakeUrl, http.Header{}, url.Values{}, testTargetFunc)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("Sending", func() {
+		When("sending an agent message", func() {
+			BeforeEach(func() {
+				setupHappyTransport()
+			})
+
+			AfterEach(func() {
+				jsonFrame.Close(fmt.Errorf("test done"))
+			})
+
+			It("sends it without error", func() {
+				Expect(jsonFrame.Send(testMessage)).To(Succeed())
+				mockTransport.AssertCalled(GinkgoT(), "Send")
+			})
+		})
+	})
+
+	Context("Receiving", func() {
+		BeforeEach(func() {
+			setupHappyTransport()
+		})
+
+		When("an invocation frame is received", func() {
+			AfterEach(func() {
+				jsonFrame.Close(fmt.Errorf("test done"))
+			})
+
+			It("forwards it in the same shape as a SignalR invocation", func() {
+				raw := mustEncode(Frame{Type: Invocation, Target: "TestMethod", Payload: testMessageBytes})
+				inboundChan <- &raw
+
+				var message *signalr.SignalRMessage
+				Eventually(jsonFrame.Inbound()).Should(Receive(&message))
+				Expect(message.Target).To(Equal("TestMethod"))
+				Expect(message.Arguments).To(HaveLen(1))
+
+				var agentMessage agentmessage.AgentMessage
+				Expect(json.Unmarshal(message.Arguments[0], &agentMessage)).To(Succeed())
+				Expect(agentMessage).To(Equal(testMessage))
+			})
+		})
+
+		When("a close frame is received", func() {
+			It("dies with a normal closure error", func() {
+				raw := mustEncode(Frame{Type: Close, Error: "goodbye"})
+				inboundChan <- &raw
+
+				Eventually(jsonFrame.Done(), time.Second).Should(BeClosed())
+
+				var normalClosure *signalr.WebsocketNormalClosure
+				Expect(jsonFrame.Err()).To(BeAssignableToTypeOf(normalClosure))
+				Expect(jsonFrame.Err().Error()).To(ContainSubstring("goodbye"))
+			})
+		})
+	})
+})
@@ -12,11 +12,26 @@ package messenger
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
 
 	"bastionzero.com/bzerolib/connection/agentmessage"
+	"bastionzero.com/bzerolib/connection/messenger/jsonframe"
 	"bastionzero.com/bzerolib/connection/messenger/signalr"
+	"bastionzero.com/bzerolib/connection/transporter"
+	"bastionzero.com/bzerolib/logger"
+)
+
+// Protocol selects which Messenger implementation we speak over the wire
+type Protocol string
+
+const (
+	// SignalR hub protocol spoken by the BastionZero connection node
+	SignalR Protocol = "signalr"
+
+	// Length-prefixed JSON frames, for use with a lightweight relay
+	JsonFrame Protocol = "json"
 )
 
 type Messenger interface {
@@ -27,3 +42,26 @@ type Messenger interface {
 	Connect(ctx context.Context, targetUrl string, headers http.Header, params url.Values, targetSelectHandler func(msg agentmessage.AgentMessage) (string, error)) error
 	Send(message agentmessage.AgentMessage) error
 }
+
+func ParseProtocol(protocol string) (Protocol, error) {
+	switch Protocol(protocol) {
+	case "":
+		return SignalR, nil
+	case SignalR, JsonFrame:
+		return Protocol(protocol), nil
+	default:
+		return "", fmt.Errorf("unrecognized messenger protocol %q, must be one of ['%s', '%s']", protocol, SignalR, JsonFrame)
+	}
+}
+
+// New creates a Messenger speaking the given protocol over the provided transporter
+func New(protocol Protocol, logger *logger.Logger, client transporter.Transporter) (Messenger, error) {
+	switch protocol {
+	case SignalR, "":
+		return signalr.New(logger.GetComponentLogger("SignalR"), client), nil
+	case JsonFrame:
+		return jsonframe.New(logger.GetComponentLogger("JsonFrame"), client), nil
+	default:
+		return nil, fmt.Errorf("unrecognized messenger protocol: %s", protocol)
+	}
+}
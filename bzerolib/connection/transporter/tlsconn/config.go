@@ -0,0 +1,58 @@
+package tlsconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ServerConfig builds the config for a listener which only accepts clients
+// presenting a certificate signed by the CA at clientCAPath
+func ServerConfig(certPath string, keyPath string, clientCAPath string) (*tls.Config, error) {
+	cert, pool, err := load(certPath, keyPath, clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// ClientConfig builds the config for dialing a server whose certificate is
+// signed by the CA at caPath, authenticating ourselves with our own certificate
+func ClientConfig(certPath string, keyPath string, caPath string) (*tls.Config, error) {
+	cert, pool, err := load(certPath, keyPath, caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+func load(certPath string, keyPath string, caPath string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to load certificate %s and key %s: %w", certPath, keyPath, err)
+	}
+
+	caBytes, err := os.ReadFile(caPath)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to read CA certificate %s: %w", caPath, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return tls.Certificate{}, nil, fmt.Errorf("no valid PEM certificates found in %s", caPath)
+	}
+
+	return cert, pool, nil
+}
@@ -0,0 +1,188 @@
+/*
+The tlsconn package is a transporter which ferries bytes over a mutually
+authenticated TLS connection instead of a websocket. It is used when the daemon
+talks directly to an agent without going through the connection node.
+
+Unlike a websocket, TLS is a stream and has no notion of message boundaries so
+it must be paired with a messenger which frames its own messages, such as
+jsonframe.
+
+A TLSConn can either dial out, in which case only the host of the url passed to
+Dial is used, or it can wrap a connection we have already accepted, in which
+case Dial simply starts reading from it.
+*/
+package tlsconn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"bastionzero.com/bzerolib/connection/transporter"
+	"bastionzero.com/bzerolib/logger"
+	"gopkg.in/tomb.v2"
+)
+
+const readBufferSize = 32 * 1024
+
+type TLSConn struct {
+	tmb    tomb.Tomb
+	logger *logger.Logger
+
+	// only set if we're dialing out
+	config *tls.Config
+
+	// guards conn and started
+	connLock sync.Mutex
+	conn     net.Conn
+
+	// an accepted connection can only be read from once and can't be redialed
+	accepted bool
+
+	// whether our tomb has a goroutine. Until it does, it can be killed but it
+	// never dies
+	started bool
+
+	// Received messages
+	inbound chan *[]byte
+}
+
+// New creates a transporter which dials the agent using the provided config
+func New(logger *logger.Logger, config *tls.Config) transporter.Transporter {
+	return &TLSConn{
+		logger:  logger,
+		config:  config,
+		inbound: make(chan *[]byte, 200),
+	}
+}
+
+// NewFromConn wraps a connection we've already accepted
+func NewFromConn(logger *logger.Logger, conn net.Conn) transporter.Transporter {
+	return &TLSConn{
+		logger:   logger,
+		conn:     conn,
+		accepted: true,
+		inbound:  make(chan *[]byte, 200),
+	}
+}
+
+func (t *TLSConn) Close(reason error) {
+	if t.tmb.Alive() {
+		t.tmb.Kill(reason)
+		t.logger.Infof("TLS connection closing because: %s", reason)
+
+		// closing the connection unblocks our read
+		if conn := t.getConn(); conn != nil {
+			conn.Close()
+		}
+
+		if t.isStarted() {
+			t.tmb.Wait()
+		}
+	} else {
+		t.logger.Infof("Close was called while in a dying state")
+	}
+}
+
+func (t *TLSConn) Done() <-chan struct{} {
+	// a connection that was closed before it started is as done as it gets
+	if !t.isStarted() {
+		return t.tmb.Dying()
+	}
+	return t.tmb.Dead()
+}
+
+func (t *TLSConn) Err() error {
+	return t.tmb.Err()
+}
+
+func (t *TLSConn) Inbound() <-chan *[]byte {
+	return t.inbound
+}
+
+func (t *TLSConn) Send(message []byte) error {
+	if conn := t.getConn(); conn != nil {
+		_, err := conn.Write(message)
+		return err
+	} else {
+		return fmt.Errorf("cannot send message because connection is closed")
+	}
+}
+
+func (t *TLSConn) Dial(connUrl *url.URL, headers http.Header, ctx context.Context) error {
+	if t.accepted {
+		if t.isStarted() {
+			return fmt.Errorf("cannot redial a connection that was accepted")
+		} else if !t.tmb.Alive() {
+			return fmt.Errorf("cannot start a connection that was closed")
+		}
+	} else {
+		dialer := tls.Dialer{Config: t.config}
+		conn, err := dialer.DialContext(ctx, "tcp", connUrl.Host)
+		if err != nil {
+			return fmt.Errorf("error dialing %s: %w", connUrl.Host, err)
+		}
+
+		t.connLock.Lock()
+		t.conn = conn
+		t.connLock.Unlock()
+
+		// Reinitialize our variables in case this is post death
+		t.tmb = tomb.Tomb{}
+	}
+
+	t.connLock.Lock()
+	t.started = true
+	t.connLock.Unlock()
+
+	t.tmb.Go(t.receive)
+
+	return nil
+}
+
+func (t *TLSConn) getConn() net.Conn {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	return t.conn
+}
+
+func (t *TLSConn) isStarted() bool {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	return t.started
+}
+
+func (t *TLSConn) receive() error {
+	defer t.logger.Infof("TLS connection closed")
+	t.logger.Infof("TLS connection started with %s", t.conn.RemoteAddr())
+
+	for {
+		buf := make([]byte, readBufferSize)
+
+		if n, err := t.conn.Read(buf); !t.tmb.Alive() {
+			return nil
+		} else if err != nil {
+			if errors.Is(err, io.EOF) {
+				t.logger.Info("TLS connection closed by remote")
+			} else {
+				t.logger.Error(err)
+			}
+			return err
+		} else {
+			message := buf[:n]
+			select {
+			case t.inbound <- &message:
+			case <-t.tmb.Dying():
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package tlsconn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bastionzero.com/bzerolib/logger"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTLSConn(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "TLS Connection Suite")
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func writePem(path string, blockType string, bytes []byte) {
+	Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600)).To(Succeed())
+}
+
+func newCA(dir string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	path := filepath.Join(dir, "ca.pem")
+	writePem(path, "CERTIFICATE", der)
+
+	return testCA{cert: cert, key: key, path: path}
+}
+
+// issue writes a leaf certificate signed by the ca and returns the cert and key paths
+func (ca testCA) issue(dir string, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+".key")
+	writePem(certPath, "CERTIFICATE", der)
+	writePem(keyPath, "EC PRIVATE KEY", keyDer)
+
+	return certPath, keyPath
+}
+
+var _ = Describe("TLS Connection", func() {
+	logger := logger.MockLogger(GinkgoWriter)
+
+	var dir string
+	var ca testCA
+	var listener net.Listener
+	var accepted chan net.Conn
+	var handshakeErr chan error
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		ca = newCA(dir)
+
+		serverCert, serverKey := ca.issue(dir, "server", x509.ExtKeyUsageServerAuth)
+		serverConfig, err := ServerConfig(serverCert, serverKey, ca.path)
+		Expect(err).ToNot(HaveOccurred())
+
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+		Expect(err).ToNot(HaveOccurred())
+
+		// the client can't finish dialing until we've done our half of the
+		// handshake, so do it as soon as we accept
+		accepted = make(chan net.Conn, 1)
+		handshakeErr = make(chan error, 1)
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				handshakeErr <- conn.(*tls.Conn).Handshake()
+				accepted <- conn
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	dialUrl := func() *url.URL {
+		return &url.URL{Scheme: "tls", Host: listener.Addr().String()}
+	}
+
+	When("the client presents a certificate signed by the CA", func() {
+		var client, server *TLSConn
+
+		BeforeEach(func() {
+			clientCert, clientKey := ca.issue(dir, "client", x509.ExtKeyUsageClientAuth)
+			clientConfig, err := ClientConfig(clientCert, clientKey, ca.path)
+			Expect(err).ToNot(HaveOccurred())
+
+			client = New(logger, clientConfig).(*TLSConn)
+			Expect(client.Dial(dialUrl(), http.Header{}, context.Background())).To(Succeed())
+
+			var conn net.Conn
+			Eventually(accepted).Should(Receive(&conn))
+			server = NewFromConn(logger, conn).(*TLSConn)
+			Expect(server.Dial(nil, http.Header{}, context.Background())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			client.Close(fmt.Errorf("test done"))
+			server.Close(fmt.Errorf("test done"))
+		})
+
+		It("ferries bytes in both directions", func() {
+			Expect(client.Send([]byte("ping"))).To(Succeed())
+
+			var received *[]byte
+			Eventually(server.Inbound()).Should(Receive(&received))
+			Expect(string(*received)).To(Equal("ping"))
+
+			Expect(server.Send([]byte("pong"))).To(Succeed())
+			Eventually(client.Inbound()).Should(Receive(&received))
+			Expect(string(*received)).To(Equal("pong"))
+		})
+
+		It("refuses to redial an accepted connection", func() {
+			Expect(server.Dial(nil, http.Header{}, context.Background())).ToNot(Succeed())
+		})
+
+		It("dies when the other side closes", func() {
+			client.Close(fmt.Errorf("goodbye"))
+			Eventually(server.Done(), 5*time.Second).Should(BeClosed())
+		})
+	})
+
+	It("is done once it's closed, even if it never started", func() {
+		server, _ := net.Pipe()
+		conn := NewFromConn(logger, server).(*TLSConn)
+		conn.Close(fmt.Errorf("never mind"))
+
+		Eventually(conn.Done()).Should(BeClosed())
+		Expect(conn.Err()).To(MatchError("never mind"))
+		Expect(conn.Dial(nil, http.Header{}, context.Background())).ToNot(Succeed())
+	})
+
+	It("closes even if nobody is reading what it receives", func() {
+		server, remote := net.Pipe()
+		conn := NewFromConn(logger, server).(*TLSConn)
+		Expect(conn.Dial(nil, http.Header{}, context.Background())).To(Succeed())
+
+		// more than fit in our inbound channel, which each go through the pipe
+		// one at a time
+		go func() {
+			for i := 0; i <= cap(conn.inbound); i++ {
+				if _, err := remote.Write([]byte("hello")); err != nil {
+					return
+				}
+			}
+		}()
+		Eventually(func() int { return len(conn.inbound) }, 5*time.Second).Should(Equal(cap(conn.inbound)))
+
+		closed := make(chan struct{})
+		go func() {
+			conn.Close(fmt.Errorf("test done"))
+			close(closed)
+		}()
+		Eventually(closed, 5*time.Second).Should(BeClosed())
+		Expect(conn.Done()).To(BeClosed())
+	})
+
+	When("the client doesn't present a certificate", func() {
+		It("is rejected", func() {
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.cert)
+
+			client := New(logger, &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS13}).(*TLSConn)
+
+			// TLS 1.3 clients finish their half of the handshake before the
+			// server has verified them, so they only find out when the server
+			// hangs up on them
+			if err := client.Dial(dialUrl(), http.Header{}, context.Background()); err == nil {
+				Eventually(handshakeErr).Should(Receive(HaveOccurred()))
+				Eventually(client.Done(), 5*time.Second).Should(BeClosed())
+			}
+		})
+	})
+})
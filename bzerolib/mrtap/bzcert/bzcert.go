@@ -2,7 +2,9 @@ package bzcert
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"bastionzero.com/bzerolib/mrtap/util"
@@ -24,6 +26,18 @@ type BZCert struct {
 	// unexported members
 	expiration time.Time
 	hash       string
+
+	// identity of the user, only populated once the certificate has been verified
+	subject string
+	email   string
+	groups  []string
+}
+
+// the identity claims we surface to the rest of the agent after verification
+type identityClaims struct {
+	Subject string          `json:"sub"`
+	Email   string          `json:"email"`
+	Groups  json.RawMessage `json:"groups"`
 }
 
 func (b *BZCert) Hash() string {
@@ -34,6 +48,24 @@ func (b *BZCert) Expired() bool {
 	return time.Now().After(b.expiration)
 }
 
+// Subject returns the IdP subject of the user this certificate belongs to. It
+// is empty until the certificate has been verified.
+func (b *BZCert) Subject() string {
+	return b.subject
+}
+
+// Email returns the email of the user this certificate belongs to, if the IdP
+// provided one. It is empty until the certificate has been verified.
+func (b *BZCert) Email() string {
+	return b.email
+}
+
+// Groups returns the groups the IdP says the user belongs to, if it provided a
+// list of them. It is empty until the certificate has been verified.
+func (b *BZCert) Groups() []string {
+	return b.groups
+}
+
 func (b *BZCert) Verify(idpProvider string, idpOrgId string, jwksUrlPatterns []string) (err error) {
 	// initialize a new verifier for BastionZero certificates
 	var verifier IBZCertVerifier
@@ -44,6 +76,8 @@ func (b *BZCert) Verify(idpProvider string, idpOrgId string, jwksUrlPatterns []s
 			return fmt.Errorf("failed to verify the certificate: %w", err)
 		} else if err := b.HashCert(); err != nil {
 			return err
+		} else if err := b.parseIdentity(); err != nil {
+			return err
 		} else {
 			b.expiration = exp
 		}
@@ -52,6 +86,36 @@ func (b *BZCert) Verify(idpProvider string, idpOrgId string, jwksUrlPatterns []s
 	return nil
 }
 
+// parseIdentity pulls the user's identity out of the current id token. This
+// must only be called after the token's signature has been verified.
+func (b *BZCert) parseIdentity() error {
+	parts := strings.Split(b.CurrentIdToken, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed current id token: expected 3 parts but got %d", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("failed to decode current id token payload: %w", err)
+	}
+
+	var claims identityClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("failed to parse current id token claims: %w", err)
+	}
+
+	b.subject = claims.Subject
+	b.email = claims.Email
+
+	// not every IdP sends groups, or sends them as a list, and we'd rather do
+	// without them than refuse an otherwise valid certificate
+	var groups []string
+	if len(claims.Groups) > 0 && json.Unmarshal(claims.Groups, &groups) == nil {
+		b.groups = groups
+	}
+	return nil
+}
+
 func (b *BZCert) HashCert() error {
 	if hashBytes, ok := util.HashPayload(*b); !ok {
 		return fmt.Errorf("failed to hash the certificate")
@@ -0,0 +1,219 @@
+package message
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Encoding is how a MrTAP message is written to the wire. JSON is what every
+// version of the agent and daemon understands, but it base64s every []byte and,
+// until CWC-2183, repeats the whole payload under keysplittingPayload. Once both
+// sides have agreed on a schema version of at least CompactSchemaVersion in the
+// Syn/SynAck they can switch to the compact encoding: CBOR, with large action
+// payloads optionally DEFLATE compressed.
+//
+// The encoding only affects what goes over the wire. Hashes and signatures are
+// always computed over the decoded payload with util.HashPayload, so the hash
+// chain is the same no matter how its messages were sent.
+type Encoding string
+
+const (
+	JSON    Encoding = "json"
+	Compact Encoding = "compact"
+)
+
+// The first schema version which understands compact messages
+const CompactSchemaVersion = "2.3"
+
+type compression string
+
+const (
+	noCompression      compression = ""
+	deflateCompression compression = "deflate"
+)
+
+const (
+	// Action payloads smaller than this aren't worth compressing
+	compressionThreshold = 1024
+
+	// The most we'll inflate a single action payload to, so that a malicious
+	// peer can't make us decompress a bomb
+	maxDecompressedLength = 64 * 1024 * 1024
+)
+
+// Compact messages start with the self-described CBOR tag (RFC 8949 3.4.6) so
+// they can never be mistaken for JSON, which means receivers can decode
+// whatever they are sent without having to know what was negotiated
+var selfDescribedCbor = []byte{0xd9, 0xd9, 0xf7}
+
+type compactMessage struct {
+	Type        PayloadType     `cbor:"1,keyasint"`
+	Signature   string          `cbor:"2,keyasint"`
+	Compression compression     `cbor:"3,keyasint,omitempty"`
+	Payload     cbor.RawMessage `cbor:"4,keyasint"`
+}
+
+// Encode marshals the message using the provided encoding
+func (m MrtapMessage) Encode(encoding Encoding) ([]byte, error) {
+	switch encoding {
+	case JSON:
+		return json.Marshal(m)
+	case Compact:
+		return m.marshalCompact()
+	default:
+		return nil, fmt.Errorf("unknown MrTAP message encoding: %s", encoding)
+	}
+}
+
+// Decode unmarshals a message sent with any encoding
+func Decode(data []byte) (MrtapMessage, error) {
+	var m MrtapMessage
+
+	if bytes.HasPrefix(data, selfDescribedCbor) {
+		return m, m.unmarshalCompact(data[len(selfDescribedCbor):])
+	} else {
+		return m, json.Unmarshal(data, &m)
+	}
+}
+
+func (m MrtapMessage) marshalCompact() ([]byte, error) {
+	payload, compression, err := compressActionPayload(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadBytes, err := cbor.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", m.Type, err)
+	}
+
+	messageBytes, err := cbor.Marshal(compactMessage{
+		Type:        m.Type,
+		Signature:   m.Signature,
+		Compression: compression,
+		Payload:     payloadBytes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s message: %w", m.Type, err)
+	}
+
+	return append(append([]byte{}, selfDescribedCbor...), messageBytes...), nil
+}
+
+func (m *MrtapMessage) unmarshalCompact(data []byte) error {
+	var msg compactMessage
+	if err := cbor.Unmarshal(data, &msg); err != nil {
+		return fmt.Errorf("malformed compact MrTAP message: %w", err)
+	}
+
+	m.Type = msg.Type
+	m.Signature = msg.Signature
+
+	var err error
+	switch m.Type {
+	case Syn:
+		var synPayload SynPayload
+		err = cbor.Unmarshal(msg.Payload, &synPayload)
+		m.Payload = synPayload
+	case SynAck:
+		var synAckPayload SynAckPayload
+		err = cbor.Unmarshal(msg.Payload, &synAckPayload)
+		m.Payload = synAckPayload
+	case Data:
+		var dataPayload DataPayload
+		err = cbor.Unmarshal(msg.Payload, &dataPayload)
+		m.Payload = dataPayload
+	case DataAck:
+		var dataAckPayload DataAckPayload
+		err = cbor.Unmarshal(msg.Payload, &dataAckPayload)
+		m.Payload = dataAckPayload
+	default:
+		return fmt.Errorf("type mismatch in MrTAP message and actual message payload")
+	}
+
+	if err != nil {
+		return fmt.Errorf("malformed %s Payload", m.Type)
+	}
+
+	switch msg.Compression {
+	case noCompression:
+		return nil
+	case deflateCompression:
+		if actionPayload, err := inflate(m.GetActionPayload()); err != nil {
+			return fmt.Errorf("failed to decompress %s action payload: %w", m.Type, err)
+		} else {
+			m.Payload = withActionPayload(m.Payload, actionPayload)
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown action payload compression: %s", msg.Compression)
+	}
+}
+
+// compressActionPayload returns a copy of the payload with its action payload
+// compressed, so long as it's big enough for that to be worthwhile
+func compressActionPayload(payload interface{}) (interface{}, compression, error) {
+	actionPayload := (&MrtapMessage{Payload: payload}).GetActionPayload()
+	if len(actionPayload) < compressionThreshold {
+		return payload, noCompression, nil
+	}
+
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, noCompression, err
+	}
+
+	if _, err := writer.Write(actionPayload); err != nil {
+		return nil, noCompression, fmt.Errorf("failed to compress action payload: %w", err)
+	} else if err := writer.Close(); err != nil {
+		return nil, noCompression, fmt.Errorf("failed to compress action payload: %w", err)
+	}
+
+	// there's no point sending something that's already compressed
+	if buf.Len() >= len(actionPayload) {
+		return payload, noCompression, nil
+	}
+
+	return withActionPayload(payload, buf.Bytes()), deflateCompression, nil
+}
+
+func inflate(compressed []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+
+	inflated, err := io.ReadAll(io.LimitReader(reader, maxDecompressedLength+1))
+	if err != nil {
+		return nil, err
+	} else if len(inflated) > maxDecompressedLength {
+		return nil, fmt.Errorf("action payload is larger than %d bytes", maxDecompressedLength)
+	}
+
+	return inflated, nil
+}
+
+// withActionPayload returns a copy of the payload with its action payload
+// replaced. All of our payloads are values, so the original is untouched
+func withActionPayload(payload interface{}, actionPayload []byte) interface{} {
+	switch msg := payload.(type) {
+	case SynPayload:
+		msg.ActionPayload = actionPayload
+		return msg
+	case SynAckPayload:
+		msg.ActionResponsePayload = actionPayload
+		return msg
+	case DataPayload:
+		msg.ActionPayload = actionPayload
+		return msg
+	case DataAckPayload:
+		msg.ActionResponsePayload = actionPayload
+		return msg
+	default:
+		return payload
+	}
+}
@@ -0,0 +1,141 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"bastionzero.com/bzerolib/keypair"
+	"github.com/fxamacker/cbor/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MrtapMessage Encoding", func() {
+	var testMessage MrtapMessage
+	var encoded []byte
+	var decoded MrtapMessage
+	var err error
+
+	buildDataMessage := func(actionPayload []byte) MrtapMessage {
+		return MrtapMessage{
+			Type: Data,
+			Payload: DataPayload{
+				SchemaVersion: SchemaVersion,
+				Type:          string(Data),
+				Action:        "shell/input",
+				Timestamp:     "1681234567",
+				TargetId:      "target",
+				HPointer:      "hpointer",
+				BZCertHash:    "bzcerthash",
+				ActionPayload: actionPayload,
+			},
+		}
+	}
+
+	Context("Compact encoding", func() {
+		When("The action payload is small", func() {
+			BeforeEach(func() {
+				testMessage = buildDataMessage([]byte("ls -la\n"))
+				encoded, err = testMessage.Encode(Compact)
+				Expect(err).ToNot(HaveOccurred())
+				decoded, err = Decode(encoded)
+			})
+
+			It("decodes into the same message", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded).To(Equal(testMessage))
+				Expect(decoded.Hash()).To(Equal(testMessage.Hash()))
+			})
+
+			It("is smaller than the same message as JSON", func() {
+				jsonBytes, err := testMessage.Encode(JSON)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(encoded)).To(BeNumerically("<", len(jsonBytes)/2))
+			})
+		})
+
+		When("The action payload is large and compressible", func() {
+			actionPayload := bytes.Repeat([]byte("the same log line over and over\n"), 1000)
+
+			BeforeEach(func() {
+				testMessage = buildDataMessage(actionPayload)
+				encoded, err = testMessage.Encode(Compact)
+				Expect(err).ToNot(HaveOccurred())
+				decoded, err = Decode(encoded)
+			})
+
+			It("compresses the action payload", func() {
+				Expect(len(encoded)).To(BeNumerically("<", len(actionPayload)/10))
+			})
+
+			It("decodes the original action payload", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded.GetActionPayload()).To(Equal(actionPayload))
+				Expect(decoded.Hash()).To(Equal(testMessage.Hash()))
+			})
+		})
+
+		When("The message is signed", func() {
+			var publicKey *keypair.PublicKey
+
+			BeforeEach(func() {
+				var privateKey *keypair.PrivateKey
+				publicKey, privateKey, err = keypair.GenerateKeyPair()
+				Expect(err).ToNot(HaveOccurred())
+
+				testMessage = buildDataMessage(bytes.Repeat([]byte{'a'}, 4096))
+				Expect(testMessage.Sign(privateKey)).To(BeTrue())
+
+				encoded, err = testMessage.Encode(Compact)
+				Expect(err).ToNot(HaveOccurred())
+				decoded, err = Decode(encoded)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("still verifies after decoding", func() {
+				Expect(decoded.VerifySignature(publicKey)).To(Succeed())
+			})
+		})
+
+		When("The payload claims an unknown compression", func() {
+			BeforeEach(func() {
+				var payloadBytes, msgBytes []byte
+				payloadBytes, err = cbor.Marshal(buildDataMessage([]byte("data")).Payload)
+				Expect(err).ToNot(HaveOccurred())
+
+				msgBytes, err = cbor.Marshal(compactMessage{
+					Type:        Data,
+					Compression: "zip",
+					Payload:     payloadBytes,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = Decode(append(append([]byte{}, selfDescribedCbor...), msgBytes...))
+			})
+
+			It("fails to decode", func() {
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("JSON encoding", func() {
+		BeforeEach(func() {
+			testMessage = buildDataMessage([]byte("ls -la\n"))
+			encoded, err = testMessage.Encode(JSON)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("is the same as marshalling the message", func() {
+			jsonBytes, err := json.Marshal(testMessage)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(encoded).To(Equal(jsonBytes))
+		})
+
+		It("can be decoded without knowing the encoding", func() {
+			decoded, err = Decode(encoded)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded).To(Equal(testMessage))
+		})
+	})
+})
@@ -20,7 +20,7 @@ const (
 )
 
 const (
-	SchemaVersion = "2.2"
+	SchemaVersion = "2.5"
 )
 
 type MrtapMessage struct {
@@ -19,8 +19,16 @@ type SynAckPayload struct {
 	TargetPublicKey string `json:"targetPublicKey"`
 	Nonce           string `json:"nonce"`
 	HPointer        string `json:"hPointer"`
+
+	// The most Data messages the agent is willing to have in flight at once.
+	// Only set when both sides speak PipelineLimitSchemaVersion or newer;
+	// it's omitted otherwise so older daemons hash the same payload we signed
+	MaxPipelineLimit int `json:"maxPipelineLimit,omitempty"`
 }
 
+// The first schema version in which agents advertise their MaxPipelineLimit
+const PipelineLimitSchemaVersion = "2.4"
+
 func (s SynAckPayload) BuildResponsePayload(action string, actionPayload []byte, bzCertHash string, schemaVersion string) (DataPayload, error) {
 	hashBytes, _ := util.HashPayload(s)
 	hash := base64.StdEncoding.EncodeToString(hashBytes)
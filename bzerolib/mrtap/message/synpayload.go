@@ -22,8 +22,16 @@ type SynPayload struct {
 	TargetId string       `json:"targetId"`
 	Nonce    string       `json:"nonce"`
 	BZCert   bzcrt.BZCert `json:"bZCert"`
+
+	// Only set when resuming an established session, in which case it's the
+	// hash of the last Data message the agent acked. It's omitted otherwise so
+	// that older agents hash the same payload we signed
+	HPointer string `json:"hPointer,omitempty"`
 }
 
+// The first schema version in which agents know how to resume a session
+const ResumptionSchemaVersion = "2.5"
+
 func (s SynPayload) BuildResponsePayload(actionPayload []byte, pubKey string, nonce string, schemaVersion string) (SynAckPayload, error) {
 	hashBytes, _ := util.HashPayload(s)
 	hash := base64.StdEncoding.EncodeToString(hashBytes)
@@ -0,0 +1,36 @@
+package udp
+
+import (
+	"time"
+
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+type UdpSubAction string
+
+const (
+	UdpStart UdpSubAction = "db/udp/start"
+	UdpInput UdpSubAction = "db/udp/input"
+	UdpStop  UdpSubAction = "db/udp/stop"
+)
+
+// how long a flow can go without a datagram in either direction before the
+// agent closes it, unless the daemon asks for something else
+const DefaultIdleTimeout = 2 * time.Minute
+
+// Each UDP flow, i.e. each address the daemon gets datagrams from, is its own
+// action. Every input message and every stream message carries exactly one
+// datagram, and since UDP makes no promises about order neither do we
+type UdpActionPayload struct {
+	RequestId string `json:"requestId"`
+	// (optional) informs Agent what SchemaVersion to use
+	StreamMessageVersion smsg.SchemaVersion `json:"streamMessageVersion"`
+	// (optional) seconds the flow can be idle for before the agent closes it
+	IdleTimeout int `json:"idleTimeout,omitempty"`
+}
+
+type UdpInputActionPayload struct {
+	RequestId      string `json:"requestId"`
+	SequenceNumber int    `json:"sequenceNumber"`
+	Datagram       []byte `json:"datagram"`
+}
@@ -5,6 +5,7 @@ type DbAction string
 const (
 	Dial DbAction = "dial"
 	Pwdb DbAction = "pwdb"
+	Udp  DbAction = "udp"
 )
 
 type DbActionParams struct {
@@ -20,7 +20,9 @@ type KubePortForwardStartActionPayload struct {
 	CommandBeingRun      string             `json:"commandBeingRun"`
 }
 
-// Portforward payload for the "kube/portforward/datain" action
+// Portforward payload for the "kube/portforward/datain" action. The first one
+// for each request has no data, so that the agent connects to the pod's port
+// before the client sends anything
 type KubePortForwardActionPayload struct {
 	RequestId            string `json:"requestId"`
 	LogId                string `json:"logId"`
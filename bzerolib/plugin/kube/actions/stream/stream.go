@@ -5,4 +5,8 @@ type StreamSubAction string
 const (
 	StreamStart StreamSubAction = "kube/stream/start"
 	StreamStop  StreamSubAction = "kube/stream/stop"
+
+	// Only sent once both sides have said they support them, see KubeStreamActionPayload
+	StreamAck   StreamSubAction = "kube/stream/ack"
+	StreamInput StreamSubAction = "kube/stream/input"
 )
@@ -15,8 +15,37 @@ type KubeStreamActionPayload struct {
 	StreamMessageVersion smsg.SchemaVersion  `json:"streamMessageVersion"` // informs Agent what SchemaVersion to use
 	LogId                string              `json:"logId"`
 	CommandBeingRun      string              `json:"commandBeingRun"`
+
+	// If set, the daemon will acknowledge the response bytes it has written to
+	// the client with StreamAck messages, and the agent should stop reading
+	// from the API server while this many bytes are unacknowledged
+	WindowSize int `json:"windowSize,omitempty"`
+
+	// If set, Body is empty and the request body will follow in StreamInput
+	// messages instead
+	StreamBody bool `json:"streamBody,omitempty"`
 }
 
 type KubeStreamHeadersPayload struct {
 	Headers map[string][]string
+
+	// Older agents don't send these, in which case the status is 200 and we
+	// must not send them StreamAck or StreamInput messages
+	StatusCode  int  `json:"statusCode,omitempty"`
+	FlowControl bool `json:"flowControl,omitempty"`
+}
+
+type KubeStreamAckPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+
+	// How many more response bytes the daemon has written to the client
+	Bytes int `json:"bytes"`
+}
+
+type KubeStreamInputPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+	Data      []byte `json:"data"`
+	EOF       bool   `json:"eof"`
 }
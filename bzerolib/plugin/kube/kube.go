@@ -7,9 +7,30 @@ const (
 	Stream      KubeAction = "stream"
 	RestApi     KubeAction = "restapi"
 	PortForward KubeAction = "portforward"
+
+	// Attach uses the same kube/exec/... messages as Exec, since the protocol is
+	// the same apart from not having a command to run
+	Attach KubeAction = "attach"
 )
 
 type KubeActionParams struct {
 	TargetUser   string   `json:"targetUser"`
 	TargetGroups []string `json:"targetGroups"`
+
+	// The target we think we're connecting to. Agents that serve more than one
+	// cluster refuse the datachannel if it isn't the target BastionZero opened
+	// our connection for
+	TargetId string `json:"targetId,omitempty"`
+}
+
+// KubeSynAckPayload is what kube agents tell the daemon they can do in their
+// SynAck. Older agents send an empty payload, which means none of it
+type KubeSynAckPayload struct {
+	// Whether the agent can take request bodies in StreamInput messages and
+	// tell us the status of the responses it streams
+	StreamBodies bool `json:"streamBodies,omitempty"`
+
+	// Whether the agent knows the attach action. Older ones attach through
+	// exec, which works just as well for them
+	Attach bool `json:"attach,omitempty"`
 }
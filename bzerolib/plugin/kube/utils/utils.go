@@ -2,7 +2,6 @@ package utils
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
@@ -50,7 +49,10 @@ func IsQueryParamPresent(request *http.Request, paramArg string) bool {
 	return false
 }
 
-func BuildHttpRequest(kubeHost string, endpoint string, body string, method string, headers map[string][]string, serviceAccountToken string, targetUser string, targetGroups []string) (*http.Request, error) {
+// BuildHttpRequest builds a request to the API server at kubeHost, made as the
+// target user and groups. It has no credentials of its own, those are added by
+// the client that makes it
+func BuildHttpRequest(kubeHost string, endpoint string, body string, method string, headers map[string][]string, targetUser string, targetGroups []string) (*http.Request, error) {
 	// Perform the api request
 	kubeApiUrl := kubeHost + endpoint
 	bodyBytesReader := bytes.NewReader([]byte(body))
@@ -67,8 +69,10 @@ func BuildHttpRequest(kubeHost string, endpoint string, body string, method stri
 		}
 	}
 
-	// Add our impersonation and token headers
-	req.Header.Set("Authorization", "Bearer "+serviceAccountToken)
+	// Never pass on the user's credentials, and leave room for ours
+	req.Header.Del("Authorization")
+
+	// Add our impersonation headers
 	req.Header.Set("Impersonate-User", targetUser)
 	for _, impersonateGroup := range targetGroups {
 		req.Header.Set("Impersonate-Group", impersonateGroup)
@@ -81,10 +85,6 @@ func BuildHttpRequest(kubeHost string, endpoint string, body string, method stri
 		return nil, rerr
 	}
 
-	// TODO: Figure out a way around this
-	// CA certs can be found here /var/run/secrets/kubernetes.io/serviceaccount/ca.crt
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-
 	return req, nil
 }
 
@@ -1,5 +1,7 @@
 package shell
 
+import "fmt"
+
 // The ShellQuitError is used when the user exits a shell session;
 // it should generally be treated as a successful termination / exit code 0
 type ShellQuitError struct{}
@@ -15,3 +17,19 @@ type ShellCancelledError struct{}
 func (e *ShellCancelledError) Error() string { return "shell request cancelled by user" }
 
 func (e *ShellCancelledError) Unwrap() error { return nil }
+
+// The ShellExecExitError is used when a command run with the exec action exits
+// with a non-zero exit code, which the daemon exits with in turn
+type ShellExecExitError struct {
+	ExitCode int
+	TimedOut bool
+}
+
+func (e *ShellExecExitError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("command timed out and exited with exit code %d", e.ExitCode)
+	}
+	return fmt.Sprintf("command exited with exit code %d", e.ExitCode)
+}
+
+func (e *ShellExecExitError) Unwrap() error { return nil }
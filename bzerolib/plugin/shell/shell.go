@@ -21,6 +21,7 @@ type ShellAction string
 
 const (
 	DefaultShell ShellAction = "default"
+	Exec         ShellAction = "exec"
 )
 
 type ShellActionParams struct {
@@ -44,6 +45,26 @@ type ShellResizeMessage struct {
 
 type ShellReplayMessage struct{}
 
+// ShellExecStartMessage runs a single command as the target user, without a pty
+type ShellExecStartMessage struct {
+	Command              string             `json:"command"`
+	TimeoutSeconds       int                `json:"timeoutSeconds"` // zero means no timeout
+	StreamMessageVersion smsg.SchemaVersion `json:"streamMessageVersion"`
+}
+
+type ShellExecInputMessage struct {
+	Data []byte `json:"data"`
+	EOF  bool   `json:"eof"` // closes the command's stdin after writing Data
+}
+
+// ShellExecExitMessage is the content of the final, Stop, stream message of an
+// exec action
+type ShellExecExitMessage struct {
+	ExitCode int    `json:"exitCode"`
+	TimedOut bool   `json:"timedOut"`
+	Error    string `json:"error,omitempty"` // set if the command couldn't be run at all
+}
+
 type ShellSubAction string
 
 const (
@@ -52,4 +73,7 @@ const (
 	ShellResize ShellSubAction = "shell/resize"
 	ShellInput  ShellSubAction = "shell/input"
 	ShellReplay ShellSubAction = "shell/replay"
+
+	ShellExecStart ShellSubAction = "shell/exec/start"
+	ShellExecInput ShellSubAction = "shell/exec/input"
 )
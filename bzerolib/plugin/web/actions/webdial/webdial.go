@@ -26,6 +26,10 @@ type WebInputActionPayload struct {
 	SequenceNumber int                 `json:"sequenceNumber"`
 	RequestId      string              `json:"requestId"`
 	More           bool                `json:"more"`
+
+	// (optional) the length of the whole body, if the client told us, so that
+	// the agent can pass it on when it streams the body upstream
+	ContentLength int64 `json:"contentLength,omitempty"`
 }
 
 type WebOutputActionPayload struct {
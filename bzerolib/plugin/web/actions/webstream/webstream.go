@@ -0,0 +1,59 @@
+package webstream
+
+import (
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
+// The stream action proxies a single request whose body is sent, and whose
+// response is returned, a chunk at a time while the other is still going. This
+// is what HTTP/2 services like gRPC need, unlike dial which waits for the whole
+// request before making it
+type WebStreamSubAction string
+
+const (
+	WebStreamStart     WebStreamSubAction = "web/stream/start"
+	WebStreamInput     WebStreamSubAction = "web/stream/datain"
+	WebStreamInterrupt WebStreamSubAction = "web/stream/interrupt"
+)
+
+type WebStreamStartActionPayload struct {
+	RequestId            string              `json:"requestId"`
+	StreamMessageVersion smsg.SchemaVersion  `json:"streamMessageVersion"`
+	Endpoint             string              `json:"endpoint"`
+	Method               string              `json:"method"`
+	Headers              map[string][]string `json:"headers"`
+
+	// the length of the request body, or -1 if it isn't known until it's over
+	ContentLength int64 `json:"contentLength"`
+
+	// the names of any trailers the client said it will send after the body
+	Trailers []string `json:"trailers"`
+
+	// the major version of HTTP the client used, so that we can speak HTTP/2 to
+	// upstreams that don't use TLS
+	ProtoMajor int `json:"protoMajor"`
+}
+
+// A chunk of the request body. The last one has More set to false and carries
+// the request's trailers, if it has any
+type WebStreamInputActionPayload struct {
+	RequestId      string              `json:"requestId"`
+	SequenceNumber int                 `json:"sequenceNumber"`
+	Body           []byte              `json:"body"`
+	More           bool                `json:"more"`
+	Trailers       map[string][]string `json:"trailers,omitempty"`
+}
+
+// A chunk of the response. The first one carries its status code and headers,
+// and the last, with More set to false on its stream message, its trailers
+type WebStreamOutputPayload struct {
+	RequestId  string              `json:"requestId"`
+	StatusCode int                 `json:"statusCode"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Content    []byte              `json:"content"`
+	Trailers   map[string][]string `json:"trailers,omitempty"`
+}
+
+type WebStreamInterruptActionPayload struct {
+	RequestId string `json:"requestId"`
+}
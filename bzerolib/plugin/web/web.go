@@ -1,13 +1,43 @@
 package web
 
+import (
+	"fmt"
+
+	smsg "bastionzero.com/bzerolib/stream/message"
+)
+
 type WebAction string
 
 const (
 	Dial      WebAction = "dial"
 	Websocket WebAction = "websocket"
+	Stream    WebAction = "stream"
 )
 
 type WebActionParams struct {
 	RemotePort int
 	RemoteHost string
 }
+
+// WebSynAckPayload is what web agents tell the daemon they can do in their
+// SynAck. Older agents send an empty payload, which means none of it
+type WebSynAckPayload struct {
+	// Whether the agent knows the stream action
+	Stream bool `json:"stream,omitempty"`
+}
+
+// ErrorMessage is what we tell the user when the agent fails to reach the
+// target with the given error stream type and message
+func ErrorMessage(streamType smsg.StreamType, message string) string {
+	switch streamType {
+	case smsg.TLSCertificateError:
+		return fmt.Sprintf("BastionZero: the agent could not verify the target's certificate: %s", message)
+	case smsg.TLSHandshakeError:
+		return fmt.Sprintf("BastionZero: the agent could not make a TLS connection to the target: %s", message)
+	default:
+		if message == "" {
+			return "BastionZero: the agent could not reach the target"
+		}
+		return fmt.Sprintf("BastionZero: the agent could not reach the target: %s", message)
+	}
+}
@@ -37,6 +37,13 @@ const (
 	Ready StreamType = "ready"
 )
 
+// web targets we couldn't make a TLS connection to, sent in place of Error so
+// that the daemon can tell the user why
+const (
+	TLSCertificateError StreamType = "web/tls/certificate" // we couldn't verify the target's certificate
+	TLSHandshakeError   StreamType = "web/tls/handshake"   // anything else, e.g. it refused our client certificate
+)
+
 // old-fashioned messages we can stop sending once daemons older than 4.5.0 are extinct in the wild
 const (
 	ReadyPortForward StreamType = "kube/portforward/ready"